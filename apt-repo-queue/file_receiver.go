@@ -9,7 +9,6 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
-	"strings"
 
 	deb ".."
 	"gopkg.in/fsnotify.v1"
@@ -148,22 +147,7 @@ func (r *NotifyFileReceiver) handleEvent(ev fsnotify.Event) error {
 		return nil
 	}
 
-	ext := path.Ext(ev.Name)
-	switch ext {
-	case ".changes", ".deb", ".udeb", ".dsc":
-		break
-	case ".gz":
-		switch {
-		case strings.HasSuffix(ev.Name, ".orig.tar.gz"):
-			break
-		case strings.HasSuffix(ev.Name, ".diff.gz"):
-			break
-		case strings.HasSuffix(ev.Name, ".tar.gz"):
-			break
-		default:
-			return nil
-		}
-	default:
+	if _, err := deb.ClassifyFileName(ev.Name); err != nil {
 		return nil
 	}
 
@@ -9,8 +9,8 @@ import (
 	"os/exec"
 	"path"
 
+	"../pgp"
 	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/clearsign"
 )
 
 type PgpKeyManager interface {
@@ -152,20 +152,34 @@ func (m *GpgKeyManager) Remove(keyId string) error {
 	return nil
 }
 
+// Entities returns the public keys of the manager, so it can be used
+// as a pgp.Keyring.
+func (m *GpgKeyManager) Entities() (openpgp.EntityList, error) {
+	return m.public_keys, nil
+}
+
+// CheckAndRemoveClearsigned reads clearsigned data and checks its
+// signature. If the signature could not be checked, the plaintext is
+// still returned with the error. Signatures made with a revoked or
+// expired key are not trusted.
 func (m *GpgKeyManager) CheckAndRemoveClearsigned(r io.Reader) (io.Reader, *openpgp.Entity, error) {
 	data, err := ioutil.ReadAll(r)
-	block, rest := clearsign.Decode(data)
-
-	if block == nil {
-		return bytes.NewReader(rest), nil, fmt.Errorf("File is not clearsigned with a signature")
+	if err != nil {
+		return nil, nil, err
 	}
 
-	res := bytes.NewReader(block.Plaintext)
-	entity, err := openpgp.CheckDetachedSignature(m.public_keys,
-		bytes.NewReader(block.Bytes),
-		block.ArmoredSignature.Body)
+	plaintext, signer, err := pgp.NewVerifier(m).CheckClearsigned(data)
+	if err == pgp.ErrNotClearsigned {
+		return bytes.NewReader(plaintext), nil, fmt.Errorf("File is not clearsigned with a signature")
+	}
+	if err != nil {
+		if signer != nil {
+			err = fmt.Errorf("Signature by %s not trusted: %s", signer.KeyID(), err)
+		}
+		return bytes.NewReader(plaintext), nil, err
+	}
 
-	return res, entity, err
+	return bytes.NewReader(plaintext), signer.Entity, nil
 }
 
 func (m *GpgKeyManager) PrivateShortKeyID() string {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"../pgp"
+	. "gopkg.in/check.v1"
+)
+
+type GpgKeyManagerSuite struct {
+	m *GpgKeyManager
+}
+
+var _ = Suite(&GpgKeyManagerSuite{})
+
+func (s *GpgKeyManagerSuite) SetUpSuite(c *C) {
+	keys, err := pgp.FileKeyring("../pgp/testdata/keyring.asc").Entities()
+	c.Assert(err, IsNil)
+	s.m = &GpgKeyManager{public_keys: keys}
+}
+
+type failingReader struct{}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("read failure")
+}
+
+func (s *GpgKeyManagerSuite) TestCheckAndRemoveClearsigned(c *C) {
+	data, err := ioutil.ReadFile("../pgp/testdata/data.txt")
+	c.Assert(err, IsNil)
+
+	f, err := os.Open("../pgp/testdata/good.txt.asc")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	r, entity, err := s.m.CheckAndRemoveClearsigned(f)
+	c.Assert(err, IsNil)
+	c.Assert(entity, NotNil)
+	c.Check(entity.Identities["Good Signer <good@example.com>"], NotNil)
+	plaintext, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(plaintext, DeepEquals, data)
+
+	r, entity, err = s.m.CheckAndRemoveClearsigned(bytes.NewReader(data))
+	c.Check(r, NotNil)
+	c.Check(entity, IsNil)
+	c.Check(err, ErrorMatches, "File is not clearsigned with a signature")
+
+	for _, name := range []string{"revoked", "expired"} {
+		f, err := os.Open("../pgp/testdata/" + name + ".txt.asc")
+		c.Assert(err, IsNil)
+		r, entity, err = s.m.CheckAndRemoveClearsigned(f)
+		f.Close()
+		c.Check(r, NotNil)
+		c.Check(entity, IsNil)
+		c.Check(err, ErrorMatches, "Signature by [0-9A-F]{16} not trusted: signing key is "+name)
+	}
+
+	r, entity, err = s.m.CheckAndRemoveClearsigned(failingReader{})
+	c.Check(r, IsNil)
+	c.Check(entity, IsNil)
+	c.Check(err, ErrorMatches, "read failure")
+}
@@ -0,0 +1,173 @@
+package deb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AutopkgTest is a paragraph of a debian/tests/control file, the
+// tests it declares share their dependencies and restrictions.
+type AutopkgTest struct {
+	// Names of the tests, executables in TestsDirectory. Empty if
+	// TestCommand is set.
+	Tests []string
+	// Shell command of the test, if Tests is empty
+	TestCommand string
+	// Directory of the tests, relative to the source tree
+	TestsDirectory string
+	// Dependencies of the tests, @ stands for the binary packages of
+	// the source package
+	Depends      []string
+	Restrictions []string
+	Features     []string
+	Classes      []string
+	// Architectures the tests run on, all if empty
+	Architecture []string
+}
+
+// HasRestriction returns true if the tests have restriction r, like
+// flaky or needs-root
+func (t AutopkgTest) HasRestriction(r string) bool {
+	for _, rr := range t.Restrictions {
+		if rr == r {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsArchitecture returns true if the tests run on architecture
+// a
+func (t AutopkgTest) SupportsArchitecture(a Architecture) bool {
+	if len(t.Architecture) == 0 {
+		return true
+	}
+	supported := false
+	for _, aa := range t.Architecture {
+		if strings.HasPrefix(aa, "!") {
+			if Architecture(aa[1:]) == a {
+				return false
+			}
+			// a negated list supports all others
+			supported = true
+			continue
+		}
+		if Architecture(aa) == a || Architecture(aa) == Any {
+			return true
+		}
+	}
+	return supported
+}
+
+// splitList splits a whitespace or comma separated list
+func splitList(data []string) []string {
+	res := []string{}
+	for _, line := range data {
+		for _, v := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// splitDependencies splits a comma separated dependency list
+func splitDependencies(data []string) []string {
+	res := []string{}
+	for _, d := range strings.Split(strings.Join(data, " "), ",") {
+		d = strings.TrimSpace(d)
+		if len(d) != 0 {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// ParseAutopkgTestControl parses a debian/tests/control file. As
+// autopkgtest does, unknown fields are ignored.
+func ParseAutopkgTestControl(r io.Reader) ([]AutopkgTest, error) {
+	l := NewControlFileLexer(r)
+	var res []AutopkgTest
+	var cur *AutopkgTest
+	paragraph := 0
+
+	closeParagraph := func() error {
+		if cur == nil {
+			return nil
+		}
+		if len(cur.Tests) == 0 && len(cur.TestCommand) == 0 {
+			return fmt.Errorf("Paragraph %d has neither Tests nor Test-Command", paragraph)
+		}
+		if len(cur.Tests) != 0 && len(cur.TestCommand) != 0 {
+			return fmt.Errorf("Paragraph %d has both Tests and Test-Command", paragraph)
+		}
+		if len(cur.Depends) == 0 {
+			cur.Depends = []string{"@"}
+		}
+		res = append(res, *cur)
+		cur = nil
+		return nil
+	}
+
+	for {
+		f, err := l.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if IsNewParagraph(f) {
+			if err := closeParagraph(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if cur == nil {
+			paragraph++
+			cur = &AutopkgTest{TestsDirectory: "debian/tests"}
+		}
+
+		switch strings.ToLower(f.Name) {
+		case "tests":
+			cur.Tests = splitList(f.Data)
+		case "test-command":
+			cur.TestCommand = strings.TrimSpace(strings.Join(f.Data, " "))
+		case "tests-directory":
+			cur.TestsDirectory = strings.TrimSpace(strings.Join(f.Data, " "))
+		case "depends":
+			cur.Depends = splitDependencies(f.Data)
+		case "restrictions":
+			cur.Restrictions = splitList(f.Data)
+		case "features":
+			cur.Features = splitList(f.Data)
+		case "classes":
+			cur.Classes = splitList(f.Data)
+		case "architecture":
+			cur.Architecture = splitList(f.Data)
+		}
+	}
+	if err := closeParagraph(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// AutopkgTestNames returns the names autopkgtest gives to the tests
+// of a control file: their name, or commandN for the Nth
+// Test-Command.
+func AutopkgTestNames(tests []AutopkgTest) []string {
+	res := []string{}
+	commands := 0
+	for _, t := range tests {
+		if len(t.TestCommand) != 0 {
+			commands++
+			res = append(res, fmt.Sprintf("command%d", commands))
+			continue
+		}
+		res = append(res, t.Tests...)
+	}
+	return res
+}
@@ -0,0 +1,74 @@
+package deb
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type AutopkgTestControlSuite struct{}
+
+var _ = Suite(&AutopkgTestControlSuite{})
+
+func (s *AutopkgTestControlSuite) TestParse(c *C) {
+	control := `Tests: smoke, upgrade
+ integration
+Depends: @, python3-pytest,
+ curl
+Restrictions: allow-stderr needs-root
+
+# a comment
+Test-Command: foo --version
+Restrictions: superficial, flaky
+Architecture: amd64 i386
+
+Test-Command: foo --self-test
+Features: test-name=self-test
+Architecture: !armel
+`
+	tests, err := ParseAutopkgTestControl(strings.NewReader(control))
+	c.Assert(err, IsNil)
+	c.Check(tests, DeepEquals, []AutopkgTest{
+		{
+			Tests:          []string{"smoke", "upgrade", "integration"},
+			TestsDirectory: "debian/tests",
+			Depends:        []string{"@", "python3-pytest", "curl"},
+			Restrictions:   []string{"allow-stderr", "needs-root"},
+		},
+		{
+			TestCommand:    "foo --version",
+			TestsDirectory: "debian/tests",
+			Depends:        []string{"@"},
+			Restrictions:   []string{"superficial", "flaky"},
+			Architecture:   []string{"amd64", "i386"},
+		},
+		{
+			TestCommand:    "foo --self-test",
+			TestsDirectory: "debian/tests",
+			Depends:        []string{"@"},
+			Features:       []string{"test-name=self-test"},
+			Architecture:   []string{"!armel"},
+		},
+	})
+
+	c.Check(AutopkgTestNames(tests), DeepEquals, []string{"smoke", "upgrade", "integration", "command1", "command2"})
+	c.Check(tests[0].HasRestriction("needs-root"), Equals, true)
+	c.Check(tests[1].HasRestriction("needs-root"), Equals, false)
+	c.Check(tests[0].SupportsArchitecture(Armel), Equals, true)
+	c.Check(tests[1].SupportsArchitecture(Amd64), Equals, true)
+	c.Check(tests[1].SupportsArchitecture(Armel), Equals, false)
+	c.Check(tests[2].SupportsArchitecture(Amd64), Equals, true)
+	c.Check(tests[2].SupportsArchitecture(Armel), Equals, false)
+}
+
+func (s *AutopkgTestControlSuite) TestInvalid(c *C) {
+	invalid := map[string]string{
+		"Depends: foo\n": "Paragraph 1 has neither Tests nor Test-Command",
+		"Tests: a\n\nTests: b\nTest-Command: c\n": "Paragraph 2 has both Tests and Test-Command",
+		"Tests: a\nnot a field\n":                 "Got unexpected line `not a field'",
+	}
+	for control, errMatch := range invalid {
+		_, err := ParseAutopkgTestControl(strings.NewReader(control))
+		c.Check(err, ErrorMatches, errMatch)
+	}
+}
@@ -0,0 +1,79 @@
+package deb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Buildinfo is a build information file (.buildinfo), recording the
+// environment a package was built in, see deb-buildinfo(5).
+type Buildinfo struct {
+	Format            string
+	Source            string
+	Binary            []string
+	Architecture      []Architecture
+	Version           string
+	BuildOrigin       string
+	BuildArchitecture Architecture
+	BuildDate         string
+	BuildPath         string
+	// The packages installed in the build environment, as
+	// `name (= version)'
+	InstalledBuildDepends []string
+	// The environment variables of the build, as NAME="value"
+	Environment []string
+}
+
+// ParseBuildinfo parses an unsigned .buildinfo file
+func ParseBuildinfo(r io.Reader) (*Buildinfo, error) {
+	l := NewControlFileLexer(r)
+	res := &Buildinfo{}
+	for {
+		f, err := l.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf(".buildinfo parse error: %s", err)
+		}
+		if IsNewParagraph(f) {
+			continue
+		}
+		single := strings.TrimSpace(strings.Join(f.Data, " "))
+		switch f.Name {
+		case "Format":
+			res.Format = single
+		case "Source":
+			res.Source = single
+		case "Binary":
+			res.Binary = strings.Fields(single)
+		case "Architecture":
+			for _, a := range strings.Fields(single) {
+				res.Architecture = append(res.Architecture, Architecture(a))
+			}
+		case "Version":
+			res.Version = single
+		case "Build-Origin":
+			res.BuildOrigin = single
+		case "Build-Architecture":
+			res.BuildArchitecture = Architecture(single)
+		case "Build-Date":
+			res.BuildDate = single
+		case "Build-Path":
+			res.BuildPath = single
+		case "Installed-Build-Depends":
+			res.InstalledBuildDepends = splitDependencies(f.Data)
+		case "Environment":
+			for _, line := range f.Data {
+				if len(line) != 0 {
+					res.Environment = append(res.Environment, line)
+				}
+			}
+		}
+	}
+	if len(res.Source) == 0 || len(res.Version) == 0 {
+		return nil, fmt.Errorf(".buildinfo parse error: missing Source or Version field")
+	}
+	return res, nil
+}
@@ -0,0 +1,46 @@
+package deb
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type BuildinfoSuite struct{}
+
+var _ = Suite(&BuildinfoSuite{})
+
+func (s *BuildinfoSuite) TestParse(c *C) {
+	content := `Format: 1.0
+Source: foo
+Binary: foo foo-doc
+Architecture: amd64 all
+Version: 1.0-1
+Checksums-Sha256:
+ 0123 1024 foo_1.0-1_amd64.deb
+Build-Origin: Debian
+Build-Architecture: amd64
+Build-Date: Mon, 19 Oct 2026 10:00:00 +0000
+Build-Path: /build/foo-1.0
+Installed-Build-Depends:
+ autoconf (= 2.71-3),
+ base-files (= 13),
+ debhelper (= 13.11)
+Environment:
+ DEB_BUILD_OPTIONS="parallel=4"
+ LANG="C.UTF-8"
+`
+	b, err := ParseBuildinfo(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	c.Check(b.Source, Equals, "foo")
+	c.Check(b.Binary, DeepEquals, []string{"foo", "foo-doc"})
+	c.Check(b.Architecture, DeepEquals, []Architecture{Amd64, All})
+	c.Check(b.Version, Equals, "1.0-1")
+	c.Check(b.BuildArchitecture, Equals, Amd64)
+	c.Check(b.BuildPath, Equals, "/build/foo-1.0")
+	c.Check(b.InstalledBuildDepends, DeepEquals, []string{"autoconf (= 2.71-3)", "base-files (= 13)", "debhelper (= 13.11)"})
+	c.Check(b.Environment, DeepEquals, []string{`DEB_BUILD_OPTIONS="parallel=4"`, `LANG="C.UTF-8"`})
+
+	_, err = ParseBuildinfo(strings.NewReader("Format: 1.0\n"))
+	c.Check(err, ErrorMatches, ".buildinfo parse error: missing Source or Version field")
+}
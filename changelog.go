@@ -0,0 +1,174 @@
+package deb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangelogEntry is an entry of a debian/changelog file.
+type ChangelogEntry struct {
+	Source string
+	Ver    Version
+	Dists  []Codename
+	// The urgency of the upload, like low or medium
+	Urgency string
+	// Any other option of the entry header, like binary-only
+	Options map[string]string
+	// Lines of the changes, without their two spaces indentation
+	Changes    []string
+	Maintainer *mail.Address
+	Date       time.Time
+}
+
+// ChangelogDateFormat is the format of dates in debian/changelog
+// entries.
+const ChangelogDateFormat = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+var changelogHeaderRx = regexp.MustCompile(`^(\S+) \(([^)]+)\) ([^;]*);(.*)$`)
+var changelogTrailerRx = regexp.MustCompile(`^ -- (.*<[^>]*>)  (.*)$`)
+var changelogEndRx = regexp.MustCompile(`^(Local variables:|Old Changelog:|#)`)
+
+// ParseChangelog parses a debian/changelog file, most recent entry
+// first. Parsing stops at the `Old Changelog:' or emacs `Local
+// variables:' markers.
+func ParseChangelog(r io.Reader) ([]ChangelogEntry, error) {
+	var res []ChangelogEntry
+	var current *ChangelogEntry
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber = lineNumber + 1
+		line := scanner.Text()
+		perr := func(format string, args ...interface{}) error {
+			return fmt.Errorf("changelog parse error: line %d: %s", lineNumber, fmt.Sprintf(format, args...))
+		}
+
+		if current == nil {
+			if len(strings.TrimSpace(line)) == 0 {
+				continue
+			}
+			if changelogEndRx.MatchString(line) {
+				break
+			}
+			m := changelogHeaderRx.FindStringSubmatch(line)
+			if m == nil {
+				return nil, perr("invalid entry header `%s'", line)
+			}
+			ver, err := ParseVersion(m[2])
+			if err != nil {
+				return nil, perr("%s", err)
+			}
+			current = &ChangelogEntry{
+				Source:  m[1],
+				Ver:     *ver,
+				Options: make(map[string]string),
+			}
+			for _, d := range strings.Fields(m[3]) {
+				current.Dists = append(current.Dists, Codename(d))
+			}
+			for _, opt := range strings.Split(m[4], ",") {
+				kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				if strings.ToLower(kv[0]) == "urgency" {
+					current.Urgency = kv[1]
+				} else {
+					current.Options[strings.ToLower(kv[0])] = kv[1]
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, " -- ") {
+			m := changelogTrailerRx.FindStringSubmatch(line)
+			if m == nil {
+				return nil, perr("invalid entry trailer `%s'", line)
+			}
+			maintainer, err := mail.ParseAddress(m[1])
+			if err != nil {
+				return nil, perr("invalid maintainer `%s': %s", m[1], err)
+			}
+			date, err := time.Parse("Mon, _2 Jan 2006 15:04:05 -0700", strings.TrimSpace(m[2]))
+			if err != nil {
+				return nil, perr("invalid date `%s'", m[2])
+			}
+			current.Maintainer = maintainer
+			current.Date = date
+			// removes leading and trailing empty lines of the changes
+			for len(current.Changes) > 0 && len(current.Changes[0]) == 0 {
+				current.Changes = current.Changes[1:]
+			}
+			for len(current.Changes) > 0 && len(current.Changes[len(current.Changes)-1]) == 0 {
+				current.Changes = current.Changes[:len(current.Changes)-1]
+			}
+			res = append(res, *current)
+			current = nil
+			continue
+		}
+
+		if len(strings.TrimSpace(line)) == 0 {
+			current.Changes = append(current.Changes, "")
+			continue
+		}
+		if strings.HasPrefix(line, "  ") == false {
+			return nil, perr("invalid change line `%s'", line)
+		}
+		current.Changes = append(current.Changes, line[2:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("changelog parse error: entry %s (%s) has no trailer", current.Source, current.Ver)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("changelog parse error: no entry found")
+	}
+	return res, nil
+}
+
+// Write writes the entry in the debian/changelog format, followed by
+// an empty line.
+func (e *ChangelogEntry) Write(w io.Writer) error {
+	dists := make([]string, 0, len(e.Dists))
+	for _, d := range e.Dists {
+		dists = append(dists, string(d))
+	}
+	options := []string{}
+	if len(e.Urgency) > 0 {
+		options = append(options, "urgency="+e.Urgency)
+	}
+	keys := make([]string, 0, len(e.Options))
+	for k := range e.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		options = append(options, k+"="+e.Options[k])
+	}
+
+	if _, err := fmt.Fprintf(w, "%s (%s) %s; %s\n\n", e.Source, e.Ver, strings.Join(dists, " "), strings.Join(options, ", ")); err != nil {
+		return err
+	}
+	for _, l := range e.Changes {
+		if len(l) > 0 {
+			l = "  " + l
+		}
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	maintainer := ""
+	if e.Maintainer != nil {
+		maintainer = fmt.Sprintf("%s <%s>", e.Maintainer.Name, e.Maintainer.Address)
+	}
+	_, err := fmt.Fprintf(w, "\n -- %s  %s\n\n", maintainer, e.Date.Format(ChangelogDateFormat))
+	return err
+}
@@ -0,0 +1,77 @@
+package deb
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ChangelogSuite struct{}
+
+var _ = Suite(&ChangelogSuite{})
+
+var ahaChangelog = `aha (0.4.7.2-1+b1) unstable; urgency=low, binary-only=yes
+
+  * Binary-only non-maintainer upload for amd64; no source changes.
+  * Rebuild against libfoo2
+
+ -- Debian amd64 Build Daemon <buildd_amd64@example.com>  Sat, 14 Jun 2014 10:00:00 +0000
+
+aha (0.4.7.2-1) unstable experimental; urgency=medium
+
+  * New upstream release
+    - fixes colors
+
+  * Bump standards version
+
+ -- Axel Beckert <abe@debian.org>  Tue, 10 Jun 2014 21:44:59 +0200
+
+Local variables:
+mode: debian-changelog
+End:
+`
+
+func (s *ChangelogSuite) TestParse(c *C) {
+	entries, err := ParseChangelog(strings.NewReader(ahaChangelog))
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+
+	e := entries[1]
+	c.Check(e.Source, Equals, "aha")
+	c.Check(e.Ver, DeepEquals, Version{0, "0.4.7.2", "1"})
+	c.Check(e.Dists, DeepEquals, []Codename{"unstable", "experimental"})
+	c.Check(e.Urgency, Equals, "medium")
+	c.Check(e.Changes, DeepEquals, []string{
+		"* New upstream release",
+		"  - fixes colors",
+		"",
+		"* Bump standards version",
+	})
+	c.Check(e.Maintainer.Name, Equals, "Axel Beckert")
+	c.Check(e.Maintainer.Address, Equals, "abe@debian.org")
+	c.Check(e.Date.Equal(time.Date(2014, time.June, 10, 19, 44, 59, 0, time.UTC)), Equals, true)
+
+	c.Check(entries[0].Options, DeepEquals, map[string]string{"binary-only": "yes"})
+	c.Check(entries[0].Urgency, Equals, "low")
+
+	var out bytes.Buffer
+	for _, e := range entries {
+		c.Assert(e.Write(&out), IsNil)
+	}
+	c.Check(out.String(), Equals, ahaChangelog[:strings.Index(ahaChangelog, "Local variables")])
+
+	errors := map[string]string{
+		"aha 1.0 unstable\n":                                                          "changelog parse error: line 1: invalid entry header `aha 1.0 unstable'",
+		"aha (1.0) unstable; urgency=low\n\n  * foo\n":                                "changelog parse error: entry aha \\(1.0\\) has no trailer",
+		"aha (1.0) unstable; urgency=low\n\n * foo\n":                                 "changelog parse error: line 3: invalid change line ` \\* foo'",
+		"aha (1.0) unstable; urgency=low\n -- foo  Tue, 10 Jun 2014 21:44:59 +0200\n": "changelog parse error: line 2: invalid entry trailer .*",
+		"aha (1.0) unstable; urgency=low\n -- Foo <foo@example.com>  yesterday\n":     "changelog parse error: line 2: invalid date `yesterday'",
+		"\n": "changelog parse error: no entry found",
+	}
+	for content, expected := range errors {
+		_, err := ParseChangelog(strings.NewReader(content))
+		c.Check(err, ErrorMatches, expected)
+	}
+}
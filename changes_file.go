@@ -4,8 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/mail"
-	"regexp"
-	"strings"
+	"path"
 	"time"
 )
 
@@ -46,29 +45,23 @@ func (c *ChangesFileRef) Filename() string {
 	return fmt.Sprintf("%s_%s.changes", c.Identifier, c.Suffix)
 }
 
-var debFileRx = regexp.MustCompile(`^(.*)_(.*)_(.*).(deb|udeb)$`)
-
-// BinaryPackages returns the list of BinaryPackageRef of a .changes file
+// BinaryPackages returns the list of BinaryPackageRef of a .changes
+// file, that is any .deb, .udeb or .ddeb it lists.
 func (c *ChangesFile) BinaryPackages() ([]BinaryPackageRef, error) {
 	res := make([]BinaryPackageRef, 0, cap(c.Md5Files))
 	for _, f := range c.Md5Files {
-		if strings.HasSuffix(f.Name, ".deb") == false &&
-			strings.HasSuffix(f.Name, ".udeb") == false {
+		ext := path.Ext(f.Name)
+		if ext != ".deb" && ext != ".udeb" && ext != ".ddeb" {
 			continue
 		}
-		matches := debFileRx.FindStringSubmatch(f.Name)
-		if matches == nil {
-			return nil, fmt.Errorf(".changes file list invalid file `%s'", f.Name)
-		}
-		ver, err := ParseVersion(matches[2])
+		ref, err := matchFileName(f.Name)
 		if err != nil {
 			return nil, err
 		}
-		res = append(res, BinaryPackageRef{
-			Name: matches[1],
-			Ver:  *ver,
-			Arch: Architecture(matches[3]),
-		})
+		if ref == nil {
+			return nil, fmt.Errorf(".changes file list invalid file `%s'", f.Name)
+		}
+		res = append(res, ref.BinaryRef())
 	}
 	return res, nil
 }
@@ -44,6 +44,7 @@ func (s *ChangesFileSuite) TestBinaryPackageListing(c *C) {
 			FileReference{Name: "libfoo-dev_3:1.2.3~4-1_i386.deb"},
 			FileReference{Name: "libfoo-dbg_3:1.2.3~4-1_i386.deb"},
 			FileReference{Name: "libfoo-doc_3:1.2.3~4-1_all.deb"},
+			FileReference{Name: "libfoo0-dbgsym_3:1.2.3~4-1_amd64.ddeb"},
 		},
 	}
 
@@ -55,7 +56,7 @@ func (s *ChangesFileSuite) TestBinaryPackageListing(c *C) {
 
 	bPackages, err := ch.BinaryPackages()
 	if c.Check(err, IsNil, Commentf("Got unexpected error: %s", err)) == true {
-		c.Assert(len(bPackages), Equals, 7)
+		c.Assert(len(bPackages), Equals, 8)
 		c.Check(bPackages[0], DeepEquals, BinaryPackageRef{Name: "libfoo0", Ver: ver, Arch: Amd64})
 		c.Check(bPackages[1], DeepEquals, BinaryPackageRef{Name: "libfoo-dev", Ver: ver, Arch: Amd64})
 		c.Check(bPackages[2], DeepEquals, BinaryPackageRef{Name: "libfoo-dbg", Ver: ver, Arch: Amd64})
@@ -63,6 +64,7 @@ func (s *ChangesFileSuite) TestBinaryPackageListing(c *C) {
 		c.Check(bPackages[4], DeepEquals, BinaryPackageRef{Name: "libfoo-dev", Ver: ver, Arch: I386})
 		c.Check(bPackages[5], DeepEquals, BinaryPackageRef{Name: "libfoo-dbg", Ver: ver, Arch: I386})
 		c.Check(bPackages[6], DeepEquals, BinaryPackageRef{Name: "libfoo-doc", Ver: ver, Arch: All})
+		c.Check(bPackages[7], DeepEquals, BinaryPackageRef{Name: "libfoo0-dbgsym", Ver: ver, Arch: Amd64})
 	}
 
 	invalidData := map[string]ChangesFile{
@@ -147,6 +149,14 @@ Files:
 		c.Check(ch.Md5Files[i].Name, Equals, ch.Sha1Files[i].Name)
 		c.Check(ch.Md5Files[i].Name, Equals, ch.Sha256Files[i].Name)
 	}
+
+	// binary-only uploads give the version of their source
+	binNMU := strings.Replace(changesFileContent, "Source: aha\n", "Source: aha (0.4.7.2-1)\n", 1)
+	binNMU = strings.Replace(binNMU, "Version: 0.4.7.2-1\n", "Version: 0.4.7.2-1+b1\n", 1)
+	ch, err = ParseChangeFile(strings.NewReader(binNMU))
+	c.Assert(err, IsNil)
+	c.Check(ch.Ref.Identifier.Source, Equals, "aha")
+	c.Check(ch.Ref.Identifier.Ver, DeepEquals, Version{0, "0.4.7.2", "1+b1"})
 }
 
 func (s *ChangesFileSuite) TestSingleLineFieldParse(c *C) {
@@ -0,0 +1,173 @@
+package deb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ContentsIndex represents a Contents-<arch> index of a
+// distribution. It maps the path of each shipped file (without
+// leading slash) to the list of package locations shipping it.
+//
+// A location is the qualified name of a binary package,
+// i.e. `<section>/<package>'.
+type ContentsIndex map[string][]string
+
+// ContentsEntry is a file path listed in a ContentsIndex, with the
+// locations of the packages shipping it.
+type ContentsEntry struct {
+	Path      string
+	Locations []string
+}
+
+// ContentsLocation returns the location of a binary package in a
+// ContentsIndex.
+func ContentsLocation(section, name string) string {
+	if len(section) == 0 {
+		return name
+	}
+	return section + "/" + name
+}
+
+// LocationPackage returns the package name of a ContentsIndex
+// location.
+func LocationPackage(location string) string {
+	return path.Base(location)
+}
+
+func cleanContentsPath(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, "."), "/")
+}
+
+// Add marks all the files as shipped by the package at location.
+func (c ContentsIndex) Add(location string, files ...string) {
+	for _, f := range files {
+		f = cleanContentsPath(f)
+		if len(f) == 0 {
+			continue
+		}
+		found := false
+		for _, l := range c[f] {
+			if l == location {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			c[f] = append(c[f], location)
+		}
+	}
+}
+
+// RemovePackage removes a binary package, whatever its section is,
+// from the index.
+func (c ContentsIndex) RemovePackage(name string) {
+	for f, locations := range c {
+		kept := make([]string, 0, len(locations))
+		for _, l := range locations {
+			if LocationPackage(l) == name {
+				continue
+			}
+			kept = append(kept, l)
+		}
+		if len(kept) == 0 {
+			delete(c, f)
+			continue
+		}
+		c[f] = kept
+	}
+}
+
+// Search returns all entries matching the query, sorted by
+// path. An absolute query or a query containing a slash will match
+// the exact path or any path ending by it, otherwise the query is
+// matched against file basenames.
+func (c ContentsIndex) Search(query string) []ContentsEntry {
+	query = cleanContentsPath(query)
+	res := []ContentsEntry{}
+	if len(query) == 0 {
+		return res
+	}
+	for f, locations := range c {
+		if f != query && strings.HasSuffix(f, "/"+query) == false {
+			continue
+		}
+		res = append(res, ContentsEntry{
+			Path:      f,
+			Locations: append([]string(nil), locations...),
+		})
+	}
+	sort.Sort(contentsEntries(res))
+	return res
+}
+
+type contentsEntries []ContentsEntry
+
+func (l contentsEntries) Len() int           { return len(l) }
+func (l contentsEntries) Less(i, j int) bool { return l[i].Path < l[j].Path }
+func (l contentsEntries) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+var contentsLineRx = regexp.MustCompile(`^(.*[^\s])\s+([^\s]+)$`)
+var contentsHeaderRx = regexp.MustCompile(`^FILE\s+LOCATION$`)
+
+// ParseContents parses a Contents-<arch> index. It accepts the
+// legacy format with a free-form header ended by a `FILE LOCATION'
+// line.
+func ParseContents(r io.Reader) (ContentsIndex, error) {
+	res := make(ContentsIndex)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNumber := 0
+	var errs []string
+	for scanner.Scan() {
+		lineNumber = lineNumber + 1
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if len(line) == 0 {
+			continue
+		}
+		if contentsHeaderRx.MatchString(line) {
+			// everything before was the legacy header
+			res = make(ContentsIndex)
+			errs = nil
+			continue
+		}
+		m := contentsLineRx.FindStringSubmatch(line)
+		if m == nil {
+			errs = append(errs, fmt.Sprintf("line %d: invalid entry `%s'", lineNumber, line))
+			continue
+		}
+		for _, l := range strings.Split(m[2], ",") {
+			res.Add(l, m[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Contents parse error: %s", errs[0])
+	}
+	return res, nil
+}
+
+// Write writes the index in the Contents-<arch> format, sorted by
+// path.
+func (c ContentsIndex) Write(w io.Writer) error {
+	paths := make([]string, 0, len(c))
+	for f := range c {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+	for _, f := range paths {
+		locations := append([]string(nil), c[f]...)
+		sort.Strings(locations)
+		if _, err := fmt.Fprintf(w, "%-60s %s\n", f, strings.Join(locations, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package deb
+
+import (
+	"bytes"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type ContentsSuite struct{}
+
+var _ = Suite(&ContentsSuite{})
+
+func (s *ContentsSuite) TestParseAndWrite(c *C) {
+	content := `This is a legacy header
+that should be ignored.
+
+FILE                                                    LOCATION
+usr/bin/foo                                             utils/foo
+usr/lib/libfoo.so.1                                     libs/libfoo1
+usr/lib/libfoo.so                                       libdevel/libfoo-dev,libs/libfoo1
+usr/share/doc/foo bar/README                            doc/foo-doc
+`
+	idx, err := ParseContents(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	c.Check(len(idx), Equals, 4)
+	c.Check(idx["usr/lib/libfoo.so"], DeepEquals, []string{"libdevel/libfoo-dev", "libs/libfoo1"})
+	c.Check(idx["usr/share/doc/foo bar/README"], DeepEquals, []string{"doc/foo-doc"})
+
+	var out bytes.Buffer
+	c.Assert(idx.Write(&out), IsNil)
+	reparsed, err := ParseContents(&out)
+	c.Assert(err, IsNil)
+	c.Check(reparsed, DeepEquals, idx)
+
+	_, err = ParseContents(strings.NewReader("usr/bin/foo\n"))
+	c.Check(err, ErrorMatches, "Contents parse error: line 1: invalid entry `usr/bin/foo'")
+}
+
+func (s *ContentsSuite) TestAddSearchAndRemove(c *C) {
+	idx := make(ContentsIndex)
+	idx.Add(ContentsLocation("libs", "libfoo1"), "./usr/lib/libfoo.so.1", "/usr/lib/libfoo.so", "./")
+	idx.Add(ContentsLocation("libdevel", "libfoo-dev"), "usr/lib/libfoo.so", "usr/include/foo.h")
+	idx.Add(ContentsLocation("", "foo"), "usr/bin/foo", "usr/bin/foo")
+
+	c.Check(len(idx), Equals, 4)
+	c.Check(idx["usr/bin/foo"], DeepEquals, []string{"foo"})
+
+	c.Check(idx.Search("/usr/lib/libfoo.so"), DeepEquals, []ContentsEntry{
+		{Path: "usr/lib/libfoo.so", Locations: []string{"libs/libfoo1", "libdevel/libfoo-dev"}},
+	})
+	c.Check(idx.Search("foo.h"), DeepEquals, []ContentsEntry{
+		{Path: "usr/include/foo.h", Locations: []string{"libdevel/libfoo-dev"}},
+	})
+	c.Check(idx.Search("lib/libfoo.so.1"), HasLen, 1)
+	c.Check(idx.Search("oo.h"), HasLen, 0)
+	c.Check(idx.Search("/"), HasLen, 0)
+
+	idx.RemovePackage("libfoo1")
+	c.Check(len(idx), Equals, 3)
+	c.Check(idx["usr/lib/libfoo.so"], DeepEquals, []string{"libdevel/libfoo-dev"})
+}
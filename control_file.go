@@ -424,12 +424,19 @@ func parseFiles(f ControlField, v interface{}) error {
 	return setField(v, "Files", files)
 }
 
+var sourceWithVersionRx = regexp.MustCompile(`^(\S+) \([^)\s]+\)$`)
+
 func parseSource(f ControlField, v interface{}) error {
 	if err := expectSingleLine(f); err != nil {
 		return err
 	}
 
 	s := strings.TrimSpace(f.Data[0])
+	// binary-only uploads give the source version, when it differs
+	// from the binary one
+	if m := sourceWithVersionRx.FindStringSubmatch(s); m != nil {
+		s = m[1]
+	}
 	if strings.Contains(s, " ") {
 		return fmt.Errorf("multiple source name")
 	}
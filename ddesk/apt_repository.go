@@ -49,5 +49,6 @@ type AptRepository interface {
 	RemoveDistribution(deb.Codename, deb.Architecture) error
 	ListPackage(deb.Codename, *regexp.Regexp) []deb.BinaryPackageRef
 	RemovePackage(deb.Codename, deb.BinaryPackageRef) error
+	SearchFile(deb.Codename, string) (map[deb.Architecture][]deb.ContentsEntry, error)
 	Access() *AptRepositoryAccess
 }
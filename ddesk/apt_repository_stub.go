@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
 
 	deb ".."
@@ -9,6 +10,7 @@ import (
 type aptRepositoryStub struct {
 	ArchiveCalled bool
 	Err           error
+	Contents      map[deb.Codename]map[deb.Architecture]deb.ContentsIndex
 }
 
 func (l *aptRepositoryStub) ArchiveChanges(c *deb.ChangesFile, dir string) error {
@@ -33,6 +35,23 @@ func (l *aptRepositoryStub) RemovePackage(deb.Codename, deb.BinaryPackageRef) er
 	return nil
 }
 
+func (l *aptRepositoryStub) SearchFile(d deb.Codename, query string) (map[deb.Architecture][]deb.ContentsEntry, error) {
+	if l.Err != nil {
+		return nil, l.Err
+	}
+	indices, ok := l.Contents[d]
+	if ok == false {
+		return nil, fmt.Errorf("Distribution %s is not supported", d)
+	}
+	res := make(map[deb.Architecture][]deb.ContentsEntry)
+	for a, idx := range indices {
+		if entries := idx.Search(query); len(entries) > 0 {
+			res[a] = entries
+		}
+	}
+	return res, nil
+}
+
 func (l *aptRepositoryStub) Access() *AptRepositoryAccess {
 	return nil
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sync"
+
+	deb ".."
+)
+
+// archBuild is the build of a package for one architecture
+type archBuild struct {
+	arch deb.Architecture
+	// also builds architecture independent packages
+	indep bool
+	log   bytes.Buffer
+	err   error
+	// architecture the packages are cross-built for, empty for a
+	// native build
+	host deb.Architecture
+	// compiler cache statistics of the build, if available
+	cacheStats *CacheStats
+	// results of the autopkgtests run after the build, if any
+	autopkgtest []AutopkgtestResult
+}
+
+// targetArch returns the architecture of the built packages
+func (ab *archBuild) targetArch() deb.Architecture {
+	if len(ab.host) != 0 {
+		return ab.host
+	}
+	return ab.arch
+}
+
+// hostArchitectures returns the architectures the host can build
+// natively
+func hostArchitectures() ArchitectureList {
+	switch runtime.GOARCH {
+	case "amd64":
+		return []deb.Architecture{deb.Amd64, deb.I386}
+	case "386":
+		return []deb.Architecture{deb.I386}
+	case "arm":
+		return []deb.Architecture{deb.Armel}
+	}
+	return nil
+}
+
+// archBackend is a BuilderBackend that builds a package one
+// architecture at a time, each in its own image
+type archBackend interface {
+	AvailableArchitectures(d deb.Codename) ArchitectureList
+	imagePath(d deb.Codename, a deb.Architecture) string
+	// buildArch builds dscFile for ab.arch, and moves its results to
+	// a.Dest
+	buildArch(ctx context.Context, a BuildArguments, ab *archBuild, dscFile string, output io.Writer) error
+}
+
+// buildArchitectures builds a package for all its architectures on
+// b. Architectures are built concurrently, as scheduled by s, their
+// output lines are then prefixed by the architecture. Only the last
+// architecture builds the architecture independent packages. The
+// changes files of all architectures are merged.
+func buildArchitectures(ctx context.Context, b archBackend, s *buildScheduler, a BuildArguments, output io.Writer) (*BuildResult, error) {
+	//checks we supports everything
+	supported := b.AvailableArchitectures(a.Dist)
+	for _, targetArch := range a.Archs {
+		found := false
+		for _, aArch := range supported {
+			if targetArch == aArch {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return nil, fmt.Errorf("Distribution %s-%s is not supported", a.Dist, targetArch)
+		}
+	}
+
+	if len(a.HostArch) != 0 {
+		if err := checkCrossBuild(a); err != nil {
+			return nil, err
+		}
+	}
+	if a.BinNMU != nil {
+		if err := checkBinNMU(a); err != nil {
+			return nil, err
+		}
+	}
+
+	//checks that the input exists
+	dscFile := path.Join(a.SourcePackage.BasePath, a.SourcePackage.Filename())
+	if _, err := os.Stat(dscFile); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Expected file %s, does not exists", dscFile)
+		}
+		return nil, fmt.Errorf("Could not check existence of %s: %s", dscFile, err)
+	}
+
+	// ensure that destination directory exists
+	if err := os.MkdirAll(a.Dest, 0755); err != nil {
+		return nil, err
+	}
+
+	// creates output buffers and result structures
+	var buf bytes.Buffer
+	var writer io.Writer = &buf
+	if output != nil {
+		writer = io.MultiWriter(&buf, output)
+	}
+
+	ref := builtRef(a)
+	var builds []*archBuild
+	if len(a.HostArch) != 0 {
+		// cross-builds only produce architecture dependent packages
+		builds = []*archBuild{{arch: a.Archs[0], host: a.HostArch}}
+	} else {
+		builds = nativeBuilds(a, writer)
+	}
+
+	if len(builds) == 0 {
+		return nil, fmt.Errorf("No architecture where build!")
+	}
+
+	var wg sync.WaitGroup
+	var outputMutex sync.Mutex
+	for _, ab := range builds {
+		var archOutput io.Writer = ioutil.Discard
+		var prefixed *prefixWriter
+		if output != nil {
+			archOutput = output
+			if len(builds) > 1 {
+				prefixed = newPrefixWriter(output, &outputMutex, fmt.Sprintf("[%s] ", ab.arch))
+				archOutput = prefixed
+			}
+		}
+		wg.Add(1)
+		go func(ab *archBuild, archOutput io.Writer) {
+			defer wg.Done()
+			ab.err = s.Run(ctx, b.imagePath(a.Dist, ab.arch), func() error {
+				return b.buildArch(ctx, a, ab, dscFile, io.MultiWriter(&ab.log, archOutput))
+			})
+			if prefixed != nil {
+				prefixed.Flush()
+			}
+		}(ab, archOutput)
+	}
+	wg.Wait()
+
+	changesFiles := make([]string, 0, len(builds))
+	for _, ab := range builds {
+		if len(builds) > 1 {
+			fmt.Fprintf(&buf, "--- Build for %s\n", ab.arch)
+		}
+		buf.Write(ab.log.Bytes())
+		changesFiles = append(changesFiles, path.Join(a.Dest, fmt.Sprintf("%s_%s.changes", ref, ab.targetArch())))
+	}
+	for _, ab := range builds {
+		if ab.err == nil {
+			continue
+		}
+		if len(ab.host) != 0 && ctx.Err() == nil {
+			if err := crossDependencyError(a.SourcePackage.Identifier, ab.host, ab.log.String()); err != nil {
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("Build for %s failed: %s", ab.arch, ab.err)
+	}
+
+	res := &BuildResult{
+		BasePath: a.Dest,
+		HostArch: a.HostArch,
+		BinNMU:   a.BinNMU,
+	}
+	for _, ab := range builds {
+		if ab.cacheStats == nil {
+			continue
+		}
+		if res.CacheStats == nil {
+			res.CacheStats = &CacheStats{}
+		}
+		res.CacheStats.Hits += ab.cacheStats.Hits
+		res.CacheStats.Misses += ab.cacheStats.Misses
+	}
+	for _, ab := range builds {
+		res.Autopkgtest = append(res.Autopkgtest, ab.autopkgtest...)
+	}
+
+	res.ChangesPath = path.Base(changesFiles[0])
+	var suffix = string(builds[len(builds)-1].targetArch())
+	if len(changesFiles) > 1 {
+		// in that case we make a multi-arch upload file
+		cmd := exec.Command("mergechanges", changesFiles...)
+		cmd.Stdin = nil
+		var mergedChanges bytes.Buffer
+		cmd.Stdout = &mergedChanges
+		cmd.Stderr = writer
+		fmt.Fprintf(writer, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
+		err := cmd.Run()
+		if err != nil {
+			return nil, err
+		}
+		res.ChangesPath = fmt.Sprintf("%s_multi.changes", ref)
+		f, err := os.Create(path.Join(res.BasePath, res.ChangesPath))
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, &mergedChanges)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		suffix = "multi"
+	}
+	res.BuildLog = Log(buf.String())
+	res.HookLogs = extractHookLogs(buf.String())
+	if a.Options.Lintian {
+		res.Lintian = ParseLintianTags(string(res.HookLogs[lintianHookName]))
+	}
+
+	cf, err := os.Open(path.Join(res.BasePath, res.ChangesPath))
+	if err != nil {
+		return nil, err
+	}
+	defer cf.Close()
+
+	res.Changes, err = deb.ParseChangeFile(cf)
+	if err != nil {
+		return nil, err
+	}
+	res.Changes.Ref.Suffix = suffix
+	res.Buildinfo = resultFiles(res, ".buildinfo")
+
+	return res, nil
+}
+
+// nativeBuilds returns the builds of the package of a for each of its
+// architectures. Only the last builds the architecture independent
+// packages, unless the build is a binNMU, the others are skipped if
+// they would produce no package.
+func nativeBuilds(a BuildArguments, output io.Writer) []*archBuild {
+	builds := []*archBuild{}
+	for i, arch := range a.Archs {
+		ab := &archBuild{arch: arch}
+		//only the last will build architecture-independent package
+		if i == len(a.Archs)-1 && a.BinNMU == nil {
+			ab.indep = true
+		} else {
+			//if it produce only arch indep package we skip the build
+			skip := true
+			for _, targetArch := range a.SourcePackage.Archs {
+				if targetArch == deb.Any {
+					skip = false
+					break
+				}
+				if targetArch == arch {
+					skip = false
+					break
+				}
+			}
+			if skip == true {
+				fmt.Fprintf(output, "Skiping build for %s, as it will produce no package\n", arch)
+				continue
+			}
+		}
+		builds = append(builds, ab)
+	}
+	return builds
+}
+
+// checkCrossBuild checks that the package of a can be cross-built for
+// a.HostArch
+func checkCrossBuild(a BuildArguments) error {
+	if len(a.Archs) != 1 {
+		return fmt.Errorf("A cross-build needs a single build architecture, got %d", len(a.Archs))
+	}
+	if a.Archs[0] == a.HostArch {
+		return fmt.Errorf("Cannot cross-build for %s on %s, it is the build architecture", a.HostArch, a.Archs[0])
+	}
+	for _, arch := range a.SourcePackage.Archs {
+		if arch == deb.Any || arch == a.HostArch {
+			return nil
+		}
+	}
+	return fmt.Errorf("`%s' has no package for %s to cross-build", a.SourcePackage.Identifier, a.HostArch)
+}
+
+// collectResults moves the files of the build for arch in resultDir
+// to a.Dest, and checks that its changes file was produced. arch is
+// the architecture of the built packages.
+func collectResults(resultDir string, a BuildArguments, arch deb.Architecture) error {
+	results, err := ioutil.ReadDir(resultDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range results {
+		if f.IsDir() {
+			continue
+		}
+		if err := moveFile(path.Join(resultDir, f.Name()), path.Join(a.Dest, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	changesFileName := path.Join(a.Dest, fmt.Sprintf("%s_%s.changes", builtRef(a), arch))
+	if _, err = os.Stat(changesFileName); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Missing expected result file %s", changesFileName)
+		}
+		return fmt.Errorf("Could not check existence of %s: %s", changesFileName, err)
+	}
+	return nil
+}
+
+// moveFile moves a file, possibly across filesystems. The destination
+// is replaced atomically, as concurrent jobs may produce the same
+// source files.
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(path.Dir(dest), "."+path.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err := copyFile(src, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
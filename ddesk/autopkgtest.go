@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	deb ".."
+)
+
+// Outcomes of an autopkgtest
+const (
+	AutopkgtestPass  = "pass"
+	AutopkgtestFail  = "fail"
+	AutopkgtestSkip  = "skip"
+	AutopkgtestFlaky = "flaky"
+)
+
+// AutopkgtestResult is the result of a test of a source package
+type AutopkgtestResult struct {
+	Name    string
+	Outcome string
+	Details string `json:",omitempty"`
+}
+
+func (r AutopkgtestResult) String() string {
+	if len(r.Details) == 0 {
+		return fmt.Sprintf("%s: %s", r.Name, r.Outcome)
+	}
+	return fmt.Sprintf("%s: %s (%s)", r.Name, r.Outcome, r.Details)
+}
+
+// sourceAutopkgTests extracts the source package dscFile in dir, and
+// returns its tests. It returns no tests if the package has none.
+func sourceAutopkgTests(dscFile, dir string) ([]deb.AutopkgTest, error) {
+	srcDir := path.Join(dir, "source")
+	cmd := exec.Command("dpkg-source", "--no-check", "-x", dscFile, srcDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("Could not extract source package:\n%s", output)
+	}
+	defer os.RemoveAll(srcDir)
+
+	f, err := os.Open(path.Join(srcDir, "debian", "tests", "control"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	tests, err := deb.ParseAutopkgTestControl(f)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid debian/tests/control: %s", err)
+	}
+	return tests, nil
+}
+
+// autopkgtestScript returns the script running in the build
+// environment the tests of dscFile against the packages of
+// changesFile, writing the autopkgtest summary to summaryFile.
+func autopkgtestScript(changesFile, dscFile, summaryFile string) string {
+	return fmt.Sprintf(`#!/bin/sh
+apt-get update > /dev/null
+apt-get install -y --no-install-recommends autopkgtest || exit 1
+autopkgtest --summary-file=%s %s %s -- null
+status=$?
+# 8 means no tests, the other codes up to 6 test failures or skips
+if [ $status -gt 8 ]; then
+	exit $status
+fi
+exit 0
+`, shellQuote(summaryFile), shellQuote(changesFile), shellQuote(dscFile))
+}
+
+// parseAutopkgtestSummary parses an autopkgtest summary file, and
+// returns the results of tests, on architecture a. Tests missing from
+// the summary, as tests not supporting a, are reported skipped.
+func parseAutopkgtestSummary(summary string, tests []deb.AutopkgTest, a deb.Architecture) []AutopkgtestResult {
+	reported := map[string]AutopkgtestResult{}
+	scanner := bufio.NewScanner(strings.NewReader(summary))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		r := AutopkgtestResult{
+			Name:    fields[0],
+			Details: strings.Join(fields[2:], " "),
+		}
+		switch fields[1] {
+		case "PASS":
+			r.Outcome = AutopkgtestPass
+		case "FAIL":
+			r.Outcome = AutopkgtestFail
+		case "FLAKY":
+			r.Outcome = AutopkgtestFlaky
+		case "SKIP", "NEUTRAL":
+			r.Outcome = AutopkgtestSkip
+		default:
+			continue
+		}
+		reported[r.Name] = r
+	}
+
+	res := []AutopkgtestResult{}
+	commands := 0
+	for _, t := range tests {
+		names := t.Tests
+		if len(t.TestCommand) != 0 {
+			commands++
+			names = []string{fmt.Sprintf("command%d", commands)}
+		}
+		for _, name := range names {
+			r, ok := reported[name]
+			if ok == false {
+				r = AutopkgtestResult{Name: name, Outcome: AutopkgtestSkip, Details: "not run"}
+				if t.SupportsArchitecture(a) == false {
+					r.Details = fmt.Sprintf("not supported on %s", a)
+				}
+			}
+			if r.Outcome == AutopkgtestFail && t.HasRestriction("flaky") {
+				r.Outcome = AutopkgtestFlaky
+			}
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// autopkgtestFailures returns the failed tests. Flaky tests are not
+// failures.
+func autopkgtestFailures(results []AutopkgtestResult) []AutopkgtestResult {
+	var res []AutopkgtestResult
+	for _, r := range results {
+		if r.Outcome == AutopkgtestFail {
+			res = append(res, r)
+		}
+	}
+	return res
+}
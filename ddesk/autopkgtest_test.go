@@ -0,0 +1,38 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+
+	deb ".."
+)
+
+type AutopkgtestSuite struct{}
+
+var _ = Suite(&AutopkgtestSuite{})
+
+func (s *AutopkgtestSuite) TestParseSummary(c *C) {
+	tests := []deb.AutopkgTest{
+		{Tests: []string{"unit", "smoke"}},
+		{Tests: []string{"network"}, Restrictions: []string{"flaky"}},
+		{TestCommand: "foo --version"},
+		{Tests: []string{"arm-only"}, Architecture: []string{"armel"}},
+		{Tests: []string{"forgotten"}},
+	}
+	summary := `unit                 PASS
+smoke                FAIL non-zero exit status 1
+network              FAIL stderr: timeout
+command1             SKIP Test needs root
+`
+	results := parseAutopkgtestSummary(summary, tests, deb.Amd64)
+	c.Check(results, DeepEquals, []AutopkgtestResult{
+		{Name: "unit", Outcome: AutopkgtestPass},
+		{Name: "smoke", Outcome: AutopkgtestFail, Details: "non-zero exit status 1"},
+		{Name: "network", Outcome: AutopkgtestFlaky, Details: "stderr: timeout"},
+		{Name: "command1", Outcome: AutopkgtestSkip, Details: "Test needs root"},
+		{Name: "arm-only", Outcome: AutopkgtestSkip, Details: "not supported on amd64"},
+		{Name: "forgotten", Outcome: AutopkgtestSkip, Details: "not run"},
+	})
+	c.Check(results[0].String(), Equals, "unit: pass")
+	c.Check(results[1].String(), Equals, "smoke: fail (non-zero exit status 1)")
+	c.Check(autopkgtestFailures(results), DeepEquals, results[1:2])
+}
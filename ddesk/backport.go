@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	deb ".."
+)
+
+// Backport records a source package rewritten for another
+// distribution than the one it targets
+type Backport struct {
+	// The backported source package
+	Origin deb.SourcePackageRef
+	// The rewritten source package
+	Ref deb.SourcePackageRef
+	// The distribution targeted by the backport
+	Dist deb.Codename
+}
+
+// String describes the backport
+func (b Backport) String() string {
+	return fmt.Sprintf("%s for %s, from %s", b.Ref, b.Dist, b.Origin)
+}
+
+// debianReleases are the release numbers of Debian distributions,
+// used in the version of their official backports
+var debianReleases = map[deb.Codename]int{
+	deb.Squeeze: 6,
+	deb.Wheezy:  7,
+	deb.Jessie:  8,
+	deb.Stretch: 9,
+	deb.Buster:  10,
+}
+
+// backportVersion returns the version of the nth backport of version v
+// to d. As backports must sort before the version they come from, it
+// is suffixed by ~bpoR+n for a Debian release R, as Debian backports
+// are, and by ~dn otherwise, as Ubuntu PPAs are.
+func backportVersion(v deb.Version, d deb.Codename, n int) deb.Version {
+	suffix := fmt.Sprintf("~%s%d", d, n)
+	if release, ok := debianReleases[d]; ok {
+		suffix = fmt.Sprintf("~bpo%d+%d", release, n)
+	}
+	if v.DebianRevision == "0" {
+		v.UpstreamVersion += suffix
+	} else {
+		v.DebianRevision += suffix
+	}
+	return v
+}
+
+// SourceBackporter rewrites source packages for other distributions
+type SourceBackporter interface {
+	// Backport extracts dsc in dest, adds entry on top of its
+	// changelog, and builds the resulting source package in
+	// dest. Progress is reported to output.
+	Backport(dsc deb.SourceControlFile, entry deb.ChangelogEntry, dest string, output io.Writer) (*deb.SourceControlFile, error)
+}
+
+// DpkgSourceBackporter is a SourceBackporter that rebuilds the source
+// packages with dpkg-source
+type DpkgSourceBackporter struct{}
+
+// NewDpkgSourceBackporter returns a new DpkgSourceBackporter
+func NewDpkgSourceBackporter() *DpkgSourceBackporter {
+	return &DpkgSourceBackporter{}
+}
+
+// prependChangelogEntry adds entry on top of the changelog at
+// filepath
+func prependChangelogEntry(filepath string, entry deb.ChangelogEntry) error {
+	previous, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := entry.Write(&buf); err != nil {
+		return err
+	}
+	buf.Write(previous)
+	return ioutil.WriteFile(filepath, buf.Bytes(), 0644)
+}
+
+// Backport implements SourceBackporter
+func (b *DpkgSourceBackporter) Backport(dsc deb.SourceControlFile, entry deb.ChangelogEntry, dest string, output io.Writer) (*deb.SourceControlFile, error) {
+	if output == nil {
+		output = ioutil.Discard
+	}
+
+	// the original files are needed next to the unpacked source to
+	// build the new one
+	for _, f := range append([]string{dsc.Filename()}, fileNames(dsc.Md5Files)...) {
+		if err := copyFile(path.Join(dsc.BasePath, f), path.Join(dest, f)); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceDir := fmt.Sprintf("%s-%s", dsc.Identifier.Source, dsc.Identifier.Ver.UpstreamVersion)
+	cmd := exec.Command("dpkg-source", "-x", dsc.Filename(), sourceDir)
+	cmd.Dir = dest
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Could not extract source package `%s': %s", dsc.Identifier, err)
+	}
+
+	if err := prependChangelogEntry(path.Join(dest, sourceDir, "debian", "changelog"), entry); err != nil {
+		return nil, fmt.Errorf("Could not add changelog entry: %s", err)
+	}
+
+	fmt.Fprintf(output, "Building source package %s %s for %v\n", entry.Source, entry.Ver, entry.Dists)
+	cmd = exec.Command("dpkg-source", "-b", sourceDir)
+	cmd.Dir = dest
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Could not build source package: %s", err)
+	}
+
+	res := deb.SourceControlFile{
+		Identifier: deb.SourcePackageRef{Source: entry.Source, Ver: entry.Ver},
+	}
+	f, err := os.Open(path.Join(dest, res.Filename()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	backport, err := deb.ParseDsc(f)
+	if err != nil {
+		return nil, err
+	}
+	backport.BasePath = dest
+	return backport, nil
+}
+
+// fileNames returns the names of files
+func fileNames(files []deb.FileReference) []string {
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		res = append(res, f.Name)
+	}
+	return res
+}
+
+func init() {
+	aptDepTracker.Add("dpkg-dev")
+}
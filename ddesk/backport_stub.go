@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+
+	deb ".."
+)
+
+type SourceBackporterStub struct {
+	Entry deb.ChangelogEntry
+	Err   error
+}
+
+func (b *SourceBackporterStub) Backport(dsc deb.SourceControlFile, entry deb.ChangelogEntry, dest string, output io.Writer) (*deb.SourceControlFile, error) {
+	b.Entry = entry
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	dsc.Identifier = deb.SourcePackageRef{Source: entry.Source, Ver: entry.Ver}
+	dsc.BasePath = dest
+	dsc.Md5Files = nil
+	if err := ioutil.WriteFile(path.Join(dest, dsc.Filename()), nil, 0644); err != nil {
+		return nil, err
+	}
+	return &dsc, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type BackportSuite struct{}
+
+var _ = Suite(&BackportSuite{})
+
+func (s *BackportSuite) TestBackportVersion(c *C) {
+	v := deb.Version{UpstreamVersion: "1.0", DebianRevision: "2"}
+	c.Check(backportVersion(v, deb.Jessie, 1).String(), Equals, "1.0-2~bpo8+1")
+	c.Check(backportVersion(v, deb.Trusty, 2).String(), Equals, "1.0-2~trusty2")
+	native := deb.Version{UpstreamVersion: "1.0", DebianRevision: "0"}
+	c.Check(backportVersion(native, deb.Buster, 1).String(), Equals, "1.0~bpo10+1")
+}
+
+func (s *BackportSuite) TestBackport(c *C) {
+	if _, err := exec.LookPath("dpkg-source"); err != nil {
+		c.Skip("dpkg-source is not installed")
+	}
+	src := c.MkDir()
+	c.Assert(os.MkdirAll(path.Join(src, "foo-1.0", "debian", "source"), 0755), IsNil)
+	files := map[string]string{
+		"debian/source/format": "3.0 (native)\n",
+		"debian/control": `Source: foo
+Maintainer: Foo Bar <foo@example.com>
+
+Package: foo
+Architecture: any
+Description: foo
+ foo
+`,
+		"debian/changelog": `foo (1.0) unstable; urgency=medium
+
+  * Initial release.
+
+ -- Foo Bar <foo@example.com>  Mon, 01 Jun 2015 10:00:00 +0200
+`,
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(path.Join(src, "foo-1.0", name), []byte(content), 0644), IsNil)
+	}
+	cmd := exec.Command("dpkg-source", "-b", "foo-1.0")
+	cmd.Dir = src
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%s", out))
+
+	f, err := os.Open(path.Join(src, "foo_1.0.dsc"))
+	c.Assert(err, IsNil)
+	dsc, err := deb.ParseDsc(f)
+	f.Close()
+	c.Assert(err, IsNil)
+	dsc.BasePath = src
+
+	entry := deb.ChangelogEntry{
+		Source:     "foo",
+		Ver:        backportVersion(dsc.Identifier.Ver, deb.Jessie, 1),
+		Dists:      []deb.Codename{deb.Jessie},
+		Urgency:    "medium",
+		Changes:    []string{"* Backport to jessie."},
+		Maintainer: dsc.Maintainer,
+		Date:       time.Date(2015, 6, 2, 10, 0, 0, 0, time.UTC),
+	}
+	dest := c.MkDir()
+	res, err := NewDpkgSourceBackporter().Backport(*dsc, entry, dest, nil)
+	c.Assert(err, IsNil)
+	c.Check(res.Identifier.Ver.String(), Equals, "1.0~bpo8+1")
+	c.Check(res.BasePath, Equals, dest)
+
+	changelog, err := ioutil.ReadFile(path.Join(dest, "foo-1.0", "debian", "changelog"))
+	c.Assert(err, IsNil)
+	entries, err := deb.ParseChangelog(strings.NewReader(string(changelog)))
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Check(entries[0].Dists, DeepEquals, []deb.Codename{deb.Jessie})
+	c.Check(entries[1].Ver.String(), Equals, "1.0")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+
+	deb ".."
+)
+
+// BinNMU is a binary-only rebuild of a source package, for instance
+// once a library it depends on changed its ABI. The source is left
+// untouched, the builder adds a changelog entry suffixing the version
+// of the binary packages with +bN.
+type BinNMU struct {
+	// Number of the rebuild of the same source version, from 1
+	Number int
+	// Reason of the rebuild, the text of the changelog entry
+	Reason string
+	// Maintainer of the changelog entry
+	Maintainer *mail.Address
+}
+
+// Check reports invalid binNMUs
+func (b BinNMU) Check() error {
+	if b.Number < 1 {
+		return fmt.Errorf("Invalid binNMU number %d", b.Number)
+	}
+	if len(strings.TrimSpace(b.Reason)) == 0 {
+		return fmt.Errorf("A binNMU needs a reason")
+	}
+	if strings.Contains(b.Reason, "\n") {
+		return fmt.Errorf("The reason of a binNMU is a single line")
+	}
+	if b.Maintainer == nil {
+		return fmt.Errorf("A binNMU needs a maintainer")
+	}
+	return nil
+}
+
+// Version returns the version of the binary packages rebuilt from
+// source version v
+func (b BinNMU) Version(v deb.Version) deb.Version {
+	suffix := fmt.Sprintf("+b%d", b.Number)
+	if v.DebianRevision == "0" {
+		v.UpstreamVersion += suffix
+	} else {
+		v.DebianRevision += suffix
+	}
+	return v
+}
+
+// maintainer formats the maintainer of the changelog entry
+func (b BinNMU) maintainer() string {
+	return fmt.Sprintf("%s <%s>", b.Maintainer.Name, b.Maintainer.Address)
+}
+
+// pbuilderArgs returns the pbuilder arguments making the build a
+// binNMU
+func (b BinNMU) pbuilderArgs() []string {
+	return []string{
+		"--bin-nmu", b.Reason,
+		"--bin-nmu-version", fmt.Sprintf("%d", b.Number),
+		"--bin-nmu-maintainer", b.maintainer(),
+	}
+}
+
+// sbuildArgs returns the sbuild arguments making the build a binNMU
+func (b BinNMU) sbuildArgs() []string {
+	return []string{
+		"--make-binNMU=" + b.Reason,
+		fmt.Sprintf("--binNMU=%d", b.Number),
+		"--maintainer=" + b.maintainer(),
+	}
+}
+
+// DefaultMaintainer returns the maintainer set by the DEBFULLNAME and
+// DEBEMAIL environment variables, as dch does
+func DefaultMaintainer() (*mail.Address, error) {
+	email := os.Getenv("DEBEMAIL")
+	if len(email) == 0 {
+		return nil, fmt.Errorf("DEBEMAIL is not set")
+	}
+	if addr, err := mail.ParseAddress(email); err == nil && len(addr.Name) != 0 {
+		return addr, nil
+	}
+	return &mail.Address{Name: os.Getenv("DEBFULLNAME"), Address: email}, nil
+}
+
+// builtRef returns the reference of the packages built with a, the
+// version of a binNMU is suffixed
+func builtRef(a BuildArguments) deb.SourcePackageRef {
+	ref := a.SourcePackage.Identifier
+	if a.BinNMU != nil {
+		ref.Ver = a.BinNMU.Version(ref.Ver)
+	}
+	return ref
+}
+
+// checkBinNMU checks that the package of a has architecture dependent
+// packages to rebuild
+func checkBinNMU(a BuildArguments) error {
+	if err := a.BinNMU.Check(); err != nil {
+		return err
+	}
+	for _, arch := range a.SourcePackage.Archs {
+		if arch != deb.All && arch != deb.Source {
+			return nil
+		}
+	}
+	return fmt.Errorf("`%s' has no architecture dependent package to rebuild", a.SourcePackage.Identifier)
+}
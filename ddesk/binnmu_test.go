@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/mail"
+	"os"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type BinNMUSuite struct{}
+
+var _ = Suite(&BinNMUSuite{})
+
+func (s *BinNMUSuite) TestVersion(c *C) {
+	b := BinNMU{Number: 2}
+	c.Check(b.Version(deb.Version{Epoch: 1, UpstreamVersion: "1.0", DebianRevision: "3"}).String(), Equals, "1:1.0-3+b2")
+	c.Check(b.Version(deb.Version{UpstreamVersion: "1.0", DebianRevision: "0"}).String(), Equals, "1.0+b2")
+}
+
+func (s *BinNMUSuite) TestArgs(c *C) {
+	b := BinNMU{
+		Number:     1,
+		Reason:     "Rebuild against libfoo2",
+		Maintainer: &mail.Address{Name: "Foo Bar", Address: "foo@example.com"},
+	}
+	c.Check(b.Check(), IsNil)
+	c.Check(b.pbuilderArgs(), DeepEquals, []string{
+		"--bin-nmu", "Rebuild against libfoo2",
+		"--bin-nmu-version", "1",
+		"--bin-nmu-maintainer", "Foo Bar <foo@example.com>",
+	})
+	c.Check(b.sbuildArgs(), DeepEquals, []string{
+		"--make-binNMU=Rebuild against libfoo2",
+		"--binNMU=1",
+		"--maintainer=Foo Bar <foo@example.com>",
+	})
+
+	b.Reason = "Rebuild\nagainst libfoo2"
+	c.Check(b.Check(), ErrorMatches, "The reason of a binNMU is a single line")
+	b.Reason = "Rebuild"
+	b.Number = 0
+	c.Check(b.Check(), ErrorMatches, "Invalid binNMU number 0")
+}
+
+func (s *BinNMUSuite) TestCheckBinNMU(c *C) {
+	a := BuildArguments{
+		SourcePackage: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{Source: "foo", Ver: deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"}},
+			Archs:      []deb.Architecture{deb.All},
+		},
+		BinNMU: &BinNMU{Number: 1, Reason: "Rebuild", Maintainer: &mail.Address{Address: "foo@example.com"}},
+	}
+	c.Check(checkBinNMU(a), ErrorMatches, "`foo_1.0-1' has no architecture dependent package to rebuild")
+	c.Check(builtRef(a).String(), Equals, "foo_1.0-1+b1")
+
+	a.SourcePackage.Archs = []deb.Architecture{deb.All, deb.Any}
+	c.Check(checkBinNMU(a), IsNil)
+}
+
+func (s *BinNMUSuite) TestDefaultMaintainer(c *C) {
+	defer os.Setenv("DEBEMAIL", os.Getenv("DEBEMAIL"))
+	defer os.Setenv("DEBFULLNAME", os.Getenv("DEBFULLNAME"))
+
+	os.Setenv("DEBEMAIL", "")
+	_, err := DefaultMaintainer()
+	c.Check(err, ErrorMatches, "DEBEMAIL is not set")
+
+	os.Setenv("DEBEMAIL", "foo@example.com")
+	os.Setenv("DEBFULLNAME", "Foo Bar")
+	m, err := DefaultMaintainer()
+	c.Assert(err, IsNil)
+	c.Check(*m, DeepEquals, mail.Address{Name: "Foo Bar", Address: "foo@example.com"})
+
+	os.Setenv("DEBEMAIL", "Baz <baz@example.com>")
+	m, err = DefaultMaintainer()
+	c.Assert(err, IsNil)
+	c.Check(*m, DeepEquals, mail.Address{Name: "Baz", Address: "baz@example.com"})
+}
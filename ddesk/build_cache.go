@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	deb ".."
+)
+
+// CacheStats are the compiler cache statistics of a build
+type CacheStats struct {
+	Hits   int
+	Misses int
+}
+
+// HitRate returns the ratio of compilations found in the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d hits, %d misses (%.0f%% hit rate)", s.Hits, s.Misses, 100*s.HitRate())
+}
+
+// BuildCache manages the caches shared by the builds of a builder:
+// a ccache directory per distribution and architecture, and the apt
+// cache of downloaded packages.
+type BuildCache struct {
+	ccachepath   string
+	aptcachepath string
+
+	ccacheSize string
+	aptMaxAge  time.Duration
+}
+
+const (
+	defaultCcacheSize = "5G"
+	defaultAptMaxAge  = 30 * 24 * time.Hour
+)
+
+// NewBuildCache returns the caches located in basepath, with default
+// limits.
+func NewBuildCache(basepath string) *BuildCache {
+	return &BuildCache{
+		ccachepath:   path.Join(basepath, "ccache"),
+		aptcachepath: path.Join(basepath, "aptcache"),
+		ccacheSize:   defaultCcacheSize,
+		aptMaxAge:    defaultAptMaxAge,
+	}
+}
+
+var ccacheSizeRx = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([kMGT]i?)?$`)
+
+// SetLimits sets the maximal size of each ccache directory, like 5G
+// or 500M, and the age after which packages are pruned from the apt
+// cache. Pruning is disabled if aptMaxAge is zero.
+func (c *BuildCache) SetLimits(ccacheSize string, aptMaxAge time.Duration) error {
+	if ccacheSizeRx.MatchString(ccacheSize) == false {
+		return fmt.Errorf("Invalid ccache size `%s', expected for example 5G or 500M", ccacheSize)
+	}
+	if aptMaxAge < 0 {
+		return fmt.Errorf("Invalid apt cache age %s", aptMaxAge)
+	}
+	c.ccacheSize = ccacheSize
+	c.aptMaxAge = aptMaxAge
+	return nil
+}
+
+// AptCacheDir returns the apt cache directory, creating it if needed
+func (c *BuildCache) AptCacheDir() (string, error) {
+	return c.aptcachepath, os.MkdirAll(c.aptcachepath, 0755)
+}
+
+// CcacheDir returns the ccache directory of d-a, creating it if
+// needed with the size limit.
+func (c *BuildCache) CcacheDir(d deb.Codename, a deb.Architecture) (string, error) {
+	dir := path.Join(c.ccachepath, fmt.Sprintf("%s-%s", d, a))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	conf := fmt.Sprintf("max_size = %s\n", c.ccacheSize)
+	if err := ioutil.WriteFile(path.Join(dir, "ccache.conf"), []byte(conf), 0644); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// parseCcacheStats parses the output of ccache --print-stats
+func parseCcacheStats(out string) (CacheStats, error) {
+	var res CacheStats
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return res, fmt.Errorf("Invalid ccache statistic %s: %s", fields[0], err)
+		}
+		switch fields[0] {
+		case "direct_cache_hit", "preprocessed_cache_hit":
+			res.Hits += int(value)
+		case "cache_miss":
+			res.Misses += int(value)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// ccacheStats returns the statistics of the ccache directory dir
+func ccacheStats(dir string) (CacheStats, error) {
+	cmd := exec.Command("ccache", "--print-stats")
+	cmd.Env = append(os.Environ(), "CCACHE_DIR="+dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return CacheStats{}, fmt.Errorf("Could not read ccache statistics of %s: %s", dir, err)
+	}
+	return parseCcacheStats(string(out))
+}
+
+// buildStats returns the statistics of the builds that ran between
+// two snapshots of the statistics of a ccache directory.
+func buildStats(before, after CacheStats) CacheStats {
+	return CacheStats{
+		Hits:   after.Hits - before.Hits,
+		Misses: after.Misses - before.Misses,
+	}
+}
+
+// PruneAptCache removes the packages of the apt cache older than the
+// maximal age, and returns the number of removed packages.
+func (c *BuildCache) PruneAptCache(now time.Time) (int, error) {
+	if c.aptMaxAge == 0 {
+		return 0, nil
+	}
+	files, err := ioutil.ReadDir(c.aptcachepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, f := range files {
+		if f.Mode().IsRegular() == false || strings.HasSuffix(f.Name(), ".deb") == false {
+			continue
+		}
+		if now.Sub(f.ModTime()) < c.aptMaxAge {
+			continue
+		}
+		if err := os.Remove(path.Join(c.aptcachepath, f.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// CacheUsage is the usage of a cache
+type CacheUsage struct {
+	Name  string
+	Size  int64
+	Files int
+	// Statistics of ccache caches, if available
+	Stats *CacheStats
+}
+
+// diskUsage returns the size and the number of the files in dir
+func diskUsage(dir string) (int64, int, error) {
+	var size int64
+	files := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files, err
+}
+
+// Usage returns the usage of the apt cache, then of the ccache
+// directories by distribution and architecture.
+func (c *BuildCache) Usage() ([]CacheUsage, error) {
+	res := []CacheUsage{}
+	if _, err := os.Stat(c.aptcachepath); err == nil {
+		u := CacheUsage{Name: "apt"}
+		if u.Size, u.Files, err = diskUsage(c.aptcachepath); err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+
+	dirs, err := ioutil.ReadDir(c.ccachepath)
+	if err != nil && os.IsNotExist(err) == false {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if d.IsDir() == false {
+			continue
+		}
+		dir := path.Join(c.ccachepath, d.Name())
+		u := CacheUsage{Name: "ccache " + d.Name()}
+		if u.Size, u.Files, err = diskUsage(dir); err != nil {
+			return nil, err
+		}
+		if stats, err := ccacheStats(dir); err == nil {
+			u.Stats = &stats
+		}
+		res = append(res, u)
+	}
+	return res, nil
+}
+
+// Clear empties the ccache directories if ccache is true, and the apt
+// cache if apt is true.
+func (c *BuildCache) Clear(ccache, apt bool) error {
+	var dirs []string
+	if ccache {
+		dirs = append(dirs, c.ccachepath)
+	}
+	if apt {
+		dirs = append(dirs, c.aptcachepath)
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	aptDepTracker.Add("ccache")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type BuildCacheSuite struct {
+	basepath string
+	cache    *BuildCache
+}
+
+var _ = Suite(&BuildCacheSuite{})
+
+func (s *BuildCacheSuite) SetUpTest(c *C) {
+	s.basepath = c.MkDir()
+	s.cache = NewBuildCache(s.basepath)
+}
+
+func (s *BuildCacheSuite) TestParseCcacheStats(c *C) {
+	stats, err := parseCcacheStats("stats_updated_timestamp\t1600000000\n" +
+		"direct_cache_hit\t30\n" +
+		"preprocessed_cache_hit\t10\n" +
+		"cache_miss\t60\n" +
+		"cache_size_kibibyte\t2048\n")
+	c.Assert(err, IsNil)
+	c.Check(stats, Equals, CacheStats{Hits: 40, Misses: 60})
+	c.Check(stats.HitRate(), Equals, 0.4)
+	c.Check(stats.String(), Equals, "40 hits, 60 misses (40% hit rate)")
+	c.Check(CacheStats{}.HitRate(), Equals, 0.0)
+
+	c.Check(buildStats(CacheStats{Hits: 10, Misses: 50}, stats), Equals, CacheStats{Hits: 30, Misses: 10})
+
+	_, err = parseCcacheStats("cache_miss\tmany\n")
+	c.Check(err, ErrorMatches, "Invalid ccache statistic cache_miss: .*")
+}
+
+func (s *BuildCacheSuite) TestCcacheDir(c *C) {
+	c.Assert(s.cache.SetLimits("500M", time.Hour), IsNil)
+	dir, err := s.cache.CcacheDir("unstable", deb.Amd64)
+	c.Assert(err, IsNil)
+	c.Check(dir, Equals, path.Join(s.basepath, "ccache", "unstable-amd64"))
+	conf, err := ioutil.ReadFile(path.Join(dir, "ccache.conf"))
+	c.Check(err, IsNil)
+	c.Check(string(conf), Equals, "max_size = 500M\n")
+
+	c.Check(s.cache.SetLimits("a lot", time.Hour), ErrorMatches, "Invalid ccache size `a lot', expected for example 5G or 500M")
+	c.Check(s.cache.SetLimits("5G", -time.Hour), ErrorMatches, "Invalid apt cache age -1h0m0s")
+}
+
+func (s *BuildCacheSuite) TestPruneAptCache(c *C) {
+	dir, err := s.cache.AptCacheDir()
+	c.Assert(err, IsNil)
+	now := time.Now()
+	files := map[string]time.Duration{
+		"old_1.0_amd64.deb":    40 * 24 * time.Hour,
+		"recent_1.0_amd64.deb": time.Hour,
+		"lock":                 40 * 24 * time.Hour,
+	}
+	for name, age := range files {
+		p := path.Join(dir, name)
+		c.Assert(ioutil.WriteFile(p, []byte("data"), 0644), IsNil)
+		c.Assert(os.Chtimes(p, now.Add(-age), now.Add(-age)), IsNil)
+	}
+
+	removed, err := s.cache.PruneAptCache(now)
+	c.Assert(err, IsNil)
+	c.Check(removed, Equals, 1)
+	remaining, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(remaining, HasLen, 2)
+	c.Check(remaining[0].Name(), Equals, "lock")
+	c.Check(remaining[1].Name(), Equals, "recent_1.0_amd64.deb")
+
+	c.Assert(s.cache.SetLimits("5G", 0), IsNil)
+	removed, err = s.cache.PruneAptCache(now.Add(365 * 24 * time.Hour))
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 0)
+}
+
+func (s *BuildCacheSuite) TestUsageAndClear(c *C) {
+	usage, err := s.cache.Usage()
+	c.Assert(err, IsNil)
+	c.Check(usage, HasLen, 0)
+
+	aptDir, err := s.cache.AptCacheDir()
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(aptDir, "foo_1.0_amd64.deb"), make([]byte, 100), 0644), IsNil)
+	ccacheDir, err := s.cache.CcacheDir("unstable", deb.Amd64)
+	c.Assert(err, IsNil)
+
+	usage, err = s.cache.Usage()
+	c.Assert(err, IsNil)
+	c.Assert(usage, HasLen, 2)
+	c.Check(usage[0], DeepEquals, CacheUsage{Name: "apt", Size: 100, Files: 1})
+	c.Check(usage[1].Name, Equals, "ccache unstable-amd64")
+	c.Check(usage[1].Files, Equals, 1)
+
+	c.Assert(s.cache.Clear(true, false), IsNil)
+	_, err = os.Stat(ccacheDir)
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(aptDir)
+	c.Check(err, IsNil)
+
+	c.Assert(s.cache.Clear(false, true), IsNil)
+	usage, err = s.cache.Usage()
+	c.Assert(err, IsNil)
+	c.Check(usage, HasLen, 0)
+}
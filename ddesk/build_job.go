@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// BuildJobID identifies a build job of a builder
+type BuildJobID uint64
+
+// BuildJobState is the state of a build job
+type BuildJobState string
+
+const (
+	JobQueued    BuildJobState = "queued"
+	JobRunning   BuildJobState = "running"
+	JobSucceeded BuildJobState = "succeeded"
+	JobFailed    BuildJobState = "failed"
+	JobCancelled BuildJobState = "cancelled"
+)
+
+// Finished returns true if the job will not change anymore
+func (s BuildJobState) Finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// BuildJob is a build submitted to a builder
+type BuildJob struct {
+	ID    BuildJobID
+	State BuildJobState
+	Args  BuildArguments
+
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+
+	// Set when a cancellation is requested for a running job
+	CancelRequested bool
+	// The error of a failed job
+	Error string
+	// The result of the build, without its log
+	Result *BuildResult
+}
+
+// String returns a short description of the job
+func (j *BuildJob) String() string {
+	return fmt.Sprintf("%d: %s for %s %v", j.ID, j.Args.SourcePackage.Identifier, j.Args.Dist, j.Args.Archs)
+}
+
+// Err returns the error of a finished job that did not succeed
+func (j *BuildJob) Err() error {
+	switch j.State {
+	case JobFailed:
+		return fmt.Errorf("%s", j.Error)
+	case JobCancelled:
+		return fmt.Errorf("Build job %d was cancelled", j.ID)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	deb ".."
+)
+
+// MatrixTarget is a distribution a source package is built for by
+// BuildMatrix, and the outcome of its build
+type MatrixTarget struct {
+	Dist  deb.Codename
+	Archs []deb.Architecture
+	// The source package built for Dist, rewritten if the original
+	// targets another distribution
+	Ref deb.SourcePackageRef
+	// The result of the build, nil if it failed
+	Result *BuildResult
+	// The error of the target, if it failed
+	Err error
+	// The file the output of the build is written to
+	LogPath string
+
+	args      BuildArguments
+	rewritten bool
+}
+
+// matrixDists returns the supported distributions, sorted
+func matrixDists(supported map[deb.Codename]ArchitectureList) []deb.Codename {
+	res := make([]deb.Codename, 0, len(supported))
+	for d, archs := range supported {
+		if len(archs) != 0 {
+			res = append(res, d)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// BuildMatrix builds a deb.SourcePackage for every distribution
+// supported by the user, on all their architectures. For the other
+// distributions than its own, the source package is rewritten like
+// BackportPackage does, with a changelog entry by maintainer. The
+// targets are built concurrently, as far as the builder allows, and
+// their results archived like BuildPackage does. The output of each
+// target is written to a log file in logDir, and copied to buildOut
+// prefixed by its distribution. The failure of a target does not stop
+// the others, it is reported in its MatrixTarget.
+func (x *Interactor) BuildMatrix(ctx context.Context, s deb.SourceControlFile, maintainer *mail.Address, opts BuildOptions, logDir string, buildOut io.Writer) ([]*MatrixTarget, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+	supported := x.userDistConfig.Supported()
+	dists := matrixDists(supported)
+	if len(dists) == 0 {
+		return nil, fmt.Errorf("No distribution is supported, add some with init-dist")
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+
+	a, err := x.archiver.ArchiveSource(s)
+	if err != nil {
+		return nil, fmt.Errorf("Could not archive source package `%s': %s", s.Identifier, err)
+	}
+
+	work, err := ioutil.TempDir("", "go-deb.ddesk_matrix_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+
+	// the sources are prepared and the results archived one target at
+	// a time, only the builds run concurrently
+	targets := make([]*MatrixTarget, 0, len(dists))
+	defer func() {
+		for _, t := range targets {
+			if len(t.args.Dest) != 0 {
+				os.RemoveAll(t.args.Dest)
+			}
+		}
+	}()
+	for _, d := range dists {
+		t := &MatrixTarget{
+			Dist:    d,
+			Archs:   supported[d],
+			Ref:     s.Identifier,
+			LogPath: path.Join(logDir, fmt.Sprintf("%s_%s.log", s.Identifier, d)),
+		}
+		targets = append(targets, t)
+		t.Err = x.prepareMatrixTarget(t, a, maintainer, opts, work)
+	}
+
+	var builds []*concurrentBuild
+	var built []*MatrixTarget
+	var outputMutex sync.Mutex
+	for _, t := range targets {
+		if t.Err != nil {
+			continue
+		}
+		f, err := os.Create(t.LogPath)
+		if err != nil {
+			t.Err = err
+			continue
+		}
+		defer f.Close()
+		b := &concurrentBuild{args: t.args, output: f}
+		if buildOut != nil {
+			prefixed := newPrefixWriter(buildOut, &outputMutex, fmt.Sprintf("[%s] ", t.Dist))
+			defer prefixed.Flush()
+			b.output = io.MultiWriter(f, prefixed)
+		}
+		builds = append(builds, b)
+		built = append(built, t)
+	}
+
+	x.runBuilds(ctx, builds)
+
+	for i, b := range builds {
+		t := built[i]
+		t.Result, t.Err = x.archiveBuild(builtRef(t.args), b.result, "", opts, b.err)
+		if t.Err == nil && t.rewritten {
+			x.history.AppendBackport(Backport{Origin: s.Identifier, Ref: t.Ref, Dist: t.Dist})
+		}
+	}
+
+	return targets, nil
+}
+
+// prepareMatrixTarget prepares the build of t from the archived source
+// a, rewritten in work if it targets another distribution
+func (x *Interactor) prepareMatrixTarget(t *MatrixTarget, a *ArchivedSource, maintainer *mail.Address, opts BuildOptions, work string) error {
+	if t.Dist != a.Changes.Dist {
+		if maintainer == nil {
+			return fmt.Errorf("Rewriting `%s' for `%s' needs a maintainer for its changelog entry", a.Dsc.Identifier, t.Dist)
+		}
+		dest := path.Join(work, string(t.Dist))
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		dsc, err := x.backportSource(a.Dsc, t.Dist, maintainer, dest, ioutil.Discard)
+		if err != nil {
+			return err
+		}
+		t.Ref = dsc.Identifier
+		t.rewritten = true
+		if a, err = x.archiver.ArchiveSource(*dsc); err != nil {
+			return fmt.Errorf("Could not archive source package `%s': %s", dsc.Identifier, err)
+		}
+	}
+
+	args, err := x.prepareBuild(a, buildTarget{}, opts)
+	if err != nil {
+		return err
+	}
+	t.args = args
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BuildOptions tune the environment of a build
+type BuildOptions struct {
+	// Skips the tests of the package
+	NoCheck bool `json:",omitempty"`
+	// Number of parallel jobs of the build, left to the package if
+	// zero
+	Parallel int `json:",omitempty"`
+	// Build profiles, like nodoc or stage1
+	Profiles []string `json:",omitempty"`
+	// Extra environment variables of the build
+	Env map[string]string `json:",omitempty"`
+	// Extra packages installed in the build environment
+	ExtraPackages []string `json:",omitempty"`
+	// User hooks registered in the builder to run during the build
+	Hooks []string `json:",omitempty"`
+	// Runs lintian on the built packages
+	Lintian bool `json:",omitempty"`
+	// Severity of the lintian tags that keep the packages out of the
+	// local repository, never if empty
+	LintianFailOn string `json:",omitempty"`
+	// Runs the autopkgtests of the package against the built packages
+	Autopkgtest bool `json:",omitempty"`
+	// Keeps the packages out of the local repository if an
+	// autopkgtest fails
+	AutopkgtestBlocking bool `json:",omitempty"`
+	// Rebuilds the package in a varied environment, and compares the
+	// packages of both builds
+	VerifyReproducible bool `json:",omitempty"`
+	// Directory of the build in the build environment, the builder
+	// default if empty
+	BuildPath string `json:",omitempty"`
+	// Octal umask of the build with its leading 0, like 0022, the
+	// builder default if empty
+	Umask string `json:",omitempty"`
+	// Shift of the clock of the build in days, like +398d, the real
+	// clock if empty
+	FakeTime string `json:",omitempty"`
+}
+
+var envNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var packageNameRx = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+var profileRx = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+var buildPathRx = regexp.MustCompile(`^/[A-Za-z0-9._+/-]+$`)
+var umaskRx = regexp.MustCompile(`^0[0-7]{3}$`)
+
+// Check reports invalid options
+func (o BuildOptions) Check() error {
+	if o.Parallel < 0 {
+		return fmt.Errorf("Invalid number of parallel jobs %d", o.Parallel)
+	}
+	for _, p := range o.Profiles {
+		if profileRx.MatchString(p) == false {
+			return fmt.Errorf("Invalid build profile `%s'", p)
+		}
+	}
+	for name := range o.Env {
+		if envNameRx.MatchString(name) == false {
+			return fmt.Errorf("Invalid environment variable name `%s'", name)
+		}
+		if name == "DEB_BUILD_OPTIONS" || name == "DEB_BUILD_PROFILES" {
+			return fmt.Errorf("%s is set from the nocheck, parallel and profile options", name)
+		}
+	}
+	for _, p := range o.ExtraPackages {
+		if packageNameRx.MatchString(p) == false {
+			return fmt.Errorf("Invalid package name `%s'", p)
+		}
+	}
+	for _, h := range o.Hooks {
+		if err := checkHookName(h); err != nil {
+			return err
+		}
+	}
+	if len(o.LintianFailOn) != 0 {
+		if lintianSeverityRank(o.LintianFailOn) < 0 {
+			return fmt.Errorf("Invalid lintian severity `%s', supported are %s", o.LintianFailOn, strings.Join(LintianFailSeverities, ", "))
+		}
+		if o.Lintian == false {
+			return fmt.Errorf("A lintian fail policy needs lintian to run")
+		}
+	}
+	if o.AutopkgtestBlocking && o.Autopkgtest == false {
+		return fmt.Errorf("Blocking autopkgtests need autopkgtests to run")
+	}
+	if len(o.BuildPath) != 0 && buildPathRx.MatchString(o.BuildPath) == false {
+		return fmt.Errorf("Invalid build path `%s'", o.BuildPath)
+	}
+	if len(o.Umask) != 0 && umaskRx.MatchString(o.Umask) == false {
+		return fmt.Errorf("Invalid umask `%s', expected an octal value like 0022", o.Umask)
+	}
+	if len(o.FakeTime) != 0 && fakeTimeRx.MatchString(o.FakeTime) == false {
+		return fmt.Errorf("Invalid clock shift `%s', expected a number of days like +398d", o.FakeTime)
+	}
+	return nil
+}
+
+// DebBuildOptions returns the value of DEB_BUILD_OPTIONS, empty if
+// not needed
+func (o BuildOptions) DebBuildOptions() string {
+	var res []string
+	if o.NoCheck {
+		res = append(res, "nocheck")
+	}
+	if o.Parallel > 0 {
+		res = append(res, fmt.Sprintf("parallel=%d", o.Parallel))
+	}
+	return strings.Join(res, " ")
+}
+
+// Environ returns the environment variables of the build, sorted
+func (o BuildOptions) Environ() []string {
+	res := []string{}
+	if opts := o.DebBuildOptions(); len(opts) != 0 {
+		res = append(res, "DEB_BUILD_OPTIONS="+opts)
+	}
+	if len(o.Profiles) != 0 {
+		res = append(res, "DEB_BUILD_PROFILES="+strings.Join(o.Profiles, " "))
+	}
+	for name, value := range o.Env {
+		res = append(res, name+"="+value)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// String describes the options, empty for the defaults
+func (o BuildOptions) String() string {
+	res := o.Environ()
+	if len(o.ExtraPackages) != 0 {
+		res = append(res, "extra packages: "+strings.Join(o.ExtraPackages, " "))
+	}
+	if len(o.Hooks) != 0 {
+		res = append(res, "hooks: "+strings.Join(o.Hooks, " "))
+	}
+	if o.Lintian {
+		lintian := "lintian"
+		if len(o.LintianFailOn) != 0 {
+			lintian += " failing on " + o.LintianFailOn
+		}
+		res = append(res, lintian)
+	}
+	if o.Autopkgtest {
+		autopkgtest := "autopkgtest"
+		if o.AutopkgtestBlocking {
+			autopkgtest += " blocking"
+		}
+		res = append(res, autopkgtest)
+	}
+	if len(o.BuildPath) != 0 {
+		res = append(res, "build path: "+o.BuildPath)
+	}
+	if len(o.Umask) != 0 {
+		res = append(res, "umask: "+o.Umask)
+	}
+	if len(o.FakeTime) != 0 {
+		res = append(res, "clock shift: "+o.FakeTime)
+	}
+	if o.VerifyReproducible {
+		res = append(res, "verify reproducible")
+	}
+	return strings.Join(res, ", ")
+}
+
+// ParseBuildEnv parses NAME=VALUE assignments
+func ParseBuildEnv(assignments []string) (map[string]string, error) {
+	if len(assignments) == 0 {
+		return nil, nil
+	}
+	res := make(map[string]string, len(assignments))
+	for _, a := range assignments {
+		fields := strings.SplitN(a, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid environment assignment `%s', expected NAME=VALUE", a)
+		}
+		res[fields[0]] = fields[1]
+	}
+	return res, nil
+}
+
+// shellQuote quotes s as a single-quoted shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// pbuilderOptions returns the pbuilder configuration applying o. As
+// pbuilder sources it as root, every value is quoted.
+func pbuilderOptions(o BuildOptions) string {
+	res := ""
+	for _, v := range o.Environ() {
+		fields := strings.SplitN(v, "=", 2)
+		res += fmt.Sprintf("export %s=%s\n", fields[0], shellQuote(fields[1]))
+	}
+	if len(o.ExtraPackages) != 0 {
+		res += fmt.Sprintf("EXTRAPACKAGES=\"${EXTRAPACKAGES}\"%s\n", shellQuote(" "+strings.Join(o.ExtraPackages, " ")))
+	}
+	if len(o.BuildPath) != 0 {
+		// exported for the hooks, like the lintian one, to find the
+		// build
+		res += fmt.Sprintf("export BUILDDIR=%s\n", shellQuote(o.BuildPath))
+	}
+	// pbuilder sources its configuration, the build inherits its umask
+	if len(o.Umask) != 0 {
+		res += fmt.Sprintf("umask %s\n", shellQuote(o.Umask))
+	}
+	return res
+}
+
+// perlQuote quotes s as a single-quoted perl string
+func perlQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// sbuildOptions returns the sbuild arguments and the content of the
+// sbuild configuration file applying o. The configuration is needed
+// as sbuild filters the environment of the builds, every value in it
+// is quoted.
+func sbuildOptions(o BuildOptions) ([]string, string) {
+	var args []string
+	if len(o.Profiles) != 0 {
+		args = append(args, "--profiles="+strings.Join(o.Profiles, ","))
+	}
+	for _, p := range o.ExtraPackages {
+		args = append(args, "--add-depends="+p)
+	}
+	if len(o.FakeTime) != 0 {
+		args = append(args, "--add-depends=libfaketime")
+	}
+	if o.Lintian {
+		args = append(args, "--finished-build-commands="+lintianSbuildCommand())
+	}
+	if len(o.BuildPath) != 0 {
+		args = append(args, "--build-path="+o.BuildPath)
+	}
+
+	// sbuild sets DEB_BUILD_PROFILES from --profiles
+	config := "$build_environment = {\n"
+	for _, v := range o.Environ() {
+		fields := strings.SplitN(v, "=", 2)
+		if fields[0] == "DEB_BUILD_PROFILES" {
+			continue
+		}
+		config += fmt.Sprintf("\t%s => %s,\n", perlQuote(fields[0]), perlQuote(fields[1]))
+	}
+	// unlike the pbuilder configuration, the build environment only
+	// applies to dpkg-buildpackage, and not to apt
+	if len(o.FakeTime) != 0 {
+		env := fakeTimeEnviron(o.FakeTime)
+		for _, name := range []string{"FAKETIME", "FAKETIME_DONT_FAKE_MONOTONIC", "LD_PRELOAD"} {
+			config += fmt.Sprintf("\t%s => %s,\n", perlQuote(name), perlQuote(env[name]))
+		}
+	}
+	config += "};\n"
+	// the build inherits the umask of sbuild
+	if len(o.Umask) != 0 {
+		config += fmt.Sprintf("umask(oct(%s));\n", perlQuote(o.Umask))
+	}
+	config += "1;\n"
+	return args, config
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type BuildOptionsSuite struct {
+	opts BuildOptions
+}
+
+var _ = Suite(&BuildOptionsSuite{})
+
+func (s *BuildOptionsSuite) SetUpTest(c *C) {
+	s.opts = BuildOptions{
+		NoCheck:       true,
+		Parallel:      4,
+		Profiles:      []string{"nodoc", "stage1"},
+		Env:           map[string]string{"LC_ALL": "C.UTF-8", "GREETING": "it's me"},
+		ExtraPackages: []string{"eatmydata", "libfoo-dev"},
+	}
+}
+
+func (s *BuildOptionsSuite) TestEnviron(c *C) {
+	c.Check(BuildOptions{}.Environ(), DeepEquals, []string{})
+	c.Check(BuildOptions{}.String(), Equals, "")
+	c.Check(s.opts.Environ(), DeepEquals, []string{
+		"DEB_BUILD_OPTIONS=nocheck parallel=4",
+		"DEB_BUILD_PROFILES=nodoc stage1",
+		"GREETING=it's me",
+		"LC_ALL=C.UTF-8",
+	})
+}
+
+func (s *BuildOptionsSuite) TestCheck(c *C) {
+	c.Check(s.opts.Check(), IsNil)
+
+	data := []struct {
+		opts  BuildOptions
+		error string
+	}{
+		{BuildOptions{Parallel: -1}, "Invalid number of parallel jobs -1"},
+		{BuildOptions{Profiles: []string{"no doc"}}, "Invalid build profile `no doc'"},
+		{BuildOptions{Env: map[string]string{"1A": ""}}, "Invalid environment variable name `1A'"},
+		{BuildOptions{Env: map[string]string{"DEB_BUILD_PROFILES": "nodoc"}}, "DEB_BUILD_PROFILES is set from the nocheck, parallel and profile options"},
+		{BuildOptions{ExtraPackages: []string{"foo;rm"}}, "Invalid package name `foo;rm'"},
+		{BuildOptions{Lintian: true, LintianFailOn: "fatal"}, "Invalid lintian severity `fatal', supported are error, warning, info, pedantic"},
+		{BuildOptions{LintianFailOn: "error"}, "A lintian fail policy needs lintian to run"},
+		{BuildOptions{AutopkgtestBlocking: true}, "Blocking autopkgtests need autopkgtests to run"},
+		{BuildOptions{BuildPath: "build"}, "Invalid build path `build'"},
+		{BuildOptions{Umask: "u=rwx"}, "Invalid umask `u=rwx', expected an octal value like 0022"},
+		{BuildOptions{Umask: "777"}, "Invalid umask `777', expected an octal value like 0022"},
+		{BuildOptions{FakeTime: "+1y"}, "Invalid clock shift `\\+1y', expected a number of days like \\+398d"},
+	}
+	for _, d := range data {
+		c.Check(d.opts.Check(), ErrorMatches, d.error)
+	}
+}
+
+func (s *BuildOptionsSuite) TestParseBuildEnv(c *C) {
+	env, err := ParseBuildEnv([]string{"A=1", "B=x=y", "C="})
+	c.Check(err, IsNil)
+	c.Check(env, DeepEquals, map[string]string{"A": "1", "B": "x=y", "C": ""})
+
+	env, err = ParseBuildEnv(nil)
+	c.Check(err, IsNil)
+	c.Check(env, IsNil)
+
+	_, err = ParseBuildEnv([]string{"A"})
+	c.Check(err, ErrorMatches, "Invalid environment assignment `A', expected NAME=VALUE")
+}
+
+func (s *BuildOptionsSuite) TestPbuilderOptions(c *C) {
+	c.Check(pbuilderOptions(BuildOptions{}), Equals, "")
+	c.Check(pbuilderOptions(s.opts), Equals, `export DEB_BUILD_OPTIONS='nocheck parallel=4'
+export DEB_BUILD_PROFILES='nodoc stage1'
+export GREETING='it'\''s me'
+export LC_ALL='C.UTF-8'
+EXTRAPACKAGES="${EXTRAPACKAGES}"' eatmydata libfoo-dev'
+`)
+}
+
+func (s *BuildOptionsSuite) TestSbuildOptions(c *C) {
+	s.opts.Lintian = true
+	args, config := sbuildOptions(s.opts)
+	c.Check(args, DeepEquals, []string{"--profiles=nodoc,stage1",
+		"--add-depends=eatmydata", "--add-depends=libfoo-dev",
+		"--finished-build-commands=" + lintianSbuildCommand()})
+	c.Check(config, Equals, `$build_environment = {
+	'DEB_BUILD_OPTIONS' => 'nocheck parallel=4',
+	'GREETING' => 'it\'s me',
+	'LC_ALL' => 'C.UTF-8',
+};
+1;
+`)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BuildQueue is a DebianBuilder that runs the builds of a
+// BuilderBackend as jobs. Jobs are persisted in a directory, with a
+// copy of their source package, their log and their results, so they
+// survive the disconnection of their client and restarts of the
+// queue. Jobs that were running when the queue stopped are run again.
+// Finished jobs are removed with their directory once older than the
+// maximal age set by SetMaxAge.
+type BuildQueue struct {
+	BuilderBackend
+
+	dir string
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	jobs    map[BuildJobID]*BuildJob
+	pending []BuildJobID
+	nextID  BuildJobID
+	closed  bool
+	workers sync.WaitGroup
+	// cancels the context of running jobs
+	cancels map[BuildJobID]context.CancelFunc
+	timeout time.Duration
+	maxAge  time.Duration
+}
+
+// logPollPeriod is the period at which attached clients check for new
+// log data
+var logPollPeriod = 100 * time.Millisecond
+
+// NewBuildQueue opens the queue persisted in dir, and starts running
+// its jobs on backend, at most workers at a time. If workers is not
+// positive, it is the number of CPUs.
+func NewBuildQueue(backend BuilderBackend, dir string, workers int) (*BuildQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	res := &BuildQueue{
+		BuilderBackend: backend,
+		dir:            dir,
+		jobs:           make(map[BuildJobID]*BuildJob),
+		nextID:         1,
+		cancels:        make(map[BuildJobID]context.CancelFunc),
+	}
+	res.cond = sync.NewCond(&res.mutex)
+
+	if err := res.load(); err != nil {
+		return nil, err
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	for i := 0; i < workers; i++ {
+		res.workers.Add(1)
+		go res.work()
+	}
+	return res, nil
+}
+
+// SetTimeout sets the wall-clock limit of the jobs that do not set
+// their own. A zero timeout means no limit.
+func (q *BuildQueue) SetTimeout(timeout time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.timeout = timeout
+}
+
+// SetMaxAge sets the age after which finished jobs are removed, with
+// their log and results. A zero age means jobs are kept forever.
+func (q *BuildQueue) SetMaxAge(maxAge time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.maxAge = maxAge
+}
+
+// PruneJobs removes the jobs that finished longer than the maximal age
+// before now, and returns the number of removed jobs.
+func (q *BuildQueue) PruneJobs(now time.Time) (int, error) {
+	q.mutex.Lock()
+	var expired []BuildJobID
+	for id, job := range q.jobs {
+		if q.maxAge == 0 || job.State.Finished() == false {
+			continue
+		}
+		if now.Sub(job.Finished) < q.maxAge {
+			continue
+		}
+		expired = append(expired, id)
+		delete(q.jobs, id)
+	}
+	q.mutex.Unlock()
+
+	sort.Sort(buildJobIDs(expired))
+	for i, id := range expired {
+		if err := os.RemoveAll(q.jobPath(id)); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+func (q *BuildQueue) jobPath(id BuildJobID, elem ...string) string {
+	return path.Join(append([]string{q.dir, strconv.FormatUint(uint64(id), 10)}, elem...)...)
+}
+
+func (q *BuildQueue) logPath(id BuildJobID) string {
+	return q.jobPath(id, "build.log")
+}
+
+// load reads the persisted jobs
+func (q *BuildQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		id, err := strconv.ParseUint(f.Name(), 10, 64)
+		if err != nil || f.IsDir() == false {
+			continue
+		}
+		data, err := ioutil.ReadFile(q.jobPath(BuildJobID(id), "job.json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// submission did not complete
+				continue
+			}
+			return err
+		}
+		job := &BuildJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return fmt.Errorf("Could not read build job %d: %s", id, err)
+		}
+		q.jobs[job.ID] = job
+		if job.ID >= q.nextID {
+			q.nextID = job.ID + 1
+		}
+	}
+
+	ids := make([]BuildJobID, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, id)
+	}
+	sort.Sort(buildJobIDs(ids))
+	for _, id := range ids {
+		job := q.jobs[id]
+		if job.State == JobRunning {
+			// the queue stopped during the build
+			if job.CancelRequested {
+				job.State = JobCancelled
+				job.Finished = time.Now()
+			} else {
+				job.State = JobQueued
+				job.Started = time.Time{}
+			}
+			if err := q.save(job); err != nil {
+				return err
+			}
+		}
+		if job.State == JobQueued {
+			q.pending = append(q.pending, id)
+		}
+	}
+	return nil
+}
+
+type buildJobIDs []BuildJobID
+
+func (l buildJobIDs) Len() int           { return len(l) }
+func (l buildJobIDs) Less(i, j int) bool { return l[i] < l[j] }
+func (l buildJobIDs) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// save persists a job, it should be called with the mutex held
+func (q *BuildQueue) save(job *BuildJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := q.jobPath(job.ID, "job.json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.jobPath(job.ID, "job.json"))
+}
+
+// SubmitBuild implements DebianBuilder. The source package files are
+// copied in the job directory, and the results are written there.
+func (q *BuildQueue) SubmitBuild(a BuildArguments) (BuildJobID, error) {
+	// clients may not have checked the options, they end up in
+	// configurations the backends run as root
+	if err := a.Options.Check(); err != nil {
+		return 0, err
+	}
+
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return 0, fmt.Errorf("Build queue is closed")
+	}
+	id := q.nextID
+	q.nextID = q.nextID + 1
+	q.mutex.Unlock()
+
+	if err := os.MkdirAll(q.jobPath(id, "result"), 0755); err != nil {
+		return 0, err
+	}
+	sourceDir := q.jobPath(id, "source")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return 0, err
+	}
+	files := []string{a.SourcePackage.Filename()}
+	for _, f := range a.SourcePackage.Md5Files {
+		files = append(files, f.Name)
+	}
+	for _, f := range files {
+		if err := copyFile(path.Join(a.SourcePackage.BasePath, f), path.Join(sourceDir, f)); err != nil {
+			os.RemoveAll(q.jobPath(id))
+			return 0, fmt.Errorf("Could not copy source file %s: %s", f, err)
+		}
+	}
+	a.SourcePackage.BasePath = sourceDir
+	a.Dest = q.jobPath(id, "result")
+
+	job := &BuildJob{
+		ID:        id,
+		State:     JobQueued,
+		Args:      a,
+		Submitted: time.Now(),
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.save(job); err != nil {
+		os.RemoveAll(q.jobPath(id))
+		return 0, err
+	}
+	q.jobs[id] = job
+	q.pending = append(q.pending, id)
+	q.cond.Signal()
+	return id, nil
+}
+
+// ListJobs implements DebianBuilder
+func (q *BuildQueue) ListJobs() ([]BuildJob, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ids := make([]BuildJobID, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, id)
+	}
+	sort.Sort(buildJobIDs(ids))
+	res := make([]BuildJob, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, *q.jobs[id])
+	}
+	return res, nil
+}
+
+// GetJob implements DebianBuilder
+func (q *BuildQueue) GetJob(id BuildJobID) (*BuildJob, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if ok == false {
+		return nil, fmt.Errorf("No build job %d", id)
+	}
+	res := *job
+	return &res, nil
+}
+
+// CancelJob implements DebianBuilder. A queued job is cancelled
+// immediately. The build of a running job is aborted, and the job is
+// marked cancelled once its build returns.
+func (q *BuildQueue) CancelJob(id BuildJobID) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if ok == false {
+		return fmt.Errorf("No build job %d", id)
+	}
+	switch job.State {
+	case JobQueued:
+		for i, p := range q.pending {
+			if p == id {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		job.State = JobCancelled
+		job.Finished = time.Now()
+	case JobRunning:
+		job.CancelRequested = true
+		if cancel, ok := q.cancels[id]; ok {
+			cancel()
+		}
+	default:
+		return fmt.Errorf("Build job %d is already %s", id, job.State)
+	}
+	q.cond.Broadcast()
+	return q.save(job)
+}
+
+// AttachJob implements DebianBuilder
+func (q *BuildQueue) AttachJob(ctx context.Context, id BuildJobID, output io.Writer) (*BuildJob, error) {
+	if output == nil {
+		output = ioutil.Discard
+	}
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		// we check the state before reading, so that once the job is
+		// finished we read the complete log
+		job, err := q.GetJob(id)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			f, err = os.Open(q.logPath(id))
+			if err != nil && os.IsNotExist(err) == false {
+				return nil, err
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(output, f); err != nil {
+				return nil, err
+			}
+		}
+		if job.State.Finished() {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(logPollPeriod):
+		}
+	}
+}
+
+// BuildPackage implements DebianBuilder, by submitting a job and
+// waiting for its result. If output fails, the job goes on. If ctx is
+// done, the job is cancelled, and BuildPackage returns once it is
+// finished.
+func (q *BuildQueue) BuildPackage(ctx context.Context, a BuildArguments, output io.Writer) (*BuildResult, error) {
+	id, err := q.SubmitBuild(a)
+	if err != nil {
+		return nil, err
+	}
+	job, err := q.AttachJob(ctx, id, output)
+	if ctx.Err() != nil {
+		q.CancelJob(id)
+		q.AttachJob(context.Background(), id, nil)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := job.Err(); err != nil {
+		return nil, err
+	}
+	res := *job.Result
+	logData, err := ioutil.ReadFile(q.logPath(id))
+	if err != nil {
+		return nil, err
+	}
+	res.BuildLog = Log(logData)
+	return &res, nil
+}
+
+// FetchResult implements DebianBuilder
+func (q *BuildQueue) FetchResult(id BuildJobID, dest string) (*BuildResult, error) {
+	job, err := q.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State != JobSucceeded || job.Result == nil {
+		return nil, fmt.Errorf("Build job %d has no result", id)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(job.Result.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() == false {
+			continue
+		}
+		if err := copyFile(path.Join(job.Result.BasePath, f.Name()), path.Join(dest, f.Name())); err != nil {
+			return nil, err
+		}
+	}
+	res := *job.Result
+	res.BasePath = dest
+	return &res, nil
+}
+
+// next returns the next job to run, or nil if the queue is closed
+func (q *BuildQueue) next() *BuildJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		for len(q.pending) == 0 && q.closed == false {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return nil
+		}
+		job := q.jobs[q.pending[0]]
+		q.pending = q.pending[1:]
+		job.State = JobRunning
+		job.Started = time.Now()
+		err := q.save(job)
+		if err == nil {
+			q.cond.Broadcast()
+			return job
+		}
+		// the job would run again after a restart
+		job.State = JobFailed
+		job.Error = fmt.Sprintf("Could not start job: %s", err)
+		job.Finished = time.Now()
+		if err := q.save(job); err != nil {
+			log.Printf("Could not save build job %d: %s", job.ID, err)
+		}
+		q.cond.Broadcast()
+	}
+}
+
+func (q *BuildQueue) work() {
+	defer q.workers.Done()
+	for {
+		job := q.next()
+		if job == nil {
+			q.mutex.Lock()
+			closed := q.closed
+			q.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+		q.run(job)
+		if _, err := q.PruneJobs(time.Now()); err != nil {
+			log.Printf("Could not prune build jobs: %s", err)
+		}
+	}
+}
+
+func (q *BuildQueue) run(job *BuildJob) {
+	q.mutex.Lock()
+	args := job.Args
+	timeout := args.Timeout
+	if timeout == 0 {
+		timeout = q.timeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+	q.cancels[job.ID] = cancel
+	// the job may have been cancelled since it was started
+	if job.CancelRequested {
+		cancel()
+	}
+	q.mutex.Unlock()
+
+	var res *BuildResult
+	logFile, err := os.Create(q.logPath(job.ID))
+	if err == nil {
+		res, err = q.BuilderBackend.BuildPackage(ctx, args, logFile)
+		logFile.Close()
+	}
+	if err == nil && res == nil {
+		err = fmt.Errorf("Builder returned no result")
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.cancels, job.ID)
+	if res != nil {
+		res.BuildLog = Log("")
+		res.JobID = job.ID
+	}
+	switch {
+	case job.CancelRequested:
+		job.State = JobCancelled
+	case ctx.Err() == context.DeadlineExceeded:
+		job.State = JobFailed
+		job.Error = fmt.Sprintf("Build timed out after %s", timeout)
+	case err != nil:
+		job.State = JobFailed
+		job.Error = err.Error()
+		job.Result = res
+	default:
+		job.State = JobSucceeded
+		job.Result = res
+	}
+	job.Finished = time.Now()
+	if err := q.save(job); err != nil {
+		log.Printf("Could not save build job %d: %s", job.ID, err)
+	}
+	q.cond.Broadcast()
+}
+
+// Close stops running queued jobs, and waits for running ones to
+// finish.
+func (q *BuildQueue) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+	q.workers.Wait()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+// blockingBackend is a BuilderBackend whose builds wait to be
+// released
+type blockingBackend struct {
+	DebianBuilderStub
+	started chan BuildArguments
+	release chan error
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{
+		started: make(chan BuildArguments, 10),
+		release: make(chan error),
+	}
+}
+
+func (b *blockingBackend) BuildPackage(ctx context.Context, args BuildArguments, out io.Writer) (*BuildResult, error) {
+	fmt.Fprintf(out, "Building %s\n", args.SourcePackage.Identifier)
+	b.started <- args
+	select {
+	case err := <-b.release:
+		if err != nil {
+			fmt.Fprintf(out, "Failed\n")
+			return nil, err
+		}
+	case <-ctx.Done():
+		fmt.Fprintf(out, "Aborted\n")
+		return nil, ctx.Err()
+	}
+	fmt.Fprintf(out, "Built %s\n", args.SourcePackage.Identifier)
+	return &BuildResult{
+		BuildLog:    Log("Should not be kept"),
+		BasePath:    args.Dest,
+		ChangesPath: "foo_1.0-1_amd64.changes",
+	}, nil
+}
+
+type BuildQueueSuite struct {
+	tmpDir  string
+	dsc     deb.SourceControlFile
+	args    BuildArguments
+	backend *blockingBackend
+	q       *BuildQueue
+}
+
+var _ = Suite(&BuildQueueSuite{})
+
+func (s *BuildQueueSuite) SetUpTest(c *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "go-deb.ddesk_build_queue_test_")
+	c.Assert(err, IsNil)
+
+	sourceDir := path.Join(s.tmpDir, "source")
+	c.Assert(os.MkdirAll(sourceDir, 0755), IsNil)
+	s.dsc = deb.SourceControlFile{
+		Identifier: deb.SourcePackageRef{
+			Source: "foo",
+			Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+		},
+		BasePath: sourceDir,
+		Md5Files: []deb.FileReference{{Name: "foo_1.0.orig.tar.gz"}},
+	}
+	for _, f := range []string{s.dsc.Filename(), "foo_1.0.orig.tar.gz"} {
+		c.Assert(ioutil.WriteFile(path.Join(sourceDir, f), []byte(f), 0644), IsNil)
+	}
+	s.args = BuildArguments{
+		SourcePackage: s.dsc,
+		Dist:          "unstable",
+		Archs:         []deb.Architecture{deb.Amd64},
+	}
+
+	s.backend = newBlockingBackend()
+	s.q, err = NewBuildQueue(s.backend, path.Join(s.tmpDir, "queue"), 1)
+	c.Assert(err, IsNil)
+}
+
+func (s *BuildQueueSuite) TearDownTest(c *C) {
+	s.q.Close()
+	c.Assert(os.RemoveAll(s.tmpDir), IsNil)
+}
+
+func (s *BuildQueueSuite) waitState(c *C, q *BuildQueue, id BuildJobID, state BuildJobState) *BuildJob {
+	for i := 0; i < 100; i++ {
+		job, err := q.GetJob(id)
+		c.Assert(err, IsNil)
+		if job.State == state {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("Job %d did not reach state %s", id, state)
+	return nil
+}
+
+func (s *BuildQueueSuite) TestRunsJobs(c *C) {
+	id, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	c.Check(id, Equals, BuildJobID(1))
+
+	args := <-s.backend.started
+	// the queue owns a copy of the sources, and the results
+	c.Check(args.SourcePackage.BasePath, Equals, path.Join(s.tmpDir, "queue", "1", "source"))
+	c.Check(args.Dest, Equals, path.Join(s.tmpDir, "queue", "1", "result"))
+	data, err := ioutil.ReadFile(path.Join(args.SourcePackage.BasePath, "foo_1.0.orig.tar.gz"))
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "foo_1.0.orig.tar.gz")
+
+	job := s.waitState(c, s.q, id, JobRunning)
+	c.Check(job.Started.IsZero(), Equals, false)
+
+	go func() { s.backend.release <- nil }()
+	var out bytes.Buffer
+	job, err = s.q.AttachJob(context.Background(), id, &out)
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, "Building foo_1.0-1\nBuilt foo_1.0-1\n")
+	c.Check(job.State, Equals, JobSucceeded)
+	c.Check(job.Err(), IsNil)
+	c.Check(job.Result.JobID, Equals, id)
+	c.Check(job.Result.BuildLog, Equals, Log(""))
+
+	// attaching a finished job replays its log
+	out.Reset()
+	_, err = s.q.AttachJob(context.Background(), id, &out)
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, "Building foo_1.0-1\nBuilt foo_1.0-1\n")
+
+	// synchronous builds also go through the queue
+	go func() {
+		<-s.backend.started
+		s.backend.release <- fmt.Errorf("Failure")
+	}()
+	res, err := s.q.BuildPackage(context.Background(), s.args, nil)
+	c.Check(res, IsNil)
+	c.Check(err, ErrorMatches, "Failure")
+
+	jobs, err := s.q.ListJobs()
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 2)
+	c.Check(jobs[1].State, Equals, JobFailed)
+	c.Check(jobs[1].Error, Equals, "Failure")
+
+	_, err = s.q.GetJob(42)
+	c.Check(err, ErrorMatches, "No build job 42")
+
+	s.args.SourcePackage.Md5Files = append(s.args.SourcePackage.Md5Files, deb.FileReference{Name: "missing.tar.gz"})
+	_, err = s.q.SubmitBuild(s.args)
+	c.Check(err, ErrorMatches, "Could not copy source file missing.tar.gz: .*")
+}
+
+func (s *BuildQueueSuite) TestPruneJobs(c *C) {
+	id, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	<-s.backend.started
+	s.backend.release <- nil
+	job := s.waitState(c, s.q, id, JobSucceeded)
+
+	// jobs are kept forever by default
+	removed, err := s.q.PruneJobs(job.Finished.Add(365 * 24 * time.Hour))
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 0)
+
+	s.q.SetMaxAge(time.Hour)
+	removed, err = s.q.PruneJobs(job.Finished.Add(time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 0)
+	_, err = os.Stat(path.Join(s.tmpDir, "queue", "1"))
+	c.Check(err, IsNil)
+
+	removed, err = s.q.PruneJobs(job.Finished.Add(2 * time.Hour))
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, 1)
+	_, err = os.Stat(path.Join(s.tmpDir, "queue", "1"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = s.q.GetJob(id)
+	c.Check(err, ErrorMatches, "No build job 1")
+}
+
+func (s *BuildQueueSuite) TestRejectsInvalidOptions(c *C) {
+	s.args.Options.ExtraPackages = []string{"foo\"; rm -rf /; \""}
+	_, err := s.q.SubmitBuild(s.args)
+	c.Check(err, ErrorMatches, "Invalid package name .*")
+	jobs, err := s.q.ListJobs()
+	c.Check(err, IsNil)
+	c.Check(jobs, HasLen, 0)
+}
+
+func (s *BuildQueueSuite) TestCancel(c *C) {
+	running, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	<-s.backend.started
+	queued, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+
+	c.Check(s.q.CancelJob(queued), IsNil)
+	job, err := s.q.GetJob(queued)
+	c.Assert(err, IsNil)
+	c.Check(job.State, Equals, JobCancelled)
+	c.Check(job.Err(), ErrorMatches, "Build job 2 was cancelled")
+
+	// the build of a running job is aborted
+	c.Check(s.q.CancelJob(running), IsNil)
+	job = s.waitState(c, s.q, running, JobCancelled)
+	c.Check(job.CancelRequested, Equals, true)
+	c.Check(job.Result, IsNil)
+	var out bytes.Buffer
+	_, err = s.q.AttachJob(context.Background(), running, &out)
+	c.Check(err, IsNil)
+	c.Check(out.String(), Equals, "Building foo_1.0-1\nAborted\n")
+
+	c.Check(s.q.CancelJob(running), ErrorMatches, "Build job 1 is already cancelled")
+	c.Check(s.q.CancelJob(42), ErrorMatches, "No build job 42")
+}
+
+func (s *BuildQueueSuite) TestTimeout(c *C) {
+	s.q.SetTimeout(50 * time.Millisecond)
+	id, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	<-s.backend.started
+	job := s.waitState(c, s.q, id, JobFailed)
+	c.Check(job.Err(), ErrorMatches, "Build timed out after 50ms")
+
+	// jobs may set their own timeout
+	s.q.SetTimeout(time.Hour)
+	s.args.Timeout = 20 * time.Millisecond
+	id, err = s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	<-s.backend.started
+	job = s.waitState(c, s.q, id, JobFailed)
+	c.Check(job.Err(), ErrorMatches, "Build timed out after 20ms")
+}
+
+func (s *BuildQueueSuite) TestBuildPackageCancellation(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.backend.started
+		cancel()
+	}()
+	res, err := s.q.BuildPackage(ctx, s.args, nil)
+	c.Check(res, IsNil)
+	c.Check(err, Equals, context.Canceled)
+	// BuildPackage returns once its job is finished
+	job, err := s.q.GetJob(1)
+	c.Assert(err, IsNil)
+	c.Check(job.State, Equals, JobCancelled)
+
+	// detaching from a job does not cancel it
+	id, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	<-s.backend.started
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = s.q.AttachJob(ctx, id, nil)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	s.backend.release <- nil
+	s.waitState(c, s.q, id, JobSucceeded)
+}
+
+func (s *BuildQueueSuite) TestSurvivesRestarts(c *C) {
+	running, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	<-s.backend.started
+	queued, err := s.q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+
+	// a new queue on the same directory, as if the first one had
+	// been killed
+	restarted := newBlockingBackend()
+	q, err := NewBuildQueue(restarted, path.Join(s.tmpDir, "queue"), 1)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	for _, id := range []BuildJobID{running, queued} {
+		args := <-restarted.started
+		c.Check(args.SourcePackage.Identifier, Equals, s.dsc.Identifier)
+		restarted.release <- nil
+		job := s.waitState(c, q, id, JobSucceeded)
+		c.Check(job.Result.JobID, Equals, id)
+	}
+
+	next, err := q.SubmitBuild(s.args)
+	c.Assert(err, IsNil)
+	c.Check(next, Equals, BuildJobID(3))
+	c.Check(q.CancelJob(next), IsNil)
+
+	// lets the first queue finish its running job only
+	c.Check(s.q.CancelJob(queued), IsNil)
+	s.backend.release <- nil
+}
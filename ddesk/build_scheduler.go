@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// buildScheduler runs builder jobs concurrently. It limits the number
+// of jobs running at the same time, and ensures that jobs modifying a
+// builder image, like its creation or update, have an exclusive
+// access to it, while builds share it.
+type buildScheduler struct {
+	slots chan bool
+
+	mutex  sync.Mutex
+	images map[string]*sync.RWMutex
+}
+
+// newBuildScheduler returns a scheduler running at most maxJobs jobs
+// at the same time.
+func newBuildScheduler(maxJobs int) *buildScheduler {
+	if maxJobs < 1 {
+		maxJobs = 1
+	}
+	res := &buildScheduler{
+		slots:  make(chan bool, maxJobs),
+		images: make(map[string]*sync.RWMutex),
+	}
+	for i := 0; i < maxJobs; i++ {
+		res.slots <- true
+	}
+	return res
+}
+
+// MaxJobs returns the maximal number of concurrent jobs
+func (s *buildScheduler) MaxJobs() int {
+	return cap(s.slots)
+}
+
+func (s *buildScheduler) imageLock(image string) *sync.RWMutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.images[image]
+	if ok == false {
+		l = &sync.RWMutex{}
+		s.images[image] = l
+	}
+	return l
+}
+
+// acquire waits for a free slot, unless ctx is done before
+func (s *buildScheduler) acquire(ctx context.Context) error {
+	select {
+	case <-s.slots:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run runs job once a slot is free, sharing image with other jobs.
+func (s *buildScheduler) Run(ctx context.Context, image string, job func() error) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { s.slots <- true }()
+	l := s.imageLock(image)
+	l.RLock()
+	defer l.RUnlock()
+	return job()
+}
+
+// RunExclusive runs job once a slot is free and no other job uses
+// image.
+func (s *buildScheduler) RunExclusive(ctx context.Context, image string, job func() error) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { s.slots <- true }()
+	l := s.imageLock(image)
+	l.Lock()
+	defer l.Unlock()
+	return job()
+}
+
+// prefixWriter writes complete lines to an io.Writer shared by
+// concurrent jobs, prefixing them to tell which job they come from.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mutex  *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func newPrefixWriter(w io.Writer, mutex *sync.Mutex, prefix string) *prefixWriter {
+	return &prefixWriter{
+		prefix: prefix,
+		w:      w,
+		mutex:  mutex,
+	}
+}
+
+// Write implements io.Writer
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf.Write(data)
+	for {
+		idx := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if idx < 0 {
+			return len(data), nil
+		}
+		if err := p.writeLine(p.buf.Next(idx + 1)); err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// Flush writes any incomplete last line
+func (p *prefixWriter) Flush() error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	line := append(p.buf.Next(p.buf.Len()), '\n')
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err := p.w.Write(append([]byte(p.prefix), line...))
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BuildSchedulerSuite struct{}
+
+var _ = Suite(&BuildSchedulerSuite{})
+
+// jobCounter records the maximal number of concurrent jobs
+type jobCounter struct {
+	mutex        sync.Mutex
+	running, max int
+}
+
+func (j *jobCounter) job(d time.Duration) func() error {
+	return func() error {
+		j.mutex.Lock()
+		j.running = j.running + 1
+		if j.running > j.max {
+			j.max = j.running
+		}
+		j.mutex.Unlock()
+		time.Sleep(d)
+		j.mutex.Lock()
+		j.running = j.running - 1
+		j.mutex.Unlock()
+		return nil
+	}
+}
+
+func (s *BuildSchedulerSuite) TestLimitsConcurrentJobs(c *C) {
+	sched := newBuildScheduler(3)
+	c.Check(sched.MaxJobs(), Equals, 3)
+	c.Check(newBuildScheduler(0).MaxJobs(), Equals, 1)
+
+	counter := &jobCounter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Check(sched.Run(context.Background(), fmt.Sprintf("image-%d", i%2), counter.job(10*time.Millisecond)), IsNil)
+		}(i)
+	}
+	wg.Wait()
+	c.Check(counter.max, Equals, 3)
+
+	err := sched.Run(context.Background(), "foo", func() error { return fmt.Errorf("Failure") })
+	c.Check(err, ErrorMatches, "Failure")
+}
+
+func (s *BuildSchedulerSuite) TestExclusiveJobs(c *C) {
+	sched := newBuildScheduler(4)
+
+	var mutex sync.Mutex
+	events := []string{}
+	record := func(e string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, e)
+	}
+
+	started := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		sched.Run(context.Background(), "unstable-amd64", func() error {
+			started <- true
+			time.Sleep(20 * time.Millisecond)
+			record("build unstable-amd64")
+			return nil
+		})
+		done <- true
+	}()
+	<-started
+
+	// other images are not blocked
+	sched.RunExclusive(context.Background(), "unstable-i386", func() error {
+		record("update unstable-i386")
+		return nil
+	})
+	// the same image waits for the build
+	sched.RunExclusive(context.Background(), "unstable-amd64", func() error {
+		record("update unstable-amd64")
+		return nil
+	})
+	<-done
+
+	c.Check(events, DeepEquals, []string{
+		"update unstable-i386",
+		"build unstable-amd64",
+		"update unstable-amd64",
+	})
+}
+
+func (s *BuildSchedulerSuite) TestPrefixWriter(c *C) {
+	var out bytes.Buffer
+	var mutex sync.Mutex
+	amd64 := newPrefixWriter(&out, &mutex, "[amd64] ")
+	i386 := newPrefixWriter(&out, &mutex, "[i386] ")
+
+	fmt.Fprintf(amd64, "foo\nba")
+	fmt.Fprintf(i386, "first\n")
+	fmt.Fprintf(amd64, "r\nbaz")
+	c.Check(out.String(), Equals, "[amd64] foo\n[i386] first\n[amd64] bar\n")
+
+	c.Check(amd64.Flush(), IsNil)
+	c.Check(i386.Flush(), IsNil)
+	c.Check(out.String(), Equals, "[amd64] foo\n[i386] first\n[amd64] bar\n[amd64] baz\n")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	deb ".."
+)
+
+// BuildSetItem is a source package of a set built by BuildSet, and the
+// outcome of its build
+type BuildSetItem struct {
+	Source deb.SourcePackageRef
+	// The layer of the package, it only build depends on packages of
+	// the previous layers
+	Layer int
+	// The result of the build, nil if it failed or was skipped
+	Result *BuildResult
+	// The error of the build, or the reason it was skipped
+	Err error
+	// Tells if the package was not built, because a package it build
+	// depends on failed, or an earlier layer did
+	Skipped bool
+}
+
+// buildSetDependencies returns, for each source package of a set, the
+// other packages of the set that build one of its build dependencies
+func buildSetDependencies(dscs []deb.SourceControlFile) (map[string][]string, error) {
+	builtBy := make(map[string]string)
+	for _, dsc := range dscs {
+		for _, b := range dsc.Binaries {
+			if other, ok := builtBy[b]; ok && other != dsc.Identifier.Source {
+				return nil, fmt.Errorf("Binary package `%s' is built by both `%s' and `%s'", b, other, dsc.Identifier.Source)
+			}
+			builtBy[b] = dsc.Identifier.Source
+		}
+	}
+
+	res := make(map[string][]string)
+	for _, dsc := range dscs {
+		source := dsc.Identifier.Source
+		if _, ok := res[source]; ok {
+			return nil, fmt.Errorf("Source package `%s' is given several times", source)
+		}
+		res[source] = []string{}
+		seen := make(map[string]bool)
+		for _, d := range dsc.BuildDependencyNames() {
+			dep, ok := builtBy[d]
+			// packages may build depend on their own binaries when
+			// bootstrapped
+			if ok == false || dep == source || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			res[source] = append(res[source], dep)
+		}
+		sort.Strings(res[source])
+	}
+	return res, nil
+}
+
+// dependencyCycle returns a cycle among deps, which has one. The cycle
+// starts and ends with the same package.
+func dependencyCycle(deps map[string][]string) []string {
+	sources := make([]string, 0, len(deps))
+	for s := range deps {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+
+	// a package of a cycle is reached again by following the first
+	// dependency of the packages, which all have some
+	visited := make(map[string]int)
+	cur := sources[0]
+	var path []string
+	for {
+		if i, ok := visited[cur]; ok {
+			return append(path[i:], cur)
+		}
+		visited[cur] = len(path)
+		path = append(path, cur)
+		cur = deps[cur][0]
+	}
+}
+
+// buildSetLayers orders the source packages of a set by their build
+// dependencies on the binary packages of each other. The packages of a
+// layer only build depend on packages of the previous layers, and are
+// sorted by name. It returns an error if the packages depend on each
+// other in a cycle.
+func buildSetLayers(dscs []deb.SourceControlFile) ([][]deb.SourceControlFile, map[string][]string, error) {
+	deps, err := buildSetDependencies(dscs)
+	if err != nil {
+		return nil, nil, err
+	}
+	bySource := make(map[string]deb.SourceControlFile)
+	for _, dsc := range dscs {
+		bySource[dsc.Identifier.Source] = dsc
+	}
+
+	remaining := make(map[string][]string)
+	for s, d := range deps {
+		remaining[s] = d
+	}
+	var layers [][]deb.SourceControlFile
+	for len(remaining) != 0 {
+		var ready []string
+		for s, d := range remaining {
+			if len(d) == 0 {
+				ready = append(ready, s)
+			}
+		}
+		if len(ready) == 0 {
+			return nil, nil, fmt.Errorf("Source packages build depend on each other in a cycle: %s", strings.Join(dependencyCycle(remaining), " -> "))
+		}
+		sort.Strings(ready)
+
+		layer := make([]deb.SourceControlFile, 0, len(ready))
+		built := make(map[string]bool)
+		for _, s := range ready {
+			layer = append(layer, bySource[s])
+			built[s] = true
+			delete(remaining, s)
+		}
+		for s, d := range remaining {
+			left := []string{}
+			for _, dep := range d {
+				if built[dep] == false {
+					left = append(left, dep)
+				}
+			}
+			remaining[s] = left
+		}
+		layers = append(layers, layer)
+	}
+	return layers, deps, nil
+}
+
+// BuildSet builds a set of interdependent deb.SourcePackage, in the
+// order of their build dependencies on each other. The packages are
+// built layer by layer, those of a layer concurrently as far as the
+// builder allows, like BuildPackage does. Each built package is
+// included in the local repository, for the following layers to use
+// it. After a failure, the next layers are skipped, unless keepGoing
+// is set, then only the packages depending on a failed one are. The
+// output of the builds is copied to buildOut, prefixed by their
+// source package.
+func (x *Interactor) BuildSet(ctx context.Context, dscs []deb.SourceControlFile, keepGoing bool, opts BuildOptions, buildOut io.Writer) ([]*BuildSetItem, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+	layers, deps, err := buildSetLayers(dscs)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*BuildSetItem
+	failed := make(map[string]bool)
+	stoppedAt := -1
+	for i, layer := range layers {
+		var builds []*concurrentBuild
+		var built []*BuildSetItem
+		var outputMutex sync.Mutex
+		for _, dsc := range layer {
+			item := &BuildSetItem{Source: dsc.Identifier, Layer: i}
+			items = append(items, item)
+			source := dsc.Identifier.Source
+			if stoppedAt >= 0 {
+				item.Skipped = true
+				item.Err = fmt.Errorf("Skipped after the failure of layer %d", stoppedAt)
+				failed[source] = true
+				continue
+			}
+			for _, dep := range deps[source] {
+				if failed[dep] {
+					item.Skipped = true
+					item.Err = fmt.Errorf("Skipped as build dependency `%s' failed", dep)
+					failed[source] = true
+					break
+				}
+			}
+			if item.Skipped {
+				continue
+			}
+
+			a, err := x.archiver.ArchiveSource(dsc)
+			if err != nil {
+				item.Err = fmt.Errorf("Could not archive source package `%s': %s", dsc.Identifier, err)
+				failed[source] = true
+				continue
+			}
+			args, err := x.prepareBuild(a, buildTarget{}, opts)
+			if err != nil {
+				item.Err = err
+				failed[source] = true
+				continue
+			}
+			b := &concurrentBuild{args: args}
+			if buildOut != nil {
+				b.output = newPrefixWriter(buildOut, &outputMutex, fmt.Sprintf("[%s] ", source))
+			}
+			builds = append(builds, b)
+			built = append(built, item)
+		}
+
+		x.runBuilds(ctx, builds)
+
+		// the packages are included in the local repository one at a
+		// time
+		for j, b := range builds {
+			item := built[j]
+			item.Result, item.Err = x.archiveBuild(builtRef(b.args), b.result, "", opts, b.err)
+			os.RemoveAll(b.args.Dest)
+			if item.Err != nil {
+				failed[item.Source.Source] = true
+			}
+		}
+		if len(failed) != 0 && keepGoing == false && stoppedAt < 0 {
+			stoppedAt = i
+		}
+		if ctx.Err() != nil {
+			return items, ctx.Err()
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+// setSource returns a source package building binaries, build
+// depending on deps
+func setSource(name string, binaries []string, deps ...string) deb.SourceControlFile {
+	return deb.SourceControlFile{
+		Identifier: deb.SourcePackageRef{
+			Source: name,
+			Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+		},
+		Binaries:     binaries,
+		BuildDepends: deps,
+	}
+}
+
+// layerNames returns the names of the source packages of layers
+func layerNames(layers [][]deb.SourceControlFile) [][]string {
+	res := [][]string{}
+	for _, l := range layers {
+		names := []string{}
+		for _, dsc := range l {
+			names = append(names, dsc.Identifier.Source)
+		}
+		res = append(res, names)
+	}
+	return res
+}
+
+type BuildSetSuite struct{}
+
+var _ = Suite(&BuildSetSuite{})
+
+func (s *BuildSetSuite) TestLayers(c *C) {
+	dscs := []deb.SourceControlFile{
+		setSource("app", []string{"app"}, "debhelper (>= 9)", "libfoo-dev (>= 1.0)", "libbar-dev | libbaz-dev"),
+		setSource("bar", []string{"libbar1", "libbar-dev"}, "libfoo-dev"),
+		setSource("foo", []string{"libfoo1", "libfoo-dev"}, "debhelper"),
+		setSource("doc", []string{"doc"}),
+		// a package build depending on itself is not a cycle
+		setSource("compiler", []string{"compiler"}, "compiler"),
+	}
+	layers, deps, err := buildSetLayers(dscs)
+	c.Assert(err, IsNil)
+	c.Check(layerNames(layers), DeepEquals, [][]string{
+		{"compiler", "doc", "foo"},
+		{"bar"},
+		{"app"},
+	})
+	c.Check(deps["app"], DeepEquals, []string{"bar", "foo"})
+	c.Check(deps["compiler"], DeepEquals, []string{})
+}
+
+func (s *BuildSetSuite) TestLayersErrors(c *C) {
+	_, _, err := buildSetLayers([]deb.SourceControlFile{
+		setSource("a", []string{"liba"}, "libc"),
+		setSource("b", []string{"libb"}, "liba"),
+		setSource("c", []string{"libc"}, "libb"),
+		setSource("d", []string{"libd"}),
+	})
+	c.Check(err, ErrorMatches, "Source packages build depend on each other in a cycle: a -> c -> b -> a")
+
+	_, _, err = buildSetLayers([]deb.SourceControlFile{
+		setSource("a", []string{"liba"}),
+		setSource("a", []string{"liba"}),
+	})
+	c.Check(err, ErrorMatches, "Source package `a' is given several times")
+
+	_, _, err = buildSetLayers([]deb.SourceControlFile{
+		setSource("a", []string{"libfoo"}),
+		setSource("b", []string{"libfoo"}),
+	})
+	c.Check(err, ErrorMatches, "Binary package `libfoo' is built by both `a' and `b'")
+}
+
+// writeSetSources writes empty .dsc files of dscs in a new directory
+func writeSetSources(c *C, dscs []deb.SourceControlFile) {
+	dir := c.MkDir()
+	for i := range dscs {
+		dscs[i].BasePath = dir
+		c.Assert(ioutil.WriteFile(path.Join(dir, dscs[i].Filename()), nil, 0644), IsNil)
+	}
+}
+
+func (s *BuildUseCaseSuite) TestBuildSet(c *C) {
+	dscs := []deb.SourceControlFile{
+		setSource("app", []string{"app"}, "libbar-dev"),
+		setSource("bar", []string{"libbar-dev"}, "libfoo-dev"),
+		setSource("foo", []string{"libfoo-dev"}),
+		setSource("doc", []string{"doc"}),
+	}
+	writeSetSources(c, dscs)
+
+	var out bytes.Buffer
+	items, err := s.x.BuildSet(context.Background(), dscs, false, BuildOptions{}, &out)
+	c.Assert(err, IsNil)
+	c.Assert(items, HasLen, 4)
+	order := []string{}
+	for _, item := range items {
+		c.Check(item.Err, IsNil)
+		c.Check(item.Result, NotNil)
+		order = append(order, fmt.Sprintf("%d:%s", item.Layer, item.Source.Source))
+	}
+	c.Check(order, DeepEquals, []string{"0:doc", "0:foo", "1:bar", "2:app"})
+	c.Check(s.builder.Builds, HasLen, 4)
+	c.Check(strings.Count(out.String(), "] Called BuildPackage\n"), Equals, 4)
+
+	// the next layers are skipped after a failure
+	s.builder.Builds = nil
+	s.builder.SourceErrs = map[string]error{"foo": fmt.Errorf("Failure")}
+	items, err = s.x.BuildSet(context.Background(), dscs, false, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(items[0].Err, IsNil)
+	c.Check(items[1].Err, ErrorMatches, "Failure")
+	c.Check(items[2].Skipped, Equals, true)
+	c.Check(items[2].Err, ErrorMatches, "Skipped after the failure of layer 0")
+	c.Check(items[3].Skipped, Equals, true)
+	c.Check(s.builder.Builds, HasLen, 2)
+
+	// or only those depending on the failed package
+	s.builder.Builds = nil
+	dscs = append(dscs, setSource("tool", []string{"tool"}, "doc"))
+	writeSetSources(c, dscs)
+	items, err = s.x.BuildSet(context.Background(), dscs, true, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(items, HasLen, 5)
+	c.Check(items[2].Source.Source, Equals, "bar")
+	c.Check(items[2].Err, ErrorMatches, "Skipped as build dependency `foo' failed")
+	c.Check(items[3].Source.Source, Equals, "tool")
+	c.Check(items[3].Err, IsNil)
+	c.Check(items[4].Err, ErrorMatches, "Skipped as build dependency `bar' failed")
+	c.Check(s.builder.Builds, HasLen, 3)
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/mail"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	deb "../"
 )
@@ -15,22 +21,83 @@ type History interface {
 	Append(deb.SourcePackageRef)
 	Get() []deb.SourcePackageRef
 	RemoveFront(deb.SourcePackageRef)
+	// AppendBackport records a successful backport
+	AppendBackport(Backport)
+	// Backports returns the backports of a source, by name, most
+	// recent first
+	Backports(source string) []Backport
 }
 
-// BuildPackage builds a deb.SourcePackage and return the result. If a io.Writer is
-// passed, the build process output will be copied to it.
-func (x *Interactor) BuildPackage(s deb.SourceControlFile, buildOut io.Writer) (*BuildResult, error) {
+// BuildPackage builds a deb.SourcePackage with the given options and
+// return the result. If a io.Writer is passed, the build process output
+// will be copied to it. The build is aborted if ctx is done.
+func (x *Interactor) BuildPackage(ctx context.Context, s deb.SourceControlFile, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	return x.buildPackage(ctx, s, buildTarget{}, opts, buildOut)
+}
+
+// CrossBuildPackage builds the architecture dependent packages of a
+// deb.SourcePackage for host, in the build environment of the first
+// architecture supported for its distribution, like BuildPackage does.
+func (x *Interactor) CrossBuildPackage(ctx context.Context, s deb.SourceControlFile, host deb.Architecture, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	if _, err := deb.ParseArchitecture(string(host)); err != nil {
+		return nil, err
+	}
+	if host == deb.Any || host == deb.All || host == deb.Source {
+		return nil, fmt.Errorf("Cannot cross-build for %s, it is not a processor architecture", host)
+	}
+	return x.buildPackage(ctx, s, buildTarget{host: host}, opts, buildOut)
+}
+
+// buildTarget selects the packages built from a source package
+type buildTarget struct {
+	// the commit the source package was generated from, if any
+	gitCommit string
+	// the architecture the packages are cross-built for, if any
+	host deb.Architecture
+	// the binary-only rebuild to make, if any
+	binNMU *BinNMU
+}
+
+// buildPackage archives and builds a source package
+func (x *Interactor) buildPackage(ctx context.Context, s deb.SourceControlFile, t buildTarget, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+
 	a, err := x.archiver.ArchiveSource(s)
 	if err != nil {
 		return nil, fmt.Errorf("Could not archive source package `%s': %s", s.Identifier, err)
 	}
 
+	return x.buildArchivedSource(ctx, a, t, opts, buildOut)
+}
+
+// buildArchivedSource builds an archived source package, and archives
+// the result
+func (x *Interactor) buildArchivedSource(ctx context.Context, a *ArchivedSource, t buildTarget, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	args, err := x.prepareBuild(a, t, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(args.Dest)
+
+	buildRes, err := x.runBuild(ctx, args, buildOut)
+	return x.archiveBuild(builtRef(args), buildRes, t.gitCommit, opts, err)
+}
+
+// prepareBuild returns the arguments of the build of an archived
+// source package for its target distribution. The source package is
+// copied in a new temporary directory, args.Dest, that the caller
+// removes.
+func (x *Interactor) prepareBuild(a *ArchivedSource, t buildTarget, opts BuildOptions) (BuildArguments, error) {
+	var args BuildArguments
+	s := a.Dsc
 	targetDist := a.Changes.Dist
 
 	supported := x.userDistConfig.Supported()
 	archs, ok := supported[targetDist]
 	if ok == false || len(archs) == 0 {
-		return nil, fmt.Errorf("Target distribution `%s' of source package `%s' is not supported", targetDist, s.Identifier)
+		return args, fmt.Errorf("Target distribution `%s' of source package `%s' is not supported", targetDist, s.Identifier)
 	}
 
 	for _, targetArch := range archs {
@@ -42,16 +109,20 @@ func (x *Interactor) BuildPackage(s deb.SourceControlFile, buildOut io.Writer) (
 			}
 		}
 		if found == false {
-			return nil, fmt.Errorf("System consistency error: builder does not support %s-%s", targetDist, targetArch)
+			return args, fmt.Errorf("System consistency error: builder does not support %s-%s", targetDist, targetArch)
 		}
 	}
 
+	if len(t.host) != 0 {
+		// the packages are cross-built in a single build environment
+		archs = archs[:1]
+	}
+
 	//outputs everything in a temporary directory
 	dest, err := ioutil.TempDir("", "go-deb.ddesk_output_")
 	if err != nil {
-		return nil, err
+		return args, err
 	}
-	defer os.RemoveAll(dest)
 
 	//we copy dsc and source file there
 	dsc := a.Dsc
@@ -63,19 +134,9 @@ func (x *Interactor) BuildPackage(s deb.SourceControlFile, buildOut io.Writer) (
 	files = append(files, dsc.Filename())
 
 	for _, fPath := range files {
-		inPath := path.Join(a.Dsc.BasePath, fPath)
-		outPath := path.Join(dsc.BasePath, fPath)
-		inF, err := os.Open(inPath)
-		if err != nil {
-			return nil, err
-		}
-		outF, err := os.Create(outPath)
-		if err != nil {
-			return nil, err
-		}
-		_, err = io.Copy(outF, inF)
-		if err != nil {
-			return nil, err
+		if err := copyFile(path.Join(a.Dsc.BasePath, fPath), path.Join(dsc.BasePath, fPath)); err != nil {
+			os.RemoveAll(dest)
+			return args, err
 		}
 	}
 
@@ -86,38 +147,298 @@ func (x *Interactor) BuildPackage(s deb.SourceControlFile, buildOut io.Writer) (
 	}
 	deps = append(deps, x.localRepository.Access())
 
-	//we do the build
-	buildRes, err := x.builder.BuildPackage(BuildArguments{
+	args = BuildArguments{
 		SourcePackage: dsc,
 		Dist:          targetDist,
 		Archs:         archs,
 		Deps:          deps,
 		Dest:          dest,
-	}, buildOut)
+		Options:       opts,
+		HostArch:      t.host,
+		BinNMU:        t.binNMU,
+	}
+	return args, nil
+}
+
+// runBuild builds a package with args, and verifies that the build is
+// reproducible if the options ask for it
+func (x *Interactor) runBuild(ctx context.Context, args BuildArguments, buildOut io.Writer) (*BuildResult, error) {
+	buildRes, err := x.builder.BuildPackage(ctx, args, buildOut)
+
+	if err == nil && buildRes != nil && args.Options.VerifyReproducible {
+		buildRes.Reproducibility, err = x.verifyReproducible(ctx, args, buildRes, buildOut)
+	}
+	return buildRes, err
+}
+
+// concurrentBuild is a build run concurrently with others by
+// runBuilds, and its outcome
+type concurrentBuild struct {
+	args   BuildArguments
+	output io.Writer
+	result *BuildResult
+	err    error
+}
+
+// runBuilds runs builds concurrently, as far as the builder allows, and
+// waits for them. The output of a build with an incomplete last line
+// is flushed once it ends.
+func (x *Interactor) runBuilds(ctx context.Context, builds []*concurrentBuild) {
+	var wg sync.WaitGroup
+	for _, b := range builds {
+		wg.Add(1)
+		go func(b *concurrentBuild) {
+			defer wg.Done()
+			b.result, b.err = x.runBuild(ctx, b.args, b.output)
+			if prefixed, ok := b.output.(*prefixWriter); ok {
+				prefixed.Flush()
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// verifyReproducible rebuilds the package built with args in a varied
+// environment, and compares the packages of both builds. A failed
+// rebuild is reported in the verdict, not as an error.
+func (x *Interactor) verifyReproducible(ctx context.Context, args BuildArguments, buildRes *BuildResult, buildOut io.Writer) (*ReproducibilityReport, error) {
+	args.Dest = path.Join(args.Dest, "rebuild")
+	args.Options = reproducibleVariation(args.Options)
+	if buildOut != nil {
+		fmt.Fprintf(buildOut, "--- Rebuilding %s to verify it is reproducible, with %s\n", args.SourcePackage.Identifier, args.Options)
+	}
+	rebuild, err := x.builder.BuildPackage(ctx, args, buildOut)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return &ReproducibilityReport{RebuildError: err.Error()}, nil
+	}
+	res, err := compareBuilds(buildRes, rebuild)
+	if err != nil {
+		return nil, fmt.Errorf("Could not compare the builds of `%s': %s", args.SourcePackage.Identifier, err)
+	}
+	return res, nil
+}
+
+// archiveBuild archives the result of the build of a source package,
+// built with opts, and includes it in the local repository. err is
+// the build error.
+func (x *Interactor) archiveBuild(ref deb.SourcePackageRef, buildRes *BuildResult, gitCommit string, opts BuildOptions, err error) (*BuildResult, error) {
 	var archErr error
 	if buildRes != nil {
+		buildRes.GitCommit = gitCommit
+		buildRes.Options = opts
 		buildRes, archErr = x.archiver.ArchiveBuildResult(*buildRes)
 	}
 
-	if archErr == nil && buildRes != nil {
+	// packages failing the lintian or autopkgtest policies are
+	// archived, but kept out of the local repository
+	var policyErr error
+	if err == nil && buildRes != nil && len(opts.LintianFailOn) != 0 {
+		if failures := lintianFailures(buildRes.Lintian, opts.LintianFailOn); len(failures) != 0 {
+			policyErr = fmt.Errorf("Lintian reported %d tags of severity %s or more, `%s' is not included in the local repository, see ddesk lint %s", len(failures), opts.LintianFailOn, ref, ref)
+		}
+	}
+	if err == nil && buildRes != nil && policyErr == nil && opts.AutopkgtestBlocking {
+		if failures := autopkgtestFailures(buildRes.Autopkgtest); len(failures) != 0 {
+			names := make([]string, 0, len(failures))
+			for _, f := range failures {
+				names = append(names, f.Name)
+			}
+			policyErr = fmt.Errorf("Autopkgtests %s failed, `%s' is not included in the local repository, see ddesk autopkgtest %s", strings.Join(names, ", "), ref, ref)
+		}
+	}
+
+	if archErr == nil && buildRes != nil && policyErr == nil {
 		archErr = x.localRepository.ArchiveChanges(buildRes.Changes, buildRes.BasePath)
 	}
 
 	if archErr != nil {
-		x.history.RemoveFront(s.Identifier)
-		return nil, fmt.Errorf("Failed to archive build result of `%s': %s", s.Identifier, archErr)
+		x.history.RemoveFront(ref)
+		return nil, fmt.Errorf("Failed to archive build result of `%s': %s", ref, archErr)
+	}
+
+	if policyErr != nil {
+		return buildRes, policyErr
 	}
 
 	if err == nil {
-		x.history.Append(s.Identifier)
+		x.history.Append(ref)
 	}
 
 	return buildRes, err
 }
 
-// BuildDebianizedGit builds a debian package from a Debianized Git repository.
-func (x *Interactor) BuildDebianizedGit(path string, buildOut io.Writer) (*BuildResult, error) {
-	return nil, deb.NotYetImplemented()
+// ListBuildJobs returns the jobs of the builder
+func (x *Interactor) ListBuildJobs() ([]BuildJob, error) {
+	return x.builder.ListJobs()
+}
+
+// CancelBuildJob cancels a job of the builder
+func (x *Interactor) CancelBuildJob(id BuildJobID) error {
+	return x.builder.CancelJob(id)
+}
+
+// AttachBuildJob copies the log of a builder job to buildOut until it
+// finishes. If the job succeeded and its result was not archived, as
+// when the client of the build was interrupted, the result is
+// archived like BuildPackage does. If ctx is done, the job goes on.
+func (x *Interactor) AttachBuildJob(ctx context.Context, id BuildJobID, buildOut io.Writer) (*BuildJob, error) {
+	var logData bytes.Buffer
+	var w io.Writer = &logData
+	if buildOut != nil {
+		w = io.MultiWriter(&logData, buildOut)
+	}
+	job, err := x.builder.AttachJob(ctx, id, w)
+	if err != nil {
+		return nil, err
+	}
+	if job.State != JobSucceeded || job.Result == nil {
+		return job, nil
+	}
+
+	ref := builtRef(job.Args)
+	if archived, err := x.archiver.GetBuildResult(ref); err == nil && archived.JobID == job.ID {
+		return job, nil
+	}
+	// the results may be on a remote builder
+	dest, err := ioutil.TempDir("", "go-deb.ddesk_output_")
+	if err != nil {
+		return job, err
+	}
+	defer os.RemoveAll(dest)
+	res, err := x.builder.FetchResult(job.ID, dest)
+	if err != nil {
+		return job, fmt.Errorf("Could not fetch result of build job %d: %s", job.ID, err)
+	}
+	res.BuildLog = Log(logData.String())
+	archived, err := x.archiveBuild(ref, res, "", job.Args.Options, nil)
+	if err != nil {
+		return job, err
+	}
+	job.Result = archived
+	return job, nil
+}
+
+// BuildDebianizedGit builds a debian package from the HEAD commit of a
+// Debianized Git repository, the current directory if repoPath is
+// empty, with the given options. The commit is recorded in the
+// BuildResult.
+func (x *Interactor) BuildDebianizedGit(ctx context.Context, repoPath string, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	if len(repoPath) == 0 {
+		repoPath = "."
+	}
+
+	dest, err := ioutil.TempDir("", "go-deb.ddesk_git_source_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dest)
+
+	src, err := x.gitSource.BuildSource(repoPath, dest, buildOut)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate source package from `%s': %s", repoPath, err)
+	}
+
+	return x.buildPackage(ctx, src.Dsc, buildTarget{gitCommit: src.Commit}, opts, buildOut)
+}
+
+// BinNMU makes a binary-only rebuild of the archived source package
+// ref, for its architecture dependent packages. Their version is
+// suffixed by +bN, N following the previous binNMUs of the same
+// source version, and they are archived as a distinct build of the
+// source. reason is the changelog entry of the rebuild.
+func (x *Interactor) BinNMU(ctx context.Context, ref deb.SourcePackageRef, reason string, maintainer *mail.Address, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+	if opts.Autopkgtest {
+		return nil, fmt.Errorf("Autopkgtests are not run for binNMUs, they test the architecture independent packages too")
+	}
+
+	a, err := x.archiver.GetArchivedSource(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get source package `%s': %s", ref, err)
+	}
+
+	binNMU := &BinNMU{Number: 1, Reason: reason, Maintainer: maintainer}
+	for {
+		built := deb.SourcePackageRef{Source: ref.Source, Ver: binNMU.Version(ref.Ver)}
+		if _, err := x.archiver.GetBuildResult(built); err != nil {
+			break
+		}
+		binNMU.Number++
+	}
+	if err := binNMU.Check(); err != nil {
+		return nil, err
+	}
+
+	return x.buildArchivedSource(ctx, a, buildTarget{binNMU: binNMU}, opts, buildOut)
+}
+
+// BackportPackage rewrites a deb.SourcePackage for the distribution
+// to and builds it like BuildPackage does. The version of the backport
+// is suffixed to sort before the original one, and a changelog entry
+// by maintainer targets to. Successful backports are recorded in the
+// history with their original source.
+func (x *Interactor) BackportPackage(ctx context.Context, s deb.SourceControlFile, to deb.Codename, maintainer *mail.Address, opts BuildOptions, buildOut io.Writer) (*BuildResult, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+	if archs := x.userDistConfig.Supported()[to]; len(archs) == 0 {
+		return nil, fmt.Errorf("Cannot backport `%s' to `%s', it is not supported", s.Identifier, to)
+	}
+
+	dest, err := ioutil.TempDir("", "go-deb.ddesk_backport_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dest)
+
+	dsc, err := x.backportSource(s, to, maintainer, dest, buildOut)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := x.buildPackage(ctx, *dsc, buildTarget{}, opts, buildOut)
+	if err == nil {
+		x.history.AppendBackport(Backport{Origin: s.Identifier, Ref: dsc.Identifier, Dist: to})
+	}
+	return res, err
+}
+
+// backportSource rewrites a source package for the distribution to,
+// in dest
+func (x *Interactor) backportSource(s deb.SourceControlFile, to deb.Codename, maintainer *mail.Address, dest string, buildOut io.Writer) (*deb.SourceControlFile, error) {
+	// a failed backport is rebuilt with the same version
+	n := 1
+	for _, b := range x.history.Backports(s.Identifier.Source) {
+		if b.Origin == s.Identifier && b.Dist == to {
+			n++
+		}
+	}
+	entry := deb.ChangelogEntry{
+		Source:     s.Identifier.Source,
+		Ver:        backportVersion(s.Identifier.Ver, to, n),
+		Dists:      []deb.Codename{to},
+		Urgency:    "medium",
+		Changes:    []string{fmt.Sprintf("* Backport to %s.", to)},
+		Maintainer: maintainer,
+		Date:       time.Now(),
+	}
+
+	dsc, err := x.backporter.Backport(s, entry, dest, buildOut)
+	if err != nil {
+		return nil, fmt.Errorf("Could not backport `%s' to `%s': %s", s.Identifier, to, err)
+	}
+	return dsc, nil
+}
+
+// Backports returns the backports of a source package, by name, most
+// recent first
+func (x *Interactor) Backports(source string) []Backport {
+	return x.history.Backports(source)
 }
 
 // GetBuildResult returns the build result of the last built of the given source package
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/mail"
 	"os"
+	"path"
 	"testing"
 
 	deb "../"
@@ -18,6 +23,8 @@ type BuildUseCaseSuite struct {
 	history         *HistoryStub
 	dsc             deb.SourceControlFile
 	distConfig      *UserDistSupportConfigStub
+	gitSource       *GitSourcePackagerStub
+	backporter      *SourceBackporterStub
 }
 
 var _ = Suite(&BuildUseCaseSuite{})
@@ -25,9 +32,60 @@ var _ = Suite(&BuildUseCaseSuite{})
 func Test(t *testing.T) { TestingT(t) }
 
 func (s *BuildUseCaseSuite) TestBuildDebianizedGit(c *C) {
-	r, err := s.x.BuildDebianizedGit("", nil)
+	s.gitSource.Res = &GitSource{
+		Dsc:    s.dsc,
+		Commit: "0123456789abcdef0123456789abcdef01234567",
+	}
+
+	r, err := s.x.BuildDebianizedGit(context.Background(), "", BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.gitSource.RepoPath, Equals, ".")
+	c.Check(r.GitCommit, Equals, s.gitSource.Res.Commit)
+	c.Check(s.packageArchiver.Results[s.dsc.Identifier].GitCommit, Equals, s.gitSource.Res.Commit)
+	c.Check(*s.x.GetLastSuccesfullUserBuild(), DeepEquals, s.dsc.Identifier)
+
+	s.gitSource.Err = fmt.Errorf("Failure")
+	r, err = s.x.BuildDebianizedGit(context.Background(), "/some/repo", BuildOptions{}, nil)
 	c.Check(r, IsNil)
-	c.Check(err, ErrorMatches, ".* is not yet implemented")
+	c.Check(err, ErrorMatches, "Could not generate source package from `/some/repo': Failure")
+}
+
+func (s *BuildUseCaseSuite) TestAttachBuildJob(c *C) {
+	id, err := s.builder.SubmitBuild(BuildArguments{SourcePackage: s.dsc})
+	c.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	job, err := s.x.AttachBuildJob(context.Background(), id, &out)
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, "Called BuildPackage\n")
+	c.Check(job.State, Equals, JobSucceeded)
+
+	// the result of the interrupted build is archived
+	c.Check(s.packageArchiver.ArchiveResultCalled, Equals, true)
+	archived := s.packageArchiver.Results[s.dsc.Identifier]
+	c.Assert(archived, NotNil)
+	c.Check(archived.JobID, Equals, id)
+	c.Check(archived.BuildLog, Equals, Log("Called BuildPackage\n"))
+	c.Check(*s.x.GetLastSuccesfullUserBuild(), DeepEquals, s.dsc.Identifier)
+
+	// but only once
+	s.packageArchiver.ArchiveResultCalled = false
+	_, err = s.x.AttachBuildJob(context.Background(), id, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.packageArchiver.ArchiveResultCalled, Equals, false)
+
+	s.builder.Err = fmt.Errorf("Failure")
+	id, err = s.builder.SubmitBuild(BuildArguments{SourcePackage: s.dsc})
+	c.Assert(err, IsNil)
+	job, err = s.x.AttachBuildJob(context.Background(), id, nil)
+	c.Assert(err, IsNil)
+	c.Check(job.Err(), ErrorMatches, "Failure")
+	c.Check(s.packageArchiver.ArchiveResultCalled, Equals, false)
+
+	jobs, err := s.x.ListBuildJobs()
+	c.Assert(err, IsNil)
+	c.Check(jobs, HasLen, 2)
+	c.Check(s.x.CancelBuildJob(id), ErrorMatches, "Build job 2 is already failed")
 }
 
 func (s *BuildUseCaseSuite) SetUpTest(c *C) {
@@ -64,7 +122,7 @@ func (s *BuildUseCaseSuite) SetUpTest(c *C) {
 		ForceTargetDist: "unstable",
 	}
 
-	s.builder.InitDistribution("unstable", deb.Amd64, nil)
+	s.builder.InitDistribution(context.Background(), "unstable", deb.Amd64, nil)
 
 	s.localApt = &aptRepositoryStub{}
 	s.localApt.AddDistribution("unstable", deb.Amd64)
@@ -75,6 +133,8 @@ func (s *BuildUseCaseSuite) SetUpTest(c *C) {
 		},
 	}
 	s.aptDeps = &AptDepsManagerStub{}
+	s.gitSource = &GitSourcePackagerStub{}
+	s.backporter = &SourceBackporterStub{}
 
 	s.x.history = s.history
 	s.x.builder = s.builder
@@ -82,6 +142,8 @@ func (s *BuildUseCaseSuite) SetUpTest(c *C) {
 	s.x.localRepository = s.localApt
 	s.x.userDistConfig = s.distConfig
 	s.x.aptDeps = s.aptDeps
+	s.x.gitSource = s.gitSource
+	s.x.backporter = s.backporter
 }
 
 func (s *BuildUseCaseSuite) TearDownTest(c *C) {
@@ -91,7 +153,7 @@ func (s *BuildUseCaseSuite) TearDownTest(c *C) {
 
 func (s *BuildUseCaseSuite) TestWorkingWorkflow(c *C) {
 
-	b, err := s.x.BuildPackage(s.dsc, nil)
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
 
 	c.Check(err, IsNil)
 	c.Check(b, DeepEquals, s.builder.Res)
@@ -108,10 +170,198 @@ func (s *BuildUseCaseSuite) TestWorkingWorkflow(c *C) {
 	c.Check(res, DeepEquals, s.builder.Res)
 }
 
+func (s *BuildUseCaseSuite) TestBuildOptions(c *C) {
+	opts := BuildOptions{
+		NoCheck:       true,
+		Parallel:      4,
+		Profiles:      []string{"nodoc"},
+		Env:           map[string]string{"LC_ALL": "C.UTF-8"},
+		ExtraPackages: []string{"eatmydata"},
+	}
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.builder.BuildArgs.Options, DeepEquals, opts)
+	c.Check(b.Options, DeepEquals, opts)
+	c.Check(s.packageArchiver.Results[s.dsc.Identifier].Options, DeepEquals, opts)
+
+	s.builder.BuildCalled = false
+	opts.Env = map[string]string{"DEB_BUILD_OPTIONS": "nostrip"}
+	_, err = s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Check(err, ErrorMatches, "DEB_BUILD_OPTIONS is set from the nocheck, parallel and profile options")
+	c.Check(s.builder.BuildCalled, Equals, false)
+}
+
+func (s *BuildUseCaseSuite) TestLintianPolicy(c *C) {
+	s.builder.Res.Lintian = []LintianTag{
+		{Package: "foo", Severity: "warning", Tag: "binary-without-manpage"},
+	}
+	opts := BuildOptions{Lintian: true, LintianFailOn: "error"}
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Assert(err, IsNil)
+	c.Check(b.Lintian, HasLen, 1)
+	c.Check(s.localApt.ArchiveCalled, Equals, true)
+
+	s.localApt.ArchiveCalled = false
+	opts.LintianFailOn = "warning"
+	b, err = s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Check(err, ErrorMatches, "Lintian reported 1 tags of severity warning or more, `.*' is not included in the local repository, see ddesk lint .*")
+	c.Assert(b, NotNil)
+	c.Check(s.packageArchiver.Results[s.dsc.Identifier].Lintian, DeepEquals, s.builder.Res.Lintian)
+	c.Check(s.localApt.ArchiveCalled, Equals, false)
+}
+
+func (s *BuildUseCaseSuite) TestAutopkgtestPolicy(c *C) {
+	s.builder.Res.Autopkgtest = []AutopkgtestResult{
+		{Name: "unit", Outcome: AutopkgtestPass},
+		{Name: "smoke", Outcome: AutopkgtestFail},
+		{Name: "network", Outcome: AutopkgtestFlaky},
+	}
+	opts := BuildOptions{Autopkgtest: true}
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Assert(err, IsNil)
+	c.Check(b.Autopkgtest, HasLen, 3)
+	c.Check(s.localApt.ArchiveCalled, Equals, true)
+
+	s.localApt.ArchiveCalled = false
+	opts.AutopkgtestBlocking = true
+	b, err = s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Check(err, ErrorMatches, "Autopkgtests smoke failed, `.*' is not included in the local repository, see ddesk autopkgtest .*")
+	c.Assert(b, NotNil)
+	c.Check(s.packageArchiver.Results[s.dsc.Identifier].Autopkgtest, DeepEquals, s.builder.Res.Autopkgtest)
+	c.Check(s.localApt.ArchiveCalled, Equals, false)
+}
+
+func (s *BuildUseCaseSuite) TestVerifyReproducible(c *C) {
+	opts := BuildOptions{Lintian: true, VerifyReproducible: true}
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, opts, nil)
+	c.Assert(err, IsNil)
+	c.Assert(b.Reproducibility, NotNil)
+	c.Check(b.Reproducibility.Reproducible, Equals, true)
+	c.Check(s.packageArchiver.Results[s.dsc.Identifier].Reproducibility, NotNil)
+	c.Check(s.packageArchiver.Results[s.dsc.Identifier].Options, DeepEquals, opts)
+
+	// the last build is the rebuild
+	c.Check(path.Base(s.builder.BuildArgs.Dest), Equals, "rebuild")
+	c.Check(s.builder.BuildArgs.Options, DeepEquals, reproducibleVariation(opts))
+}
+
+func (s *BuildUseCaseSuite) TestCrossBuildPackage(c *C) {
+	_, err := s.x.CrossBuildPackage(context.Background(), s.dsc, deb.Arm64, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.builder.BuildArgs.Archs, DeepEquals, []deb.Architecture{deb.Amd64})
+	c.Check(s.builder.BuildArgs.HostArch, Equals, deb.Arm64)
+
+	s.builder.BuildCalled = false
+	_, err = s.x.CrossBuildPackage(context.Background(), s.dsc, "sparc", BuildOptions{}, nil)
+	c.Check(err, ErrorMatches, "Unknown architecture sparc")
+	_, err = s.x.CrossBuildPackage(context.Background(), s.dsc, deb.All, BuildOptions{}, nil)
+	c.Check(err, ErrorMatches, "Cannot cross-build for all, it is not a processor architecture")
+	c.Check(s.builder.BuildCalled, Equals, false)
+}
+
+func (s *BuildUseCaseSuite) TestBinNMU(c *C) {
+	maintainer := &mail.Address{Name: "Foo Bar", Address: "foo@example.com"}
+	_, err := s.x.BinNMU(context.Background(), s.dsc.Identifier, "Rebuild against libfoo2", maintainer, BuildOptions{}, nil)
+	c.Check(err, ErrorMatches, "Could not get source package `.*': .*")
+	c.Check(s.builder.BuildCalled, Equals, false)
+
+	_, err = s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	s.packageArchiver.ArchiveSourceCalled = false
+
+	_, err = s.x.BinNMU(context.Background(), s.dsc.Identifier, "Rebuild against libfoo2", maintainer, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.packageArchiver.ArchiveSourceCalled, Equals, false)
+	c.Assert(s.builder.BuildArgs.BinNMU, NotNil)
+	c.Check(*s.builder.BuildArgs.BinNMU, DeepEquals, BinNMU{Number: 1, Reason: "Rebuild against libfoo2", Maintainer: maintainer})
+	built := builtRef(s.builder.BuildArgs)
+	c.Check(built.Ver.DebianRevision, Equals, s.dsc.Identifier.Ver.DebianRevision+"+b1")
+	c.Check(*s.x.GetLastSuccesfullUserBuild(), DeepEquals, built)
+
+	// the next binNMU of the same source follows the archived ones
+	s.packageArchiver.Results[built] = s.builder.Res
+	_, err = s.x.BinNMU(context.Background(), s.dsc.Identifier, "Rebuild against libfoo3", maintainer, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.builder.BuildArgs.BinNMU.Number, Equals, 2)
+
+	_, err = s.x.BinNMU(context.Background(), s.dsc.Identifier, " ", maintainer, BuildOptions{}, nil)
+	c.Check(err, ErrorMatches, "A binNMU needs a reason")
+	_, err = s.x.BinNMU(context.Background(), s.dsc.Identifier, "Rebuild", maintainer, BuildOptions{Autopkgtest: true}, nil)
+	c.Check(err, ErrorMatches, "Autopkgtests are not run for binNMUs, .*")
+}
+
+func (s *BuildUseCaseSuite) TestBackportPackage(c *C) {
+	maintainer := &mail.Address{Name: "Foo Bar", Address: "foo@example.com"}
+	_, err := s.x.BackportPackage(context.Background(), s.dsc, deb.Jessie, maintainer, BuildOptions{}, nil)
+	c.Check(err, ErrorMatches, "Cannot backport `.*' to `jessie', it is not supported")
+	c.Check(s.builder.BuildCalled, Equals, false)
+
+	s.distConfig.supported[deb.Jessie] = map[deb.Architecture]bool{deb.Amd64: true}
+	_, err = s.x.BackportPackage(context.Background(), s.dsc, deb.Jessie, maintainer, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.backporter.Entry.Dists, DeepEquals, []deb.Codename{deb.Jessie})
+	c.Check(s.backporter.Entry.Maintainer, Equals, maintainer)
+	first := s.backporter.Entry.Ver
+	c.Check(first, DeepEquals, backportVersion(s.dsc.Identifier.Ver, deb.Jessie, 1))
+	c.Check(s.builder.BuildArgs.SourcePackage.Identifier.Ver, DeepEquals, first)
+
+	s.backporter.Err = fmt.Errorf("Failure")
+	_, err = s.x.BackportPackage(context.Background(), s.dsc, deb.Jessie, maintainer, BuildOptions{}, nil)
+	c.Check(err, ErrorMatches, "Could not backport `.*' to `jessie': Failure")
+
+	// backports are numbered after the previous successful ones
+	s.backporter.Err = nil
+	_, err = s.x.BackportPackage(context.Background(), s.dsc, deb.Jessie, maintainer, BuildOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.backporter.Entry.Ver, DeepEquals, backportVersion(s.dsc.Identifier.Ver, deb.Jessie, 2))
+
+	backports := s.x.Backports(s.dsc.Identifier.Source)
+	c.Assert(backports, HasLen, 2)
+	c.Check(backports[1], DeepEquals, Backport{Origin: s.dsc.Identifier, Ref: deb.SourcePackageRef{Source: s.dsc.Identifier.Source, Ver: first}, Dist: deb.Jessie})
+	c.Check(s.x.Backports("bar"), HasLen, 0)
+}
+
+func (s *BuildUseCaseSuite) TestBuildMatrix(c *C) {
+	s.distConfig.supported[deb.Jessie] = map[deb.Architecture]bool{deb.Amd64: true}
+	logDir := c.MkDir()
+	var out bytes.Buffer
+	targets, err := s.x.BuildMatrix(context.Background(), s.dsc, nil, BuildOptions{}, logDir, &out)
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 2)
+
+	// the source targets unstable, it cannot be rewritten for jessie
+	// without a maintainer
+	c.Check(targets[0].Dist, Equals, deb.Jessie)
+	c.Check(targets[0].Err, ErrorMatches, "Rewriting `.*' for `jessie' needs a maintainer for its changelog entry")
+	c.Check(targets[1].Dist, Equals, deb.Codename("unstable"))
+	c.Check(targets[1].Err, IsNil)
+	c.Check(targets[1].Ref, DeepEquals, s.dsc.Identifier)
+	c.Check(targets[1].Result, NotNil)
+	c.Check(out.String(), Equals, "[unstable] Called BuildPackage\n")
+	log, err := ioutil.ReadFile(targets[1].LogPath)
+	c.Assert(err, IsNil)
+	c.Check(string(log), Equals, "Called BuildPackage\n")
+
+	s.builder.Builds = nil
+	maintainer := &mail.Address{Name: "Foo Bar", Address: "foo@example.com"}
+	targets, err = s.x.BuildMatrix(context.Background(), s.dsc, maintainer, BuildOptions{}, logDir, nil)
+	c.Assert(err, IsNil)
+	c.Check(targets[0].Err, IsNil)
+	c.Check(targets[0].Ref.Ver, DeepEquals, backportVersion(s.dsc.Identifier.Ver, deb.Jessie, 1))
+	c.Check(s.builder.Builds, HasLen, 2)
+	c.Check(s.x.Backports(s.dsc.Identifier.Source), HasLen, 1)
+
+	s.builder.Err = fmt.Errorf("Failure")
+	targets, err = s.x.BuildMatrix(context.Background(), s.dsc, maintainer, BuildOptions{}, logDir, nil)
+	c.Assert(err, IsNil)
+	c.Check(targets[0].Err, ErrorMatches, "Failure")
+	c.Check(targets[1].Err, ErrorMatches, "Failure")
+}
+
 func (s *BuildUseCaseSuite) TestBuildCouldNotArchiveSource(c *C) {
 	s.packageArchiver.SourceErr = fmt.Errorf("Failure")
 
-	b, err := s.x.BuildPackage(s.dsc, nil)
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
 	c.Check(b, IsNil)
 	c.Check(err, ErrorMatches, "Could not archive source package `.*': Failure")
 	c.Check(s.builder.BuildCalled, Equals, false)
@@ -124,7 +374,7 @@ func (s *BuildUseCaseSuite) TestBuildCouldNotArchiveSource(c *C) {
 func (s *BuildUseCaseSuite) TestBuildCouldNotBuildButArchive(c *C) {
 	s.builder.Err = fmt.Errorf("Failure")
 
-	b, err := s.x.BuildPackage(s.dsc, nil)
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
 
 	c.Check(b, NotNil)
 	c.Check(err, ErrorMatches, "Failure")
@@ -140,7 +390,7 @@ func (s *BuildUseCaseSuite) TestBuildCouldBuildButNotArchive(c *C) {
 	s.packageArchiver.BuildErr = fmt.Errorf("Failure")
 
 	s.history.hist = []deb.SourcePackageRef{s.dsc.Identifier}
-	b, err := s.x.BuildPackage(s.dsc, nil)
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
 	c.Check(b, IsNil)
 	c.Check(err, ErrorMatches, "Failed to archive build result of `.*': Failure")
 	c.Check(s.builder.BuildCalled, Equals, true)
@@ -153,7 +403,7 @@ func (s *BuildUseCaseSuite) TestBuildCouldBuildButNotArchive(c *C) {
 func (s *BuildUseCaseSuite) TestBuildUnsupportedDistribution(c *C) {
 	s.packageArchiver.ForceTargetDist = "sid"
 
-	b, err := s.x.BuildPackage(s.dsc, nil)
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
 
 	c.Check(b, IsNil)
 	c.Check(err, ErrorMatches, "Target distribution `.*' of source package `.*' is not supported")
@@ -168,7 +418,7 @@ func (s *BuildUseCaseSuite) TestBuildConsistencyError(c *C) {
 	err := s.distConfig.Add("unstable", deb.I386)
 	c.Assert(err, IsNil)
 
-	b, err := s.x.BuildPackage(s.dsc, nil)
+	b, err := s.x.BuildPackage(context.Background(), s.dsc, BuildOptions{}, nil)
 
 	c.Check(b, IsNil)
 	c.Check(err, ErrorMatches, "System consistency error: builder does not support unstable-i386")
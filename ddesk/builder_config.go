@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	deb ".."
+)
+
+// DistributionConfig configures the build environments of a
+// distribution
+type DistributionConfig struct {
+	// Vendor of the distribution, debian or ubuntu. Its defaults are
+	// used for the unset fields.
+	Vendor     string          `json:",omitempty"`
+	Mirror     string          `json:",omitempty"`
+	Components []deb.Component `json:",omitempty"`
+	// Keyring checking the mirror
+	Keyring string `json:",omitempty"`
+	// Extra options of debootstrap, or of the tool creating the
+	// images of other builders
+	DebootstrapOptions []string `json:",omitempty"`
+	// HTTP proxy of apt, if any
+	AptProxy string `json:",omitempty"`
+}
+
+var vendorDefaults = map[string]DistributionConfig{
+	"debian": {
+		Mirror:     "http://ftp.us.debian.org/debian",
+		Components: []deb.Component{"main", "contrib", "non-free"},
+		Keyring:    "/usr/share/keyrings/debian-archive-keyring.gpg",
+	},
+	"ubuntu": {
+		Mirror:     "http://ftp.ubuntu.com/ubuntu",
+		Components: []deb.Component{"main", "restricted", "universe", "multiverse"},
+		Keyring:    "/usr/share/keyrings/ubuntu-archive-keyring.gpg",
+	},
+}
+
+// knownDistributions are the distributions supported without
+// configuration, and their vendor
+var knownDistributions = map[deb.Codename]string{}
+
+func init() {
+	for _, d := range []deb.Codename{"lucid", "maverick", "natty", "oneiric", "precise",
+		"quantal", "raring", "saucy", "trusty", "utopic", "vivid"} {
+		knownDistributions[d] = "ubuntu"
+	}
+	for _, d := range []deb.Codename{"sid", "squeeze", "wheezy", "jessie", "stretch",
+		"buster", "unstable", "testing", "stable"} {
+		knownDistributions[d] = "debian"
+	}
+}
+
+// BuilderConfig is the configuration of the distributions of a
+// builder, persisted in its basepath. Builders read it each time they
+// create or update an image, so it can be edited while they run.
+type BuilderConfig struct {
+	Distributions map[deb.Codename]DistributionConfig
+
+	path string
+}
+
+// LoadBuilderConfig loads the configuration of the builder in
+// basepath. A builder without configuration only supports the
+// known Debian and Ubuntu distributions, from their official
+// mirrors.
+func LoadBuilderConfig(basepath string) (*BuilderConfig, error) {
+	res := &BuilderConfig{
+		Distributions: make(map[deb.Codename]DistributionConfig),
+		path:          path.Join(basepath, "builder-config.json"),
+	}
+	data, err := ioutil.ReadFile(res.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("Could not parse builder configuration %s: %s", res.path, err)
+	}
+	if res.Distributions == nil {
+		res.Distributions = make(map[deb.Codename]DistributionConfig)
+	}
+	return res, nil
+}
+
+// Save persists the configuration
+func (c *BuilderConfig) Save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".new"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Distribution returns the configuration of d, with the defaults of
+// its vendor.
+func (c *BuilderConfig) Distribution(d deb.Codename) (*DistributionConfig, error) {
+	res, configured := c.Distributions[d]
+	if len(res.Vendor) == 0 {
+		res.Vendor = knownDistributions[d]
+	}
+	if len(res.Vendor) == 0 {
+		if configured {
+			return nil, fmt.Errorf("Configuration of %s has no vendor", d)
+		}
+		return nil, fmt.Errorf("%s is not supported by this builder", d)
+	}
+	defaults, ok := vendorDefaults[res.Vendor]
+	if ok == false {
+		return nil, fmt.Errorf("Unknown vendor `%s' of %s", res.Vendor, d)
+	}
+	if len(res.Mirror) == 0 {
+		res.Mirror = defaults.Mirror
+	}
+	if len(res.Components) == 0 {
+		res.Components = defaults.Components
+	}
+	if len(res.Keyring) == 0 {
+		res.Keyring = defaults.Keyring
+	}
+	return &res, nil
+}
+
+// Set sets the configuration of d
+func (c *BuilderConfig) Set(d deb.Codename, config DistributionConfig) error {
+	if len(config.Vendor) != 0 {
+		if _, ok := vendorDefaults[config.Vendor]; ok == false {
+			return fmt.Errorf("Unknown vendor `%s', supported are debian and ubuntu", config.Vendor)
+		}
+	} else if len(knownDistributions[d]) == 0 {
+		return fmt.Errorf("Vendor of %s is required, as it is not a known distribution", d)
+	}
+	c.Distributions[d] = config
+	return nil
+}
+
+// Unset restores the default configuration of d
+func (c *BuilderConfig) Unset(d deb.Codename) error {
+	if _, ok := c.Distributions[d]; ok == false {
+		return fmt.Errorf("%s is not configured", d)
+	}
+	delete(c.Distributions, d)
+	return nil
+}
+
+// List returns the configured and known distributions, sorted
+func (c *BuilderConfig) List() []deb.Codename {
+	res := []deb.Codename{}
+	for d := range knownDistributions {
+		res = append(res, d)
+	}
+	for d := range c.Distributions {
+		if _, ok := knownDistributions[d]; ok == false {
+			res = append(res, d)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// distributionConfig returns the configuration of d of the builder in
+// basepath
+func distributionConfig(basepath string, d deb.Codename) (*DistributionConfig, error) {
+	c, err := LoadBuilderConfig(basepath)
+	if err != nil {
+		return nil, err
+	}
+	return c.Distribution(d)
+}
+
+func joinComponents(comps []deb.Component, sep string) string {
+	res := ""
+	for i, c := range comps {
+		if i > 0 {
+			res += sep
+		}
+		res += string(c)
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type BuilderConfigSuite struct {
+	basepath string
+}
+
+var _ = Suite(&BuilderConfigSuite{})
+
+func (s *BuilderConfigSuite) SetUpTest(c *C) {
+	s.basepath = c.MkDir()
+}
+
+func (s *BuilderConfigSuite) TestDefaults(c *C) {
+	config, err := LoadBuilderConfig(s.basepath)
+	c.Assert(err, IsNil)
+
+	dist, err := config.Distribution("jessie")
+	c.Assert(err, IsNil)
+	c.Check(*dist, DeepEquals, DistributionConfig{
+		Vendor:     "debian",
+		Mirror:     "http://ftp.us.debian.org/debian",
+		Components: []deb.Component{"main", "contrib", "non-free"},
+		Keyring:    "/usr/share/keyrings/debian-archive-keyring.gpg",
+	})
+
+	dist, err = config.Distribution("trusty")
+	c.Assert(err, IsNil)
+	c.Check(dist.Vendor, Equals, "ubuntu")
+	c.Check(dist.Mirror, Equals, "http://ftp.ubuntu.com/ubuntu")
+
+	_, err = config.Distribution("hamm")
+	c.Check(err, ErrorMatches, "hamm is not supported by this builder")
+}
+
+func (s *BuilderConfigSuite) TestSetAndUnset(c *C) {
+	config, err := LoadBuilderConfig(s.basepath)
+	c.Assert(err, IsNil)
+
+	c.Check(config.Set("xenial", DistributionConfig{}), ErrorMatches, "Vendor of xenial is required, as it is not a known distribution")
+	c.Check(config.Set("xenial", DistributionConfig{Vendor: "gentoo"}), ErrorMatches, "Unknown vendor `gentoo', supported are debian and ubuntu")
+	c.Assert(config.Set("xenial", DistributionConfig{Vendor: "ubuntu", Mirror: "http://mirror.example.com/ubuntu"}), IsNil)
+	c.Assert(config.Set("jessie", DistributionConfig{AptProxy: "http://proxy:3142"}), IsNil)
+	c.Assert(config.Save(), IsNil)
+
+	config, err = LoadBuilderConfig(s.basepath)
+	c.Assert(err, IsNil)
+	dist, err := config.Distribution("xenial")
+	c.Assert(err, IsNil)
+	c.Check(dist.Mirror, Equals, "http://mirror.example.com/ubuntu")
+	c.Check(dist.Keyring, Equals, "/usr/share/keyrings/ubuntu-archive-keyring.gpg")
+	dist, err = config.Distribution("jessie")
+	c.Assert(err, IsNil)
+	c.Check(dist.Vendor, Equals, "debian")
+	c.Check(dist.AptProxy, Equals, "http://proxy:3142")
+
+	list := config.List()
+	c.Check(list, HasLen, len(knownDistributions)+1)
+	c.Check(list[len(list)-1], Equals, deb.Codename("xenial"))
+
+	c.Assert(config.Unset("xenial"), IsNil)
+	c.Check(config.Unset("xenial"), ErrorMatches, "xenial is not configured")
+	_, err = config.Distribution("xenial")
+	c.Check(err, ErrorMatches, "xenial is not supported by this builder")
+}
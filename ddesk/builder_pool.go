@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	deb ".."
+)
+
+// poolRetryDelay is the time a builder that failed is avoided by a
+// BuilderPool
+var poolRetryDelay = time.Minute
+
+// poolFetchRetries is the number of attempts to fetch the result of a
+// build that succeeded, poolFetchRetryDelay apart
+var poolFetchRetries = 3
+var poolFetchRetryDelay = 5 * time.Second
+
+type poolMember struct {
+	name    string
+	builder DebianBuilder
+	// builds submitted through the pool and not yet finished
+	running int
+	// the member is avoided until then
+	downUntil time.Time
+}
+
+// BuilderPool is a DebianBuilder that dispatches builds to several
+// builders, local or remote. Each build goes to a builder supporting
+// its distribution and architectures, preferring healthy builders
+// with the fewest unfinished jobs. If a builder fails, for example
+// because it cannot be reached, the build is retried on another one,
+// and the failing builder is avoided for a while. A failing build is
+// not retried.
+//
+// The ID of a job of the pool encodes the builder running it, so it
+// stays valid as long as the pool is created with the same builders.
+type BuilderPool struct {
+	members []*poolMember
+	mutex   sync.Mutex
+}
+
+// NewBuilderPool returns a pool of builders, indexed by their
+// name. Jobs are dispatched in names order when builders are equally
+// loaded.
+func NewBuilderPool(builders map[string]DebianBuilder) (*BuilderPool, error) {
+	if len(builders) == 0 {
+		return nil, fmt.Errorf("A builder pool needs at least one builder")
+	}
+	res := &BuilderPool{}
+	for name, b := range builders {
+		res.members = append(res.members, &poolMember{name: name, builder: b})
+	}
+	sort.Slice(res.members, func(i, j int) bool {
+		return res.members[i].name < res.members[j].name
+	})
+	return res, nil
+}
+
+// Builders returns the names of the builders of the pool
+func (p *BuilderPool) Builders() []string {
+	res := make([]string, 0, len(p.members))
+	for _, m := range p.members {
+		res = append(res, m.name)
+	}
+	return res
+}
+
+// poolID returns the ID in the pool of the job id of member i
+func (p *BuilderPool) poolID(i int, id BuildJobID) BuildJobID {
+	return id*BuildJobID(len(p.members)) + BuildJobID(i)
+}
+
+// member returns the member running a job of the pool, and the ID of
+// the job on that member.
+func (p *BuilderPool) member(id BuildJobID) (*poolMember, BuildJobID) {
+	n := BuildJobID(len(p.members))
+	return p.members[id%n], id / n
+}
+
+func (p *BuilderPool) index(m *poolMember) int {
+	for i, mm := range p.members {
+		if mm == m {
+			return i
+		}
+	}
+	panic("Unknown builder pool member " + m.name)
+}
+
+// job converts a job of a member to a job of the pool
+func (p *BuilderPool) job(m *poolMember, j *BuildJob) *BuildJob {
+	if j == nil {
+		return nil
+	}
+	res := *j
+	res.ID = p.poolID(p.index(m), j.ID)
+	if res.Result != nil {
+		res.Result = p.result(m, j.ID, res.Result)
+	}
+	return &res
+}
+
+func (p *BuilderPool) result(m *poolMember, id BuildJobID, r *BuildResult) *BuildResult {
+	res := *r
+	res.JobID = p.poolID(p.index(m), id)
+	res.Builder = m.name
+	return &res
+}
+
+func (p *BuilderPool) failed(m *poolMember) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	m.downUntil = time.Now().Add(poolRetryDelay)
+}
+
+func (p *BuilderPool) succeeded(m *poolMember) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	m.downUntil = time.Time{}
+}
+
+func (p *BuilderPool) setRunning(m *poolMember, delta int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	m.running += delta
+}
+
+// supports returns true if m can build for d all archs
+func supports(m *poolMember, d deb.Codename, archs []deb.Architecture) bool {
+	available := m.builder.AvailableArchitectures(d)
+	for _, a := range archs {
+		found := false
+		for _, aa := range available {
+			if aa == a {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return false
+		}
+	}
+	return true
+}
+
+// load returns the number of unfinished jobs of m
+func (p *BuilderPool) load(m *poolMember) (int, error) {
+	jobs, err := m.builder.ListJobs()
+	if err != nil {
+		return 0, err
+	}
+	res := 0
+	for _, j := range jobs {
+		if j.State.Finished() == false {
+			res++
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// builds may not be listed yet
+	if m.running > res {
+		res = m.running
+	}
+	return res, nil
+}
+
+// pick returns the builder that should build archs for d, excluding
+// the ones already tried. Builders that failed recently are only
+// picked if no other builder can.
+func (p *BuilderPool) pick(d deb.Codename, archs []deb.Architecture, tried map[*poolMember]bool) (*poolMember, error) {
+	type candidate struct {
+		m    *poolMember
+		down bool
+		load int
+	}
+	candidates := []candidate{}
+	now := time.Now()
+	for _, m := range p.members {
+		if tried[m] || supports(m, d, archs) == false {
+			continue
+		}
+		p.mutex.Lock()
+		down := now.Before(m.downUntil)
+		p.mutex.Unlock()
+		load, err := p.load(m)
+		if err != nil {
+			p.failed(m)
+			down = true
+		}
+		candidates = append(candidates, candidate{m: m, down: down, load: load})
+	}
+	if len(candidates) == 0 {
+		if len(tried) > 0 {
+			return nil, fmt.Errorf("No other builder supports %s %v", d, archs)
+		}
+		return nil, fmt.Errorf("No builder supports %s %v", d, archs)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].down != candidates[j].down {
+			return candidates[j].down
+		}
+		return candidates[i].load < candidates[j].load
+	})
+	return candidates[0].m, nil
+}
+
+// submit submits a build to the best builder that accepts it. lastErr
+// is the failure of the previously tried builder, if any.
+func (p *BuilderPool) submit(args BuildArguments, tried map[*poolMember]bool, lastErr error, output io.Writer) (*poolMember, BuildJobID, error) {
+	for {
+		m, err := p.pick(args.Dist, args.Archs, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, 0, fmt.Errorf("%s. %s", lastErr, err)
+			}
+			return nil, 0, err
+		}
+		tried[m] = true
+		id, err := m.builder.SubmitBuild(args)
+		if err == nil {
+			// it may have been picked while down, as the last one
+			p.succeeded(m)
+			return m, id, nil
+		}
+		p.failed(m)
+		lastErr = fmt.Errorf("Builder `%s' failed: %s", m.name, err)
+		if output != nil {
+			fmt.Fprintf(output, "%s, trying another builder\n", lastErr)
+		}
+	}
+}
+
+// BuildPackage implements DebianBuilder. The build is retried on
+// another builder if its builder fails. If ctx is done, the job is
+// cancelled.
+func (p *BuilderPool) BuildPackage(ctx context.Context, args BuildArguments, output io.Writer) (*BuildResult, error) {
+	tried := make(map[*poolMember]bool)
+	var lastErr error
+	for {
+		m, id, err := p.submit(args, tried, lastErr, output)
+		if err != nil {
+			return nil, err
+		}
+		res, err := p.buildOn(ctx, m, id, args, output)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			p.succeeded(m)
+			return res, nil
+		}
+		if res != nil {
+			p.succeeded(m)
+			return nil, err
+		}
+		// res is only nil if the builder failed
+		p.failed(m)
+		m.builder.CancelJob(id)
+		lastErr = fmt.Errorf("Builder `%s' failed: %s", m.name, err)
+		if output != nil {
+			fmt.Fprintf(output, "%s, retrying on another builder\n", lastErr)
+		}
+	}
+}
+
+// buildOn follows job id of m until it finishes, and fetches its
+// result. The returned error is the build error if the job finished,
+// and a builder error otherwise. A result that cannot be fetched is
+// reported with an empty result, as the build must not be run again.
+func (p *BuilderPool) buildOn(ctx context.Context, m *poolMember, id BuildJobID, args BuildArguments, output io.Writer) (*BuildResult, error) {
+	p.setRunning(m, 1)
+	defer p.setRunning(m, -1)
+
+	var logData bytes.Buffer
+	w := io.Writer(&logData)
+	if output != nil {
+		w = io.MultiWriter(&logData, output)
+	}
+	job, err := m.builder.AttachJob(ctx, id, w)
+	if ctx.Err() != nil {
+		if cerr := m.builder.CancelJob(id); cerr != nil {
+			return nil, fmt.Errorf("%s, and could not cancel build job %d on `%s': %s", ctx.Err(), id, m.name, cerr)
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := job.Err(); err != nil {
+		// an empty result reports that the job finished
+		return &BuildResult{}, err
+	}
+	res := job.Result
+	if res == nil {
+		res = &BuildResult{}
+	} else if len(args.Dest) != 0 {
+		if res, err = p.fetchResult(m, id, args.Dest); err != nil {
+			return &BuildResult{}, fmt.Errorf("Build job %d succeeded on builder `%s', but its result could not be fetched, retry with attach: %s",
+				p.poolID(p.index(m), id), m.name, err)
+		}
+	}
+	res = p.result(m, id, res)
+	res.BuildLog = Log(logData.String())
+	return res, nil
+}
+
+// fetchResult fetches the result of job id of m, retrying on failures
+func (p *BuilderPool) fetchResult(m *poolMember, id BuildJobID, dest string) (*BuildResult, error) {
+	var err error
+	for i := 0; i < poolFetchRetries; i++ {
+		if i > 0 {
+			time.Sleep(poolFetchRetryDelay)
+		}
+		var res *BuildResult
+		if res, err = m.builder.FetchResult(id, dest); err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+// InitDistribution implements DebianBuilder, by initializing d-a on
+// every builder that does not support it yet
+func (p *BuilderPool) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return p.forEach(func(m *poolMember) error {
+		if supports(m, d, []deb.Architecture{a}) {
+			return nil
+		}
+		return m.builder.InitDistribution(ctx, d, a, output)
+	})
+}
+
+// RemoveDistribution implements DebianBuilder, by removing d-a from
+// every builder supporting it
+func (p *BuilderPool) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
+	return p.forEach(func(m *poolMember) error {
+		if supports(m, d, []deb.Architecture{a}) == false {
+			return nil
+		}
+		return m.builder.RemoveDistribution(d, a)
+	})
+}
+
+// UpdateDistribution implements DebianBuilder, by updating d-a on
+// every builder supporting it
+func (p *BuilderPool) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return p.forEach(func(m *poolMember) error {
+		if supports(m, d, []deb.Architecture{a}) == false {
+			return nil
+		}
+		return m.builder.UpdateDistribution(ctx, d, a, output)
+	})
+}
+
+// forEach runs f on every builder, and reports all their errors
+func (p *BuilderPool) forEach(f func(m *poolMember) error) error {
+	var errs []string
+	for _, m := range p.members {
+		if err := f(m); err != nil {
+			errs = append(errs, fmt.Sprintf("builder `%s': %s", m.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// AvailableDistributions implements DebianBuilder, it returns the
+// distributions supported by any builder
+func (p *BuilderPool) AvailableDistributions() []deb.Codename {
+	res := []deb.Codename{}
+	set := make(map[deb.Codename]bool)
+	for _, m := range p.members {
+		for _, d := range m.builder.AvailableDistributions() {
+			if set[d] {
+				continue
+			}
+			set[d] = true
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// AvailableArchitectures implements DebianBuilder, it returns the
+// architectures of d supported by any builder
+func (p *BuilderPool) AvailableArchitectures(d deb.Codename) ArchitectureList {
+	res := ArchitectureList{}
+	set := make(map[deb.Architecture]bool)
+	for _, m := range p.members {
+		for _, a := range m.builder.AvailableArchitectures(d) {
+			if set[a] {
+				continue
+			}
+			set[a] = true
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// SubmitBuild implements DebianBuilder
+func (p *BuilderPool) SubmitBuild(args BuildArguments) (BuildJobID, error) {
+	m, id, err := p.submit(args, make(map[*poolMember]bool), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	p.succeeded(m)
+	return p.poolID(p.index(m), id), nil
+}
+
+// ListJobs implements DebianBuilder. Builders that cannot be reached
+// are skipped.
+func (p *BuilderPool) ListJobs() ([]BuildJob, error) {
+	res := []BuildJob{}
+	for _, m := range p.members {
+		jobs, err := m.builder.ListJobs()
+		if err != nil {
+			p.failed(m)
+			continue
+		}
+		for _, j := range jobs {
+			res = append(res, *p.job(m, &j))
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Submitted.Before(res[j].Submitted)
+	})
+	return res, nil
+}
+
+// GetJob implements DebianBuilder
+func (p *BuilderPool) GetJob(id BuildJobID) (*BuildJob, error) {
+	m, mID := p.member(id)
+	j, err := m.builder.GetJob(mID)
+	if err != nil {
+		return nil, p.jobError(id, m, err)
+	}
+	return p.job(m, j), nil
+}
+
+// AttachJob implements DebianBuilder
+func (p *BuilderPool) AttachJob(ctx context.Context, id BuildJobID, output io.Writer) (*BuildJob, error) {
+	m, mID := p.member(id)
+	j, err := m.builder.AttachJob(ctx, mID, output)
+	if err != nil {
+		return nil, p.jobError(id, m, err)
+	}
+	return p.job(m, j), nil
+}
+
+// CancelJob implements DebianBuilder
+func (p *BuilderPool) CancelJob(id BuildJobID) error {
+	m, mID := p.member(id)
+	return p.jobError(id, m, m.builder.CancelJob(mID))
+}
+
+// FetchResult implements DebianBuilder
+func (p *BuilderPool) FetchResult(id BuildJobID, dest string) (*BuildResult, error) {
+	m, mID := p.member(id)
+	res, err := m.builder.FetchResult(mID, dest)
+	if err != nil {
+		return nil, p.jobError(id, m, err)
+	}
+	return p.result(m, mID, res), nil
+}
+
+// jobError reports an error of the builder running job id
+func (p *BuilderPool) jobError(id BuildJobID, m *poolMember, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("Build job %d on builder `%s': %s", id, m.name, err)
+}
+
+// offlineBuilder is a DebianBuilder that could not be reached. It
+// keeps its place in a BuilderPool, so the IDs of the jobs of the
+// other builders do not change.
+type offlineBuilder struct {
+	err error
+}
+
+func (b *offlineBuilder) BuildPackage(ctx context.Context, args BuildArguments, output io.Writer) (*BuildResult, error) {
+	return nil, b.err
+}
+
+func (b *offlineBuilder) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return b.err
+}
+
+func (b *offlineBuilder) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
+	return b.err
+}
+
+func (b *offlineBuilder) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return b.err
+}
+
+func (b *offlineBuilder) AvailableDistributions() []deb.Codename {
+	return nil
+}
+
+func (b *offlineBuilder) AvailableArchitectures(d deb.Codename) ArchitectureList {
+	return nil
+}
+
+func (b *offlineBuilder) SubmitBuild(args BuildArguments) (BuildJobID, error) {
+	return 0, b.err
+}
+
+func (b *offlineBuilder) ListJobs() ([]BuildJob, error) {
+	return nil, b.err
+}
+
+func (b *offlineBuilder) GetJob(id BuildJobID) (*BuildJob, error) {
+	return nil, b.err
+}
+
+func (b *offlineBuilder) AttachJob(ctx context.Context, id BuildJobID, output io.Writer) (*BuildJob, error) {
+	return nil, b.err
+}
+
+func (b *offlineBuilder) CancelJob(id BuildJobID) error {
+	return b.err
+}
+
+func (b *offlineBuilder) FetchResult(id BuildJobID, dest string) (*BuildResult, error) {
+	return nil, b.err
+}
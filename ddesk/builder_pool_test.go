@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+// unreachableBuilder advertises its distributions, but cannot be
+// reached to build
+type unreachableBuilder struct {
+	DebianBuilderStub
+}
+
+func (b *unreachableBuilder) SubmitBuild(args BuildArguments) (BuildJobID, error) {
+	return 0, fmt.Errorf("connection refused")
+}
+
+// unfetchableBuilder builds, but its results cannot be fetched
+type unfetchableBuilder struct {
+	DebianBuilderStub
+	fetches int
+}
+
+func (b *unfetchableBuilder) FetchResult(id BuildJobID, dest string) (*BuildResult, error) {
+	b.fetches++
+	return nil, fmt.Errorf("connection reset")
+}
+
+type BuilderPoolSuite struct {
+	a, b          *DebianBuilderStub
+	p             *BuilderPool
+	oldDelay      time.Duration
+	oldFetchDelay time.Duration
+}
+
+var _ = Suite(&BuilderPoolSuite{})
+
+func newPoolStub(archs ...deb.Architecture) *DebianBuilderStub {
+	return &DebianBuilderStub{
+		Res:         &BuildResult{ChangesPath: "foo_1.0-1_multi.changes"},
+		DistAndArch: map[deb.Codename][]deb.Architecture{"unstable": archs},
+	}
+}
+
+func (s *BuilderPoolSuite) SetUpTest(c *C) {
+	s.a = newPoolStub(deb.Amd64)
+	s.b = newPoolStub(deb.Amd64, "i386")
+	var err error
+	s.p, err = NewBuilderPool(map[string]DebianBuilder{"a": s.a, "b": s.b})
+	c.Assert(err, IsNil)
+	s.oldDelay = poolRetryDelay
+	s.oldFetchDelay = poolFetchRetryDelay
+	poolFetchRetryDelay = 0
+}
+
+func (s *BuilderPoolSuite) TearDownTest(c *C) {
+	poolRetryDelay = s.oldDelay
+	poolFetchRetryDelay = s.oldFetchDelay
+}
+
+func buildArgs(archs ...deb.Architecture) BuildArguments {
+	return BuildArguments{
+		SourcePackage: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{
+				Source: "foo",
+				Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+			},
+		},
+		Dist:  "unstable",
+		Archs: archs,
+	}
+}
+
+func (s *BuilderPoolSuite) TestNeedsBuilders(c *C) {
+	_, err := NewBuilderPool(nil)
+	c.Check(err, ErrorMatches, "A builder pool needs at least one builder")
+	c.Check(s.p.Builders(), DeepEquals, []string{"a", "b"})
+}
+
+func (s *BuilderPoolSuite) TestDispatchesByCapability(c *C) {
+	var out bytes.Buffer
+	res, err := s.p.BuildPackage(context.Background(), buildArgs(deb.Amd64, "i386"), &out)
+	c.Assert(err, IsNil)
+	c.Check(s.a.BuildCalled, Equals, false)
+	c.Check(s.b.BuildCalled, Equals, true)
+	c.Check(res.Builder, Equals, "b")
+	c.Check(res.JobID, Equals, BuildJobID(3))
+	c.Check(res.BuildLog, Equals, Log("Called BuildPackage\n"))
+	c.Check(out.String(), Equals, "Called BuildPackage\n")
+
+	_, err = s.p.BuildPackage(context.Background(), buildArgs("arm64"), nil)
+	c.Check(err, ErrorMatches, `No builder supports unstable \[arm64\]`)
+}
+
+func (s *BuilderPoolSuite) TestDispatchesByLoad(c *C) {
+	// equally loaded builders are used in names order
+	res, err := s.p.BuildPackage(context.Background(), buildArgs(deb.Amd64), nil)
+	c.Assert(err, IsNil)
+	c.Check(res.Builder, Equals, "a")
+
+	s.a.Jobs = append(s.a.Jobs, BuildJob{ID: 2, State: JobRunning})
+	res, err = s.p.BuildPackage(context.Background(), buildArgs(deb.Amd64), nil)
+	c.Assert(err, IsNil)
+	c.Check(res.Builder, Equals, "b")
+}
+
+func (s *BuilderPoolSuite) TestRetriesOnBuilderFailure(c *C) {
+	down := &unreachableBuilder{DebianBuilderStub: *newPoolStub(deb.Amd64)}
+	p, err := NewBuilderPool(map[string]DebianBuilder{"a": down, "b": s.b})
+	c.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	res, err := p.BuildPackage(context.Background(), buildArgs(deb.Amd64), &out)
+	c.Assert(err, IsNil)
+	c.Check(res.Builder, Equals, "b")
+	c.Check(out.String(), Equals, "Builder `a' failed: connection refused, trying another builder\nCalled BuildPackage\n")
+
+	// the failing builder is avoided, even if it is less loaded
+	s.b.Jobs = append(s.b.Jobs, BuildJob{ID: 2, State: JobRunning})
+	id, err := p.SubmitBuild(buildArgs(deb.Amd64))
+	c.Assert(err, IsNil)
+	c.Check(id, Equals, BuildJobID(7))
+
+	// until it is retried
+	poolRetryDelay = 0
+	_, err = p.SubmitBuild(buildArgs(deb.Amd64))
+	c.Check(err, IsNil)
+
+	p, err = NewBuilderPool(map[string]DebianBuilder{"a": down})
+	c.Assert(err, IsNil)
+	_, err = p.BuildPackage(context.Background(), buildArgs(deb.Amd64), nil)
+	c.Check(err, ErrorMatches, "Builder `a' failed: connection refused. No other builder supports unstable \\[amd64\\]")
+}
+
+func (s *BuilderPoolSuite) TestUnfetchableResultIsNotRebuilt(c *C) {
+	a := &unfetchableBuilder{DebianBuilderStub: *newPoolStub(deb.Amd64)}
+	p, err := NewBuilderPool(map[string]DebianBuilder{"a": a, "b": s.b})
+	c.Assert(err, IsNil)
+
+	args := buildArgs(deb.Amd64)
+	args.Dest = c.MkDir()
+	_, err = p.BuildPackage(context.Background(), args, nil)
+	c.Check(err, ErrorMatches, "Build job 2 succeeded on builder `a', but its result could not be fetched, retry with attach: connection reset")
+	c.Check(a.fetches, Equals, poolFetchRetries)
+	c.Check(a.BuildCalled, Equals, true)
+	c.Check(s.b.BuildCalled, Equals, false)
+
+	// the builder is not considered down
+	s.b.Jobs = append(s.b.Jobs, BuildJob{ID: 1, State: JobRunning})
+	id, err := p.SubmitBuild(buildArgs(deb.Amd64))
+	c.Assert(err, IsNil)
+	c.Check(id, Equals, BuildJobID(4))
+}
+
+func (s *BuilderPoolSuite) TestDownBuilderRecovers(c *C) {
+	p, err := NewBuilderPool(map[string]DebianBuilder{"a": s.a, "b": s.b})
+	c.Assert(err, IsNil)
+	p.failed(p.members[0])
+	p.failed(p.members[1])
+
+	// the last builder left is tried, and is up again once it accepts
+	// a build
+	_, err = p.SubmitBuild(buildArgs("i386"))
+	c.Assert(err, IsNil)
+	c.Check(time.Now().Before(p.members[1].downUntil), Equals, false)
+	c.Check(time.Now().Before(p.members[0].downUntil), Equals, true)
+}
+
+func (s *BuilderPoolSuite) TestFailedBuildIsNotRetried(c *C) {
+	s.a.Err = fmt.Errorf("dpkg-buildpackage failed")
+	_, err := s.p.BuildPackage(context.Background(), buildArgs(deb.Amd64), nil)
+	c.Check(err, ErrorMatches, "dpkg-buildpackage failed")
+	c.Check(s.a.BuildCalled, Equals, true)
+	c.Check(s.b.BuildCalled, Equals, false)
+}
+
+func (s *BuilderPoolSuite) TestJobs(c *C) {
+	idA, err := s.p.SubmitBuild(buildArgs(deb.Amd64))
+	c.Assert(err, IsNil)
+	idB, err := s.p.SubmitBuild(buildArgs("i386"))
+	c.Assert(err, IsNil)
+	c.Check(idA, Equals, BuildJobID(2))
+	c.Check(idB, Equals, BuildJobID(3))
+
+	jobs, err := s.p.ListJobs()
+	c.Assert(err, IsNil)
+	c.Assert(len(jobs), Equals, 2)
+	c.Check(jobs[0].ID, Equals, idA)
+	c.Check(jobs[1].ID, Equals, idB)
+
+	job, err := s.p.GetJob(idB)
+	c.Assert(err, IsNil)
+	c.Check(job.ID, Equals, idB)
+	c.Check(job.Args.Archs, DeepEquals, []deb.Architecture{"i386"})
+	c.Check(job.Result.Builder, Equals, "b")
+	c.Check(job.Result.JobID, Equals, idB)
+
+	var out bytes.Buffer
+	job, err = s.p.AttachJob(context.Background(), idA, &out)
+	c.Assert(err, IsNil)
+	c.Check(job.ID, Equals, idA)
+	c.Check(out.String(), Equals, "Called BuildPackage\n")
+
+	res, err := s.p.FetchResult(idA, "/tmp/result")
+	c.Assert(err, IsNil)
+	c.Check(res.BasePath, Equals, "/tmp/result")
+	c.Check(res.Builder, Equals, "a")
+
+	c.Check(s.p.CancelJob(idA), ErrorMatches, "Build job 2 on builder `a': Build job 1 is already succeeded")
+	_, err = s.p.GetJob(42)
+	c.Check(err, ErrorMatches, "Build job 42 on builder `a': No build job 21")
+}
+
+func (s *BuilderPoolSuite) TestDistributions(c *C) {
+	c.Check(s.p.AvailableDistributions(), DeepEquals, []deb.Codename{"unstable"})
+	c.Check(s.p.AvailableArchitectures("unstable"), DeepEquals, ArchitectureList{deb.Amd64, "i386"})
+
+	var out bytes.Buffer
+	c.Check(s.p.InitDistribution(context.Background(), "unstable", "i386", &out), IsNil)
+	c.Check(out.String(), Equals, "Called InitDistribution\n")
+	c.Check(s.a.AvailableArchitectures("unstable"), DeepEquals, ArchitectureList{deb.Amd64, "i386"})
+
+	out.Reset()
+	c.Check(s.p.UpdateDistribution(context.Background(), "unstable", deb.Amd64, &out), IsNil)
+	c.Check(out.String(), Equals, "Called UpdateDistribution\nCalled UpdateDistribution\n")
+
+	s.b.Err = fmt.Errorf("permission denied")
+	c.Check(s.p.RemoveDistribution("unstable", "i386"), ErrorMatches, "builder `b': permission denied")
+	c.Check(s.a.AvailableArchitectures("unstable"), DeepEquals, ArchitectureList{deb.Amd64})
+}
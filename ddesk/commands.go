@@ -1,18 +1,45 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
 	"os"
+	"os/signal"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	deb ".."
+	"../upload"
+	"github.com/nightlyone/lockfile"
 )
 
 // ServeBuilderCommand is a CLI command that will start a RpcBuilderServer
 type ServeBuilderCommand struct {
-	BasePath string `long:"basepath" short:"b" description:"basepath for the builder to run" default:"/var/lib/go-deb.ddesk"`
-	Socket   string `long:"socket" short:"s" description:"socket relative to basepath" default:"builder.sock"`
-	Type     string `long:"type" short:"t" description:"type of the builder" default:"cowbuilder"`
+	BasePath string        `long:"basepath" short:"b" description:"basepath for the builder to run" default:"/var/lib/go-deb.ddesk"`
+	Socket   string        `long:"socket" short:"s" description:"socket relative to basepath" default:"builder.sock"`
+	Group    string        `long:"socket-group" description:"group allowed to use the socket, the group of the builder process if empty. Its members can run builds as root"`
+	Type     string        `long:"type" short:"t" description:"type of the builder, cowbuilder, sbuild or unshare. unshare builders do not need root privileges, but a writable --basepath" default:"cowbuilder"`
+	Jobs     int           `long:"jobs" short:"j" description:"maximal number of concurrent build jobs, default to the number of CPUs"`
+	Timeout  time.Duration `long:"build-timeout" description:"abort builds running longer than this duration (e.g. 3h), no limit if zero"`
+	MaxAge   time.Duration `long:"job-max-age" description:"finished build jobs older than this duration are removed with their log and results, never if zero" default:"720h"`
+
+	Bootstrap string `long:"bootstrap" description:"for sbuild, tool creating the chroots, sbuild-createchroot or mmdebstrap" default:"sbuild-createchroot"`
+
+	CcacheSize     string        `long:"ccache-size" description:"for cowbuilder, maximal size of the compiler cache of each distribution and architecture" default:"5G"`
+	AptCacheMaxAge time.Duration `long:"apt-cache-max-age" description:"for cowbuilder, packages older than this duration are pruned from the apt cache, never if zero" default:"720h"`
+
+	Listen    string `long:"listen" description:"also serve remote clients on this TCP address (host:port), requires --tls-cert and --tls-key"`
+	TLSCert   string `long:"tls-cert" description:"certificate of the builder for TCP clients"`
+	TLSKey    string `long:"tls-key" description:"key of the builder certificate"`
+	ClientCA  string `long:"client-ca" description:"authenticates TCP clients by certificates signed by these authorities"`
+	TokenFile string `long:"token-file" description:"authenticates TCP clients by the token in this file"`
 }
 
 // Execute implements command
@@ -21,20 +48,64 @@ func (x *ServeBuilderCommand) Execute(args []string) error {
 		return fmt.Errorf("take no arguments")
 	}
 
-	if x.Type != "cowbuilder" {
-		return fmt.Errorf("Only --type=cowbuilder is supported")
-	}
-
 	// WARNING : do not create an intercator here. We could mess up
 	// with user settings. we should just wrap a builder with a RpcBuilder.
 
-	b, err := NewCowbuilder(x.BasePath)
+	var b BuilderBackend
+	var err error
+	switch x.Type {
+	case "cowbuilder":
+		var c *Cowbuilder
+		c, err = NewCowbuilder(x.BasePath, x.Jobs)
+		if err != nil {
+			return fmt.Errorf("Cowbuilder initialization error: %s", err)
+		}
+		if err = c.SetCacheLimits(x.CcacheSize, x.AptCacheMaxAge); err != nil {
+			return err
+		}
+		b = c
+	case "sbuild":
+		b, err = NewSbuild(x.BasePath, "/etc/schroot", x.Bootstrap, x.Jobs)
+		if err != nil {
+			return fmt.Errorf("Sbuild initialization error: %s", err)
+		}
+	case "unshare":
+		b, err = NewUnshareBuilder(x.BasePath, x.Jobs)
+		if err != nil {
+			return fmt.Errorf("Unshare builder initialization error: %s", err)
+		}
+	default:
+		return fmt.Errorf("Unsupported builder type `%s', supported are cowbuilder, sbuild and unshare", x.Type)
+	}
+
+	q, err := NewBuildQueue(b, path.Join(x.BasePath, "queue"), x.Jobs)
 	if err != nil {
-		return fmt.Errorf("Cowbuilder initialization error: %s", err)
+		return fmt.Errorf("Build queue initialization error: %s", err)
+	}
+	q.SetTimeout(x.Timeout)
+	q.SetMaxAge(x.MaxAge)
+	if _, err := q.PruneJobs(time.Now()); err != nil {
+		log.Printf("Could not prune build jobs: %s", err)
 	}
 
 	socketPath := path.Join(x.BasePath, x.Socket)
-	s := NewRpcBuilderServer(b, socketPath)
+	s := NewRpcBuilderServer(q, socketPath)
+	s.SetSocketGroup(x.Group)
+	if len(x.Listen) != 0 {
+		tlsConfig, err := NewServerTLSConfig(x.TLSCert, x.TLSKey, x.ClientCA)
+		if err != nil {
+			return err
+		}
+		var token string
+		if len(x.TokenFile) != 0 {
+			if token, err = ReadTokenFile(x.TokenFile); err != nil {
+				return err
+			}
+		}
+		if _, err := s.ListenTCP(x.Listen, tlsConfig, token); err != nil {
+			return fmt.Errorf("Could not listen on %s: %s", x.Listen, err)
+		}
+	}
 	// in any case we will remove the path
 
 	go func() {
@@ -47,6 +118,24 @@ func (x *ServeBuilderCommand) Execute(args []string) error {
 	return nil
 }
 
+// interruptibleContext returns a context done once the command is
+// interrupted by SIGINT or SIGTERM. A hangup does not cancel it, so a
+// build whose terminal is lost goes on in the builder.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
 // InitDistributionCommand is a CLI command that will init a
 // distribution for the current builder.
 type InitDistributionCommand struct {
@@ -65,7 +154,9 @@ func (x *InitDistributionCommand) Execute(args []string) error {
 		return err
 	}
 
-	res, err := i.AddDistributionSupport(deb.Codename(x.Dist),
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	res, err := i.AddDistributionSupport(ctx, deb.Codename(x.Dist),
 		deb.Architecture(x.Arch),
 		os.Stdout)
 	if err != nil {
@@ -160,14 +251,280 @@ func (x *UpdateDistCommand) Execute(args []string) error {
 		return err
 	}
 
-	return i.builder.UpdateDistribution(deb.Codename(x.Dist),
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	return i.builder.UpdateDistribution(ctx, deb.Codename(x.Dist),
 		deb.Architecture(x.Arch),
 		os.Stdout)
 }
 
+// builderPathOptions are the options of the subcommands working on
+// the files of a local builder
+type builderPathOptions struct {
+	BasePath string `long:"basepath" short:"b" description:"basepath of the local builder" default:"/var/lib/go-deb.ddesk"`
+}
+
+// BuilderConfigShowCommand is a CLI command that prints the
+// distribution configuration of a builder
+type BuilderConfigShowCommand struct {
+	builderPathOptions
+}
+
+// Execute implements command
+func (x *BuilderConfigShowCommand) Execute(args []string) error {
+	c, err := LoadBuilderConfig(x.BasePath)
+	if err != nil {
+		return err
+	}
+	dists := c.List()
+	if len(args) > 0 {
+		dists = nil
+		for _, d := range args {
+			dists = append(dists, deb.Codename(d))
+		}
+	}
+	for _, d := range dists {
+		dist, err := c.Distribution(d)
+		if err != nil {
+			return err
+		}
+		_, configured := c.Distributions[d]
+		fmt.Printf("%s (%s", d, dist.Vendor)
+		if configured {
+			fmt.Printf(", configured")
+		}
+		fmt.Printf(")\n")
+		fmt.Printf("  mirror: %s\n", dist.Mirror)
+		fmt.Printf("  components: %s\n", joinComponents(dist.Components, " "))
+		fmt.Printf("  keyring: %s\n", dist.Keyring)
+		if len(dist.DebootstrapOptions) != 0 {
+			fmt.Printf("  debootstrap options: %s\n", strings.Join(dist.DebootstrapOptions, " "))
+		}
+		if len(dist.AptProxy) != 0 {
+			fmt.Printf("  apt proxy: %s\n", dist.AptProxy)
+		}
+	}
+	return nil
+}
+
+// BuilderConfigSetCommand is a CLI command that configures a
+// distribution of a builder
+type BuilderConfigSetCommand struct {
+	builderPathOptions
+	Vendor             string   `long:"vendor" description:"vendor of the distribution, debian or ubuntu, required for unknown distributions"`
+	Mirror             string   `long:"mirror" description:"archive mirror, for example a local file:// mirror"`
+	Components         []string `long:"component" description:"component of the archive, can be repeated"`
+	Keyring            string   `long:"keyring" description:"keyring checking the mirror"`
+	DebootstrapOptions []string `long:"debootstrap-option" description:"extra option of debootstrap or mmdebstrap, can be repeated"`
+	AptProxy           string   `long:"apt-proxy" description:"HTTP proxy used by apt in the build environments"`
+}
+
+// Execute implements command
+func (x *BuilderConfigSetCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("builder-config set takes exactly one distribution argument")
+	}
+	c, err := LoadBuilderConfig(x.BasePath)
+	if err != nil {
+		return err
+	}
+	dist := DistributionConfig{
+		Vendor:             x.Vendor,
+		Mirror:             x.Mirror,
+		Keyring:            x.Keyring,
+		DebootstrapOptions: x.DebootstrapOptions,
+		AptProxy:           x.AptProxy,
+	}
+	for _, comp := range x.Components {
+		dist.Components = append(dist.Components, deb.Component(comp))
+	}
+	if err := c.Set(deb.Codename(args[0]), dist); err != nil {
+		return err
+	}
+	if err := c.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Configured %s, update-dist applies it to its existing images\n", args[0])
+	return nil
+}
+
+// BuilderConfigUnsetCommand is a CLI command that restores the
+// default configuration of a distribution of a builder
+type BuilderConfigUnsetCommand struct {
+	builderPathOptions
+}
+
+// Execute implements command
+func (x *BuilderConfigUnsetCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("builder-config unset takes exactly one distribution argument")
+	}
+	c, err := LoadBuilderConfig(x.BasePath)
+	if err != nil {
+		return err
+	}
+	if err := c.Unset(deb.Codename(args[0])); err != nil {
+		return err
+	}
+	return c.Save()
+}
+
+// HookAddCommand is a CLI command that registers a user hook in a
+// builder
+type HookAddCommand struct {
+	builderPathOptions
+	Stage string `long:"stage" description:"pbuilder stage the hook runs at: A before the build, B after a successful build, C after a failure, D before installing the build dependencies, E after unpacking the chroot, F before a login, I after copying the results" required:"true"`
+}
+
+// Execute implements command
+func (x *HookAddCommand) Execute(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("hook add takes exactly two arguments, the name of the hook and its script")
+	}
+	script, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	return NewHookRegistry(x.BasePath).Add(Hook{Name: args[0], Stage: x.Stage, Script: script})
+}
+
+// HookRemoveCommand is a CLI command that unregisters a user hook of a
+// builder
+type HookRemoveCommand struct {
+	builderPathOptions
+}
+
+// Execute implements command
+func (x *HookRemoveCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("hook remove takes exactly one argument, the name of the hook")
+	}
+	return NewHookRegistry(x.BasePath).Remove(args[0])
+}
+
+// HookListCommand is a CLI command that lists the user hooks of a
+// builder
+type HookListCommand struct {
+	builderPathOptions
+}
+
+// Execute implements command
+func (x *HookListCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("hook list takes no arguments")
+	}
+	hooks, err := NewHookRegistry(x.BasePath).List()
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		fmt.Printf("%s (stage %s)\n", h.Name, h.Stage)
+	}
+	return nil
+}
+
+// CacheStatsCommand is a CLI command that prints the usage of the
+// caches of a cowbuilder builder
+type CacheStatsCommand struct {
+	builderPathOptions
+}
+
+// Execute implements command
+func (x *CacheStatsCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("cache stats takes no arguments")
+	}
+	usage, err := NewBuildCache(path.Join(x.BasePath, "images")).Usage()
+	if err != nil {
+		return err
+	}
+	lineFormat := "%30s | %10s | %8s | %s\n"
+	fmt.Printf(lineFormat, "cache", "size", "files", "statistics")
+	fmt.Printf("--------------------------------------------------------------------------\n")
+	for _, u := range usage {
+		stats := ""
+		if u.Stats != nil {
+			stats = u.Stats.String()
+		}
+		fmt.Printf(lineFormat, u.Name, fmt.Sprintf("%.1fM", float64(u.Size)/(1024*1024)), strconv.Itoa(u.Files), stats)
+	}
+	return nil
+}
+
+// CacheClearCommand is a CLI command that empties the caches of a
+// cowbuilder builder
+type CacheClearCommand struct {
+	builderPathOptions
+	Ccache bool `long:"ccache" description:"only clear the compiler caches"`
+	Apt    bool `long:"apt" description:"only clear the apt cache"`
+}
+
+// Execute implements command
+func (x *CacheClearCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("cache clear takes no arguments")
+	}
+	// the caches are not cleared under running builds
+	lock, err := lockfile.New(path.Join(x.BasePath, "global.lock"))
+	if err != nil {
+		return err
+	}
+	if err := lock.TryLock(); err != nil {
+		return fmt.Errorf("Could not lock builder in %s, it should be stopped first: %s", x.BasePath, err)
+	}
+	defer lock.Unlock()
+
+	ccache, apt := x.Ccache, x.Apt
+	if ccache == false && apt == false {
+		ccache, apt = true, true
+	}
+	return NewBuildCache(path.Join(x.BasePath, "images")).Clear(ccache, apt)
+}
+
 // BuildCommand is a CLI command that triggers a binary build of a
 // deb.SourcePackage.
 type BuildCommand struct {
+	buildOptionsFlags
+	HostArch   string `long:"host-arch" description:"cross-build the architecture dependent packages for this architecture, like armel or arm64, in the build environment of the first supported architecture"`
+	Matrix     bool   `long:"matrix" description:"build the package for every supported distribution and architecture, concurrently, rewriting it for the other distributions than its own"`
+	Maintainer string `long:"maintainer" description:"with --matrix, maintainer of the changelog entries of the rewritten packages, as 'Name <email>', defaults to DEBFULLNAME and DEBEMAIL"`
+	LogDir     string `long:"log-dir" description:"with --matrix, directory of the build logs of each distribution, a new temporary directory by default"`
+}
+
+// buildOptionsFlags are the flags tuning the environment of a build
+type buildOptionsFlags struct {
+	NoCheck             bool     `long:"nocheck" description:"skip the tests of the package"`
+	Parallel            int      `long:"parallel" short:"j" description:"number of parallel jobs of the build"`
+	Profiles            []string `long:"profile" short:"P" description:"build profile, like nodoc or stage1, can be repeated"`
+	Env                 []string `long:"env" short:"e" description:"NAME=VALUE environment variable of the build, can be repeated"`
+	ExtraPackages       []string `long:"extra-package" description:"package to install in the build environment, can be repeated"`
+	Hooks               []string `long:"hook" description:"user hook registered in the builder to run during the build, can be repeated"`
+	Lintian             bool     `long:"lintian" description:"run lintian on the built packages, see the lint command"`
+	LintianFailOn       string   `long:"lintian-fail-on" description:"keep the packages out of the local repository if lintian reports tags of this severity or more: error, warning, info or pedantic. Implies --lintian"`
+	Autopkgtest         bool     `long:"autopkgtest" description:"run the autopkgtests of the package against the built packages, see the autopkgtest command"`
+	AutopkgtestBlocking bool     `long:"autopkgtest-blocking" description:"keep the packages out of the local repository if an autopkgtest fails. Implies --autopkgtest"`
+	VerifyReproducible  bool     `long:"verify-reproducible" description:"rebuild the package with a varied build path, umask, locale, time zone and clock, and report the files differing between both builds"`
+}
+
+// options returns the BuildOptions of the flags
+func (x *buildOptionsFlags) options() (BuildOptions, error) {
+	env, err := ParseBuildEnv(x.Env)
+	if err != nil {
+		return BuildOptions{}, err
+	}
+	return BuildOptions{
+		NoCheck:             x.NoCheck,
+		Parallel:            x.Parallel,
+		Profiles:            x.Profiles,
+		Env:                 env,
+		ExtraPackages:       x.ExtraPackages,
+		Hooks:               x.Hooks,
+		Lintian:             x.Lintian || len(x.LintianFailOn) != 0,
+		LintianFailOn:       x.LintianFailOn,
+		Autopkgtest:         x.Autopkgtest || x.AutopkgtestBlocking,
+		AutopkgtestBlocking: x.AutopkgtestBlocking,
+		VerifyReproducible:  x.VerifyReproducible,
+	}, nil
 }
 
 // Execute implements command
@@ -179,35 +536,653 @@ func (x *BuildCommand) Execute(args []string) error {
 	if err := deb.IsDscFileName(args[0]); err != nil {
 		return fmt.Errorf("Invalid argument %s: %s", args[0], err)
 	}
-	f, err := os.Open(args[0])
+	if x.Matrix && len(x.HostArch) != 0 {
+		return fmt.Errorf("--matrix and --host-arch are exclusive")
+	}
+	if x.Matrix == false && (len(x.Maintainer) != 0 || len(x.LogDir) != 0) {
+		return fmt.Errorf("--maintainer and --log-dir need --matrix")
+	}
+	opts, err := x.options()
 	if err != nil {
 		return err
 	}
-
 	i, err := NewInteractor(options)
 	if err != nil {
 		return err
 	}
+	dsc, err := readDsc(i, args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	if x.Matrix {
+		return x.buildMatrix(ctx, i, *dsc, opts)
+	}
+	var res *BuildResult
+	if len(x.HostArch) != 0 {
+		res, err = i.CrossBuildPackage(ctx, *dsc, deb.Architecture(x.HostArch), opts, os.Stdout)
+	} else {
+		res, err = i.BuildPackage(ctx, *dsc, opts, os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully build %s%s, final changes is: %s\n", res.Changes.Ref.Identifier, builtOn(res), path.Join(res.BasePath, res.ChangesPath))
+	printCacheStats(res)
+	printReproducibility(res)
+
+	return nil
+}
+
+// readDsc reads a .dsc file, which may be signed
+func readDsc(i *Interactor, filename string) (*deb.SourceControlFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
 	// we use a stub auth to remove the signature
 	cleared, err := i.auth.CheckAnyClearsigned(f)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	dsc, err := deb.ParseDsc(cleared)
+	if err != nil {
+		return nil, err
+	}
+
+	dsc.BasePath = path.Dir(filename)
+	return dsc, nil
+}
+
+// buildMatrix builds dsc for every supported distribution, and prints
+// the summary of the builds
+func (x *BuildCommand) buildMatrix(ctx context.Context, i *Interactor, dsc deb.SourceControlFile, opts BuildOptions) error {
+	// the maintainer is only needed to rewrite the package, the
+	// targets needing it fail without
+	maintainer, err := changelogMaintainer(x.Maintainer)
+	if err != nil && len(x.Maintainer) != 0 {
+		return err
+	}
+	logDir := x.LogDir
+	if len(logDir) == 0 {
+		logDir, err = ioutil.TempDir("", fmt.Sprintf("ddesk-matrix-%s_", dsc.Identifier))
+		if err != nil {
+			return err
+		}
+	}
+
+	targets, err := i.BuildMatrix(ctx, dsc, maintainer, opts, logDir, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	lineFormat := "%12s | %-20s | %-24s | %-9s | %s\n"
+	fmt.Printf(lineFormat, "distribution", "architectures", "version", "result", "log")
+	fmt.Printf("--------------------------------------------------------------------------------------------\n")
+	for _, t := range targets {
+		result := "succeeded"
+		if t.Err != nil {
+			result = "failed"
+			failed++
+		}
+		fmt.Printf(lineFormat, t.Dist, fmt.Sprint(t.Archs), t.Ref.Ver, result, t.LogPath)
+	}
+	for _, t := range targets {
+		if t.Err != nil {
+			fmt.Printf("%s: %s\n", t.Dist, t.Err)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d distributions failed", failed, len(targets))
+	}
+	return nil
+}
+
+// BuildSetCommand is a CLI command that builds a set of interdependent
+// source packages in the order of their build dependencies
+type BuildSetCommand struct {
+	buildOptionsFlags
+	KeepGoing bool `long:"keep-going" short:"k" description:"after a failure, go on with the packages that do not depend on the failed one, instead of stopping"`
+}
+
+// Execute implements command
+func (x *BuildSetCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("build-set takes the .dsc files to build as arguments")
+	}
+	for _, a := range args {
+		if err := deb.IsDscFileName(a); err != nil {
+			return fmt.Errorf("Invalid argument %s: %s", a, err)
+		}
+	}
+	opts, err := x.options()
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+	dscs := make([]deb.SourceControlFile, 0, len(args))
+	for _, a := range args {
+		dsc, err := readDsc(i, a)
+		if err != nil {
+			return fmt.Errorf("Could not read %s: %s", a, err)
+		}
+		dscs = append(dscs, *dsc)
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	items, err := i.BuildSet(ctx, dscs, x.KeepGoing, opts, os.Stdout)
+	if err != nil && items == nil {
+		return err
+	}
+
+	failed := 0
+	lineFormat := "%5s | %-40s | %-9s | %s\n"
+	fmt.Printf(lineFormat, "layer", "source package", "result", "")
+	fmt.Printf("--------------------------------------------------------------------------\n")
+	for _, item := range items {
+		var result, details string
+		switch {
+		case item.Err == nil:
+			result = "succeeded"
+			details = path.Join(item.Result.BasePath, item.Result.ChangesPath)
+		case item.Skipped:
+			result, details = "skipped", item.Err.Error()
+			failed++
+		default:
+			result, details = "failed", item.Err.Error()
+			failed++
+		}
+		fmt.Printf(lineFormat, strconv.Itoa(item.Layer), item.Source, result, details)
+	}
+	if err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d source packages were not built", failed, len(items))
+	}
+	return nil
+}
+
+// BuildGitCommand is a CLI command that builds the HEAD commit of a
+// Debianized git repository.
+type BuildGitCommand struct {
+	buildOptionsFlags
+}
+
+// Execute implements command
+func (x *BuildGitCommand) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("build-git takes at most one argument, the path of the git repository")
+	}
+	repoPath := "."
+	if len(args) == 1 {
+		repoPath = args[0]
+	}
+	opts, err := x.options()
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	res, err := i.BuildDebianizedGit(ctx, repoPath, opts, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully build %s from commit %s%s, final changes is: %s\n", res.Changes.Ref.Identifier, res.GitCommit, builtOn(res), path.Join(res.BasePath, res.ChangesPath))
+	printCacheStats(res)
+	printReproducibility(res)
+
+	return nil
+}
+
+// LintCommand is a CLI command that prints the lintian tags of the
+// last build of a source package
+type LintCommand struct {
+	Severity string `long:"severity" description:"only print the tags of this severity or more: error, warning, info or pedantic"`
+}
+
+// parseSourceRef parses a source package reference, like
+// foo_1.0-1
+func parseSourceRef(s string) (*deb.SourcePackageRef, error) {
+	fields := strings.SplitN(s, "_", 2)
+	if len(fields) != 2 || len(fields[0]) == 0 {
+		return nil, fmt.Errorf("Invalid source package reference `%s', expected source_version", s)
+	}
+	v, err := deb.ParseVersion(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid version in `%s': %s", s, err)
+	}
+	return &deb.SourcePackageRef{Source: fields[0], Ver: *v}, nil
+}
+
+// Execute implements command
+func (x *LintCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("lint takes exactly one argument, the source_version of the package")
+	}
+	ref, err := parseSourceRef(args[0])
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+	res, err := i.GetBuildResult(*ref)
+	if err != nil {
+		return err
+	}
+	if res.Options.Lintian == false {
+		return fmt.Errorf("Lintian did not run on the build of %s, it runs with build --lintian", ref)
+	}
+
+	tags := res.Lintian
+	if len(x.Severity) != 0 {
+		if lintianSeverityRank(x.Severity) < 0 {
+			return fmt.Errorf("Invalid lintian severity `%s', supported are %s", x.Severity, strings.Join(LintianFailSeverities, ", "))
+		}
+		tags = lintianFailures(tags, x.Severity)
+	}
+	for _, t := range tags {
+		fmt.Println(t)
+	}
+	return nil
+}
+
+// AutopkgtestCommand is a CLI command that prints the autopkgtest
+// results of the last build of a source package
+type AutopkgtestCommand struct{}
+
+// Execute implements command
+func (x *AutopkgtestCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("autopkgtest takes exactly one argument, the source_version of the package")
+	}
+	ref, err := parseSourceRef(args[0])
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+	res, err := i.GetBuildResult(*ref)
+	if err != nil {
+		return err
+	}
+	if res.Options.Autopkgtest == false {
+		return fmt.Errorf("Autopkgtests did not run on the build of %s, they run with build --autopkgtest", ref)
+	}
+	if len(res.Autopkgtest) == 0 {
+		fmt.Printf("%s has no autopkgtests\n", ref)
+	}
+	for _, r := range res.Autopkgtest {
+		fmt.Println(r)
+	}
+	return nil
+}
+
+// BinNMUCommand is a CLI command that makes a binary-only rebuild of
+// an archived source package
+type BinNMUCommand struct {
+	buildOptionsFlags
+	Reason     string `long:"reason" description:"reason of the rebuild, used as its changelog entry" required:"true"`
+	Maintainer string `long:"maintainer" description:"maintainer of the changelog entry, as 'Name <email>', defaults to DEBFULLNAME and DEBEMAIL"`
+}
+
+// Execute implements command
+func (x *BinNMUCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("binnmu takes exactly one argument, the source_version of the package")
+	}
+	ref, err := parseSourceRef(args[0])
+	if err != nil {
+		return err
+	}
+	opts, err := x.options()
+	if err != nil {
+		return err
+	}
+	maintainer, err := changelogMaintainer(x.Maintainer)
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	res, err := i.BinNMU(ctx, *ref, x.Reason, maintainer, opts, os.Stdout)
 	if err != nil {
 		return err
 	}
 
-	dsc.BasePath = path.Dir(args[0])
+	fmt.Printf("Successfully build binNMU %s of %s%s, final changes is: %s\n", res.Changes.Ref.Identifier, ref, builtOn(res), path.Join(res.BasePath, res.ChangesPath))
+	printCacheStats(res)
+	printReproducibility(res)
+
+	return nil
+}
+
+// BackportCommand is a CLI command that backports a deb.SourcePackage
+// to another distribution and builds it
+type BackportCommand struct {
+	buildOptionsFlags
+	To         string `long:"to" description:"distribution to backport the package to" required:"true"`
+	Maintainer string `long:"maintainer" description:"maintainer of the changelog entry, as 'Name <email>', defaults to DEBFULLNAME and DEBEMAIL"`
+}
+
+// changelogMaintainer returns the maintainer given as flag, or the
+// default one
+func changelogMaintainer(flag string) (*mail.Address, error) {
+	if len(flag) != 0 {
+		maintainer, err := mail.ParseAddress(flag)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maintainer `%s': %s", flag, err)
+		}
+		return maintainer, nil
+	}
+	maintainer, err := DefaultMaintainer()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the maintainer of the changelog entry, set it with --maintainer: %s", err)
+	}
+	return maintainer, nil
+}
+
+// Execute implements command
+func (x *BackportCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("backport takes exactly one argument, the .dsc to backport")
+	}
+
+	if err := deb.IsDscFileName(args[0]); err != nil {
+		return fmt.Errorf("Invalid argument %s: %s", args[0], err)
+	}
+	opts, err := x.options()
+	if err != nil {
+		return err
+	}
+	maintainer, err := changelogMaintainer(x.Maintainer)
+	if err != nil {
+		return err
+	}
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+	dsc, err := readDsc(i, args[0])
+	if err != nil {
+		return err
+	}
 
-	res, err := i.BuildPackage(*dsc, os.Stdout)
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	res, err := i.BackportPackage(ctx, *dsc, deb.Codename(x.To), maintainer, opts, os.Stdout)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Successfully build %s, final changes is: %s\n", res.Changes.Ref.Identifier, path.Join(res.BasePath, res.ChangesPath))
+	fmt.Printf("Successfully build backport %s%s, final changes is: %s\n", res.Changes.Ref.Identifier, builtOn(res), path.Join(res.BasePath, res.ChangesPath))
+	printCacheStats(res)
+	printReproducibility(res)
+
+	return nil
+}
 
+// BackportsCommand is a CLI command that lists the backports of a
+// source package
+type BackportsCommand struct{}
+
+// Execute implements command
+func (x *BackportsCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("backports takes exactly one argument, the name of the source package")
+	}
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+	for _, b := range i.Backports(args[0]) {
+		fmt.Println(b)
+	}
+	return nil
+}
+
+// printCacheStats prints the compiler cache statistics of res, if any
+func printCacheStats(res *BuildResult) {
+	if res.CacheStats != nil {
+		fmt.Printf("Compiler cache: %s\n", res.CacheStats)
+	}
+}
+
+// printReproducibility prints the reproducibility verdict of res, and
+// the differing files, if the build was verified
+func printReproducibility(res *BuildResult) {
+	r := res.Reproducibility
+	if r == nil {
+		return
+	}
+	fmt.Printf("Reproducibility: %s\n", r)
+	for _, f := range r.Missing {
+		fmt.Printf("  %s: built only once\n", f)
+	}
+	files := make([]string, 0, len(r.Differences))
+	for f := range r.Differences {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		for _, d := range r.Differences[f] {
+			fmt.Printf("  %s: %s\n", f, d)
+		}
+	}
+	if len(r.BuildDependencies) != 0 {
+		fmt.Printf("  build dependencies changed between the builds: %s\n", strings.Join(r.BuildDependencies, " "))
+	}
+}
+
+// builtOn describes the builder of a pool that built res, if any
+func builtOn(res *BuildResult) string {
+	if len(res.Builder) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" on %s", res.Builder)
+}
+
+// JobsCommand is a CLI command that lists the jobs of the builder
+type JobsCommand struct {
+	All bool `long:"all" short:"a" description:"Also list finished jobs"`
+}
+
+// Execute implements command
+func (x *JobsCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("jobs takes no arguments")
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := i.ListBuildJobs()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if j.State.Finished() && x.All == false {
+			continue
+		}
+		state := string(j.State)
+		if j.CancelRequested && j.State == JobRunning {
+			state = "cancelling"
+		}
+		fmt.Printf("%4d %-10s %s %s %v, submitted %s\n", j.ID, state,
+			j.Args.SourcePackage.Identifier, j.Args.Dist, j.Args.Archs,
+			j.Submitted.Format(time.RFC1123))
+	}
+	return nil
+}
+
+func parseJobID(command string, args []string) (BuildJobID, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("%s takes exactly one argument, the job ID", command)
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid job ID `%s'", args[0])
+	}
+	return BuildJobID(id), nil
+}
+
+// AttachCommand is a CLI command that follows the log of a builder
+// job until it finishes.
+type AttachCommand struct {
+}
+
+// Execute implements command
+func (x *AttachCommand) Execute(args []string) error {
+	id, err := parseJobID("attach", args)
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+
+	// interrupting only detaches from the job
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	job, err := i.AttachBuildJob(ctx, id, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if err := job.Err(); err != nil {
+		return err
+	}
+	res := job.Result
+	fmt.Printf("Successfully build %s%s, final changes is: %s\n", res.Changes.Ref.Identifier, builtOn(res), path.Join(res.BasePath, res.ChangesPath))
+	printCacheStats(res)
+	return nil
+}
+
+// CancelCommand is a CLI command that cancels a builder job
+type CancelCommand struct {
+}
+
+// Execute implements command
+func (x *CancelCommand) Execute(args []string) error {
+	id, err := parseJobID("cancel", args)
+	if err != nil {
+		return err
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+
+	return i.CancelBuildJob(id)
+}
+
+// SearchFileCommand is a CLI command that looks up which packages of
+// the local repository ship a file.
+type SearchFileCommand struct {
+	Dists []string `long:"dist" short:"D" description:"Distribution(s) to search, default to all user supported distributions"`
+}
+
+// Execute implements command
+func (x *SearchFileCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("search-file takes exactly one argument, the path to search")
+	}
+
+	i, err := NewInteractor(options)
+	if err != nil {
+		return err
+	}
+
+	dists := make([]deb.Codename, 0, len(x.Dists))
+	for _, d := range x.Dists {
+		dists = append(dists, deb.Codename(d))
+	}
+
+	results, err := i.SearchFile(args[0], dists)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Printf("No package of the local repository ships %s\n", args[0])
+		return nil
+	}
+
+	for _, r := range results {
+		fmt.Printf("%s-%s: /%s: %s\n", r.Dist, r.Arch, r.Path, strings.Join(r.Locations, ", "))
+	}
+	return nil
+}
+
+// UploadCommand is a CLI command that uploads a .changes file to a
+// host defined in dput.cf or dupload.conf.
+type UploadCommand struct {
+	Force bool `long:"force" short:"f" description:"Upload even if the upload log records a previous upload to this host"`
+}
+
+// Execute implements command
+func (x *UploadCommand) Execute(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("upload takes one or two arguments, an optional host and the .changes to upload")
+	}
+	host := ""
+	changesPath := args[len(args)-1]
+	if len(args) == 2 {
+		host = args[0]
+	}
+
+	conf, err := upload.LoadConfig(os.Getenv("HOME"))
+	if err != nil {
+		return err
+	}
+	h, err := conf.Host(host)
+	if err != nil {
+		return err
+	}
+	u, err := upload.NewUploader(h)
+	if err != nil {
+		return err
+	}
+	u.Force = x.Force
+
+	if err = u.Upload(changesPath, os.Stdout); err != nil {
+		return err
+	}
+	fmt.Printf("Successfully uploaded %s to %s\n", path.Base(changesPath), h.Name)
 	return nil
 }
 
@@ -252,9 +1227,116 @@ func init() {
 
 	parser.AddCommand("build",
 		"Builds a .dsc file",
-		"build will start a build for all architecture the user supports given a .dsc file. Distribution will be infered from the debian/changelog",
+		"build will start a build for all architecture the user supports given a .dsc file. Distribution will be infered from the debian/changelog, or with --matrix the package is built for all the distributions the user supports",
 		&BuildCommand{})
 
+	parser.AddCommand("jobs",
+		"Lists the builder jobs",
+		"Lists the queued and running jobs of the builder. Builds go on when their client is interrupted, and can be followed again with attach.",
+		&JobsCommand{})
+
+	parser.AddCommand("attach",
+		"Follows a builder job",
+		"Prints the log of a builder job until it finishes. If the build succeeded and its result was not archived, it is archived and included in the local repository like build does.",
+		&AttachCommand{})
+
+	parser.AddCommand("cancel",
+		"Cancels a builder job",
+		"Cancels a queued or running builder job",
+		&CancelCommand{})
+
+	parser.AddCommand("build-set",
+		"Builds a set of interdependent .dsc files",
+		"Builds .dsc files in the order of their build dependencies on the binary packages of each other. The packages are built in layers, concurrently within a layer, and each built package is included in the local repository for the next layers. By default the build stops after a failed layer.",
+		&BuildSetCommand{})
+
+	parser.AddCommand("build-git",
+		"Builds a Debianized git repository",
+		"build-git generates the source package of the HEAD commit of a Debianized git repository, the current directory by default, and builds it like build does. The orig tarball is taken from the parent directory, the pristine-tar branch, an upstream tag, or HEAD without its debian directory.",
+		&BuildGitCommand{})
+
+	parser.AddCommand("search-file",
+		"Search packages shipping a file",
+		"Search which packages of the local repository ship the given path, using its Contents indices",
+		&SearchFileCommand{})
+
+	parser.AddCommand("upload",
+		"Upload a .changes file",
+		"Uploads a .changes file and the files it lists to a host defined in ~/.dput.cf, /etc/dput.cf or their dupload.conf equivalents. Without host, the default one is used.",
+		&UploadCommand{})
+
+	configCmd, _ := parser.AddCommand("builder-config",
+		"Configures the distributions of a builder",
+		"Configures the mirror, components, keyring, debootstrap options and apt proxy used by a builder to create the images of each distribution. It edits the configuration in the basepath of a local builder, which uses it for the next created or updated images.",
+		&struct{}{})
+	configCmd.AddCommand("show",
+		"Shows the distribution configuration",
+		"Shows the configuration of the given distributions, or of all known and configured ones",
+		&BuilderConfigShowCommand{})
+	configCmd.AddCommand("set",
+		"Configures a distribution",
+		"Replaces the configuration of a distribution, unset fields take the defaults of its vendor",
+		&BuilderConfigSetCommand{})
+	configCmd.AddCommand("unset",
+		"Restores the default configuration of a distribution",
+		"Removes the configuration of a distribution, known distributions are then built from the official mirrors of their vendor",
+		&BuilderConfigUnsetCommand{})
+
+	parser.AddCommand("lint",
+		"Prints the lintian tags of a build",
+		"Prints the lintian tags of the last build of a source package, given as source_version, built with build --lintian",
+		&LintCommand{})
+
+	parser.AddCommand("autopkgtest",
+		"Prints the autopkgtest results of a build",
+		"Prints the autopkgtest results of the last build of a source package, given as source_version, built with build --autopkgtest",
+		&AutopkgtestCommand{})
+
+	parser.AddCommand("binnmu",
+		"Makes a binary-only rebuild of a source package",
+		"Rebuilds the architecture dependent packages of an archived source package, given as source_version, with a binNMU changelog entry. Their version is suffixed by +bN, and they are archived as a distinct build of the source.",
+		&BinNMUCommand{})
+
+	parser.AddCommand("backport",
+		"Backports a source package to another distribution",
+		"Rewrites a .dsc for the distribution given with --to, and builds it. The version of the backport is suffixed by ~bpoN+M for Debian distributions, by ~<codename>M otherwise, and a changelog entry targets the distribution.",
+		&BackportCommand{})
+
+	parser.AddCommand("backports",
+		"Lists the backports of a source package",
+		"Lists the successful backports of a source package, given by name, most recent first",
+		&BackportsCommand{})
+
+	hookCmd, _ := parser.AddCommand("hook",
+		"Manages the user hooks of a builder",
+		"Manages the user pbuilder hooks of a local cowbuilder builder. Builds select them with build --hook, their output is prefixed by their name in the build log.",
+		&struct{}{})
+	hookCmd.AddCommand("add",
+		"Registers a hook",
+		"Registers a script as a hook with the given name, replacing the hook of the same name, if any",
+		&HookAddCommand{})
+	hookCmd.AddCommand("remove",
+		"Unregisters a hook",
+		"Unregisters a hook",
+		&HookRemoveCommand{})
+	hookCmd.AddCommand("list",
+		"Lists the hooks",
+		"Lists the registered hooks and their stage",
+		&HookListCommand{})
+
+	cacheCmd, _ := parser.AddCommand("cache",
+		"Manages the caches of a builder",
+		"Manages the compiler and apt caches of a local cowbuilder builder",
+		&struct{}{})
+	cacheCmd.AddCommand("stats",
+		"Shows the usage of the caches",
+		"Shows the size of the apt cache, and the size and hit rate of the compiler cache of each distribution and architecture",
+		&CacheStatsCommand{})
+	cacheCmd.AddCommand("clear",
+		"Empties the caches",
+		"Empties the compiler and apt caches, or only one of them. The builder must be stopped.",
+		&CacheClearCommand{})
+
 	parser.AddCommand("install",
 		"Install necessary files to the system",
 		"Installs all necessary files to the system, likes package dependency, groups, and services",
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+
+	deb ".."
+)
+
+// DebContents is the list of files shipped by a binary package.
+type DebContents struct {
+	Package string
+	Section string
+	Arch    deb.Architecture
+	Files   []string
+}
+
+// Location returns the location of the package in a
+// deb.ContentsIndex.
+func (c *DebContents) Location() string {
+	return deb.ContentsLocation(c.Section, c.Package)
+}
+
+// ReadDebContents lists the files shipped by a .deb archive, using
+// dpkg-deb to extract its control fields and its data tarball.
+func ReadDebContents(debPath string) (*DebContents, error) {
+	var fields, stderr bytes.Buffer
+	cmd := exec.Command("dpkg-deb", "-f", debPath, "Package", "Section", "Architecture")
+	cmd.Stdin = nil
+	cmd.Stdout = &fields
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Could not read control fields of %s:\n%s", debPath, stderr.String())
+	}
+
+	res := &DebContents{}
+	l := deb.NewControlFileLexer(&fields)
+	for {
+		f, err := l.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse control fields of %s: %s", debPath, err)
+		}
+		if deb.IsNewParagraph(f) || len(f.Data) != 1 {
+			continue
+		}
+		switch f.Name {
+		case "Package":
+			res.Package = f.Data[0]
+		case "Section":
+			res.Section = f.Data[0]
+		case "Architecture":
+			res.Arch = deb.Architecture(f.Data[0])
+		}
+	}
+	if len(res.Package) == 0 {
+		return nil, fmt.Errorf("%s has no Package: field", debPath)
+	}
+
+	stderr.Reset()
+	cmd = exec.Command("dpkg-deb", "--fsys-tarfile", debPath)
+	cmd.Stdin = nil
+	cmd.Stderr = &stderr
+	data, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(data)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cmd.Wait()
+			return nil, fmt.Errorf("Could not read data of %s: %s", debPath, err)
+		}
+		// Contents indices do not list directories
+		if h.Typeflag == tar.TypeDir {
+			continue
+		}
+		res.Files = append(res.Files, path.Clean("/" + h.Name)[1:])
+	}
+
+	if err = cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("Could not extract data of %s:\n%s", debPath, stderr.String())
+	}
+
+	return res, nil
+}
+
+// AddDebToContents adds the files shipped by a .deb to the
+// deb.ContentsIndex of each architecture it is installable on. An
+// architecture independent package is added to all indices.
+func AddDebToContents(c *DebContents, indices map[deb.Architecture]deb.ContentsIndex) {
+	for a, idx := range indices {
+		if c.Arch != deb.All && c.Arch != a {
+			continue
+		}
+		idx.Add(c.Location(), c.Files...)
+	}
+}
+
+func init() {
+	aptDepTracker.Add("dpkg")
+}
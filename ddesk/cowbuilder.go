@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,8 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	deb ".."
 	"github.com/nightlyone/lockfile"
@@ -20,27 +23,38 @@ import (
 // Cowbuilder is a DebianBuilder based on the cowbuilder utility. As
 // it put the entire system on a minimal chroot it works only in
 // debian-based system and needs root priviliges.
+//
+// Builds of different packages, and of the different architectures
+// of a package, run concurrently. Each cowbuilder run has its own
+// job directory for its configuration, hooks, build place and
+// results.
 type Cowbuilder struct {
 	basepath  string
 	imagepath string
-	hookspath string
+	jobspath  string
 	confpath  string
 
 	lock lockfile.Lockfile
 
 	supported ArchitectureList
 
-	keepEnv     []string
-	debianDists []string
-	ubuntuDists []string
-	semaphore   chan bool
+	keepEnv []string
+
+	scheduler *buildScheduler
+	cache     *BuildCache
+	hooks     *HookRegistry
+	// images beeing created, that are not available yet
+	creating      map[string]bool
+	creatingMutex sync.Mutex
 }
 
 // NewCowbuilder initialize a new Cowbuilder with chroot locaed in
-// basepath.
-func NewCowbuilder(basepath string) (*Cowbuilder, error) {
+// basepath, running at most maxJobs cowbuilder jobs at the same
+// time. If maxJobs is not positive, it is the number of CPUs.
+func NewCowbuilder(basepath string, maxJobs int) (*Cowbuilder, error) {
 	res := &Cowbuilder{
 		basepath: basepath,
+		creating: make(map[string]bool),
 	}
 	err := os.MkdirAll(basepath, 0755)
 	if err != nil {
@@ -58,12 +72,16 @@ func NewCowbuilder(basepath string) (*Cowbuilder, error) {
 	}
 	runtime.SetFinalizer(res, res.lock.Unlock())
 
-	res.semaphore = make(chan bool, 1)
-	res.release()
+	if maxJobs <= 0 {
+		maxJobs = runtime.NumCPU()
+	}
+	res.scheduler = newBuildScheduler(maxJobs)
 
 	res.imagepath = path.Join(res.basepath, "images")
-	res.hookspath = path.Join(res.basepath, "hooks")
+	res.jobspath = path.Join(res.basepath, "jobs")
 	res.confpath = path.Join(res.basepath, ".pbuilderrc")
+	res.cache = NewBuildCache(res.imagepath)
+	res.hooks = NewHookRegistry(res.basepath)
 
 	//check path
 	if _, err := os.Stat(res.confpath); err != nil {
@@ -81,7 +99,7 @@ func NewCowbuilder(basepath string) (*Cowbuilder, error) {
 		return nil, err
 	}
 
-	err = os.MkdirAll(res.hookspath, 0755)
+	err = os.MkdirAll(res.jobspath, 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -90,11 +108,6 @@ func NewCowbuilder(basepath string) (*Cowbuilder, error) {
 
 	res.keepEnv = []string{"PATH"}
 
-	res.ubuntuDists = []string{"lucid", "maverick", "natty", "oneiric", "precise",
-		"quantal", "raring", "saucy", "trusty", "utopic", "vivid"}
-	res.debianDists = []string{"sid", "squeeze", "wheezy", "jessie", "stretch",
-		"buster", "unstable", "testing", "stable"}
-
 	return res, nil
 }
 
@@ -110,224 +123,312 @@ func (b *Cowbuilder) maskedEnviron() []string {
 	return res
 }
 
-// BuildPackage builds a deb.SourcePackageRef package. if an io.Writer
-// is passed, all the current output of cowbuilder will be copied to
-// it.
-func (b *Cowbuilder) BuildPackage(a BuildArguments, output io.Writer) (*BuildResult, error) {
-	b.acquire()
-	defer b.release()
-
-	//checks we supports everything
-	supported := b.getAllImages()
-	for _, targetArch := range a.Archs {
-		found := false
-		for _, aArch := range supported[a.Dist] {
-			if targetArch == aArch {
-				found = true
-				break
-			}
-		}
-		if found == false {
-			return nil, fmt.Errorf("Distribution %s-%s is not supported", a.Dist, targetArch)
-		}
-	}
+// cowbuilderJob is the private directory of a cowbuilder run, so
+// that concurrent runs do not share their configuration, hooks and
+// build place.
+type cowbuilderJob struct {
+	dir string
+}
 
-	//checks that the input exists
-	dscFile := path.Join(a.SourcePackage.BasePath, a.SourcePackage.Filename())
-	if _, err := os.Stat(dscFile); err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("Expected file %s, does not exists", dscFile)
+func (b *Cowbuilder) newJob(d deb.Codename, a deb.Architecture) (*cowbuilderJob, error) {
+	dir, err := ioutil.TempDir(b.jobspath, fmt.Sprintf("%s-%s_", d, a))
+	if err != nil {
+		return nil, err
+	}
+	res := &cowbuilderJob{dir: dir}
+	for _, d := range []string{res.hooksPath(), res.buildPath(), res.resultPath()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("Could not check existence of %s: %s", dscFile, err)
 	}
+	return res, nil
+}
 
-	// ensure that destination directory exists
-	if err := os.MkdirAll(a.Dest, 0755); err != nil {
-		return nil, err
+func (j *cowbuilderJob) confPath() string {
+	return path.Join(j.dir, "pbuilderrc")
+}
+
+// appendConfig appends lines to the configuration of the job
+func (j *cowbuilderJob) appendConfig(lines string) error {
+	f, err := os.OpenFile(j.confPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
 	}
+	_, err = f.WriteString(lines)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
-	// creates output buffers and result structures
-	var buf bytes.Buffer
-	changesFiles := []string{}
-	var writer io.Writer = &buf
-	if output != nil {
-		writer = io.MultiWriter(&buf, output)
+func (j *cowbuilderJob) hooksPath() string {
+	return path.Join(j.dir, "hooks")
+}
+
+func (j *cowbuilderJob) buildPath() string {
+	return path.Join(j.dir, "build")
+}
+
+func (j *cowbuilderJob) resultPath() string {
+	return path.Join(j.dir, "result")
+}
+
+// autopkgtestPath is the directory of the autopkgtest script and
+// summary
+func (j *cowbuilderJob) autopkgtestPath() string {
+	return path.Join(j.dir, "autopkgtest")
+}
+
+// Clean removes the job directory. The build place is only removed if
+// empty, as an interrupted cowbuilder could leave bind mounts in it.
+func (j *cowbuilderJob) Clean() error {
+	for _, d := range []string{j.confPath(), j.hooksPath(), j.resultPath(), j.autopkgtestPath()} {
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(j.buildPath()); err != nil && os.IsNotExist(err) == false {
+		return fmt.Errorf("Could not remove build place %s: %s", j.buildPath(), err)
 	}
+	return os.Remove(j.dir)
+}
 
-	var lastBuildArch deb.Architecture
-	for i, arch := range a.Archs {
-		debbuildopts := []string{}
-		//only the last will build architecture-independent package
-		var cmd *exec.Cmd
-		var err error
-		if i == len(a.Archs)-1 {
-			debbuildopts = append(debbuildopts, "-b")
-		} else {
-			//if it produce only arch indep package we skip the build
-			skip := true
-			for _, targetArch := range a.SourcePackage.Archs {
-				if targetArch == deb.Any {
-					skip = false
-					break
-				}
-				if targetArch == arch {
-					skip = false
-					break
-				}
-			}
-			if skip == true {
-				fmt.Fprintf(writer, "Skiping build for %s, as it will produce no package\n", arch)
-				continue
+// buildArch runs the build of a package for one architecture, and
+// moves its results to the destination directory.
+func (b *Cowbuilder) buildArch(ctx context.Context, a BuildArguments, ab *archBuild, dscFile string, output io.Writer) error {
+	job, err := b.newJob(a.Dist, ab.arch)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			// cowbuilder may have been killed before removing its
+			// build place
+			if err := cleanBuildPlace(job.buildPath()); err != nil {
+				log.Printf("Could not clean build place %s: %s", job.buildPath(), err)
 			}
-			debbuildopts = append(debbuildopts, "-B")
 		}
-		cmd, err = b.cowbuilderCommand(a.Dist, arch, a.Deps, "--build",
-			"--debbuildopts", `"`+strings.Join(debbuildopts, " ")+`"`,
-			"--buildresult", a.Dest,
-			dscFile)
-		if err != nil {
-			return nil, err
+		if err := job.Clean(); err != nil {
+			log.Printf("Could not clean job directory %s: %s", job.dir, err)
 		}
+	}()
 
-		cmd.Stdin = nil
-		cmd.Stderr = writer
-		cmd.Stdout = writer
-		fmt.Fprintf(writer, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
-		err = cmd.Run()
-		if err != nil {
-			return nil, err
+	debbuildopts := "-B"
+	if ab.indep {
+		debbuildopts = "-b"
+	}
+	buildArgs := []string{"--debbuildopts", debbuildopts, "--buildresult", job.resultPath()}
+	if len(ab.host) != 0 {
+		buildArgs = append(buildArgs, "--host-arch", string(ab.host))
+	}
+	if a.BinNMU != nil {
+		buildArgs = append(buildArgs, a.BinNMU.pbuilderArgs()...)
+	}
+	cmd, err := b.cowbuilderCommand(job, a.Dist, ab.arch, a.Deps, "--build", append(buildArgs, dscFile)...)
+	if err != nil {
+		return err
+	}
+	if len(ab.host) != 0 {
+		// the default resolver cannot satisfy cross build dependencies
+		if err := job.appendConfig("PBUILDERSATISFYDEPENDSCMD=\"/usr/lib/pbuilder/pbuilder-satisfydepends-apt\"\n"); err != nil {
+			return err
 		}
-
-		changesFileName := path.Join(a.Dest, fmt.Sprintf("%s_%s.changes", a.SourcePackage.Identifier, arch))
-		if _, err = os.Stat(changesFileName); err != nil {
-			if os.IsNotExist(err) {
-				return nil, fmt.Errorf("Missing expected result file %s", changesFileName)
-			}
-			return nil, fmt.Errorf("Could not check existence of %s: %s", changesFileName, err)
+		if err := installHook(job.hooksPath(), crossHook(ab.host)); err != nil {
+			return err
+		}
+	}
+	if err := job.appendConfig(pbuilderOptions(a.Options)); err != nil {
+		return err
+	}
+	if err := b.hooks.Install(job.hooksPath(), a.Options.Hooks); err != nil {
+		return err
+	}
+	if a.Options.Lintian {
+		if err := installHook(job.hooksPath(), lintianHook()); err != nil {
+			return err
+		}
+	}
+	if len(a.Options.FakeTime) != 0 {
+		if err := installHook(job.hooksPath(), fakeTimeHook(a.Options.FakeTime)); err != nil {
+			return err
 		}
-		changesFiles = append(changesFiles, changesFileName)
-		lastBuildArch = arch
 	}
 
-	res := &BuildResult{
-		BasePath: a.Dest,
+	// the statistics are only approximated when builds for the same
+	// distribution and architecture overlap, as they share the cache
+	ccacheDir, err := b.cache.CcacheDir(a.Dist, ab.arch)
+	if err != nil {
+		return err
 	}
-	if len(changesFiles) == 0 {
-		return nil, fmt.Errorf("No architecture where build!")
+	before, statsErr := ccacheStats(ccacheDir)
+	if statsErr != nil {
+		log.Printf("%s", statsErr)
 	}
 
-	res.ChangesPath = path.Base(changesFiles[0])
-	var suffix = string(lastBuildArch)
-	if len(changesFiles) > 1 {
-		// in that case we make a multi-arch upload file
-		cmd := exec.Command("mergechanges", changesFiles...)
-		cmd.Stdin = nil
-		var mergedChanges bytes.Buffer
-		cmd.Stdout = &mergedChanges
-		cmd.Stderr = writer
-		fmt.Fprintf(writer, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
-		err := cmd.Run()
-		if err == nil {
-			return nil, err
-		}
-		res.ChangesPath = fmt.Sprintf("%s_multi.changes", a.SourcePackage.Identifier)
-		f, err := os.Create(path.Join(res.BasePath, res.ChangesPath))
-		if err != nil {
-			return nil, err
+	cmd.Stdin = nil
+	cmd.Stderr = output
+	cmd.Stdout = output
+	fmt.Fprintf(output, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
+	if err := runCommand(ctx, cmd); err != nil {
+		return err
+	}
+
+	if statsErr == nil {
+		if after, err := ccacheStats(ccacheDir); err != nil {
+			log.Printf("%s", err)
+		} else {
+			stats := buildStats(before, after)
+			ab.cacheStats = &stats
 		}
-		_, err = io.Copy(f, &mergedChanges)
+	}
+
+	// the tests run once, against the build of all the packages
+	if a.Options.Autopkgtest && ab.indep {
+		results, err := b.runAutopkgtest(ctx, job, a, ab.arch, dscFile, output)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		suffix = "multi"
+		ab.autopkgtest = results
 	}
-	res.BuildLog = Log(buf.String())
 
-	cf, err := os.Open(path.Join(res.BasePath, res.ChangesPath))
+	return collectResults(job.resultPath(), a, ab.targetArch())
+}
+
+// runAutopkgtest runs the autopkgtests of dscFile against the packages
+// built in job, in the image of the build. It returns no results if
+// the package has no tests.
+func (b *Cowbuilder) runAutopkgtest(ctx context.Context, job *cowbuilderJob, a BuildArguments, arch deb.Architecture, dscFile string, output io.Writer) ([]AutopkgtestResult, error) {
+	tests, err := sourceAutopkgTests(dscFile, job.dir)
 	if err != nil {
 		return nil, err
 	}
+	if len(tests) == 0 {
+		fmt.Fprintf(output, "--- No autopkgtests in %s\n", a.SourcePackage.Identifier)
+		return nil, nil
+	}
 
-	res.Changes, err = deb.ParseChangeFile(cf)
+	outPath := job.autopkgtestPath()
+	if err := os.MkdirAll(outPath, 0755); err != nil {
+		return nil, err
+	}
+	summaryFile := path.Join(outPath, "summary")
+	changesFile := path.Join(job.resultPath(), fmt.Sprintf("%s_%s.changes", builtRef(a), arch))
+	script := path.Join(outPath, "run.sh")
+	if err := ioutil.WriteFile(script, []byte(autopkgtestScript(changesFile, dscFile, summaryFile)), 0755); err != nil {
+		return nil, err
+	}
+
+	cmd, err := b.cowbuilderCommand(job, a.Dist, arch, a.Deps, "--execute", script)
 	if err != nil {
 		return nil, err
 	}
-	res.Changes.Ref.Suffix = suffix
+	// the tests need the network to install their dependencies
+	if err := job.appendConfig(fmt.Sprintf("BINDMOUNTS=\"${BINDMOUNTS} %s %s %s\"\nUSENETWORK=yes\n",
+		job.resultPath(), path.Dir(dscFile), outPath)); err != nil {
+		return nil, err
+	}
 
-	return res, nil
+	cmd.Stdin = nil
+	cmd.Stderr = output
+	cmd.Stdout = output
+	fmt.Fprintf(output, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
+	if err := runCommand(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("Could not run autopkgtests: %s", err)
+	}
+
+	summary, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read autopkgtest summary: %s", err)
+	}
+	return parseAutopkgtestSummary(string(summary), tests, arch), nil
 }
 
-// returns an equivalent of .pbuilderrc run
-func (b *Cowbuilder) cowbuilderCommand(d deb.Codename, a deb.Architecture, deps []*AptRepositoryAccess, command string, args ...string) (*exec.Cmd, error) {
+// BuildPackage builds a deb.SourcePackageRef package. if an io.Writer
+// is passed, all the current output of cowbuilder will be copied to
+// it. Architectures are built concurrently, their output lines are
+// then prefixed by the architecture. When ctx is done, the cowbuilder
+// processes are killed and their build places are removed.
+func (b *Cowbuilder) BuildPackage(ctx context.Context, a BuildArguments, output io.Writer) (*BuildResult, error) {
+	if err := a.Options.Check(); err != nil {
+		return nil, err
+	}
+	for _, name := range a.Options.Hooks {
+		if _, err := b.hooks.Get(name); err != nil {
+			return nil, err
+		}
+	}
+	res, err := buildArchitectures(ctx, b, b.scheduler, a, output)
+	if _, perr := b.cache.PruneAptCache(time.Now()); perr != nil {
+		log.Printf("Could not prune apt cache: %s", perr)
+	}
+	return res, err
+}
 
-	isUbuntu, err := b.isSupportedUbuntu(d)
+// SetCacheLimits sets the maximal size of the ccache directories, and
+// the age after which packages are pruned from the apt cache, see
+// BuildCache.SetLimits.
+func (b *Cowbuilder) SetCacheLimits(ccacheSize string, aptMaxAge time.Duration) error {
+	return b.cache.SetLimits(ccacheSize, aptMaxAge)
+}
+
+// returns a cowbuilder command, configured for the given image in
+// the job directory
+func (b *Cowbuilder) cowbuilderCommand(job *cowbuilderJob, d deb.Codename, a deb.Architecture, deps []*AptRepositoryAccess, command string, args ...string) (*exec.Cmd, error) {
+
+	dist, err := distributionConfig(b.basepath, d)
 	if err != nil {
 		return nil, err
 	}
 
 	imagePath := b.imagePath(d, a)
 	baseCowPath := path.Join(imagePath, "base.cow")
-	buildPath := path.Join(imagePath, "build")
-	aptCache := path.Join(b.basepath, "images/aptcache")
-	ccache := path.Join(b.basepath, "images/ccache")
-
-	toClean := []string{b.confpath, b.hookspath}
-	toCreate := []string{buildPath, aptCache, ccache, b.hookspath}
-
-	for _, f := range toClean {
-		err = os.RemoveAll(f)
-		if err != nil {
-			return nil, err
-		}
+	aptCache, err := b.cache.AptCacheDir()
+	if err != nil {
+		return nil, err
 	}
-
-	for _, d := range toCreate {
-		err = os.MkdirAll(d, 0755)
-		if err != nil {
-			return nil, err
-		}
+	ccacheDir, err := b.cache.CcacheDir(d, a)
+	if err != nil {
+		return nil, err
 	}
 
-	bindmounts, err := b.setHooksForRepoDeps(d, deps)
+	bindmounts, err := b.setHooksForRepoDeps(job.hooksPath(), d, deps)
 	if err != nil {
 		return nil, err
 	}
 
 	preDebootstrapOpts := fmt.Sprintf("\"--arch\" \"%s\"", a)
-	var mirror, components, mirrorsite, postDebootstrapOpts string
-	if isUbuntu == true {
-		mirror = "http://ftp.ubuntu.com/ubuntu"
-		mirrorsite = "http://ftp.ubuntu.com/ubuntu"
-		components = "main restricted universe multiverse"
-		postDebootstrapOpts = "\"--keyring=/usr/share/keyrings/ubuntu-archive-keyring.gpg\""
-	} else {
-		mirror = "http://ftp.us.debian.org/debian"
-		mirrorsite = "http://ftp.us.debian.org/debian"
-		components = "main contrib non-free"
-		postDebootstrapOpts = "\"--keyring=/usr/share/keyrings/debian-archive-keyring.gpg\""
+	postDebootstrapOpts := fmt.Sprintf("\"--keyring=%s\"", dist.Keyring)
+	for _, o := range dist.DebootstrapOptions {
+		postDebootstrapOpts += fmt.Sprintf(" \"%s\"", o)
 	}
+	components := joinComponents(dist.Components, " ")
 
-	cmd := exec.Command("cowbuilder", command)
+	cmd := exec.Command("cowbuilder", command, "--configfile", job.confPath())
 	cmd.Args = append(cmd.Args, args...)
 
 	cmd.Env = append(b.maskedEnviron(), fmt.Sprintf("HOME=%s", b.basepath))
 
-	f, err := os.Create(b.confpath)
+	f, err := os.Create(job.confPath())
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	fmt.Fprintf(f, "%s=\"%s\"\n", "BASEPATH", baseCowPath)
-	fmt.Fprintf(f, "%s=\"%s\"\n", "BUILDPLACE", buildPath)
-	fmt.Fprintf(f, "%s=\"%s\"\n", "HOOKDIR", b.hookspath)
+	fmt.Fprintf(f, "%s=\"%s\"\n", "BUILDPLACE", job.buildPath())
+	fmt.Fprintf(f, "%s=\"%s\"\n", "HOOKDIR", job.hooksPath())
 	fmt.Fprintf(f, "%s=\"%s\"\n", "DISTRIBUTION", d)
 	fmt.Fprintf(f, "%s=\"%s\"\n", "ARCHITECTURE", a)
 	fmt.Fprintf(f, "%s=\"%s\"\n", "APTCACHE", aptCache)
+	fmt.Fprintf(f, "%s=\"%s\"\n", "CCACHEDIR", ccacheDir)
 	fmt.Fprintf(f, "%s=(%s \"${DEBOOTSTRAPOPTS[@]}\" %s)\n", "DEBOOTSTRAPOPTS", preDebootstrapOpts, postDebootstrapOpts)
-	fmt.Fprintf(f, "%s=\"%s\"\n", "MIRROR", mirror)
-	fmt.Fprintf(f, "%s=\"%s\"\n", "MIRRORSITE", mirrorsite)
+	fmt.Fprintf(f, "%s=\"%s\"\n", "MIRROR", dist.Mirror)
+	fmt.Fprintf(f, "%s=\"%s\"\n", "MIRRORSITE", dist.Mirror)
 	fmt.Fprintf(f, "%s=\"%s\"\n", "COMPONENTS", components)
 	fmt.Fprintf(f, "%s=\"%s\"\n", "BINDMOUNTS", strings.Join(bindmounts, " "))
+	if len(dist.AptProxy) != 0 {
+		fmt.Fprintf(f, "export http_proxy=\"%s\"\n", dist.AptProxy)
+	}
 
 	return cmd, nil
 }
@@ -336,33 +437,37 @@ func (b *Cowbuilder) setBuildResult(cmd *exec.Cmd, path string) {
 	cmd.Env = append(cmd.Env, fmt.Sprintf("BUILDRESULT=%s", path))
 }
 
-// Returns true if it is a supported ubuntu distribution, or false if
-// it is a supported Debian one.
-// if not supported returns an error
-func (b *Cowbuilder) isSupportedUbuntu(d deb.Codename) (bool, error) {
-	for _, dd := range b.ubuntuDists {
-		if d == deb.Codename(dd) {
-			return true, nil
-		}
-	}
+// InitDistribution is initializing a distribution with the given
+// architecture for the builder. Since a copy-on-write chroot is
+// initialized with a bare default system, the output of the commmand
+// is synchronously copied to the given output. If ctx is done before
+// the end of the creation, the partially created image is removed.
+func (b *Cowbuilder) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	image := b.imagePath(d, a)
+	return b.scheduler.RunExclusive(ctx, image, func() error {
+		b.setCreating(image, true)
+		defer b.setCreating(image, false)
+		return b.initDistribution(ctx, d, a, output)
+	})
+}
 
-	for _, dd := range b.debianDists {
-		if d == deb.Codename(dd) {
-			return false, nil
-		}
+func (b *Cowbuilder) setCreating(image string, creating bool) {
+	b.creatingMutex.Lock()
+	defer b.creatingMutex.Unlock()
+	if creating {
+		b.creating[image] = true
+	} else {
+		delete(b.creating, image)
 	}
-
-	return false, fmt.Errorf("%s is not supported by this builder", d)
 }
 
-// InitDistribution is initializing a distribution with the given
-// architecture for the builder. Since a copy-on-write chroot is
-// initialized with a bare default system, the output of the commmand
-// is synchronously copied to the given output.
-func (b *Cowbuilder) InitDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error {
-	b.acquire()
-	defer b.release()
+func (b *Cowbuilder) isCreating(image string) bool {
+	b.creatingMutex.Lock()
+	defer b.creatingMutex.Unlock()
+	return b.creating[image]
+}
 
+func (b *Cowbuilder) initDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
 	_, err := b.supportedDistributionPath(d, a)
 	if err == nil {
 		return fmt.Errorf("Distribution %s architecture %s is already supported", d, a)
@@ -380,7 +485,16 @@ func (b *Cowbuilder) InitDistribution(d deb.Codename, a deb.Architecture, output
 		return fmt.Errorf("Architecture %s is not in the supported architecture list %v.", a, b.supported)
 	}
 
-	cmd, err := b.cowbuilderCommand(d, a, nil, "--create")
+	job, err := b.newJob(d, a)
+	if err != nil {
+		return err
+	}
+	defer job.Clean()
+
+	cmd, err := b.cowbuilderCommand(job, d, a, nil, "--create")
+	if err != nil {
+		return err
+	}
 
 	cmd.Stdout = output
 	cmd.Stderr = output
@@ -388,35 +502,50 @@ func (b *Cowbuilder) InitDistribution(d deb.Codename, a deb.Architecture, output
 	if output != nil {
 		fmt.Fprintf(output, "--- Executing: %v\n--- Env: %v\n", cmd.Args, cmd.Env)
 	}
-	return cmd.Run()
+	err = runCommand(ctx, cmd)
+	if ctx.Err() != nil {
+		if cerr := cleanBuildPlace(b.imagePath(d, a)); cerr != nil {
+			log.Printf("Could not remove interrupted image %s: %s", b.imagePath(d, a), cerr)
+		}
+	}
+	return err
 }
 
 // RemoveDistribution is removing a distribution support from the
 // builder.
 func (b *Cowbuilder) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
-	b.acquire()
-	defer b.release()
-
-	imagePath, err := b.supportedDistributionPath(d, a)
-	if err != nil {
-		return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
-	}
+	return b.scheduler.RunExclusive(context.Background(), b.imagePath(d, a), func() error {
+		imagePath, err := b.supportedDistributionPath(d, a)
+		if err != nil {
+			return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
+		}
 
-	return os.RemoveAll(imagePath)
+		return os.RemoveAll(imagePath)
+	})
 }
 
 // UpdateDistribution is updating the chroot for the given
-// distribution.
-func (b *Cowbuilder) UpdateDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error {
-	b.acquire()
-	defer b.release()
+// distribution. If ctx is done before the end of the update, the
+// image is left as is, and should be updated again.
+func (b *Cowbuilder) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return b.scheduler.RunExclusive(ctx, b.imagePath(d, a), func() error {
+		return b.updateDistribution(ctx, d, a, output)
+	})
+}
 
+func (b *Cowbuilder) updateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
 	_, err := b.supportedDistributionPath(d, a)
 	if err != nil {
 		return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
 	}
 
-	cmd, err := b.cowbuilderCommand(d, a, nil, "--update")
+	job, err := b.newJob(d, a)
+	if err != nil {
+		return err
+	}
+	defer job.Clean()
+
+	cmd, err := b.cowbuilderCommand(job, d, a, nil, "--update")
 	if err != nil {
 		return err
 	}
@@ -428,14 +557,20 @@ func (b *Cowbuilder) UpdateDistribution(d deb.Codename, a deb.Architecture, outp
 		fmt.Fprintf(output, "--- Executing: %v\n--- Env: %v\n", cmd.Args, cmd.Env)
 	}
 
-	return cmd.Run()
+	err = runCommand(ctx, cmd)
+	if ctx.Err() != nil {
+		// cowbuilder updates the image in place, only its mounts are
+		// cleaned
+		if merr := detachMounts(b.imagePath(d, a)); merr != nil {
+			log.Printf("Could not clean interrupted image %s: %s", b.imagePath(d, a), merr)
+		}
+		return fmt.Errorf("Update of %s-%s was interrupted, it should be updated again: %s", d, a, err)
+	}
+	return err
 }
 
 // AvailableDistributions returns
 func (b *Cowbuilder) AvailableDistributions() []deb.Codename {
-	b.acquire()
-	defer b.release()
-
 	res := []deb.Codename{}
 	for d := range b.getAllImages() {
 		res = append(res, d)
@@ -445,9 +580,6 @@ func (b *Cowbuilder) AvailableDistributions() []deb.Codename {
 
 // AvailableArchitectures returns
 func (b *Cowbuilder) AvailableArchitectures(d deb.Codename) ArchitectureList {
-	b.acquire()
-	defer b.release()
-
 	dists := b.getAllImages()
 	if dists == nil {
 		return nil
@@ -456,14 +588,6 @@ func (b *Cowbuilder) AvailableArchitectures(d deb.Codename) ArchitectureList {
 	return dists[d]
 }
 
-func (b *Cowbuilder) acquire() {
-	_ = <-b.semaphore
-}
-
-func (b *Cowbuilder) release() {
-	b.semaphore <- true
-}
-
 func (b *Cowbuilder) imagePath(d deb.Codename, a deb.Architecture) string {
 	return path.Join(b.imagepath, fmt.Sprintf("%s-%s", d, a))
 }
@@ -488,6 +612,10 @@ func (b *Cowbuilder) getAllImages() map[deb.Codename]ArchitectureList {
 			continue
 		}
 
+		if b.isCreating(path.Join(b.imagepath, f.Name())) {
+			continue
+		}
+
 		baseCow, err := os.Stat(path.Join(b.imagepath, f.Name(), "base.cow"))
 		if err != nil {
 			continue
@@ -520,17 +648,10 @@ func (b *Cowbuilder) supportedDistributionPath(d deb.Codename, a deb.Architectur
 }
 
 func (b *Cowbuilder) getSupportedArchitectures() {
-	switch runtime.GOARCH {
-	case "amd64":
-		b.supported = []deb.Architecture{deb.Amd64, deb.I386}
-	case "386":
-		b.supported = []deb.Architecture{deb.I386}
-	case "arm":
-		b.supported = []deb.Architecture{deb.Armel}
-	}
+	b.supported = hostArchitectures()
 }
 
-func (b *Cowbuilder) setHooksForRepoDeps(targetDist deb.Codename, deps []*AptRepositoryAccess) ([]string, error) {
+func (b *Cowbuilder) setHooksForRepoDeps(hookspath string, targetDist deb.Codename, deps []*AptRepositoryAccess) ([]string, error) {
 	var content bytes.Buffer
 	fmt.Fprintf(&content, `#!/bin/bash
 listfile=/etc/apt/sources.list.d/deps.list
@@ -577,7 +698,7 @@ fi
 		fmt.Fprintf(&content, "\" >> $listfile\n")
 	}
 	fmt.Fprintf(&content, "\n\napt-get update\n")
-	f, err := os.Create(path.Join(b.hookspath, "D01_apt_dep.sh"))
+	f, err := os.Create(path.Join(hookspath, "D01_apt_dep.sh"))
 	if err != nil {
 		return bindmounts, err
 	}
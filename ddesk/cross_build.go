@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	deb ".."
+)
+
+// crossHookName is the name of the hook preparing the build
+// environment of a cross-build
+const crossHookName = "ddesk-cross"
+
+// crossHook returns the pbuilder hook installing the cross toolchain
+// for host, before the build dependencies are satisfied
+func crossHook(host deb.Architecture) Hook {
+	return Hook{
+		Name:  crossHookName,
+		Stage: "D",
+		Script: []byte(fmt.Sprintf(`#!/bin/sh
+set -e
+dpkg --add-architecture %[1]s
+apt-get update
+apt-get install -y --no-install-recommends crossbuild-essential-%[1]s
+`, host)),
+	}
+}
+
+// sbuildArchArgs returns the sbuild arguments selecting the
+// architectures of ab
+func sbuildArchArgs(ab *archBuild) []string {
+	if len(ab.host) == 0 {
+		return []string{"--arch=" + string(ab.arch)}
+	}
+	return []string{"--build=" + string(ab.arch), "--host=" + string(ab.host)}
+}
+
+var unmetDependencyRx = regexp.MustCompile(`^\s+(?:\S+ : )?(?:Pre-)?Depends: (.*)$`)
+
+// unsatisfiableDependencies returns the unmet dependencies apt reports
+// in a build log
+func unsatisfiableDependencies(buildLog string) []string {
+	var res []string
+	inReport := false
+	scanner := bufio.NewScanner(strings.NewReader(buildLog))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "have unmet dependencies:") {
+			inReport = true
+			continue
+		}
+		if inReport == false {
+			continue
+		}
+		m := unmetDependencyRx.FindStringSubmatch(line)
+		if m == nil {
+			inReport = false
+			continue
+		}
+		res = append(res, strings.TrimSpace(m[1]))
+	}
+	return res
+}
+
+// crossDependencyError returns the error reporting the build
+// dependencies that cannot be satisfied for host, nil if the log of
+// the failed build reports none.
+func crossDependencyError(ref deb.SourcePackageRef, host deb.Architecture, buildLog string) error {
+	unmet := unsatisfiableDependencies(buildLog)
+	if len(unmet) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Build dependencies of `%s' cannot be satisfied when cross-building for %s, they may lack Multi-Arch annotations or %s packages:\n  %s",
+		ref, host, host, strings.Join(unmet, "\n  "))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type CrossBuildSuite struct{}
+
+var _ = Suite(&CrossBuildSuite{})
+
+func (s *CrossBuildSuite) TestUnsatisfiableDependencies(c *C) {
+	buildLog := `Reading package lists...
+Some packages could not be installed. This may mean that you have
+requested an impossible situation.
+The following packages have unmet dependencies:
+ pbuilder-satisfydepends-dummy:arm64 : Depends: libfoo-dev:arm64 but it is not installable
+                                       Depends: python3-dev:arm64 but it is not going to be installed
+E: Unable to correct problems, you have held broken packages.
+`
+	unmet := unsatisfiableDependencies(buildLog)
+	c.Check(unmet, DeepEquals, []string{
+		"libfoo-dev:arm64 but it is not installable",
+		"python3-dev:arm64 but it is not going to be installed",
+	})
+
+	ref := deb.SourcePackageRef{Source: "foo", Ver: deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"}}
+	c.Check(crossDependencyError(ref, deb.Arm64, buildLog), ErrorMatches, `(?s)Build dependencies of .foo_1.0-1. cannot be satisfied when cross-building for arm64, .*:
+  libfoo-dev:arm64 but it is not installable
+  python3-dev:arm64 but it is not going to be installed`)
+	c.Check(crossDependencyError(ref, deb.Arm64, "make: *** [all] Error 2\n"), IsNil)
+}
+
+func (s *CrossBuildSuite) TestCheckCrossBuild(c *C) {
+	a := BuildArguments{
+		SourcePackage: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{Source: "foo", Ver: deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"}},
+			Archs:      []deb.Architecture{deb.All},
+		},
+		Archs:    []deb.Architecture{deb.Amd64},
+		HostArch: deb.Armel,
+	}
+	c.Check(checkCrossBuild(a), ErrorMatches, "`foo_1.0-1' has no package for armel to cross-build")
+	a.SourcePackage.Archs = append(a.SourcePackage.Archs, deb.Any)
+	c.Check(checkCrossBuild(a), IsNil)
+
+	a.HostArch = deb.Amd64
+	c.Check(checkCrossBuild(a), ErrorMatches, "Cannot cross-build for amd64 on amd64, it is the build architecture")
+	a.Archs = append(a.Archs, deb.I386)
+	c.Check(checkCrossBuild(a), ErrorMatches, "A cross-build needs a single build architecture, got 2")
+}
+
+func (s *CrossBuildSuite) TestSbuildArchArgs(c *C) {
+	c.Check(sbuildArchArgs(&archBuild{arch: deb.Amd64}), DeepEquals, []string{"--arch=amd64"})
+	c.Check(sbuildArchArgs(&archBuild{arch: deb.Amd64, host: deb.Armel}), DeepEquals, []string{"--build=amd64", "--host=armel"})
+	c.Check((&archBuild{arch: deb.Amd64, host: deb.Armel}).targetArch(), Equals, deb.Armel)
+}
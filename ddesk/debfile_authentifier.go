@@ -9,8 +9,7 @@ import (
 	"os/exec"
 	"path"
 
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/clearsign"
+	"../pgp"
 )
 
 type DebfileAuthentifier interface {
@@ -21,8 +20,8 @@ type DebfileAuthentifier interface {
 // A module that can read and check clearsigned content, and sign
 // necessary dsc and control file
 type GnupgAuthentifier struct {
-	kr          openpgp.KeyRing
-	pubringPath string
+	pubring  pgp.FileKeyring
+	verifier *pgp.Verifier
 }
 
 var gnupgHomeEnv = "GNUPGHOME"
@@ -36,24 +35,16 @@ func NewAuthentifier() (*GnupgAuthentifier, error) {
 		gnupghome = path.Join(os.Getenv("HOME"), ".gnupg")
 	}
 
-	res := &GnupgAuthentifier{}
-
-	res.pubringPath = path.Join(gnupghome, "pubring.gpg")
-	f, err := os.Open(res.pubringPath)
-	if err != nil {
-		return res, nil
-	}
-	defer f.Close()
-
-	res.kr, err = openpgp.ReadKeyRing(f)
-	if err != nil {
-		return nil, err
+	res := &GnupgAuthentifier{
+		pubring: pgp.FileKeyring(path.Join(gnupghome, "pubring.gpg")),
 	}
+	res.verifier = pgp.NewVerifier(res.pubring)
 	return res, nil
 }
 
 // Reads a debian clearsigned file (.changes, .dsc) check the
-// signature if any , and returns a plaintext version.
+// signature if any , and returns a plaintext version. Signatures made
+// by a revoked or expired key are rejected.
 func (a *GnupgAuthentifier) CheckAnyClearsigned(r io.Reader) (io.Reader, error) {
 	//we need to read all the file
 	allData, err := ioutil.ReadAll(r)
@@ -61,23 +52,24 @@ func (a *GnupgAuthentifier) CheckAnyClearsigned(r io.Reader) (io.Reader, error)
 		return nil, err
 	}
 
-	block, rest := clearsign.Decode(allData)
-	if block == nil {
-		return bytes.NewReader(rest), nil
+	plaintext, signed := pgp.Decode(allData)
+	if signed == false {
+		return bytes.NewReader(plaintext), nil
 	}
 
-	if a.kr == nil {
-		return nil, fmt.Errorf("data is clearsigned but no keyring file found in `%s'", a.pubringPath)
+	if a.pubring.Exists() == false {
+		return nil, fmt.Errorf("data is clearsigned but no keyring file found in `%s'", a.pubring)
 	}
 
-	_, err = openpgp.CheckDetachedSignature(a.kr,
-		bytes.NewReader(block.Bytes),
-		block.ArmoredSignature.Body)
+	plaintext, signer, err := a.verifier.CheckClearsigned(allData)
 	if err != nil {
+		if signer != nil {
+			return nil, fmt.Errorf("Invalid signature by %s: %s", signer.KeyID(), err)
+		}
 		return nil, err
 	}
 
-	return bytes.NewReader(block.Plaintext), nil
+	return bytes.NewReader(plaintext), nil
 }
 
 func (a *GnupgAuthentifier) SignChanges(filePath string) error {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"io"
+	"time"
 
 	deb ".."
 )
@@ -24,6 +26,31 @@ type BuildResult struct {
 	ChangesPath string
 	// The base path to find all files on the current filesystem
 	BasePath string
+	// The git commit the source package was generated from, if any
+	GitCommit string
+	// The builder job that produced the result, if any
+	JobID BuildJobID
+	// The builder of a pool that produced the result, if any
+	Builder string
+	// The options of the build
+	Options BuildOptions
+	// Compiler cache statistics of the build, if available
+	CacheStats *CacheStats
+	// The output of each user hook of the build, also in BuildLog
+	HookLogs map[string]Log `json:",omitempty"`
+	// The lintian tags of the built packages, if lintian ran
+	Lintian []LintianTag `json:",omitempty"`
+	// The results of the autopkgtests of the package, if they ran
+	Autopkgtest []AutopkgtestResult `json:",omitempty"`
+	// The .buildinfo files of the build, relative to BasePath
+	Buildinfo []string `json:",omitempty"`
+	// The verdict of the reproducibility verification, if the build
+	// was verified
+	Reproducibility *ReproducibilityReport `json:",omitempty"`
+	// The architecture the packages were cross-built for, if any
+	HostArch deb.Architecture `json:",omitempty"`
+	// The binary-only rebuild the packages result from, if any
+	BinNMU *BinNMU `json:",omitempty"`
 }
 
 type BuildArguments struct {
@@ -32,14 +59,49 @@ type BuildArguments struct {
 	Archs         []deb.Architecture
 	Deps          []*AptRepositoryAccess
 	Dest          string
+	// Wall-clock limit of the build, the builder default is used if
+	// zero
+	Timeout time.Duration
+	// Options tuning the build environment
+	Options BuildOptions
+	// Architecture to cross-build the packages for, in the build
+	// environment of the single architecture of Archs. Empty for a
+	// native build.
+	HostArch deb.Architecture `json:",omitempty"`
+	// Binary-only rebuild to make, only architecture dependent
+	// packages are then built. Nil for a regular build.
+	BinNMU *BinNMU `json:",omitempty"`
 }
 
-// Interface of a module that can build packages
-type DebianBuilder interface {
-	BuildPackage(b BuildArguments, output io.Writer) (*BuildResult, error)
-	InitDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error
+// Interface of a module that can build packages in its build
+// environments. Builds, initializations and updates are aborted when
+// their context is done.
+type BuilderBackend interface {
+	BuildPackage(ctx context.Context, b BuildArguments, output io.Writer) (*BuildResult, error)
+	InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error
 	RemoveDistribution(d deb.Codename, a deb.Architecture) error
-	UpdateDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error
+	UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error
 	AvailableDistributions() []deb.Codename
 	AvailableArchitectures(d deb.Codename) ArchitectureList
 }
+
+// Interface of a module that can build packages, synchronously or as
+// jobs running in the background
+type DebianBuilder interface {
+	BuilderBackend
+	// SubmitBuild queues a build and returns its job ID
+	SubmitBuild(b BuildArguments) (BuildJobID, error)
+	// ListJobs returns all jobs, by submission order
+	ListJobs() ([]BuildJob, error)
+	// GetJob returns the current state of a job
+	GetJob(id BuildJobID) (*BuildJob, error)
+	// AttachJob copies the log of a job to output, from its start
+	// until the job is finished, and returns the finished job. The job
+	// keeps running if ctx is done before.
+	AttachJob(ctx context.Context, id BuildJobID, output io.Writer) (*BuildJob, error)
+	// CancelJob cancels a queued or running job
+	CancelJob(id BuildJobID) error
+	// FetchResult copies the result files of a succeeded job to dest,
+	// and returns its result, without log, relative to dest
+	FetchResult(id BuildJobID, dest string) (*BuildResult, error)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	deb ".."
 )
@@ -11,18 +14,33 @@ type DebianBuilderStub struct {
 	Err         error
 	Res         *BuildResult
 	BuildCalled bool
+	BuildArgs   BuildArguments
+	// the arguments of all the builds, which may be concurrent
+	Builds      []BuildArguments
+	buildsMutex sync.Mutex
+	// errors of the builds of some source packages, by name
+	SourceErrs  map[string]error
 	DistAndArch map[deb.Codename][]deb.Architecture
+	Jobs        []BuildJob
+	JobLogs     map[BuildJobID]string
 }
 
-func (b *DebianBuilderStub) BuildPackage(args BuildArguments, out io.Writer) (*BuildResult, error) {
+func (b *DebianBuilderStub) BuildPackage(ctx context.Context, args BuildArguments, out io.Writer) (*BuildResult, error) {
+	b.buildsMutex.Lock()
+	defer b.buildsMutex.Unlock()
 	b.BuildCalled = true
+	b.BuildArgs = args
+	b.Builds = append(b.Builds, args)
 	if out != nil {
 		fmt.Fprintf(out, "Called BuildPackage\n")
 	}
+	if err, ok := b.SourceErrs[args.SourcePackage.Identifier.Source]; ok {
+		return nil, err
+	}
 	return b.Res, b.Err
 }
 
-func (b *DebianBuilderStub) InitDistribution(d deb.Codename, a deb.Architecture, out io.Writer) error {
+func (b *DebianBuilderStub) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, out io.Writer) error {
 	if b.Err != nil {
 		return b.Err
 	}
@@ -61,7 +79,7 @@ func (b *DebianBuilderStub) RemoveDistribution(d deb.Codename, a deb.Architectur
 	return nil
 }
 
-func (b *DebianBuilderStub) UpdateDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error {
+func (b *DebianBuilderStub) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
 	archs, ok := b.DistAndArch[d]
 	if output != nil {
 		fmt.Fprintf(output, "Called UpdateDistribution\n")
@@ -104,3 +122,81 @@ func (b *DebianBuilderStub) AvailableArchitectures(d deb.Codename) ArchitectureL
 func (b *DebianBuilderStub) CurrentBuild() *InBuildResult {
 	return nil
 }
+
+// SubmitBuild runs the build synchronously
+func (b *DebianBuilderStub) SubmitBuild(args BuildArguments) (BuildJobID, error) {
+	var out bytes.Buffer
+	res, err := b.BuildPackage(context.Background(), args, &out)
+	job := BuildJob{
+		ID:     BuildJobID(len(b.Jobs) + 1),
+		State:  JobSucceeded,
+		Args:   args,
+		Result: res,
+	}
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	if res != nil {
+		r := *res
+		r.JobID = job.ID
+		job.Result = &r
+	}
+	b.Jobs = append(b.Jobs, job)
+	if b.JobLogs == nil {
+		b.JobLogs = make(map[BuildJobID]string)
+	}
+	b.JobLogs[job.ID] = out.String()
+	return job.ID, nil
+}
+
+func (b *DebianBuilderStub) ListJobs() ([]BuildJob, error) {
+	return b.Jobs, nil
+}
+
+func (b *DebianBuilderStub) GetJob(id BuildJobID) (*BuildJob, error) {
+	for _, j := range b.Jobs {
+		if j.ID == id {
+			return &j, nil
+		}
+	}
+	return nil, fmt.Errorf("No build job %d", id)
+}
+
+func (b *DebianBuilderStub) AttachJob(ctx context.Context, id BuildJobID, output io.Writer) (*BuildJob, error) {
+	j, err := b.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if output != nil {
+		io.WriteString(output, b.JobLogs[id])
+	}
+	return j, nil
+}
+
+func (b *DebianBuilderStub) CancelJob(id BuildJobID) error {
+	for i, j := range b.Jobs {
+		if j.ID != id {
+			continue
+		}
+		if j.State.Finished() {
+			return fmt.Errorf("Build job %d is already %s", id, j.State)
+		}
+		b.Jobs[i].State = JobCancelled
+		return nil
+	}
+	return fmt.Errorf("No build job %d", id)
+}
+
+func (b *DebianBuilderStub) FetchResult(id BuildJobID, dest string) (*BuildResult, error) {
+	j, err := b.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.State != JobSucceeded || j.Result == nil {
+		return nil, fmt.Errorf("Build job %d has no result", id)
+	}
+	res := *j.Result
+	res.BasePath = dest
+	return &res, nil
+}
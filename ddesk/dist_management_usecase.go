@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 
@@ -35,7 +36,7 @@ type DistributionInitResult struct {
 	CreateLog Log
 }
 
-func (x *Interactor) AddDistributionSupport(d deb.Codename, a deb.Architecture, output io.Writer) (*DistributionInitResult, error) {
+func (x *Interactor) AddDistributionSupport(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) (*DistributionInitResult, error) {
 	supported := false
 	for _, aa := range x.builder.AvailableArchitectures(d) {
 		if aa == a {
@@ -54,7 +55,7 @@ func (x *Interactor) AddDistributionSupport(d deb.Codename, a deb.Architecture,
 		} else {
 			w = io.MultiWriter(&createOut, output)
 		}
-		err := x.builder.InitDistribution(d, a, w)
+		err := x.builder.InitDistribution(ctx, d, a, w)
 		res.CreateLog = Log(createOut.String())
 		if err != nil {
 			res.Message = fmt.Sprintf("Builder could not initialize distribution %s-%s", d, a)
@@ -129,7 +130,7 @@ func (x *Interactor) GetSupportedDistribution() (DistributionSupportReport, erro
 	return res, nil
 }
 
-func (x *Interactor) UpdateDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error {
+func (x *Interactor) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
 	supported := false
 	for _, aa := range x.builder.AvailableArchitectures(d) {
 		if aa == a {
@@ -142,5 +143,5 @@ func (x *Interactor) UpdateDistribution(d deb.Codename, a deb.Architecture, outp
 		return fmt.Errorf("Distribution %s-%s is not supported by builder, could not update it.", d, a)
 	}
 
-	return x.builder.UpdateDistribution(d, a, output)
+	return x.builder.UpdateDistribution(ctx, d, a, output)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
 
@@ -69,19 +70,19 @@ func (s *DistManagementUseCaseSuite) SetUpSuite(c *C) {
 }
 
 func (s *DistManagementUseCaseSuite) TestAddAndRemoveDistribution(c *C) {
-	message, err := s.x.AddDistributionSupport("unstable", deb.Amd64, nil)
+	message, err := s.x.AddDistributionSupport(context.Background(), "unstable", deb.Amd64, nil)
 	c.Check(err, IsNil)
 	c.Check(message.Message, Equals, "Builder initialized unstable-amd64\nEnabled user distribution support for unstable-amd64")
-	message, err = s.x.AddDistributionSupport("unstable", deb.I386, nil)
+	message, err = s.x.AddDistributionSupport(context.Background(), "unstable", deb.I386, nil)
 	c.Check(err, IsNil)
 	c.Check(message.Message, Equals, "Builder initialized unstable-i386\nEnabled user distribution support for unstable-i386")
 
-	message, err = s.x.AddDistributionSupport("unstable", deb.Amd64, nil)
+	message, err = s.x.AddDistributionSupport(context.Background(), "unstable", deb.Amd64, nil)
 	c.Check(err, IsNil)
 	c.Check(message.Message, Equals, "Enabled user distribution support for unstable-amd64")
 	s.builder.Err = fmt.Errorf("I cannot cross-compile")
 
-	message, err = s.x.AddDistributionSupport("unstable", deb.Armel, nil)
+	message, err = s.x.AddDistributionSupport(context.Background(), "unstable", deb.Armel, nil)
 	c.Check(err, ErrorMatches, "I cannot cross-compile")
 	c.Check(message.Message, Equals, "Builder could not initialize distribution unstable-armel")
 	s.builder.Err = nil
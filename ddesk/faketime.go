@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// fakeTimeHookName is the name of the pbuilder hook shifting the clock
+// of the build
+const fakeTimeHookName = "ddesk-faketime"
+
+// fakeTimeLibrary is the faketime preload library, $LIB being expanded
+// by the dynamic loader to the library directory of each binary
+const fakeTimeLibrary = "/usr/$LIB/faketime/libfaketime.so.1"
+
+var fakeTimeRx = regexp.MustCompile(`^[+-][0-9]{1,4}d$`)
+
+// fakeTimeEnviron returns the environment variables shifting the clock
+// of a process by offset. The monotonic clock is left alone, as some
+// build tools hang when it is faked.
+func fakeTimeEnviron(offset string) map[string]string {
+	return map[string]string{
+		"FAKETIME":                     offset,
+		"FAKETIME_DONT_FAKE_MONOTONIC": "1",
+		"LD_PRELOAD":                   fakeTimeLibrary,
+	}
+}
+
+// fakeTimeHook returns the pbuilder hook shifting the clock of the
+// build by offset. pbuilder and the build dependencies installation
+// keep the real clock: the hook runs once they are installed, and
+// only wraps dpkg-buildpackage.
+func fakeTimeHook(offset string) Hook {
+	return Hook{
+		Name:  fakeTimeHookName,
+		Stage: "A",
+		Script: []byte(fmt.Sprintf(`#!/bin/sh
+set -e
+apt-get install -y --no-install-recommends libfaketime
+dpkg-divert --local --rename --add /usr/bin/dpkg-buildpackage
+cat > /usr/bin/dpkg-buildpackage <<'EOF'
+#!/bin/sh
+export FAKETIME=%s FAKETIME_DONT_FAKE_MONOTONIC=1
+export LD_PRELOAD="/usr/\$LIB/faketime/libfaketime.so.1"
+exec /usr/bin/dpkg-buildpackage.distrib "$@"
+EOF
+chmod 755 /usr/bin/dpkg-buildpackage
+`, shellQuote(offset))),
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	deb ".."
+)
+
+// GitSource is a source package generated from a git repository
+type GitSource struct {
+	// The generated source package
+	Dsc deb.SourceControlFile
+	// The commit the source package was generated from
+	Commit string
+}
+
+// GitSourcePackager generates source packages from Debianized git
+// repositories
+type GitSourcePackager interface {
+	// BuildSource generates the source package of the HEAD commit of
+	// the repository containing repoPath in dest. Progress is
+	// reported to output.
+	BuildSource(repoPath, dest string, output io.Writer) (*GitSource, error)
+}
+
+// GitDpkgSourcePackager is a GitSourcePackager that exports the
+// repository with git archive and build the source package with
+// dpkg-source.
+type GitDpkgSourcePackager struct{}
+
+// NewGitDpkgSourcePackager returns a new GitDpkgSourcePackager
+func NewGitDpkgSourcePackager() *GitDpkgSourcePackager {
+	return &GitDpkgSourcePackager{}
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// isNativeFormat tells if the source package has no orig tarball
+func isNativeFormat(format string, v deb.Version) bool {
+	if strings.Contains(format, "(native)") {
+		return true
+	}
+	return format == "1.0" && v.DebianRevision == "0"
+}
+
+// BuildSource implements GitSourcePackager
+func (p *GitDpkgSourcePackager) BuildSource(repoPath, dest string, output io.Writer) (*GitSource, error) {
+	if output == nil {
+		output = ioutil.Discard
+	}
+	top, err := runGit(repoPath, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+	commit, err := runGit(top, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	commit = strings.TrimSpace(commit)
+
+	// we build HEAD, uncommitted changes would not be part of the build
+	status, err := runGit(top, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(status)) != 0 {
+		return nil, fmt.Errorf("Working tree `%s' has uncommitted changes", top)
+	}
+
+	changelog, err := runGit(top, "show", "HEAD:debian/changelog")
+	if err != nil {
+		return nil, fmt.Errorf("Could not read debian/changelog: %s", err)
+	}
+	entries, err := deb.ParseChangelog(strings.NewReader(changelog))
+	if err != nil {
+		return nil, err
+	}
+	last := entries[0]
+
+	format := "1.0"
+	if f, err := runGit(top, "show", "HEAD:debian/source/format"); err == nil {
+		format = strings.TrimSpace(f)
+	}
+	native := isNativeFormat(format, last.Ver)
+	if strings.Contains(format, "(native)") && last.Ver.DebianRevision != "0" {
+		return nil, fmt.Errorf("Source format `%s' requires a native version, got %s", format, last.Ver)
+	}
+	if strings.Contains(format, "(quilt)") && native {
+		return nil, fmt.Errorf("Source format `%s' requires a Debian revision, got %s", format, last.Ver)
+	}
+
+	fmt.Fprintf(output, "Generating source package %s %s (format %s) from commit %s\n", last.Source, last.Ver, format, commit)
+
+	upstreamDir := fmt.Sprintf("%s-%s", last.Source, last.Ver.UpstreamVersion)
+	if err := exportTree(top, "HEAD", dest, upstreamDir+"/"); err != nil {
+		return nil, err
+	}
+
+	if native == false {
+		from, err := p.origTarball(top, last, dest)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(output, "Using orig tarball from %s\n", from)
+	}
+
+	cmd := exec.Command("dpkg-source", "-b", upstreamDir)
+	cmd.Dir = dest
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Could not build source package: %s", err)
+	}
+
+	res := &GitSource{
+		Dsc: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{
+				Source: last.Source,
+				Ver:    last.Ver,
+			},
+		},
+		Commit: commit,
+	}
+	f, err := os.Open(path.Join(dest, res.Dsc.Filename()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dsc, err := deb.ParseDsc(f)
+	if err != nil {
+		return nil, err
+	}
+	dsc.BasePath = dest
+	res.Dsc = *dsc
+	return res, nil
+}
+
+// exportTree extracts the content of a git tree-ish in dest, with the
+// given prefix
+func exportTree(repo, treeish, dest, prefix string) error {
+	archive := exec.Command("git", "archive", "--format=tar", "--prefix="+prefix, treeish)
+	archive.Dir = repo
+	extract := exec.Command("tar", "-x", "-C", dest)
+	var stderr, extractStderr bytes.Buffer
+	archive.Stderr = &stderr
+	extract.Stderr = &extractStderr
+
+	r, err := archive.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	extract.Stdin = r
+	if err := extract.Start(); err != nil {
+		return err
+	}
+	if err := archive.Run(); err != nil {
+		extract.Wait()
+		return fmt.Errorf("Could not export %s: %s", treeish, strings.TrimSpace(stderr.String()))
+	}
+	if err := extract.Wait(); err != nil {
+		return fmt.Errorf("Could not export %s: %s", treeish, strings.TrimSpace(extractStderr.String()))
+	}
+	return nil
+}
+
+// dep14Mangle mangles a version to be used in a git tag name, as
+// described in DEP-14
+func dep14Mangle(v string) string {
+	v = strings.Replace(v, "~", "_", -1)
+	v = strings.Replace(v, ":", "%", -1)
+	return strings.Replace(v, "..", ".#.", -1)
+}
+
+// upstreamTagCandidates returns the usual tag names of an upstream
+// version, by order of preference
+func upstreamTagCandidates(source, version string) []string {
+	candidates := []string{
+		"upstream/" + version,
+		"upstream/" + dep14Mangle(version),
+		"v" + version,
+		version,
+		source + "-" + version,
+	}
+	res := make([]string, 0, len(candidates))
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		res = append(res, c)
+	}
+	return res
+}
+
+// origTarball puts the orig tarball of the package in dest, and
+// returns where it comes from. It looks, in order, for an existing
+// tarball next to the repository, the pristine-tar branch, an
+// upstream tag, and otherwise exports HEAD without the debian
+// directory.
+func (p *GitDpkgSourcePackager) origTarball(repo string, e deb.ChangelogEntry, dest string) (string, error) {
+	prefix := fmt.Sprintf("%s_%s.orig.tar.", e.Source, e.Ver.UpstreamVersion)
+
+	existing, err := filepath.Glob(path.Join(path.Dir(repo), prefix+"*"))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range existing {
+		if strings.HasSuffix(f, ".asc") {
+			continue
+		}
+		if err := copyFile(f, path.Join(dest, path.Base(f))); err != nil {
+			return "", err
+		}
+		return f, nil
+	}
+
+	if _, err := runGit(repo, "rev-parse", "--verify", "-q", "refs/heads/pristine-tar"); err == nil {
+		if _, err := exec.LookPath("pristine-tar"); err == nil {
+			cmd := exec.Command("pristine-tar", "list")
+			cmd.Dir = repo
+			list, err := cmd.Output()
+			if err != nil {
+				return "", fmt.Errorf("Could not list pristine-tar tarballs: %s", err)
+			}
+			for _, name := range strings.Fields(string(list)) {
+				if strings.HasPrefix(name, prefix) == false {
+					continue
+				}
+				cmd := exec.Command("pristine-tar", "checkout", path.Join(dest, name))
+				cmd.Dir = repo
+				if out, err := cmd.CombinedOutput(); err != nil {
+					return "", fmt.Errorf("Could not checkout %s with pristine-tar:\n%s", name, out)
+				}
+				return "pristine-tar branch", nil
+			}
+		}
+	}
+
+	tarball := path.Join(dest, prefix+"gz")
+	upstreamDir := fmt.Sprintf("%s-%s/", e.Source, e.Ver.UpstreamVersion)
+	for _, tag := range upstreamTagCandidates(e.Source, e.Ver.UpstreamVersion) {
+		if _, err := runGit(repo, "rev-parse", "--verify", "-q", "refs/tags/"+tag); err != nil {
+			continue
+		}
+		if _, err := runGit(repo, "archive", "--format=tar.gz", "--prefix="+upstreamDir, "-o", tarball, "refs/tags/"+tag); err != nil {
+			return "", err
+		}
+		return "tag " + tag, nil
+	}
+
+	if _, err := runGit(repo, "archive", "--format=tar.gz", "--prefix="+upstreamDir, "-o", tarball, "HEAD", "--", ".", ":(exclude)debian"); err != nil {
+		return "", err
+	}
+	return "HEAD without debian/", nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func init() {
+	aptDepTracker.Add("git")
+}
@@ -0,0 +1,17 @@
+package main
+
+import "io"
+
+type GitSourcePackagerStub struct {
+	Res      *GitSource
+	Err      error
+	RepoPath string
+}
+
+func (g *GitSourcePackagerStub) BuildSource(repoPath, dest string, output io.Writer) (*GitSource, error) {
+	g.RepoPath = repoPath
+	if g.Err != nil {
+		return nil, g.Err
+	}
+	return g.Res, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type GitSourceSuite struct {
+	tmpDir string
+	repo   string
+	dest   string
+}
+
+var _ = Suite(&GitSourceSuite{})
+
+func (s *GitSourceSuite) git(c *C, args ...string) string {
+	args = append([]string{"-c", "user.name=Foo Bar", "-c", "user.email=foo@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.repo
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("git %s: %s", strings.Join(args, " "), out))
+	return strings.TrimSpace(string(out))
+}
+
+func (s *GitSourceSuite) write(c *C, name, content string) {
+	p := path.Join(s.repo, name)
+	c.Assert(os.MkdirAll(path.Dir(p), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(p, []byte(content), 0644), IsNil)
+}
+
+func (s *GitSourceSuite) SetUpTest(c *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "go-deb.ddesk_git_source_test_")
+	c.Assert(err, IsNil)
+	s.repo = path.Join(s.tmpDir, "foo")
+	s.dest = path.Join(s.tmpDir, "dest")
+	c.Assert(os.MkdirAll(s.repo, 0755), IsNil)
+	c.Assert(os.MkdirAll(s.dest, 0755), IsNil)
+
+	s.git(c, "init", "-q")
+	s.write(c, "foo.sh", "#!/bin/sh\necho foo\n")
+	s.git(c, "add", ".")
+	s.git(c, "commit", "-q", "-m", "upstream release")
+	s.git(c, "tag", "v1.0")
+
+	s.write(c, "debian/control", `Source: foo
+Section: misc
+Priority: optional
+Maintainer: Foo Bar <foo@example.com>
+Standards-Version: 3.9.5
+
+Package: foo
+Architecture: all
+Description: foo
+ foo
+`)
+	s.write(c, "debian/changelog", `foo (1.0-1) unstable; urgency=low
+
+  * Initial release
+
+ -- Foo Bar <foo@example.com>  Tue, 10 Jun 2014 21:44:59 +0200
+`)
+	s.write(c, "debian/source/format", "3.0 (quilt)\n")
+	s.write(c, "debian/rules", "#!/usr/bin/make -f\n%:\n\tdh $@\n")
+	s.git(c, "add", ".")
+	s.git(c, "commit", "-q", "-m", "debianize")
+}
+
+func (s *GitSourceSuite) TearDownTest(c *C) {
+	c.Assert(os.RemoveAll(s.tmpDir), IsNil)
+}
+
+func (s *GitSourceSuite) TestBuildsFromUpstreamTag(c *C) {
+	p := NewGitDpkgSourcePackager()
+	var out strings.Builder
+	res, err := p.BuildSource(path.Join(s.repo, "debian"), s.dest, &out)
+	c.Assert(err, IsNil, Commentf("%s", out.String()))
+
+	c.Check(res.Commit, Equals, s.git(c, "rev-parse", "HEAD"))
+	c.Check(res.Dsc.Identifier.Source, Equals, "foo")
+	c.Check(res.Dsc.Identifier.Ver, DeepEquals, deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"})
+	c.Check(res.Dsc.BasePath, Equals, s.dest)
+	c.Check(out.String(), Matches, "(?s).*Using orig tarball from tag v1.0\n.*")
+
+	names := []string{}
+	for _, f := range res.Dsc.Md5Files {
+		names = append(names, f.Name)
+		_, err := os.Stat(path.Join(s.dest, f.Name))
+		c.Check(err, IsNil)
+	}
+	c.Check(names, DeepEquals, []string{"foo_1.0.orig.tar.gz", "foo_1.0-1.debian.tar.xz"})
+}
+
+func (s *GitSourceSuite) TestFallsBackToHead(c *C) {
+	s.git(c, "tag", "-d", "v1.0")
+	p := NewGitDpkgSourcePackager()
+	var out strings.Builder
+	_, err := p.BuildSource(s.repo, s.dest, &out)
+	c.Assert(err, IsNil, Commentf("%s", out.String()))
+	c.Check(out.String(), Matches, "(?s).*Using orig tarball from HEAD without debian/\n.*")
+}
+
+func (s *GitSourceSuite) TestNativePackage(c *C) {
+	s.write(c, "debian/source/format", "3.0 (native)\n")
+	s.write(c, "debian/changelog", `foo (1.1) unstable; urgency=low
+
+  * Native release
+
+ -- Foo Bar <foo@example.com>  Tue, 10 Jun 2014 21:44:59 +0200
+`)
+	s.git(c, "commit", "-q", "-a", "-m", "native")
+
+	p := NewGitDpkgSourcePackager()
+	res, err := p.BuildSource(s.repo, s.dest, nil)
+	c.Assert(err, IsNil)
+	c.Check(res.Dsc.Md5Files, HasLen, 1)
+	c.Check(res.Dsc.Md5Files[0].Name, Equals, "foo_1.1.tar.xz")
+}
+
+func (s *GitSourceSuite) TestRejectsInvalidTrees(c *C) {
+	p := NewGitDpkgSourcePackager()
+
+	s.write(c, "foo.sh", "#!/bin/sh\necho bar\n")
+	_, err := p.BuildSource(s.repo, s.dest, nil)
+	c.Check(err, ErrorMatches, "Working tree `.*' has uncommitted changes")
+	s.git(c, "checkout", "foo.sh")
+
+	s.write(c, "debian/source/format", "3.0 (native)\n")
+	s.git(c, "commit", "-q", "-a", "-m", "broken format")
+	_, err = p.BuildSource(s.repo, s.dest, nil)
+	c.Check(err, ErrorMatches, "Source format `3.0 \\(native\\)' requires a native version, got 1.0-1")
+
+	_, err = p.BuildSource(s.tmpDir, s.dest, nil)
+	c.Check(err, ErrorMatches, "git rev-parse --show-toplevel failed: .*")
+}
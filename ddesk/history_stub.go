@@ -3,7 +3,8 @@ package main
 import deb ".."
 
 type HistoryStub struct {
-	hist []deb.SourcePackageRef
+	hist      []deb.SourcePackageRef
+	backports []Backport
 }
 
 func (h *HistoryStub) Append(p deb.SourcePackageRef) {
@@ -22,3 +23,15 @@ func (h *HistoryStub) RemoveFront(p deb.SourcePackageRef) {
 		h.hist = append(h.hist, oldP)
 	}
 }
+func (h *HistoryStub) AppendBackport(b Backport) {
+	h.backports = append([]Backport{b}, h.backports...)
+}
+func (h *HistoryStub) Backports(source string) []Backport {
+	var res []Backport
+	for _, b := range h.backports {
+		if b.Origin.Source == source {
+			res = append(res, b)
+		}
+	}
+	return res
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HookStages are the pbuilder hook stages user hooks can run at, see
+// pbuilder(8):
+//
+//	A: before the build, once the source package is unpacked
+//	B: after a successful build
+//	C: after a build failure
+//	D: before satisfying the build dependencies
+//	E: after the chroot is unpacked
+//	F: before a login in the chroot
+//	I: after a successful build, once the results are copied
+var HookStages = []string{"A", "B", "C", "D", "E", "F", "I"}
+
+// Hook is a user script run in the build environment at a stage of
+// the build
+type Hook struct {
+	Name   string
+	Stage  string
+	Script []byte
+}
+
+// HookRegistry stores the user hooks of a builder, builds select
+// them by name.
+type HookRegistry struct {
+	path string
+}
+
+var hookNameRx = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// NewHookRegistry returns the hooks registered in the builder
+// basepath
+func NewHookRegistry(basepath string) *HookRegistry {
+	return &HookRegistry{path: path.Join(basepath, "hooks")}
+}
+
+func checkHookName(name string) error {
+	if hookNameRx.MatchString(name) == false {
+		return fmt.Errorf("Invalid hook name `%s'", name)
+	}
+	return nil
+}
+
+func (r *HookRegistry) scriptPath(stage, name string) string {
+	return path.Join(r.path, stage, name)
+}
+
+// Add registers a hook, replacing the hook of the same name, if any
+func (r *HookRegistry) Add(h Hook) error {
+	if err := checkHookName(h.Name); err != nil {
+		return err
+	}
+	if strings.HasPrefix(h.Name, "ddesk-") {
+		return fmt.Errorf("Hook names starting with ddesk- are reserved")
+	}
+	valid := false
+	for _, s := range HookStages {
+		if s == h.Stage {
+			valid = true
+			break
+		}
+	}
+	if valid == false {
+		return fmt.Errorf("Invalid hook stage `%s', supported are %s", h.Stage, strings.Join(HookStages, ", "))
+	}
+	if old, err := r.Get(h.Name); err == nil && old.Stage != h.Stage {
+		if err := os.Remove(r.scriptPath(old.Stage, old.Name)); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path.Join(r.path, h.Stage), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.scriptPath(h.Stage, h.Name), h.Script, 0755)
+}
+
+// Get returns a registered hook
+func (r *HookRegistry) Get(name string) (*Hook, error) {
+	if err := checkHookName(name); err != nil {
+		return nil, err
+	}
+	for _, s := range HookStages {
+		script, err := ioutil.ReadFile(r.scriptPath(s, name))
+		if err == nil {
+			return &Hook{Name: name, Stage: s, Script: script}, nil
+		}
+		if os.IsNotExist(err) == false {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Unknown hook `%s'", name)
+}
+
+// Remove unregisters a hook
+func (r *HookRegistry) Remove(name string) error {
+	h, err := r.Get(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(r.scriptPath(h.Stage, h.Name))
+}
+
+// List returns the registered hooks, sorted by name
+func (r *HookRegistry) List() ([]Hook, error) {
+	res := []Hook{}
+	for _, s := range HookStages {
+		files, err := ioutil.ReadDir(path.Join(r.path, s))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, f := range files {
+			if f.Mode().IsRegular() == false || checkHookName(f.Name()) != nil {
+				continue
+			}
+			h, err := r.Get(f.Name())
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, *h)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// hookWrapper runs the script of a hook, copied aside in the pbuilder
+// hook directory, with its output prefixed by its name.
+const hookWrapper = `#!/bin/sh
+hookdir=$(dirname "$0")
+echo "--- Hook %[1]s (stage %[2]s)"
+{ "$hookdir/%[1]s.hook" 2>&1; echo $? > "$hookdir/%[1]s.status"; } | sed -e 's/^/[hook %[1]s] /'
+status=$(cat "$hookdir/%[1]s.status")
+echo "--- Hook %[1]s exited with status $status"
+exit $status
+`
+
+// Install copies the given hooks in the pbuilder hook directory dir
+func (r *HookRegistry) Install(dir string, names []string) error {
+	for _, name := range names {
+		h, err := r.Get(name)
+		if err != nil {
+			return err
+		}
+		if err := installHook(dir, *h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installHook copies h in the pbuilder hook directory dir
+func installHook(dir string, h Hook) error {
+	if err := ioutil.WriteFile(path.Join(dir, h.Name+".hook"), h.Script, 0755); err != nil {
+		return err
+	}
+	wrapper := fmt.Sprintf(hookWrapper, h.Name, h.Stage)
+	return ioutil.WriteFile(path.Join(dir, fmt.Sprintf("%s50%s", h.Stage, h.Name)), []byte(wrapper), 0755)
+}
+
+var hookLogRx = regexp.MustCompile(`^\[hook ([a-z0-9][a-z0-9_-]*)\] (.*)$`)
+
+// extractHookLogs returns the output of each hook in a build log
+func extractHookLogs(buildLog string) map[string]Log {
+	res := map[string]Log{}
+	scanner := bufio.NewScanner(strings.NewReader(buildLog))
+	for scanner.Scan() {
+		m := hookLogRx.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		res[m[1]] += Log(m[2] + "\n")
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
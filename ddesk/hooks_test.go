@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path"
+
+	. "gopkg.in/check.v1"
+)
+
+type HookRegistrySuite struct {
+	r *HookRegistry
+}
+
+var _ = Suite(&HookRegistrySuite{})
+
+func (s *HookRegistrySuite) SetUpTest(c *C) {
+	s.r = NewHookRegistry(c.MkDir())
+}
+
+func (s *HookRegistrySuite) TestRegistration(c *C) {
+	c.Assert(s.r.Add(Hook{Name: "lintian", Stage: "B", Script: []byte("#!/bin/sh\nlintian\n")}), IsNil)
+	c.Assert(s.r.Add(Hook{Name: "debug-tools", Stage: "D", Script: []byte("#!/bin/sh\napt-get install -y gdb\n")}), IsNil)
+	c.Check(s.r.Add(Hook{Name: "Shell", Stage: "C"}), ErrorMatches, "Invalid hook name `Shell'")
+	c.Check(s.r.Add(Hook{Name: "shell", Stage: "G"}), ErrorMatches, "Invalid hook stage `G', supported are A, B, C, D, E, F, I")
+	c.Check(s.r.Add(lintianHook()), ErrorMatches, "Hook names starting with ddesk- are reserved")
+
+	hooks, err := s.r.List()
+	c.Assert(err, IsNil)
+	c.Check(hooks, DeepEquals, []Hook{
+		{Name: "debug-tools", Stage: "D", Script: []byte("#!/bin/sh\napt-get install -y gdb\n")},
+		{Name: "lintian", Stage: "B", Script: []byte("#!/bin/sh\nlintian\n")},
+	})
+
+	// replacing a hook may change its stage
+	c.Assert(s.r.Add(Hook{Name: "lintian", Stage: "I", Script: []byte("#!/bin/sh\nlintian -I\n")}), IsNil)
+	h, err := s.r.Get("lintian")
+	c.Assert(err, IsNil)
+	c.Check(h.Stage, Equals, "I")
+	hooks, err = s.r.List()
+	c.Assert(err, IsNil)
+	c.Check(hooks, HasLen, 2)
+
+	c.Assert(s.r.Remove("lintian"), IsNil)
+	c.Check(s.r.Remove("lintian"), ErrorMatches, "Unknown hook `lintian'")
+	_, err = s.r.Get("lintian/B")
+	c.Check(err, ErrorMatches, "Invalid hook name `lintian/B'")
+}
+
+func (s *HookRegistrySuite) TestInstall(c *C) {
+	c.Assert(s.r.Add(Hook{Name: "check", Stage: "B", Script: []byte("#!/bin/sh\necho first\necho second >&2\nexit 3\n")}), IsNil)
+	dir := c.MkDir()
+	c.Assert(s.r.Install(dir, []string{"check"}), IsNil)
+	c.Check(s.r.Install(dir, []string{"missing"}), ErrorMatches, "Unknown hook `missing'")
+
+	out, err := exec.Command(path.Join(dir, "B50check")).CombinedOutput()
+	c.Check(err, ErrorMatches, "exit status 3")
+	c.Check(string(out), Equals, `--- Hook check (stage B)
+[hook check] first
+[hook check] second
+--- Hook check exited with status 3
+`)
+
+	logs := extractHookLogs("I: building\n" + string(out) + "[hook other] done\n")
+	c.Check(logs, DeepEquals, map[string]Log{
+		"check": "first\nsecond\n",
+		"other": "done\n",
+	})
+	c.Check(extractHookLogs("I: building\n"), IsNil)
+
+	script, err := ioutil.ReadFile(path.Join(dir, "check.hook"))
+	c.Check(err, IsNil)
+	c.Check(string(script), Equals, "#!/bin/sh\necho first\necho second >&2\nexit 3\n")
+}
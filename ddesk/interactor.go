@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log"
 	"path"
 
 	"launchpad.net/go-xdg"
@@ -15,6 +17,49 @@ type Interactor struct {
 	history         History
 	userDistConfig  UserDistSupportConfig
 	auth            DebfileAuthentifier
+	gitSource       GitSourcePackager
+	backporter      SourceBackporter
+}
+
+// dialBuilder connects to the builder at address
+func dialBuilder(o *Options, address string) (*ClientBuilder, error) {
+	network, addr := ParseBuilderAddress(address)
+	var tlsConfig *tls.Config
+	var token string
+	var err error
+	if network == "tcp" {
+		tlsConfig, err = NewClientTLSConfig(o.BuilderCA, o.BuilderCert, o.BuilderKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(o.BuilderToken) != 0 {
+		token, err = ReadTokenFile(o.BuilderToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return DialClientBuilder(network, addr, tlsConfig, token)
+}
+
+// newBuilder returns the builder given by the options, a pool if
+// several builders are given. Builders of a pool that cannot be
+// reached stay offline.
+func newBuilder(o *Options) (DebianBuilder, error) {
+	if len(o.BuilderSocket) == 1 {
+		return dialBuilder(o, o.BuilderSocket[0])
+	}
+	builders := make(map[string]DebianBuilder)
+	for _, address := range o.BuilderSocket {
+		b, err := dialBuilder(o, address)
+		if err != nil {
+			log.Printf("Builder %s is offline: %s", address, err)
+			builders[address] = &offlineBuilder{err: err}
+			continue
+		}
+		builders[address] = b
+	}
+	return NewBuilderPool(builders)
 }
 
 func NewInteractor(o *Options) (*Interactor, error) {
@@ -25,7 +70,7 @@ func NewInteractor(o *Options) (*Interactor, error) {
 
 	res := &Interactor{}
 	var err error
-	res.builder, err = NewClientBuilder("unix", o.BuilderSocket)
+	res.builder, err = newBuilder(o)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +100,9 @@ func NewInteractor(o *Options) (*Interactor, error) {
 		return nil, err
 	}
 
+	res.gitSource = NewGitDpkgSourcePackager()
+	res.backporter = NewDpkgSourceBackporter()
+
 	res.aptDeps, err = NewXdgAptDepsManager()
 	if err != nil {
 		return nil, err
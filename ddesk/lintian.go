@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LintianTag is a tag reported by lintian on a built package
+type LintianTag struct {
+	Package string
+	// Type of the package, source, binary or udeb, if reported
+	Type     string `json:",omitempty"`
+	Severity string
+	Tag      string
+	Info     string `json:",omitempty"`
+}
+
+func (t LintianTag) String() string {
+	pkg := t.Package
+	if len(t.Type) != 0 {
+		pkg += " " + t.Type
+	}
+	res := fmt.Sprintf("%s: %s: %s", strings.ToUpper(t.Severity[:1]), pkg, t.Tag)
+	if len(t.Info) != 0 {
+		res += " " + t.Info
+	}
+	return res
+}
+
+// lintianSeverities are the severities of the lintian tag codes
+var lintianSeverities = map[string]string{
+	"E": "error",
+	"W": "warning",
+	"I": "info",
+	"P": "pedantic",
+	"X": "experimental",
+	"O": "overridden",
+	"C": "classification",
+	"M": "masked",
+}
+
+// LintianFailSeverities are the severities a build can fail on, from
+// the most to the least severe
+var LintianFailSeverities = []string{"error", "warning", "info", "pedantic"}
+
+func lintianSeverityRank(severity string) int {
+	for i, s := range LintianFailSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+var lintianTagRx = regexp.MustCompile(`^([EWIPXOCM]): ([a-z0-9][a-z0-9+.-]*)(?: (source|binary|udeb))?: ([A-Za-z0-9][A-Za-z0-9+._/-]*)(?: (.*))?$`)
+
+// ParseLintianTags parses the tags of a lintian output. Tags reported
+// more than once, as when the packages of several architectures are
+// checked, are only returned once.
+func ParseLintianTags(output string) []LintianTag {
+	var res []LintianTag
+	seen := map[LintianTag]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		m := lintianTagRx.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		t := LintianTag{
+			Package:  m[2],
+			Type:     m[3],
+			Severity: lintianSeverities[m[1]],
+			Tag:      m[4],
+			Info:     m[5],
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		res = append(res, t)
+	}
+	return res
+}
+
+// lintianFailures returns the tags of severity failOn or more severe
+func lintianFailures(tags []LintianTag, failOn string) []LintianTag {
+	rank := lintianSeverityRank(failOn)
+	var res []LintianTag
+	for _, t := range tags {
+		if r := lintianSeverityRank(t.Severity); r >= 0 && r <= rank {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// lintianHookName is the name of the hook running lintian in the
+// build environment, its output is captured as the one of user hooks.
+const lintianHookName = "ddesk-lintian"
+
+// lintianCommand returns a shell command running lintian on the
+// changes files in dir, in the build environment. Its exit status
+// is always 0, as the fail policy is applied by ddesk.
+func lintianCommand(dir string) string {
+	return "apt-get install -y --no-install-recommends lintian > /dev/null 2>&1; " +
+		"for c in " + dir + "/*.changes; do lintian -I \"$c\"; done; true"
+}
+
+// lintianHook returns the pbuilder hook running lintian once the
+// package is built
+func lintianHook() Hook {
+	return Hook{
+		Name:   lintianHookName,
+		Stage:  "B",
+		Script: []byte("#!/bin/sh\n" + lintianCommand("\"${BUILDDIR:-/build}\"") + "\n"),
+	}
+}
+
+// lintianSbuildCommand returns the sbuild command running lintian once
+// the package is built, its output prefixed like a hook output.
+func lintianSbuildCommand() string {
+	return fmt.Sprintf("sh -c '{ %s; } 2>&1 | sed -e \"s/^/[hook %s] /\"'",
+		lintianCommand("%SBUILD_PKGBUILD_DIR/.."), lintianHookName)
+}
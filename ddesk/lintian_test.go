@@ -0,0 +1,46 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type LintianSuite struct{}
+
+var _ = Suite(&LintianSuite{})
+
+func (s *LintianSuite) TestParseTags(c *C) {
+	output := `E: foo source: source-is-missing src/foo.min.js
+W: foo: binary-without-manpage usr/bin/foo
+I: foo-doc: extended-description-is-probably-too-short
+E: Unable to locate package lintian
+N: some explanation
+W: foo: binary-without-manpage usr/bin/foo
+O: foo: hardening-no-fortify-functions usr/bin/foo
+`
+	tags := ParseLintianTags(output)
+	c.Check(tags, DeepEquals, []LintianTag{
+		{Package: "foo", Type: "source", Severity: "error", Tag: "source-is-missing", Info: "src/foo.min.js"},
+		{Package: "foo", Severity: "warning", Tag: "binary-without-manpage", Info: "usr/bin/foo"},
+		{Package: "foo-doc", Severity: "info", Tag: "extended-description-is-probably-too-short"},
+		{Package: "foo", Severity: "overridden", Tag: "hardening-no-fortify-functions", Info: "usr/bin/foo"},
+	})
+	c.Check(tags[0].String(), Equals, "E: foo source: source-is-missing src/foo.min.js")
+	c.Check(tags[2].String(), Equals, "I: foo-doc: extended-description-is-probably-too-short")
+
+	c.Check(lintianFailures(tags, "error"), DeepEquals, tags[:1])
+	c.Check(lintianFailures(tags, "warning"), DeepEquals, tags[:2])
+	c.Check(lintianFailures(tags, "pedantic"), DeepEquals, tags[:3])
+}
+
+func (s *LintianSuite) TestCommands(c *C) {
+	h := lintianHook()
+	c.Check(h.Stage, Equals, "B")
+	c.Check(string(h.Script), Equals, "#!/bin/sh\n"+
+		"apt-get install -y --no-install-recommends lintian > /dev/null 2>&1; "+
+		"for c in \"${BUILDDIR:-/build}\"/*.changes; do lintian -I \"$c\"; done; true\n")
+
+	c.Check(lintianSbuildCommand(), Equals, "sh -c '{ "+
+		"apt-get install -y --no-install-recommends lintian > /dev/null 2>&1; "+
+		"for c in %SBUILD_PKGBUILD_DIR/../*.changes; do lintian -I \"$c\"; done; true; "+
+		"} 2>&1 | sed -e \"s/^/[hook ddesk-lintian] /\"'")
+}
@@ -3,8 +3,12 @@ package main
 import "github.com/jessevdk/go-flags"
 
 type Options struct {
-	BuilderType   string `long:"type" short:"t" description:"Builder type for build operation, supported are client or cowbuilder" default:"client"`
-	BuilderSocket string `long:"socket" short:"s" description:"For client builder, address of the rpc server" default:"/var/lib/go-deb.ddesk/builder.sock"`
+	BuilderType   string   `long:"type" short:"t" description:"Builder type for build operation, supported are client or cowbuilder" default:"client"`
+	BuilderSocket []string `long:"socket" short:"s" description:"For client builder, address of the rpc server, a unix socket path or tcp://host:port. If repeated, builds are dispatched on the pool of builders" default:"/var/lib/go-deb.ddesk/builder.sock"`
+	BuilderCA     string   `long:"builder-ca" description:"For tcp builders, certificate authorities of the builder, default to the system ones"`
+	BuilderCert   string   `long:"builder-cert" description:"For tcp builders, client certificate for mutual TLS"`
+	BuilderKey    string   `long:"builder-key" description:"For tcp builders, key of the client certificate"`
+	BuilderToken  string   `long:"builder-token-file" description:"For tcp builders, file containing the authentication token"`
 }
 
 var options = &Options{}
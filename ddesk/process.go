@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killGracePeriod is how long a cancelled command has to terminate
+// after SIGTERM, before its whole process tree is killed.
+var killGracePeriod = 10 * time.Second
+
+// runCommand runs cmd until it exits or ctx is done, and then returns
+// ctx.Err(). On cancellation, the process group of cmd receives
+// SIGTERM, so that cowbuilder can clean up after itself. If it does
+// not exit within killGracePeriod, all its descendants, even those
+// that left its process group, are killed.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	pid := cmd.Process.Pid
+	// descendants are listed before they could be orphaned
+	tree := processTree(pid)
+	syscall.Kill(-pid, syscall.SIGTERM)
+	exited := false
+	select {
+	case <-done:
+		exited = true
+	case <-time.After(killGracePeriod):
+		tree = append(tree, processTree(pid)...)
+	}
+	// children of the group leader may survive it
+	syscall.Kill(-pid, syscall.SIGKILL)
+	for _, p := range tree {
+		syscall.Kill(p, syscall.SIGKILL)
+	}
+	if exited == false {
+		select {
+		case <-done:
+		case <-time.After(killGracePeriod):
+			return fmt.Errorf("%s (process %d could not be killed)", ctx.Err(), pid)
+		}
+	}
+	return ctx.Err()
+}
+
+// processTree returns the PIDs of the descendants of a process
+func processTree(pid int) []int {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	children := make(map[int][]int)
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(path.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command name may contain spaces and parenthesis
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], p)
+	}
+
+	var res []int
+	toVisit := children[pid]
+	for len(toVisit) > 0 {
+		p := toVisit[0]
+		toVisit = append(toVisit[1:], children[p]...)
+		res = append(res, p)
+	}
+	return res
+}
+
+// unescapeMountPoint decodes the octal escapes of /proc/mounts
+func unescapeMountPoint(s string) string {
+	var res []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				res = append(res, byte(c))
+				i = i + 3
+				continue
+			}
+		}
+		res = append(res, s[i])
+	}
+	return string(res)
+}
+
+// parseMountPoints returns the mount points of a /proc/mounts file
+// that are in dir, deepest first.
+func parseMountPoints(r io.Reader, dir string) ([]string, error) {
+	dir = path.Clean(dir)
+	var res []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		mp := unescapeMountPoint(fields[1])
+		if mp == dir || strings.HasPrefix(mp, dir+"/") {
+			res = append(res, mp)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(res)))
+	return res, scanner.Err()
+}
+
+func mountPointsUnder(dir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountPoints(f, dir)
+}
+
+// detachMounts lazily unmounts the filesystems mounted in dir, and
+// fails if some remain.
+func detachMounts(dir string) error {
+	mounts, err := mountPointsUnder(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		syscall.Unmount(m, syscall.MNT_DETACH)
+	}
+	mounts, err = mountPointsUnder(dir)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return fmt.Errorf("Could not unmount %s", strings.Join(mounts, ", "))
+	}
+	return nil
+}
+
+// cleanBuildPlace removes a chroot left by an interrupted command. It
+// refuses to remove anything if some filesystems could not be
+// unmounted, as they could be bind mounts of the host.
+func cleanBuildPlace(dir string) error {
+	if err := detachMounts(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
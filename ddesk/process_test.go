@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProcessSuite struct{}
+
+var _ = Suite(&ProcessSuite{})
+
+func (s *ProcessSuite) TestRunCommand(c *C) {
+	c.Check(runCommand(context.Background(), exec.Command("true")), IsNil)
+	c.Check(runCommand(context.Background(), exec.Command("false")), ErrorMatches, "exit status 1")
+}
+
+// isAlive tells if a process exists and is not a zombie
+func isAlive(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func (s *ProcessSuite) TestKillsProcessTree(c *C) {
+	oldGracePeriod := killGracePeriod
+	killGracePeriod = 100 * time.Millisecond
+	defer func() { killGracePeriod = oldGracePeriod }()
+
+	tmpDir := c.MkDir()
+	pidFile := path.Join(tmpDir, "pids")
+	// a child ignoring SIGTERM, and one leaving the process group
+	cmd := exec.Command("sh", "-c", `sh -c 'trap "" TERM; sleep 100' & echo $! >> pids; setsid sleep 100 & echo $! >> pids; wait`)
+	cmd.Dir = tmpDir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var pids []int
+	go func() {
+		defer cancel()
+		for i := 0; i < 500; i++ {
+			data, _ := ioutil.ReadFile(pidFile)
+			if lines := strings.Fields(string(data)); len(lines) == 2 {
+				for _, l := range lines {
+					pid, _ := strconv.Atoi(l)
+					pids = append(pids, pid)
+				}
+				// lets setsid exec sleep
+				time.Sleep(50 * time.Millisecond)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	err := runCommand(ctx, cmd)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+
+	c.Assert(pids, HasLen, 2)
+	for _, pid := range pids {
+		alive := true
+		for i := 0; i < 50 && alive; i++ {
+			alive = isAlive(pid)
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Check(alive, Equals, false, Commentf("process %d is alive", pid))
+	}
+}
+
+func (s *ProcessSuite) TestParseMountPoints(c *C) {
+	mounts := `proc /proc proc rw,nosuid 0 0
+proc /var/cache/build/cow.1234/proc proc rw 0 0
+devpts /var/cache/build/cow.1234/dev/pts devpts rw 0 0
+/dev/sda1 /var/cache/build/cow.1234/home/my\040repo ext4 rw 0 0
+/dev/sda1 /var/cache/build-other ext4 rw 0 0
+`
+	res, err := parseMountPoints(strings.NewReader(mounts), "/var/cache/build/")
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []string{
+		"/var/cache/build/cow.1234/proc",
+		"/var/cache/build/cow.1234/home/my repo",
+		"/var/cache/build/cow.1234/dev/pts",
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
@@ -209,9 +210,130 @@ func (r *Reprepro) ArchiveChanges(c *deb.ChangesFile, dir string) error {
 		return fmt.Errorf("Could not archive result of %s build:\n %s", c.Ref.Filename(), output)
 	}
 
+	if err = r.unsafeUpdateContents(c, dir, buildPackages); err != nil {
+		return fmt.Errorf("Could not update Contents indices of %s: %s", targetDist, err)
+	}
+
 	return nil
 }
 
+// contentsPath returns the path of the Contents index of d-a. It is
+// kept next to the reprepro database, and not in dists/ where it would
+// not be listed in the signed Release file, and would be removed by
+// the next export.
+func (r *Reprepro) contentsPath(d deb.Codename, a deb.Architecture) string {
+	return path.Join(r.basepath, "contents", string(d), fmt.Sprintf("Contents-%s.gz", a))
+}
+
+// legacyContentsPath returns the path of the Contents index of d-a
+// written by previous versions
+func (r *Reprepro) legacyContentsPath(d deb.Codename, a deb.Architecture) string {
+	return path.Join(r.basepath, "dists", string(d), "main", fmt.Sprintf("Contents-%s.gz", a))
+}
+
+func (r *Reprepro) unsafeLoadContents(d deb.Codename) (map[deb.Architecture]deb.ContentsIndex, error) {
+	res := make(map[deb.Architecture]deb.ContentsIndex)
+	for a := range r.dists[d] {
+		res[a] = make(deb.ContentsIndex)
+		f, err := os.Open(r.contentsPath(d, a))
+		if err != nil && os.IsNotExist(err) {
+			f, err = os.Open(r.legacyContentsPath(d, a))
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		gz, err := gzip.NewReader(f)
+		if err == nil {
+			res[a], err = deb.ParseContents(gz)
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", r.contentsPath(d, a), err)
+		}
+	}
+	return res, nil
+}
+
+func (r *Reprepro) unsafeSaveContents(d deb.Codename, indices map[deb.Architecture]deb.ContentsIndex) error {
+	for a, idx := range indices {
+		cPath := r.contentsPath(d, a)
+		if err := os.MkdirAll(path.Dir(cPath), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(cPath)
+		if err != nil {
+			return err
+		}
+		gz := gzip.NewWriter(f)
+		err = idx.Write(gz)
+		if err == nil {
+			err = gz.Close()
+		}
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			return fmt.Errorf("Could not write %s: %s", cPath, err)
+		}
+		if err := os.Remove(r.legacyContentsPath(d, a)); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reprepro) unsafeUpdateContents(c *deb.ChangesFile, dir string, packages []deb.BinaryPackageRef) error {
+	indices, err := r.unsafeLoadContents(c.Dist)
+	if err != nil {
+		return err
+	}
+	for _, p := range packages {
+		for _, idx := range indices {
+			idx.RemovePackage(p.Name)
+		}
+	}
+	for _, f := range c.Md5Files {
+		ref, err := deb.ClassifyFileName(f.Name)
+		// Contents indices only list installable packages
+		if err != nil || ref.Kind != deb.DebKind {
+			continue
+		}
+		contents, err := ReadDebContents(path.Join(dir, f.Name))
+		if err != nil {
+			return err
+		}
+		AddDebToContents(contents, indices)
+	}
+	return r.unsafeSaveContents(c.Dist, indices)
+}
+
+// SearchFile returns, for each architecture of the distribution, the
+// entries of the Contents index matching query.
+func (r *Reprepro) SearchFile(d deb.Codename, query string) (map[deb.Architecture][]deb.ContentsEntry, error) {
+	if _, ok := r.dists[d]; ok == false {
+		return nil, fmt.Errorf("Distribution %s is not supported", d)
+	}
+	if err := r.tryLock(); err != nil {
+		return nil, err
+	}
+	defer r.unlockOrPanic()
+
+	indices, err := r.unsafeLoadContents(d)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[deb.Architecture][]deb.ContentsEntry)
+	for a, idx := range indices {
+		if entries := idx.Search(query); len(entries) > 0 {
+			res[a] = entries
+		}
+	}
+	return res, nil
+}
+
 func (r *Reprepro) AddDistribution(d deb.Codename, a deb.Architecture) error {
 	saved, ok := r.dists[d]
 	if ok == false {
@@ -342,7 +464,18 @@ func (r *Reprepro) RemovePackage(d deb.Codename, p deb.BinaryPackageRef) error {
 	}
 	defer r.unlockOrPanic()
 
-	return r.unsafeRemovePackage(string(d), p.Name)
+	if err := r.unsafeRemovePackage(string(d), p.Name); err != nil {
+		return err
+	}
+
+	indices, err := r.unsafeLoadContents(d)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indices {
+		idx.RemovePackage(p.Name)
+	}
+	return r.unsafeSaveContents(d, indices)
 }
 
 func (r *Reprepro) Access() *AptRepositoryAccess {
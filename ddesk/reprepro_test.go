@@ -110,3 +110,33 @@ func (s *RepreproSuite) TestCanAddSameArchitectureTwice(c *C) {
 	c.Assert(err, IsNil, Commentf("Initialization error %s", err))
 
 }
+
+type RepreproContentsSuite struct{}
+
+var _ = Suite(&RepreproContentsSuite{})
+
+func (s *RepreproContentsSuite) TestContentsLocation(c *C) {
+	r := &Reprepro{
+		basepath: c.MkDir(),
+		dists:    map[deb.Codename]map[deb.Architecture]bool{deb.Unstable: {deb.Amd64: true}},
+	}
+	idx := make(deb.ContentsIndex)
+	idx.Add("libs/libfoo1", "usr/lib/libfoo.so.1")
+
+	// indices of previous versions are read, and moved out of dists/
+	legacy := r.legacyContentsPath(deb.Unstable, deb.Amd64)
+	c.Assert(os.MkdirAll(path.Dir(legacy), 0755), IsNil)
+	c.Assert(r.unsafeSaveContents(deb.Unstable, map[deb.Architecture]deb.ContentsIndex{deb.Amd64: idx}), IsNil)
+	c.Assert(os.Rename(r.contentsPath(deb.Unstable, deb.Amd64), legacy), IsNil)
+	indices, err := r.unsafeLoadContents(deb.Unstable)
+	c.Assert(err, IsNil)
+	c.Check(indices[deb.Amd64], DeepEquals, idx)
+
+	c.Assert(r.unsafeSaveContents(deb.Unstable, indices), IsNil)
+	_, err = os.Stat(legacy)
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(r.contentsPath(deb.Unstable, deb.Amd64), Equals, path.Join(r.basepath, "contents", "unstable", "Contents-amd64.gz"))
+	indices, err = r.unsafeLoadContents(deb.Unstable)
+	c.Assert(err, IsNil)
+	c.Check(indices[deb.Amd64], DeepEquals, idx)
+}
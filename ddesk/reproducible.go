@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	deb ".."
+)
+
+// ReproducibilityReport is the verdict of the verification that a
+// build is reproducible, obtained by rebuilding the package in a
+// varied environment.
+type ReproducibilityReport struct {
+	Reproducible bool
+	// The binary packages that were compared
+	Packages []string `json:",omitempty"`
+	// The differences between the two builds, per binary package
+	Differences map[string][]deb.DebDifference `json:",omitempty"`
+	// The binary packages produced by only one of the builds
+	Missing []string `json:",omitempty"`
+	// The installed build dependencies that changed between the
+	// builds, as reported by their .buildinfo files. They may explain
+	// the differences.
+	BuildDependencies []string `json:",omitempty"`
+	// The error of the rebuild, if it failed
+	RebuildError string `json:",omitempty"`
+}
+
+// String summarizes the verdict
+func (r ReproducibilityReport) String() string {
+	if len(r.RebuildError) != 0 {
+		return fmt.Sprintf("not reproducible, the rebuild failed: %s", r.RebuildError)
+	}
+	if r.Reproducible {
+		return fmt.Sprintf("reproducible, %d packages are identical", len(r.Packages))
+	}
+	return fmt.Sprintf("not reproducible, %d of %d packages differ", len(r.Differences)+len(r.Missing), len(r.Packages))
+}
+
+// reproducibleVariation returns the options of the rebuild verifying
+// that a build with opts is reproducible. As reprotest does, the
+// build path, the umask, the locale, the time zone and the clock are
+// varied. The time zone is 14 hours ahead of UTC, the default of the
+// build environments, and the clock of the build step is shifted by
+// 398 days, so that the date of the rebuild differs. The checks on the
+// results are not run again.
+func reproducibleVariation(opts BuildOptions) BuildOptions {
+	res := opts
+	res.Env = map[string]string{}
+	for k, v := range opts.Env {
+		res.Env[k] = v
+	}
+	res.Env["LANG"] = "fr_CH.UTF-8"
+	res.Env["LC_ALL"] = "fr_CH.UTF-8"
+	res.Env["TZ"] = "/usr/share/zoneinfo/Etc/GMT-14"
+	res.BuildPath = "/build/ddesk-rebuild"
+	res.Umask = "0002"
+	res.FakeTime = "+398d"
+	res.Lintian = false
+	res.LintianFailOn = ""
+	res.Autopkgtest = false
+	res.AutopkgtestBlocking = false
+	res.VerifyReproducible = false
+	return res
+}
+
+// resultFiles returns the files of a build with one of the given
+// extensions, sorted
+func resultFiles(res *BuildResult, extensions ...string) []string {
+	var files []string
+	if res.Changes == nil {
+		return files
+	}
+	for _, f := range res.Changes.Md5Files {
+		for _, ext := range extensions {
+			if path.Ext(f.Name) == ext {
+				files = append(files, f.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func readDebFile(filepath string) (*deb.DebFile, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res, err := deb.ReadDebFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", filepath, err)
+	}
+	return res, nil
+}
+
+func readBuildinfo(filepath string) (*deb.Buildinfo, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return deb.ParseBuildinfo(f)
+}
+
+// diffLists returns the elements only in a, prefixed by -, and the
+// elements only in b, prefixed by +
+func diffLists(a, b []string) []string {
+	inA := map[string]bool{}
+	for _, e := range a {
+		inA[e] = true
+	}
+	inB := map[string]bool{}
+	for _, e := range b {
+		inB[e] = true
+	}
+	var res []string
+	for _, e := range a {
+		if inB[e] == false {
+			res = append(res, "-"+e)
+		}
+	}
+	for _, e := range b {
+		if inA[e] == false {
+			res = append(res, "+"+e)
+		}
+	}
+	return res
+}
+
+// compareBuilds compares the binary packages of two builds of the
+// same source package
+func compareBuilds(first, second *BuildResult) (*ReproducibilityReport, error) {
+	res := &ReproducibilityReport{}
+
+	secondDebs := map[string]bool{}
+	for _, f := range resultFiles(second, ".deb", ".udeb", ".ddeb") {
+		secondDebs[f] = true
+	}
+	for _, f := range resultFiles(first, ".deb", ".udeb", ".ddeb") {
+		res.Packages = append(res.Packages, f)
+		if secondDebs[f] == false {
+			res.Missing = append(res.Missing, f)
+			continue
+		}
+		delete(secondDebs, f)
+		a, err := readDebFile(path.Join(first.BasePath, f))
+		if err != nil {
+			return nil, err
+		}
+		b, err := readDebFile(path.Join(second.BasePath, f))
+		if err != nil {
+			return nil, err
+		}
+		if diffs := deb.CompareDebFiles(a, b); len(diffs) != 0 {
+			if res.Differences == nil {
+				res.Differences = map[string][]deb.DebDifference{}
+			}
+			res.Differences[f] = diffs
+		}
+	}
+	for f := range secondDebs {
+		res.Missing = append(res.Missing, f)
+	}
+	sort.Strings(res.Missing)
+
+	secondInfos := map[string]bool{}
+	for _, f := range second.Buildinfo {
+		secondInfos[f] = true
+	}
+	for _, f := range first.Buildinfo {
+		if secondInfos[f] == false {
+			continue
+		}
+		a, err := readBuildinfo(path.Join(first.BasePath, f))
+		if err != nil {
+			return nil, err
+		}
+		b, err := readBuildinfo(path.Join(second.BasePath, f))
+		if err != nil {
+			return nil, err
+		}
+		res.BuildDependencies = append(res.BuildDependencies, diffLists(a.InstalledBuildDepends, b.InstalledBuildDepends)...)
+	}
+
+	res.Reproducible = len(res.Differences) == 0 && len(res.Missing) == 0
+	return res, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type ReproducibleSuite struct{}
+
+var _ = Suite(&ReproducibleSuite{})
+
+// buildTestDeb builds foo_1.0_all.deb in dir, shipping usr/bin/foo
+// with the given content
+func buildTestDeb(c *C, dir, content string) {
+	root := path.Join(dir, "root")
+	c.Assert(os.MkdirAll(path.Join(root, "DEBIAN"), 0755), IsNil)
+	c.Assert(os.MkdirAll(path.Join(root, "usr", "bin"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(root, "DEBIAN", "control"), []byte(`Package: foo
+Version: 1.0
+Architecture: all
+Maintainer: Foo <foo@example.com>
+Description: foo
+`), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(root, "usr", "bin", "foo"), []byte(content), 0755), IsNil)
+	cmd := exec.Command("dpkg-deb", "--root-owner-group", "-Zgzip", "--build", root, path.Join(dir, "foo_1.0_all.deb"))
+	cmd.Env = append(os.Environ(), "SOURCE_DATE_EPOCH=1500000000")
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%s", out))
+	c.Assert(os.RemoveAll(root), IsNil)
+}
+
+func (s *ReproducibleSuite) TestCompareBuilds(c *C) {
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		c.Skip("dpkg-deb is not installed")
+	}
+	changes := &deb.ChangesFile{
+		Md5Files: []deb.FileReference{
+			{Name: "foo_1.0.dsc"},
+			{Name: "foo_1.0_all.deb"},
+		},
+	}
+	first := &BuildResult{BasePath: c.MkDir(), Changes: changes}
+	second := &BuildResult{BasePath: c.MkDir(), Changes: changes}
+	buildTestDeb(c, first.BasePath, "#!/bin/sh\necho foo\n")
+	buildTestDeb(c, second.BasePath, "#!/bin/sh\necho foo\n")
+
+	r, err := compareBuilds(first, second)
+	c.Assert(err, IsNil)
+	c.Check(r.Reproducible, Equals, true)
+	c.Check(r.Packages, DeepEquals, []string{"foo_1.0_all.deb"})
+	c.Check(r.String(), Equals, "reproducible, 1 packages are identical")
+
+	buildTestDeb(c, second.BasePath, "#!/bin/sh\necho built on a monday\n")
+	r, err = compareBuilds(first, second)
+	c.Assert(err, IsNil)
+	c.Check(r.Reproducible, Equals, false)
+	c.Check(r.Differences, DeepEquals, map[string][]deb.DebDifference{
+		"foo_1.0_all.deb": {
+			{Member: "data.tar", Path: "usr/bin/foo", Description: "content differ"},
+		},
+	})
+	c.Check(r.String(), Equals, "not reproducible, 1 of 1 packages differ")
+
+	second.Changes = &deb.ChangesFile{}
+	r, err = compareBuilds(first, second)
+	c.Assert(err, IsNil)
+	c.Check(r.Reproducible, Equals, false)
+	c.Check(r.Missing, DeepEquals, []string{"foo_1.0_all.deb"})
+}
+
+func (s *ReproducibleSuite) TestVariation(c *C) {
+	opts := BuildOptions{
+		Env:                map[string]string{"FOO": "bar"},
+		Lintian:            true,
+		VerifyReproducible: true,
+	}
+	v := reproducibleVariation(opts)
+	c.Check(v.Check(), IsNil)
+	c.Check(opts.Env, DeepEquals, map[string]string{"FOO": "bar"})
+	c.Check(v.Env["FOO"], Equals, "bar")
+	c.Check(v.Env["TZ"], Equals, "/usr/share/zoneinfo/Etc/GMT-14")
+	c.Check(v.Lintian, Equals, false)
+	c.Check(v.VerifyReproducible, Equals, false)
+	c.Check(v.FakeTime, Equals, "+398d")
+	// the clock of pbuilder on the host is not shifted, the hook
+	// shifts it for the build step only
+	c.Check(pbuilderOptions(BuildOptions{BuildPath: v.BuildPath, Umask: v.Umask, FakeTime: v.FakeTime}), Equals, "export BUILDDIR='/build/ddesk-rebuild'\numask '0002'\n")
+
+	args, config := sbuildOptions(BuildOptions{BuildPath: v.BuildPath, Umask: v.Umask, FakeTime: v.FakeTime})
+	c.Check(args, DeepEquals, []string{"--add-depends=libfaketime", "--build-path=/build/ddesk-rebuild"})
+	c.Check(config, Equals, `$build_environment = {
+	'FAKETIME' => '+398d',
+	'FAKETIME_DONT_FAKE_MONOTONIC' => '1',
+	'LD_PRELOAD' => '/usr/$LIB/faketime/libfaketime.so.1',
+};
+umask(oct('0002'));
+1;
+`)
+}
+
+func (s *ReproducibleSuite) TestFakeTimeHook(c *C) {
+	h := fakeTimeHook("+398d")
+	c.Check(h.Name, Equals, "ddesk-faketime")
+	c.Check(h.Stage, Equals, "A")
+	c.Check(string(h.Script), Matches, `(?s)#!/bin/sh
+set -e
+apt-get install -y --no-install-recommends libfaketime
+dpkg-divert --local --rename --add /usr/bin/dpkg-buildpackage
+.*export FAKETIME='\+398d' FAKETIME_DONT_FAKE_MONOTONIC=1
+export LD_PRELOAD="/usr/\\\$LIB/faketime/libfaketime.so.1"
+exec /usr/bin/dpkg-buildpackage.distrib "\$@"
+.*`)
+}
+
+func (s *ReproducibleSuite) TestDiffLists(c *C) {
+	c.Check(diffLists([]string{"a (= 1)", "b (= 1)"}, []string{"a (= 1)", "b (= 2)", "c (= 1)"}),
+		DeepEquals, []string{"-b (= 1)", "+b (= 2)", "+c (= 1)"})
+	c.Check(diffLists([]string{"a"}, []string{"a"}), IsNil)
+}
@@ -2,126 +2,325 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"os/user"
 	"path"
-	"time"
+	"strconv"
+	"sync"
 
 	deb ".."
 )
 
+// transferChunkSize is the maximal size of the file chunks sent in a
+// single call
+var transferChunkSize = 1 << 20
+
 // ClientBuilder is a DebianBuilder that defers build operation to
-// another DebianBuilder through a unix socket (should be on the same
-// system)
+// another DebianBuilder through a unix socket, or a TCP connection to
+// a remote builder. Source packages are uploaded to the builder, and
+// build results downloaded back. The builder should be able to reach
+// the apt repositories of the build dependencies.
 type ClientBuilder struct {
 	conn *rpc.Client
 }
 
+// NewClientBuilder connects to a local RpcBuilderServer
 func NewClientBuilder(network, addr string) (*ClientBuilder, error) {
-	var err error
-	res := &ClientBuilder{}
-	res.conn, err = rpc.DialHTTP(network, addr)
-	return res, err
+	return DialClientBuilder(network, addr, nil, "")
 }
 
-// syncs the output of the to the given writer, errChan is here to
-// report that all the data was consumed.
-func (s *SyncOutputResults) sync(output io.Writer, errChan chan error) (*bytes.Buffer, error) {
-	// we connect to the given address, and write output to both
-	// writter and buffer
-	conn, err := net.Dial(s.Network, s.Address)
+// DialClientBuilder connects to a RpcBuilderServer. TCP connections
+// are secured with tlsConfig, which is then required. The token, if
+// not empty, is presented to the server.
+func DialClientBuilder(network, addr string, tlsConfig *tls.Config, token string) (*ClientBuilder, error) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.Dial(network, addr, tlsConfig)
+	} else if network == "tcp" {
+		return nil, fmt.Errorf("TCP connections to a builder require TLS")
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
 	if err != nil {
 		return nil, err
 	}
-	logData := &bytes.Buffer{}
-	go func() {
-		var logDest io.Writer = logData
-		if output != nil {
-			logDest = io.MultiWriter(logData, output)
-		}
+	if err := clientHandshake(conn, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ClientBuilder{conn: rpc.NewClient(conn)}, nil
+}
 
-		_, err := io.Copy(logDest, conn)
-		defer func() { errChan <- err }()
-		if err != nil {
-			return
-		}
-		err = conn.Close()
-	}()
+// Close closes the connection to the builder
+func (c *ClientBuilder) Close() error {
+	return c.conn.Close()
+}
 
-	return logData, nil
+// readSync copies a synchronized output to output until its end
+func (c *ClientBuilder) readSync(id SyncOutputID, output io.Writer) error {
+	for {
+		chunk := SyncOutputData{}
+		if err := c.conn.Call("RpcBuilder.ReadSync", id, &chunk); err != nil {
+			return err
+		}
+		if _, err := output.Write(chunk.Data); err != nil {
+			return err
+		}
+		if chunk.EOF {
+			return nil
+		}
+	}
 }
 
-func (c *ClientBuilder) initSynchronization(output io.Writer) (SyncOutputID, *bytes.Buffer, chan error, error) {
-	initArgs := NoValue{}
-	syncOut := SyncOutputResults{}
-	if err := c.conn.Call("RpcBuilder.InitSync", initArgs, &syncOut); err != nil {
-		return 0, nil, nil, err
+// callSynchronized calls a method whose output is synchronized to
+// output, and returns the synchronized data. If ctx is done before
+// the call returns, the server is asked to abort the call.
+func (c *ClientBuilder) callSynchronized(ctx context.Context, method string, args func(SyncOutputID) interface{}, reply interface{}, output io.Writer) (*bytes.Buffer, error) {
+	var id SyncOutputID
+	if err := c.conn.Call("RpcBuilder.InitSync", NoValue{}, &id); err != nil {
+		return nil, err
+	}
+
+	logData := &bytes.Buffer{}
+	var logDest io.Writer = logData
+	if output != nil {
+		logDest = io.MultiWriter(logData, output)
+	}
+	readErr := make(chan error, 1)
+	go func() { readErr <- c.readSync(id, logDest) }()
+
+	call := c.conn.Go(method, args(id), reply, nil)
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		c.conn.Call("RpcBuilder.CancelSync", id, &NoValue{})
+		<-call.Done
+	}
+	// the output may not have been used if the call failed early
+	c.conn.Call("RpcBuilder.CloseSync", id, &NoValue{})
+	err := <-readErr
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if call.Error != nil {
+		return nil, call.Error
 	}
-	errChan := make(chan error)
-	logData, err := syncOut.sync(output, errChan)
 	if err != nil {
-		return 0, nil, nil, err
+		return nil, err
 	}
-	return syncOut.ID, logData, errChan, nil
+	return logData, nil
 }
 
-func (c *ClientBuilder) BuildPackage(args BuildArguments, output io.Writer) (*BuildResult, error) {
-	id, logData, errChan, err := c.initSynchronization(output)
+// BuildPackage submits a build job, attach to it and fetches its
+// result in the destination directory. If ctx is done, or the
+// connection to the builder is lost, the job is cancelled.
+func (c *ClientBuilder) BuildPackage(ctx context.Context, args BuildArguments, output io.Writer) (*BuildResult, error) {
+	jobID, err := c.submit(args, true)
 	if err != nil {
 		return nil, err
 	}
-	rArgs := RpcBuildArguments{
-		ID:   id,
-		Args: args,
+
+	job, logData, err := c.attachJob(ctx, jobID, output)
+	if ctx.Err() != nil {
+		if cerr := c.CancelJob(jobID); cerr != nil {
+			return nil, fmt.Errorf("%s, and could not cancel build job %d: %s", ctx.Err(), jobID, cerr)
+		}
+		return nil, ctx.Err()
 	}
-	res := &BuildResult{}
-	if err = c.conn.Call("RpcBuilder.Build", rArgs, res); err != nil {
+	if err != nil {
 		return nil, err
 	}
-	err = <-errChan
+	if err := job.Err(); err != nil {
+		return nil, err
+	}
+	res := job.Result
+	if res == nil {
+		res = &BuildResult{}
+	} else if len(args.Dest) != 0 {
+		if res, err = c.FetchResult(jobID, args.Dest); err != nil {
+			return nil, err
+		}
+	}
 	res.BuildLog = Log(logData.String())
 
-	return res, err
+	return res, nil
 }
 
-func (c *ClientBuilder) InitDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error {
-	id, _, errChan, err := c.initSynchronization(output)
+// upload sends a file to an upload of the server
+func (c *ClientBuilder) upload(id UploadID, filePath string) error {
+	f, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	buf := make([]byte, transferChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			chunk := UploadChunk{ID: id, Name: path.Base(filePath), Data: buf[:n]}
+			if err := c.conn.Call("RpcBuilder.Upload", chunk, &NoValue{}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
 
-	args := CreateArgs{
-		ID:   id,
-		Dist: d,
-		Arch: a,
+// SubmitBuild uploads the source package to the builder, and queues
+// its build. The job goes on once the client disconnects, and can be
+// attached again.
+func (c *ClientBuilder) SubmitBuild(args BuildArguments) (BuildJobID, error) {
+	return c.submit(args, false)
+}
+
+// submit uploads the source package to the builder, and queues its
+// build, cancelled on disconnection if cancelOnDisconnect is set
+func (c *ClientBuilder) submit(args BuildArguments, cancelOnDisconnect bool) (BuildJobID, error) {
+	var id UploadID
+	if err := c.conn.Call("RpcBuilder.InitUpload", NoValue{}, &id); err != nil {
+		return 0, err
 	}
-	if err = c.conn.Call("RpcBuilder.Create", args, nil); err != nil {
-		return err
+	dsc := args.SourcePackage
+	files := []string{dsc.Filename()}
+	for _, f := range dsc.Md5Files {
+		files = append(files, f.Name)
 	}
-	err = <-errChan
-	return err
+	for _, f := range files {
+		if err := c.upload(id, path.Join(dsc.BasePath, f)); err != nil {
+			c.conn.Call("RpcBuilder.CancelUpload", id, &NoValue{})
+			return 0, fmt.Errorf("Could not upload %s: %s", f, err)
+		}
+	}
+
+	var res BuildJobID
+	err := c.conn.Call("RpcBuilder.Submit", RpcSubmitArgs{
+		Upload:             id,
+		Args:               args,
+		CancelOnDisconnect: cancelOnDisconnect,
+	}, &res)
+	return res, err
 }
 
-func (c *ClientBuilder) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
-	return fmt.Errorf("Client builder are not allowed to remove distribution/architecture")
+func (c *ClientBuilder) ListJobs() ([]BuildJob, error) {
+	res := BuildJobList{}
+	if err := c.conn.Call("RpcBuilder.Jobs", NoValue{}, &res); err != nil {
+		return nil, err
+	}
+	return res.Jobs, nil
+}
+
+func (c *ClientBuilder) GetJob(id BuildJobID) (*BuildJob, error) {
+	res := &BuildJob{}
+	if err := c.conn.Call("RpcBuilder.Job", id, res); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
-func (c *ClientBuilder) UpdateDistribution(d deb.Codename, a deb.Architecture, output io.Writer) error {
-	id, _, errChan, err := c.initSynchronization(output)
+func (c *ClientBuilder) attachJob(ctx context.Context, jobID BuildJobID, output io.Writer) (*BuildJob, *bytes.Buffer, error) {
+	res := &BuildJob{}
+	logData, err := c.callSynchronized(ctx, "RpcBuilder.Attach", func(id SyncOutputID) interface{} {
+		return AttachArgs{ID: id, Job: jobID}
+	}, res, output)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return res, logData, nil
+}
 
-	if err = c.conn.Call("RpcBuilder.Update", UpdateArgs{ID: id, Dist: d, Arch: a}, &NoValue{}); err != nil {
+// AttachJob implements DebianBuilder. If ctx is done, the client
+// detaches from the job, which goes on.
+func (c *ClientBuilder) AttachJob(ctx context.Context, jobID BuildJobID, output io.Writer) (*BuildJob, error) {
+	res, _, err := c.attachJob(ctx, jobID, output)
+	return res, err
+}
+
+func (c *ClientBuilder) CancelJob(id BuildJobID) error {
+	return c.conn.Call("RpcBuilder.Cancel", id, &NoValue{})
+}
+
+// download copies a result file of a job to dest
+func (c *ClientBuilder) download(id BuildJobID, name, dest string) error {
+	f, err := os.Create(path.Join(dest, name))
+	if err != nil {
 		return err
 	}
-	err = <-errChan
+	defer f.Close()
+	for offset := int64(0); ; {
+		chunk := FileChunk{}
+		if err := c.conn.Call("RpcBuilder.ReadResult", ReadResultArgs{Job: id, Name: name, Offset: offset}, &chunk); err != nil {
+			return err
+		}
+		if _, err := f.Write(chunk.Data); err != nil {
+			return err
+		}
+		offset += int64(len(chunk.Data))
+		if chunk.EOF {
+			return nil
+		}
+	}
+}
+
+// FetchResult implements DebianBuilder, by downloading the result
+// files of the job
+func (c *ClientBuilder) FetchResult(id BuildJobID, dest string) (*BuildResult, error) {
+	job, err := c.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State != JobSucceeded || job.Result == nil {
+		return nil, fmt.Errorf("Build job %d has no result", id)
+	}
+	files := ResultFileList{}
+	if err := c.conn.Call("RpcBuilder.ResultFiles", id, &files); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	for _, name := range files.Files {
+		if err := checkFileName(name); err != nil {
+			return nil, err
+		}
+		if err := c.download(id, name, dest); err != nil {
+			return nil, fmt.Errorf("Could not download %s: %s", name, err)
+		}
+	}
+	res := *job.Result
+	res.BasePath = dest
+	return &res, nil
+}
+
+func (c *ClientBuilder) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	_, err := c.callSynchronized(ctx, "RpcBuilder.Create", func(id SyncOutputID) interface{} {
+		return CreateArgs{ID: id, Dist: d, Arch: a}
+	}, &NoValue{}, output)
+	return err
+}
+
+func (c *ClientBuilder) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
+	return fmt.Errorf("Client builder are not allowed to remove distribution/architecture")
+}
+
+func (c *ClientBuilder) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	_, err := c.callSynchronized(ctx, "RpcBuilder.Update", func(id SyncOutputID) interface{} {
+		return UpdateArgs{ID: id, Dist: d, Arch: a}
+	}, &NoValue{}, output)
 	return err
 }
 
@@ -143,154 +342,172 @@ func (c *ClientBuilder) AvailableArchitectures(d deb.Codename) ArchitectureList
 
 type SyncOutputID uint64
 
+// syncOutput buffers the output of a call until its client reads it
 type syncOutput struct {
-	id      SyncOutputID
-	w       io.WriteCloser
-	timeout *time.Time
-	file    string
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+	// done once the call should be aborted
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func (s syncOutput) Close() {
-	if s.w != nil {
-		s.w.Close()
-	}
-	if len(s.file) != 0 {
-		os.Remove(s.file)
-	}
+func newSyncOutput(ctx context.Context) *syncOutput {
+	res := &syncOutput{}
+	res.cond = sync.NewCond(&res.mutex)
+	res.ctx, res.cancel = context.WithCancel(ctx)
+	return res
 }
 
-type SyncOutputResults struct {
-	//the address of the unix socket that will be use to send the
-	//build output
-	Network, Address string
-	//the ID of the current synchronized output
-	ID SyncOutputID
+// Write implements io.Writer
+func (s *syncOutput) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	s.buf.Write(p)
+	s.cond.Broadcast()
+	return len(p), nil
 }
 
-type RpcBuilder struct {
-	actualBuilder DebianBuilder
+// Close ends the output, once its data is read
+func (s *syncOutput) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
 
-	ticker                             chan bool
-	generator                          chan SyncOutputID
-	timeoutClearer, timeouter, remover chan SyncOutputID
-	syncOutputs                        map[SyncOutputID]syncOutput
-	logger                             *log.Logger
+// read waits for data, or the end of the output
+func (s *syncOutput) read(res *SyncOutputData) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.buf.Len() == 0 && s.closed == false {
+		s.cond.Wait()
+	}
+	n := s.buf.Len()
+	if n > transferChunkSize {
+		n = transferChunkSize
+	}
+	res.Data = append([]byte(nil), s.buf.Next(n)...)
+	res.EOF = s.closed && s.buf.Len() == 0
 }
 
-func (b *RpcBuilder) manageSyncID() {
-	newId := SyncOutputID(0)
+type SyncOutputData struct {
+	Data []byte
+	EOF  bool
+}
 
-	b.ticker = make(chan bool)
+type UploadID uint64
 
-	go func() {
-		time.Sleep(10 * time.Second)
-		b.ticker <- true
-	}()
-	i := 0
-	for {
-		select {
-		case b.generator <- newId:
-			newId = newId + 1
-		case toRemove := <-b.remover:
-			b.syncOutputs[toRemove].Close()
-			delete(b.syncOutputs, toRemove)
-		case id := <-b.timeouter:
-			s, ok := b.syncOutputs[id]
-			if ok == true {
-				time := time.Now().Add(100 * time.Second)
-				s.timeout = &time
-			}
-		case id := <-b.timeoutClearer:
-			s, ok := b.syncOutputs[id]
-			if ok == true {
-				s.timeout = nil
-			}
-		case _ = <-b.ticker:
-			for k, v := range b.syncOutputs {
-				if v.timeout == nil {
-					continue
-				}
-				if time.Now().After(*v.timeout) {
-					v.Close()
-					delete(b.syncOutputs, k)
-				}
-			}
+// RpcBuilder is the RPC service of a RpcBuilderServer connection. The
+// calls of a connection are aborted once it is closed.
+type RpcBuilder struct {
+	actualBuilder DebianBuilder
+	logger        *log.Logger
+	ctx           context.Context
+
+	mutex       sync.Mutex
+	nextID      uint64
+	syncOutputs map[SyncOutputID]*syncOutput
+	uploads     map[UploadID]string
+	// jobs cancelled when the connection is closed
+	ownedJobs []BuildJobID
+}
+
+func newRpcBuilder(ctx context.Context, builder DebianBuilder, logger *log.Logger) *RpcBuilder {
+	return &RpcBuilder{
+		actualBuilder: builder,
+		logger:        logger,
+		ctx:           ctx,
+		syncOutputs:   make(map[SyncOutputID]*syncOutput),
+		uploads:       make(map[UploadID]string),
+	}
+}
+
+// close releases the outputs and uploads of the connection, and
+// cancels the jobs it owns
+func (b *RpcBuilder) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, id := range b.ownedJobs {
+		job, err := b.actualBuilder.GetJob(id)
+		if err != nil || job.State.Finished() {
+			continue
+		}
+		b.logger.Printf("Client of job %d disconnected, cancelling it\n", id)
+		if err := b.actualBuilder.CancelJob(id); err != nil {
+			b.logger.Printf("Could not cancel job %d: %s\n", id, err)
 		}
-		i = i + 1
+	}
+	b.ownedJobs = nil
+	for id, s := range b.syncOutputs {
+		s.cancel()
+		s.Close()
+		delete(b.syncOutputs, id)
+	}
+	for id, dir := range b.uploads {
+		os.RemoveAll(dir)
+		delete(b.uploads, id)
 	}
 }
 
-func (b *RpcBuilder) waitForSyncOutputConnection(l net.Listener, id SyncOutputID) {
-	b.timeouter <- id
-	defer l.Close()
-	conn, err := l.Accept()
-	if err != nil {
-		//todo: log
-		return
-	}
-	b.timeoutClearer <- id
+func (b *RpcBuilder) syncOutput(id SyncOutputID) (*syncOutput, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	s, ok := b.syncOutputs[id]
 	if ok == false {
-		//todo: loh
-		return
+		return nil, fmt.Errorf("No output synchronization %d available", id)
 	}
-	s.w = conn
-	b.syncOutputs[id] = s
-	b.timeouter <- id
+	return s, nil
 }
 
 type NoValue struct{}
 
-func (b *RpcBuilder) InitSync(args NoValue, res *SyncOutputResults) error {
-	id := <-b.generator
-	tmpFile := path.Join(os.TempDir(), fmt.Sprintf("go-deb.ddesk-%d-%d.sock", os.Getpid(), id))
-	l, err := listenUnix(tmpFile)
+// InitSync creates an output for a call, to be read with ReadSync
+func (b *RpcBuilder) InitSync(args NoValue, res *SyncOutputID) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nextID++
+	id := SyncOutputID(b.nextID)
+	b.syncOutputs[id] = newSyncOutput(b.ctx)
+	*res = id
+	return nil
+}
+
+// ReadSync waits for the next data of an output
+func (b *RpcBuilder) ReadSync(id SyncOutputID, res *SyncOutputData) error {
+	s, err := b.syncOutput(id)
 	if err != nil {
 		return err
 	}
-
-	s := syncOutput{
-		id:   id,
-		file: tmpFile,
+	s.read(res)
+	if res.EOF {
+		b.mutex.Lock()
+		delete(b.syncOutputs, id)
+		b.mutex.Unlock()
+		s.cancel()
 	}
-	b.syncOutputs[id] = s
-	res.ID = id
-	res.Network = "unix"
-	res.Address = tmpFile
-	go b.waitForSyncOutputConnection(l, id)
 	return nil
 }
 
-type RpcBuildArguments struct {
-	ID   SyncOutputID
-	Args BuildArguments
-}
-
-func (b *RpcBuilder) Build(args RpcBuildArguments, res *BuildResult) error {
-	b.timeoutClearer <- args.ID
-	s, ok := b.syncOutputs[args.ID]
-	if ok == false {
-		return fmt.Errorf("No output synchronization %d available", args.ID)
-	}
-	defer func() { b.remover <- args.ID }()
-	writer := s.w
-	if writer == nil {
-		return fmt.Errorf("Client is not connected to synchronization output %d", args.ID)
-	}
-
-	b.logger.Printf("[%d]: Building package %s for distribution %s and architectures %s\n", args.ID,
-		args.Args.SourcePackage.Identifier,
-		args.Args.Dist,
-		args.Args.Archs)
-	actualRes, err := b.actualBuilder.BuildPackage(args.Args, s.w)
-	b.logger.Printf("[%d]: Built %s, success:%v\n", args.ID, args.Args.SourcePackage.Identifier, err == nil)
+// CancelSync aborts the call using an output
+func (b *RpcBuilder) CancelSync(id SyncOutputID, res *NoValue) error {
+	s, err := b.syncOutput(id)
 	if err != nil {
 		return err
 	}
-	// do not re-send build log over network
-	if actualRes != nil {
-		actualRes.BuildLog = Log("")
-		*res = *actualRes
+	s.cancel()
+	return nil
+}
+
+// CloseSync ends an output, which is otherwise ended by the call using
+// it
+func (b *RpcBuilder) CloseSync(id SyncOutputID, res *NoValue) error {
+	if s, err := b.syncOutput(id); err == nil {
+		s.Close()
 	}
 	return nil
 }
@@ -301,22 +518,18 @@ type CreateArgs struct {
 	Arch deb.Architecture
 }
 
+// Create initializes a distribution. It is aborted if the client
+// disconnects, as Update is.
 func (b *RpcBuilder) Create(args CreateArgs, res *NoValue) error {
-	b.timeoutClearer <- args.ID
-	s, ok := b.syncOutputs[args.ID]
-	if ok == false {
-		return fmt.Errorf("No output synchronization %d available", args.ID)
-	}
-	defer func() { b.remover <- args.ID }()
-
-	writer := s.w
-	if writer == nil {
-		return fmt.Errorf("Client is not connected to synchronization output %d", args.ID)
+	out, err := b.syncOutput(args.ID)
+	if err != nil {
+		return err
 	}
+	defer out.Close()
 
-	b.logger.Printf("[%d]: Creating distribution %s-%s\n", args.ID, args.Dist, args.Arch)
-	err := b.actualBuilder.InitDistribution(args.Dist, args.Arch, writer)
-	b.logger.Printf("[%d]: Created distribution %s-%s, success:%v\n", args.ID, args.Dist, args.Arch, err == nil)
+	b.logger.Printf("Creating distribution %s-%s\n", args.Dist, args.Arch)
+	err = b.actualBuilder.InitDistribution(out.ctx, args.Dist, args.Arch, out)
+	b.logger.Printf("Created distribution %s-%s, success:%v\n", args.Dist, args.Arch, err == nil)
 
 	return err
 }
@@ -328,23 +541,259 @@ type UpdateArgs struct {
 }
 
 func (b *RpcBuilder) Update(args UpdateArgs, res *NoValue) error {
-	b.timeoutClearer <- args.ID
-	s, ok := b.syncOutputs[args.ID]
+	out, err := b.syncOutput(args.ID)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	b.logger.Printf("Updating distribution %s-%s", args.Dist, args.Arch)
+	err = b.actualBuilder.UpdateDistribution(out.ctx, args.Dist, args.Arch, out)
+	b.logger.Printf("Updated distribution %s-%s, success:%v", args.Dist, args.Arch, err == nil)
+	return err
+}
+
+// checkFileName ensures a file name sent by a client stays in its
+// directory
+func checkFileName(name string) error {
+	if len(name) == 0 || name == "." || name == ".." || path.Base(name) != name {
+		return fmt.Errorf("Invalid file name `%s'", name)
+	}
+	return nil
+}
+
+// checkSourceFileNames checks that the files of dsc are named after
+// files of an upload, and not paths elsewhere
+func checkSourceFileNames(dsc deb.SourceControlFile) error {
+	if err := checkFileName(dsc.Filename()); err != nil {
+		return err
+	}
+	for _, f := range dsc.Md5Files {
+		if err := checkFileName(f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitUpload creates a directory to receive source files
+func (b *RpcBuilder) InitUpload(args NoValue, res *UploadID) error {
+	dir, err := ioutil.TempDir("", "go-deb.ddesk_upload_")
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nextID++
+	*res = UploadID(b.nextID)
+	b.uploads[*res] = dir
+	return nil
+}
+
+func (b *RpcBuilder) uploadDir(id UploadID) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	dir, ok := b.uploads[id]
 	if ok == false {
-		return fmt.Errorf("No output sunchronization %d available", args.ID)
+		return "", fmt.Errorf("No upload %d", id)
 	}
-	defer func() { b.remover <- args.ID }()
-	writer := s.w
-	if writer == nil {
-		return fmt.Errorf("Client is not connected to synchronization output %d", args.ID)
+	return dir, nil
+}
+
+// CancelUpload removes an upload
+func (b *RpcBuilder) CancelUpload(id UploadID, res *NoValue) error {
+	dir, err := b.uploadDir(id)
+	if err != nil {
+		return err
 	}
+	b.mutex.Lock()
+	delete(b.uploads, id)
+	b.mutex.Unlock()
+	return os.RemoveAll(dir)
+}
 
-	b.logger.Printf("[%d]: Updating distribution %s-%s", args.ID, args.Dist, args.Arch)
-	err := b.actualBuilder.UpdateDistribution(args.Dist, args.Arch, writer)
-	b.logger.Printf("[%d]: Updated distribution %s-%s, success:%v", args.ID, args.Dist, args.Arch, err == nil)
+type UploadChunk struct {
+	ID   UploadID
+	Name string
+	Data []byte
+}
+
+// Upload appends data to a file of an upload
+func (b *RpcBuilder) Upload(args UploadChunk, res *NoValue) error {
+	dir, err := b.uploadDir(args.ID)
+	if err != nil {
+		return err
+	}
+	if err := checkFileName(args.Name); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(dir, args.Name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(args.Data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	return err
 }
 
+type RpcSubmitArgs struct {
+	// The upload containing the source package files
+	Upload UploadID
+	Args   BuildArguments
+	// Cancels the job if the connection is closed before it ends
+	CancelOnDisconnect bool
+}
+
+// Submit queues the build of an uploaded source package
+func (b *RpcBuilder) Submit(args RpcSubmitArgs, res *BuildJobID) error {
+	dir, err := b.uploadDir(args.Upload)
+	if err != nil {
+		return err
+	}
+	defer b.CancelUpload(args.Upload, &NoValue{})
+
+	if err := checkSourceFileNames(args.Args.SourcePackage); err != nil {
+		return err
+	}
+	if err := args.Args.Options.Check(); err != nil {
+		return err
+	}
+	args.Args.SourcePackage.BasePath = dir
+	id, err := b.actualBuilder.SubmitBuild(args.Args)
+	if err != nil {
+		return err
+	}
+	b.logger.Printf("Submitted job %d: building package %s for distribution %s and architectures %s\n", id,
+		args.Args.SourcePackage.Identifier,
+		args.Args.Dist,
+		args.Args.Archs)
+	if args.CancelOnDisconnect {
+		b.mutex.Lock()
+		b.ownedJobs = append(b.ownedJobs, id)
+		b.mutex.Unlock()
+	}
+	*res = id
+	return nil
+}
+
+type BuildJobList struct {
+	Jobs []BuildJob
+}
+
+func (b *RpcBuilder) Jobs(args NoValue, res *BuildJobList) error {
+	jobs, err := b.actualBuilder.ListJobs()
+	res.Jobs = jobs
+	return err
+}
+
+func (b *RpcBuilder) Job(id BuildJobID, res *BuildJob) error {
+	job, err := b.actualBuilder.GetJob(id)
+	if err != nil {
+		return err
+	}
+	*res = *job
+	return nil
+}
+
+func (b *RpcBuilder) Cancel(id BuildJobID, res *NoValue) error {
+	b.logger.Printf("Cancelling job %d\n", id)
+	return b.actualBuilder.CancelJob(id)
+}
+
+type AttachArgs struct {
+	ID  SyncOutputID
+	Job BuildJobID
+}
+
+func (b *RpcBuilder) Attach(args AttachArgs, res *BuildJob) error {
+	out, err := b.syncOutput(args.ID)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// a disconnection of the client only stops the attachment, jobs
+	// submitted to be cancelled on disconnection are cancelled by
+	// close
+	job, err := b.actualBuilder.AttachJob(out.ctx, args.Job, out)
+	if err != nil {
+		return err
+	}
+	*res = *job
+	return nil
+}
+
+// resultPath returns the directory of the result of a job
+func (b *RpcBuilder) resultPath(id BuildJobID) (string, error) {
+	job, err := b.actualBuilder.GetJob(id)
+	if err != nil {
+		return "", err
+	}
+	if job.State != JobSucceeded || job.Result == nil {
+		return "", fmt.Errorf("Build job %d has no result", id)
+	}
+	return job.Result.BasePath, nil
+}
+
+type ResultFileList struct {
+	Files []string
+}
+
+// ResultFiles lists the result files of a job
+func (b *RpcBuilder) ResultFiles(id BuildJobID, res *ResultFileList) error {
+	dir, err := b.resultPath(id)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			res.Files = append(res.Files, f.Name())
+		}
+	}
+	return nil
+}
+
+type ReadResultArgs struct {
+	Job    BuildJobID
+	Name   string
+	Offset int64
+}
+
+type FileChunk struct {
+	Data []byte
+	EOF  bool
+}
+
+// ReadResult reads a chunk of a result file of a job
+func (b *RpcBuilder) ReadResult(args ReadResultArgs, res *FileChunk) error {
+	dir, err := b.resultPath(args.Job)
+	if err != nil {
+		return err
+	}
+	if err := checkFileName(args.Name); err != nil {
+		return err
+	}
+	f, err := os.Open(path.Join(dir, args.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, transferChunkSize)
+	n, err := f.ReadAt(buf, args.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	res.Data = buf[:n]
+	res.EOF = err == io.EOF
+	return nil
+}
+
 type DistributionList struct {
 	Dists []deb.Codename
 }
@@ -363,84 +812,193 @@ func (b *RpcBuilder) AvailableArchitectures(d deb.Codename, res *ArchitectureLis
 	return nil
 }
 
+// rpcListener is a listener of a RpcBuilderServer, and the token its
+// clients should present
+type rpcListener struct {
+	net.Listener
+	token string
+}
+
+// RpcBuilderServer serves a DebianBuilder on a unix socket, and
+// optionally on TCP. As builds run as root, the unix socket is only
+// accessible to its owner and group.
 type RpcBuilderServer struct {
-	b       *RpcBuilder
+	builder DebianBuilder
 	address string
 	errChan chan error
 	logger  *log.Logger
+	// group of the unix socket, the one of the process if empty
+	socketGroup string
+
+	mutex     sync.Mutex
+	listeners []rpcListener
+	stopped   bool
 }
 
 func NewRpcBuilderServer(builder DebianBuilder, address string) *RpcBuilderServer {
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 	return &RpcBuilderServer{
-		b: &RpcBuilder{
-			actualBuilder: builder,
-			logger:        logger,
-		},
+		builder: builder,
 		address: address,
 		errChan: make(chan error),
 		logger:  logger,
 	}
 }
 
-func listenUnix(address string) (net.Listener, error) {
+// SetSocketGroup sets the group allowed to use the unix socket, the
+// group of the process if empty. It should be called before Serve.
+func (s *RpcBuilderServer) SetSocketGroup(group string) {
+	s.socketGroup = group
+}
 
-	l, err := net.Listen("unix", address)
+// ListenTCP makes the server also listen on a TCP address. Clients
+// are authenticated by their certificate if tlsConfig requires one,
+// and by token if it is not empty. At least one of them is required.
+func (s *RpcBuilderServer) ListenTCP(address string, tlsConfig *tls.Config, token string) (net.Addr, error) {
+	if tlsConfig == nil {
+		return nil, fmt.Errorf("TCP transport requires TLS")
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert && len(token) == 0 {
+		return nil, fmt.Errorf("TCP transport requires client certificates or a token")
+	}
+	l, err := tls.Listen("tcp", address, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners = append(s.listeners, rpcListener{Listener: l, token: token})
+	return l.Addr(), nil
+}
 
-	//TODO: use a special group for this
-	fi, err := os.Stat(address)
-	if err != nil {
-		return nil, err
+// listenUnix listens on a unix socket only accessible to its owner
+// and group, set to group if not empty
+func listenUnix(address string, group string) (net.Listener, error) {
+	gid := -1
+	if len(group) != 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("Invalid gid `%s' of group `%s'", g.Gid, group)
+		}
 	}
 
-	err = os.Chmod(address, fi.Mode()|0777)
+	l, err := net.Listen("unix", address)
 	if err != nil {
 		return nil, err
 	}
+	if err := os.Chown(address, -1, gid); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Chmod(address, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
 	return l, nil
 }
 
-func (s *RpcBuilderServer) Serve() {
-	if s.b.generator != nil {
-		s.errChan <- fmt.Errorf("Already started")
+// sessionConn is a connection that calls closeSession once reading it
+// fails, as net/rpc waits for the running calls of a connection before
+// closing it.
+type sessionConn struct {
+	net.Conn
+	once         sync.Once
+	closeSession func()
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.once.Do(c.closeSession)
 	}
-	if err := rpc.Register(s.b); err != nil {
-		s.errChan <- err
+	return n, err
+}
+
+// serveConn serves the RPC calls of an authenticated connection
+func (s *RpcBuilderServer) serveConn(conn net.Conn, token string) {
+	defer conn.Close()
+	if err := serverHandshake(conn, token); err != nil {
+		s.logger.Printf("Refused connection from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := newRpcBuilder(ctx, s.builder, s.logger)
+
+	server := rpc.NewServer()
+	if err := server.Register(b); err != nil {
+		cancel()
+		s.logger.Printf("Could not register RPC builder: %s\n", err)
 		return
 	}
-	rpc.HandleHTTP()
+	server.ServeConn(&sessionConn{
+		Conn: conn,
+		closeSession: func() {
+			cancel()
+			b.close()
+		},
+	})
+}
 
-	l, err := listenUnix(s.address)
+func (s *RpcBuilderServer) accept(l rpcListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			stopped := s.stopped
+			s.mutex.Unlock()
+			if stopped == false {
+				s.logger.Printf("Stopped listening on %s: %s\n", l.Addr(), err)
+			}
+			return
+		}
+		go s.serveConn(conn, l.token)
+	}
+}
+
+func (s *RpcBuilderServer) Serve() {
+	l, err := listenUnix(s.address, s.socketGroup)
 	if err != nil {
 		s.errChan <- err
 		return
 	}
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 	go func() {
 		for _ = range signals {
-			s.Stop(l)
+			s.Stop()
 		}
 	}()
 
-	s.b.generator = make(chan SyncOutputID)
-	s.b.timeouter = make(chan SyncOutputID)
-	s.b.timeoutClearer = make(chan SyncOutputID)
-	s.b.remover = make(chan SyncOutputID)
-	s.b.syncOutputs = make(map[SyncOutputID]syncOutput)
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, rpcListener{Listener: l})
+	listeners := s.listeners
+	s.mutex.Unlock()
 
-	go s.b.manageSyncID()
 	s.errChan <- nil
-	s.logger.Printf("Started RPC builder on unix:/%s\n", s.address)
-	http.Serve(l, nil)
-}
-
-func (s *RpcBuilderServer) Stop(l net.Listener) {
-	l.Close()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		s.logger.Printf("Started RPC builder on %s:%s\n", l.Addr().Network(), l.Addr())
+		wg.Add(1)
+		go func(l rpcListener) {
+			defer wg.Done()
+			s.accept(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+// Stop stops accepting connections
+func (s *RpcBuilderServer) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
 	s.logger.Printf("Stopping RPC\n")
 	s.logger.Printf("Removing unix:/%s\n", s.address)
 	os.Remove(s.address)
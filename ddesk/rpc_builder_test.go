@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
@@ -36,7 +37,6 @@ func (s *RpcBuilderSuite) SetUpSuite(c *C) {
 	//we remove output from tests
 	//TODO: we coudl unit test the logging now
 	voidLogger := log.New(&s.output, s.s.logger.Prefix(), s.s.logger.Flags())
-	s.s.b.logger = voidLogger
 	s.s.logger = voidLogger
 
 	go s.s.Serve()
@@ -47,6 +47,7 @@ func (s *RpcBuilderSuite) SetUpSuite(c *C) {
 }
 
 func (s *RpcBuilderSuite) TearDownSuite(c *C) {
+	s.s.Stop()
 	err := os.RemoveAll(s.tmpDir)
 	c.Assert(err, IsNil)
 }
@@ -62,7 +63,10 @@ func (s *RpcBuilderSuite) TestBuild(c *C) {
 				DebianRevision:  "1",
 			},
 		},
+		BasePath: s.tmpDir,
 	}
+	// source files are uploaded to the builder
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, dsc.Filename()), nil, 0644), IsNil)
 
 	args := BuildArguments{
 		SourcePackage: dsc,
@@ -71,7 +75,7 @@ func (s *RpcBuilderSuite) TestBuild(c *C) {
 		Deps:          nil,
 	}
 	var out bytes.Buffer
-	b, err := s.c.BuildPackage(args, &out)
+	b, err := s.c.BuildPackage(context.Background(), args, &out)
 	c.Check(err, IsNil)
 	c.Check(b, NotNil)
 	c.Check(out.String(), Equals, "Called BuildPackage\n")
@@ -80,7 +84,7 @@ func (s *RpcBuilderSuite) TestBuild(c *C) {
 
 func (s *RpcBuilderSuite) TestCreateAndRemove(c *C) {
 	var out bytes.Buffer
-	err := s.c.InitDistribution("sid", deb.Amd64, &out)
+	err := s.c.InitDistribution(context.Background(), "sid", deb.Amd64, &out)
 	c.Check(err, IsNil)
 	c.Check(out.String(), Equals, "Called InitDistribution\n")
 
@@ -101,11 +105,47 @@ func (s *RpcBuilderSuite) TestCreateAndRemove(c *C) {
 
 func (s *RpcBuilderSuite) TestUpdateDistribution(c *C) {
 	var out bytes.Buffer
-	err := s.c.UpdateDistribution("unstable", deb.Amd64, &out)
+	err := s.c.UpdateDistribution(context.Background(), "unstable", deb.Amd64, &out)
 	c.Check(err, IsNil)
 	c.Check(out.String(), Equals, "Called UpdateDistribution\n")
 	//cannot use sid in that example, it may or may not have been
 	//added by other test
-	err = s.c.UpdateDistribution("buzz", deb.Amd64, nil)
+	err = s.c.UpdateDistribution(context.Background(), "buzz", deb.Amd64, nil)
 	c.Check(err, ErrorMatches, "Distribution buzz is not supported")
 }
+
+func (s *RpcBuilderSuite) TestJobs(c *C) {
+	args := BuildArguments{
+		SourcePackage: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{
+				Source: "bar",
+				Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+			},
+			BasePath: s.tmpDir,
+		},
+		Dist:  "unstable",
+		Archs: []deb.Architecture{deb.Amd64},
+	}
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, args.SourcePackage.Filename()), nil, 0644), IsNil)
+	id, err := s.c.SubmitBuild(args)
+	c.Assert(err, IsNil)
+
+	job, err := s.c.GetJob(id)
+	c.Assert(err, IsNil)
+	c.Check(job.State, Equals, JobSucceeded)
+	c.Check(job.Args.SourcePackage.Identifier, Equals, args.SourcePackage.Identifier)
+
+	jobs, err := s.c.ListJobs()
+	c.Assert(err, IsNil)
+	c.Check(jobs[len(jobs)-1].ID, Equals, id)
+
+	var out bytes.Buffer
+	job, err = s.c.AttachJob(context.Background(), id, &out)
+	c.Assert(err, IsNil)
+	c.Check(job.ID, Equals, id)
+	c.Check(out.String(), Equals, "Called BuildPackage\n")
+
+	c.Check(s.c.CancelJob(id), ErrorMatches, "Build job [0-9]+ is already succeeded")
+	_, err = s.c.GetJob(4242)
+	c.Check(err, ErrorMatches, "No build job 4242")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// rpcProtocol starts the handshake of a RpcBuilder connection. The
+// client sends the protocol and its token on a line, the server
+// replies with OK or ERROR and a message.
+const rpcProtocol = "DDESK-RPC/1"
+
+// rpcHandshakeTimeout bounds the time a client has to authenticate
+var rpcHandshakeTimeout = 10 * time.Second
+
+// ParseBuilderAddress splits a builder address in a network and an
+// address for net.Dial. Addresses are either tcp://host:port or a
+// unix socket path, optionally prefixed by unix://.
+func ParseBuilderAddress(address string) (string, string) {
+	if strings.HasPrefix(address, "tcp://") {
+		return "tcp", strings.TrimPrefix(address, "tcp://")
+	}
+	return "unix", strings.TrimPrefix(address, "unix://")
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(data) == false {
+		return nil, fmt.Errorf("No certificate found in `%s'", caFile)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig returns the TLS configuration of a builder TCP
+// listener. If clientCAFile is not empty, clients must present a
+// certificate signed by one of its authorities.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load builder certificate: %s", err)
+	}
+	res := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(clientCAFile) != 0 {
+		res.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client authorities: %s", err)
+		}
+		res.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return res, nil
+}
+
+// NewClientTLSConfig returns the TLS configuration to connect to a
+// builder. The builder certificate is checked against caFile, or the
+// system authorities if empty. The client certificate is optional.
+func NewClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	res := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if len(caFile) != 0 {
+		res.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load builder authorities: %s", err)
+		}
+	}
+	if len(certFile) != 0 || len(keyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %s", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+// ReadTokenFile reads an authentication token, ignoring surrounding
+// white spaces.
+func ReadTokenFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	res := strings.TrimSpace(string(data))
+	if len(res) == 0 || strings.ContainsAny(res, " \t\n") {
+		return "", fmt.Errorf("Invalid token in `%s'", file)
+	}
+	return res, nil
+}
+
+// readLine reads a short line without buffering, as the rest of the
+// connection belongs to the RPC codec.
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("Handshake line too long")
+}
+
+func clientHandshake(conn net.Conn, token string) error {
+	conn.SetDeadline(time.Now().Add(rpcHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(conn, "%s %s\n", rpcProtocol, token); err != nil {
+		return err
+	}
+	reply, err := readLine(conn)
+	if err != nil {
+		return fmt.Errorf("Builder handshake failed: %s", err)
+	}
+	if reply != "OK" {
+		return fmt.Errorf("Builder refused connection: %s", strings.TrimPrefix(reply, "ERROR "))
+	}
+	return nil
+}
+
+// serverHandshake checks the client token, if token is not empty
+func serverHandshake(conn net.Conn, token string) error {
+	conn.SetDeadline(time.Now().Add(rpcHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	line, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(line, " ", 2)
+	if fields[0] != rpcProtocol {
+		fmt.Fprintf(conn, "ERROR Unsupported protocol\n")
+		return fmt.Errorf("Unsupported protocol `%s'", fields[0])
+	}
+	if len(token) != 0 {
+		var clientToken string
+		if len(fields) == 2 {
+			clientToken = fields[1]
+		}
+		if subtle.ConstantTimeCompare([]byte(clientToken), []byte(token)) != 1 {
+			fmt.Fprintf(conn, "ERROR Invalid authentication token\n")
+			return fmt.Errorf("Invalid authentication token")
+		}
+	}
+	_, err = fmt.Fprintf(conn, "OK\n")
+	return err
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+// remoteBackend is a BuilderBackend that builds from the content of
+// its source files, and whose updates wait to be aborted. Sources
+// whose content is "block" build until they are aborted.
+type remoteBackend struct {
+	DebianBuilderStub
+	updating chan bool
+	aborted  chan error
+	building chan bool
+}
+
+func (b *remoteBackend) BuildPackage(ctx context.Context, args BuildArguments, out io.Writer) (*BuildResult, error) {
+	data, err := ioutil.ReadFile(path.Join(args.SourcePackage.BasePath, "foo_1.0.orig.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == "block" {
+		b.building <- true
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	fmt.Fprintf(out, "Building from %d bytes\n", len(data))
+	changes := fmt.Sprintf("%s_amd64.changes", args.SourcePackage.Identifier)
+	if err := ioutil.WriteFile(path.Join(args.Dest, changes), []byte("changes"), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(args.Dest, "foo_1.0-1_amd64.deb"), bytes.ToUpper(data), 0644); err != nil {
+		return nil, err
+	}
+	return &BuildResult{BasePath: args.Dest, ChangesPath: changes}, nil
+}
+
+func (b *remoteBackend) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, out io.Writer) error {
+	fmt.Fprintf(out, "Updating %s-%s\n", d, a)
+	b.updating <- true
+	<-ctx.Done()
+	b.aborted <- ctx.Err()
+	return ctx.Err()
+}
+
+type RpcTransportSuite struct {
+	tmpDir             string
+	backend            *remoteBackend
+	q                  *BuildQueue
+	s                  *RpcBuilderServer
+	mtlsAddr, tokenAdr string
+	oldChunkSize       int
+}
+
+var _ = Suite(&RpcTransportSuite{})
+
+// writePEM writes a certificate or a key signed by parent, or self
+// signed if nil, and returns them
+func writePEM(c *C, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return cert, key
+}
+
+func (s *RpcTransportSuite) certificate(serial int64, name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func (s *RpcTransportSuite) SetUpTest(c *C) {
+	s.tmpDir = c.MkDir()
+	s.oldChunkSize = transferChunkSize
+	transferChunkSize = 16
+
+	ca := s.certificate(1, "ddesk test CA")
+	ca.IsCA = true
+	ca.BasicConstraintsValid = true
+	ca.KeyUsage = x509.KeyUsageCertSign
+	caCert, caKey := writePEM(c, s.tmpDir, "ca", ca, nil, nil)
+	server := s.certificate(2, "builder")
+	server.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	writePEM(c, s.tmpDir, "server", server, caCert, caKey)
+	client := s.certificate(3, "developer")
+	client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	writePEM(c, s.tmpDir, "client", client, caCert, caKey)
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, "token"), []byte("s3cr3t\n"), 0600), IsNil)
+
+	s.backend = &remoteBackend{
+		DebianBuilderStub: DebianBuilderStub{
+			DistAndArch: map[deb.Codename][]deb.Architecture{"unstable": {deb.Amd64}},
+		},
+		updating: make(chan bool, 1),
+		aborted:  make(chan error, 1),
+		building: make(chan bool, 1),
+	}
+	var err error
+	s.q, err = NewBuildQueue(s.backend, path.Join(s.tmpDir, "queue"), 1)
+	c.Assert(err, IsNil)
+
+	s.s = NewRpcBuilderServer(s.q, path.Join(s.tmpDir, "builder.sock"))
+	s.s.logger = log.New(ioutil.Discard, "", 0)
+	mtls, err := NewServerTLSConfig(path.Join(s.tmpDir, "server.crt"), path.Join(s.tmpDir, "server.key"), path.Join(s.tmpDir, "ca.crt"))
+	c.Assert(err, IsNil)
+	addr, err := s.s.ListenTCP("127.0.0.1:0", mtls, "")
+	c.Assert(err, IsNil)
+	s.mtlsAddr = addr.String()
+
+	tokenOnly, err := NewServerTLSConfig(path.Join(s.tmpDir, "server.crt"), path.Join(s.tmpDir, "server.key"), "")
+	c.Assert(err, IsNil)
+	token, err := ReadTokenFile(path.Join(s.tmpDir, "token"))
+	c.Assert(err, IsNil)
+	addr, err = s.s.ListenTCP("127.0.0.1:0", tokenOnly, token)
+	c.Assert(err, IsNil)
+	s.tokenAdr = addr.String()
+
+	go s.s.Serve()
+	c.Assert(s.s.WaitEstablished(), IsNil)
+}
+
+func (s *RpcTransportSuite) TearDownTest(c *C) {
+	transferChunkSize = s.oldChunkSize
+	s.s.Stop()
+	s.q.Close()
+}
+
+func (s *RpcTransportSuite) dial(c *C, addr string, withCert bool, token string) (*ClientBuilder, error) {
+	cert, key := "", ""
+	if withCert {
+		cert, key = path.Join(s.tmpDir, "client.crt"), path.Join(s.tmpDir, "client.key")
+	}
+	tlsConfig, err := NewClientTLSConfig(path.Join(s.tmpDir, "ca.crt"), cert, key)
+	c.Assert(err, IsNil)
+	return DialClientBuilder("tcp", addr, tlsConfig, token)
+}
+
+func (s *RpcTransportSuite) TestParseBuilderAddress(c *C) {
+	data := map[string][2]string{
+		"tcp://builder.local:7676":           {"tcp", "builder.local:7676"},
+		"unix:///var/lib/ddesk/builder.sock": {"unix", "/var/lib/ddesk/builder.sock"},
+		"/var/lib/ddesk/builder.sock":        {"unix", "/var/lib/ddesk/builder.sock"},
+	}
+	for address, expected := range data {
+		network, addr := ParseBuilderAddress(address)
+		c.Check([2]string{network, addr}, Equals, expected)
+	}
+}
+
+func (s *RpcTransportSuite) TestTransfersFiles(c *C) {
+	client, err := s.dial(c, s.mtlsAddr, true, "")
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	sourceDir := path.Join(s.tmpDir, "source")
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, "foo_1.0-1.dsc"), []byte("dsc"), 0644), IsNil)
+	orig := []byte("an orig tarball spanning several chunks")
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, "foo_1.0.orig.tar.gz"), orig, 0644), IsNil)
+	args := BuildArguments{
+		SourcePackage: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{
+				Source: "foo",
+				Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+			},
+			BasePath: s.tmpDir,
+			Md5Files: []deb.FileReference{{Name: "foo_1.0.orig.tar.gz"}},
+		},
+		Dist:  "unstable",
+		Archs: []deb.Architecture{deb.Amd64},
+		Dest:  path.Join(s.tmpDir, "result"),
+	}
+
+	var out bytes.Buffer
+	res, err := client.BuildPackage(context.Background(), args, &out)
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, fmt.Sprintf("Building from %d bytes\n", len(orig)))
+	c.Check(res.BuildLog, Equals, Log(out.String()))
+	c.Check(res.BasePath, Equals, args.Dest)
+	c.Check(res.ChangesPath, Equals, "foo_1.0-1_amd64.changes")
+	data, err := ioutil.ReadFile(path.Join(args.Dest, "foo_1.0-1_amd64.deb"))
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, bytes.ToUpper(orig))
+
+	// results can be fetched again, over unix sockets too
+	local, err := NewClientBuilder("unix", path.Join(s.tmpDir, "builder.sock"))
+	c.Assert(err, IsNil)
+	defer local.Close()
+	res, err = local.FetchResult(res.JobID, sourceDir)
+	c.Assert(err, IsNil)
+	c.Check(res.BasePath, Equals, sourceDir)
+	data, err = ioutil.ReadFile(path.Join(sourceDir, "foo_1.0-1_amd64.changes"))
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "changes")
+
+	_, err = local.FetchResult(42, sourceDir)
+	c.Check(err, ErrorMatches, "No build job 42")
+
+	args.SourcePackage.Md5Files = append(args.SourcePackage.Md5Files, deb.FileReference{Name: "missing.tar.gz"})
+	_, err = client.SubmitBuild(args)
+	c.Check(err, ErrorMatches, "Could not upload missing.tar.gz: .*")
+}
+
+func (s *RpcTransportSuite) TestRejectsUnsafeFileNames(c *C) {
+	client, err := s.dial(c, s.mtlsAddr, true, "")
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	data := []struct {
+		dsc   deb.SourceControlFile
+		error string
+	}{
+		{
+			deb.SourceControlFile{
+				Identifier: deb.SourcePackageRef{Source: "etc/foo", Ver: deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"}},
+			},
+			"Invalid file name `etc/foo_1.0-1.dsc'",
+		},
+		{
+			deb.SourceControlFile{
+				Identifier: deb.SourcePackageRef{Source: "foo", Ver: deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"}},
+				Md5Files:   []deb.FileReference{{Name: "../../etc/shadow"}},
+			},
+			"Invalid file name `../../etc/shadow'",
+		},
+	}
+	for _, d := range data {
+		// a client may send any arguments, not only those of a
+		// ClientBuilder
+		var id UploadID
+		c.Assert(client.conn.Call("RpcBuilder.InitUpload", NoValue{}, &id), IsNil)
+		var res BuildJobID
+		err := client.conn.Call("RpcBuilder.Submit", RpcSubmitArgs{
+			Upload: id,
+			Args:   BuildArguments{SourcePackage: d.dsc, Dist: "unstable", Archs: []deb.Architecture{deb.Amd64}},
+		}, &res)
+		c.Check(err, ErrorMatches, d.error)
+	}
+	jobs, err := s.q.ListJobs()
+	c.Check(err, IsNil)
+	c.Check(jobs, HasLen, 0)
+}
+
+func (s *RpcTransportSuite) TestAuthentication(c *C) {
+	client, err := s.dial(c, s.tokenAdr, false, "s3cr3t")
+	c.Assert(err, IsNil)
+	c.Check(client.AvailableDistributions(), DeepEquals, []deb.Codename{"unstable"})
+	client.Close()
+
+	_, err = s.dial(c, s.tokenAdr, false, "guessed")
+	c.Check(err, ErrorMatches, "Builder refused connection: Invalid authentication token")
+
+	_, err = s.dial(c, s.tokenAdr, false, "")
+	c.Check(err, ErrorMatches, "Builder refused connection: Invalid authentication token")
+
+	// the certificate of the client is required
+	_, err = s.dial(c, s.mtlsAddr, false, "s3cr3t")
+	c.Check(err, NotNil)
+
+	// the builder is not trusted with the system authorities
+	tlsConfig, err := NewClientTLSConfig("", path.Join(s.tmpDir, "client.crt"), path.Join(s.tmpDir, "client.key"))
+	c.Assert(err, IsNil)
+	_, err = DialClientBuilder("tcp", s.mtlsAddr, tlsConfig, "")
+	c.Check(err, ErrorMatches, ".*certificate.*")
+
+	_, err = DialClientBuilder("tcp", s.mtlsAddr, nil, "s3cr3t")
+	c.Check(err, ErrorMatches, "TCP connections to a builder require TLS")
+
+	_, err = s.s.ListenTCP("127.0.0.1:0", nil, "s3cr3t")
+	c.Check(err, ErrorMatches, "TCP transport requires TLS")
+	tokenOnly, err := NewServerTLSConfig(path.Join(s.tmpDir, "server.crt"), path.Join(s.tmpDir, "server.key"), "")
+	c.Assert(err, IsNil)
+	_, err = s.s.ListenTCP("127.0.0.1:0", tokenOnly, "")
+	c.Check(err, ErrorMatches, "TCP transport requires client certificates or a token")
+}
+
+func (s *RpcTransportSuite) TestCancellation(c *C) {
+	client, err := s.dial(c, s.mtlsAddr, true, "")
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.backend.updating
+		cancel()
+	}()
+	var out bytes.Buffer
+	err = client.UpdateDistribution(ctx, "unstable", deb.Amd64, &out)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(<-s.backend.aborted, Equals, context.Canceled)
+
+	// a disconnection aborts the calls of the client
+	other, err := s.dial(c, s.tokenAdr, false, "s3cr3t")
+	c.Assert(err, IsNil)
+	go other.UpdateDistribution(context.Background(), "unstable", deb.Amd64, nil)
+	<-s.backend.updating
+	other.Close()
+	select {
+	case err := <-s.backend.aborted:
+		c.Check(err, Equals, context.Canceled)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Update was not aborted on disconnection")
+	}
+
+	// the first connection is still usable
+	c.Check(client.AvailableDistributions(), DeepEquals, []deb.Codename{"unstable"})
+}
+
+func (s *RpcTransportSuite) waitJobState(c *C, id BuildJobID, state BuildJobState) {
+	for i := 0; i < 500; i++ {
+		job, err := s.q.GetJob(id)
+		c.Assert(err, IsNil)
+		if job.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("Job %d did not reach state %s", id, state)
+}
+
+func (s *RpcTransportSuite) TestDisconnection(c *C) {
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, "foo_1.0-1.dsc"), []byte("dsc"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(s.tmpDir, "foo_1.0.orig.tar.gz"), []byte("block"), 0644), IsNil)
+	args := BuildArguments{
+		SourcePackage: deb.SourceControlFile{
+			Identifier: deb.SourcePackageRef{
+				Source: "foo",
+				Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+			},
+			BasePath: s.tmpDir,
+			Md5Files: []deb.FileReference{{Name: "foo_1.0.orig.tar.gz"}},
+		},
+		Dist:  "unstable",
+		Archs: []deb.Architecture{deb.Amd64},
+	}
+
+	// the build of a killed client is cancelled
+	client, err := s.dial(c, s.mtlsAddr, true, "")
+	c.Assert(err, IsNil)
+	go client.BuildPackage(context.Background(), args, nil)
+	<-s.backend.building
+	client.Close()
+	s.waitJobState(c, 1, JobCancelled)
+
+	// a job submitted then attached goes on
+	client, err = s.dial(c, s.mtlsAddr, true, "")
+	c.Assert(err, IsNil)
+	id, err := client.SubmitBuild(args)
+	c.Assert(err, IsNil)
+	go client.AttachJob(context.Background(), id, nil)
+	<-s.backend.building
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+	job, err := s.q.GetJob(id)
+	c.Assert(err, IsNil)
+	c.Check(job.State, Equals, JobRunning)
+	c.Check(s.q.CancelJob(id), IsNil)
+	s.waitJobState(c, id, JobCancelled)
+}
+
+func (s *RpcTransportSuite) TestUnixSocketPermissions(c *C) {
+	fi, err := os.Stat(path.Join(s.tmpDir, "builder.sock"))
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0660))
+
+	g, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	c.Assert(err, IsNil)
+	socketPath := path.Join(s.tmpDir, "group.sock")
+	l, err := listenUnix(socketPath, g.Name)
+	c.Assert(err, IsNil)
+	defer l.Close()
+	fi, err = os.Stat(socketPath)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0660))
+	c.Check(fi.Sys().(*syscall.Stat_t).Gid, Equals, uint32(os.Getgid()))
+
+	_, err = listenUnix(path.Join(s.tmpDir, "other.sock"), "no-such-group-ddesk")
+	c.Check(err, ErrorMatches, ".*no-such-group-ddesk.*")
+}
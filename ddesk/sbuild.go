@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	deb ".."
+	"github.com/nightlyone/lockfile"
+)
+
+// sbuildProfile is the schroot profile of the Sbuild chroots. It is
+// a copy of the sbuild profile, whose fstab also bind mounts the
+// local apt repositories builds depend on.
+const sbuildProfile = "ddesk-sbuild"
+
+// SbuildBootstraps are the supported tools to create sbuild chroots
+var SbuildBootstraps = []string{"sbuild-createchroot", "mmdebstrap"}
+
+// Sbuild is a DebianBuilder based on sbuild and schroot, as the
+// Debian official build daemons. Its chroots are plain directories,
+// declared to schroot with an overlay, so builds do not modify
+// them. Like Cowbuilder, it needs root privileges.
+//
+// Builds of different packages, and of the different architectures
+// of a package, run concurrently. Each sbuild run has its own job
+// directory for its results and repository keys.
+type Sbuild struct {
+	basepath   string
+	chrootpath string
+	jobspath   string
+	schrootDir string
+	bootstrap  string
+
+	lock lockfile.Lockfile
+
+	supported ArchitectureList
+	keepEnv   []string
+
+	scheduler *buildScheduler
+	// chroots beeing created, that are not available yet
+	creating      map[string]bool
+	creatingMutex sync.Mutex
+	// protects the fstab of the schroot profile
+	fstabMutex sync.Mutex
+}
+
+// NewSbuild initializes a Sbuild with its chroots located in
+// basepath, declared in the schroot configuration directory
+// schrootDir, usually /etc/schroot. Chroots are created by bootstrap,
+// one of SbuildBootstraps. At most maxJobs sbuild jobs run at the
+// same time, if maxJobs is not positive, it is the number of CPUs.
+func NewSbuild(basepath, schrootDir, bootstrap string, maxJobs int) (*Sbuild, error) {
+	found := false
+	for _, b := range SbuildBootstraps {
+		if b == bootstrap {
+			found = true
+			break
+		}
+	}
+	if found == false {
+		return nil, fmt.Errorf("Unsupported chroot bootstrap `%s', supported are %v", bootstrap, SbuildBootstraps)
+	}
+
+	res := &Sbuild{
+		basepath:   basepath,
+		chrootpath: path.Join(basepath, "chroots"),
+		jobspath:   path.Join(basepath, "jobs"),
+		schrootDir: schrootDir,
+		bootstrap:  bootstrap,
+		supported:  hostArchitectures(),
+		keepEnv:    []string{"PATH"},
+		creating:   make(map[string]bool),
+	}
+
+	for _, d := range []string{res.chrootpath, res.jobspath, path.Join(schrootDir, "chroot.d")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	res.lock, err = lockfile.New(path.Join(basepath, "global.lock"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = res.lock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(res, res.lock.Unlock())
+
+	if maxJobs <= 0 {
+		maxJobs = runtime.NumCPU()
+	}
+	res.scheduler = newBuildScheduler(maxJobs)
+
+	if err := res.setProfile(); err != nil {
+		return nil, fmt.Errorf("Could not create schroot profile %s: %s", sbuildProfile, err)
+	}
+
+	return res, nil
+}
+
+func (b *Sbuild) profilePath() string {
+	return path.Join(b.schrootDir, sbuildProfile)
+}
+
+// setProfile creates the schroot profile of the chroots from the
+// sbuild one, if it does not exist yet.
+func (b *Sbuild) setProfile() error {
+	if _, err := os.Stat(b.profilePath()); err == nil {
+		return nil
+	}
+	sbuildPath := path.Join(b.schrootDir, "sbuild")
+	files, err := ioutil.ReadDir(sbuildPath)
+	if err != nil {
+		return fmt.Errorf("%s, is sbuild installed?", err)
+	}
+	tmpPath := b.profilePath() + ".new"
+	if err := os.MkdirAll(tmpPath, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+	for _, f := range files {
+		if f.Mode().IsRegular() == false {
+			continue
+		}
+		if err := copyFile(path.Join(sbuildPath, f.Name()), path.Join(tmpPath, f.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, b.profilePath())
+}
+
+// bindMounts ensures that the chroots bind mount paths read-only.
+// Mounts are never removed, as concurrent builds may use them.
+func (b *Sbuild) bindMounts(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	b.fstabMutex.Lock()
+	defer b.fstabMutex.Unlock()
+
+	fstabPath := path.Join(b.profilePath(), "fstab")
+	f, err := os.OpenFile(fstabPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mounted := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		mounted[fields[1]] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if mounted[p] {
+			continue
+		}
+		if _, err := fmt.Fprintf(f, "%s\t%s\tnone\tro,bind\t0\t0\n", p, p); err != nil {
+			return err
+		}
+		mounted[p] = true
+	}
+	return nil
+}
+
+func (b *Sbuild) maskedEnviron() []string {
+	res := []string{fmt.Sprintf("HOME=%s", b.basepath)}
+	for _, key := range b.keepEnv {
+		value := os.Getenv(key)
+		if len(value) == 0 {
+			continue
+		}
+		res = append(res, key+"="+value)
+	}
+	return res
+}
+
+// chrootName returns the schroot name of the chroot of d-a
+func (b *Sbuild) chrootName(d deb.Codename, a deb.Architecture) string {
+	return fmt.Sprintf("ddesk-%s-%s", d, a)
+}
+
+func (b *Sbuild) imagePath(d deb.Codename, a deb.Architecture) string {
+	return path.Join(b.chrootpath, fmt.Sprintf("%s-%s", d, a))
+}
+
+func (b *Sbuild) confPath(d deb.Codename, a deb.Architecture) string {
+	return path.Join(b.schrootDir, "chroot.d", b.chrootName(d, a))
+}
+
+// schrootConfig returns the schroot declaration of the chroot of d-a
+func (b *Sbuild) schrootConfig(d deb.Codename, a deb.Architecture) string {
+	var res bytes.Buffer
+	fmt.Fprintf(&res, "[%s]\n", b.chrootName(d, a))
+	fmt.Fprintf(&res, "description=ddesk %s %s build chroot\n", d, a)
+	fmt.Fprintf(&res, "type=directory\n")
+	fmt.Fprintf(&res, "directory=%s\n", b.imagePath(d, a))
+	fmt.Fprintf(&res, "union-type=overlay\n")
+	fmt.Fprintf(&res, "groups=root,sbuild\n")
+	fmt.Fprintf(&res, "root-groups=root,sbuild\n")
+	fmt.Fprintf(&res, "profile=%s\n", sbuildProfile)
+	return res.String()
+}
+
+// extraRepositories returns the sbuild arguments adding deps to a
+// build for targetDist, and the local repositories to bind mount in
+// the chroot. Keys of the repositories are written in keysPath.
+func extraRepositories(keysPath string, targetDist deb.Codename, deps []*AptRepositoryAccess) ([]string, []string, error) {
+	args := []string{}
+	bindmounts := []string{}
+	for i, dep := range deps {
+		comps, found := dep.Components[targetDist]
+		if found == false {
+			log.Printf("Could not set dependency on apt repository %s, as it does not provide %s",
+				dep, targetDist)
+			continue
+		}
+
+		if strings.HasPrefix(dep.Address, "file:/") == true {
+			localpath := strings.TrimPrefix(dep.Address, "file:")
+			if _, err := os.Stat(path.Join(localpath, "dists")); err != nil {
+				if os.IsNotExist(err) == false {
+					return nil, nil, err
+				}
+				log.Printf("Skipping dependency %s:  %s", dep.Address, err)
+				continue
+			}
+			bindmounts = append(bindmounts, localpath)
+		}
+
+		forceTrusted := ""
+		if dep.ArmoredPublicKey == nil {
+			forceTrusted = "[trusted=yes] "
+		} else {
+			if err := os.MkdirAll(keysPath, 0755); err != nil {
+				return nil, nil, err
+			}
+			keyPath := path.Join(keysPath, fmt.Sprintf("%d.asc", i))
+			if err := ioutil.WriteFile(keyPath, dep.ArmoredPublicKey, 0644); err != nil {
+				return nil, nil, err
+			}
+			args = append(args, "--extra-repository-key="+keyPath)
+		}
+
+		line := fmt.Sprintf("deb %s%s %s", forceTrusted, dep.Address, targetDist)
+		for _, c := range comps {
+			line += " " + string(c)
+		}
+		args = append(args, "--extra-repository="+line)
+	}
+	return args, bindmounts, nil
+}
+
+// buildArch runs the build of a package for one architecture, and
+// moves its results to the destination directory.
+func (b *Sbuild) buildArch(ctx context.Context, a BuildArguments, ab *archBuild, dscFile string, output io.Writer) error {
+	jobPath, err := ioutil.TempDir(b.jobspath, fmt.Sprintf("%s-%s_", a.Dist, ab.arch))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(jobPath); err != nil {
+			log.Printf("Could not clean job directory %s: %s", jobPath, err)
+		}
+	}()
+	resultPath := path.Join(jobPath, "result")
+	if err := os.MkdirAll(resultPath, 0755); err != nil {
+		return err
+	}
+
+	repositories, bindmounts, err := extraRepositories(path.Join(jobPath, "keys"), a.Dist, a.Deps)
+	if err != nil {
+		return err
+	}
+	if err := b.bindMounts(bindmounts); err != nil {
+		return fmt.Errorf("Could not bind mount local repositories: %s", err)
+	}
+
+	optionArgs, config := sbuildOptions(a.Options)
+	configPath := path.Join(jobPath, "sbuildrc")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		return err
+	}
+
+	archAll := "--no-arch-all"
+	if ab.indep {
+		archAll = "--arch-all"
+	}
+	cmd := exec.Command("sbuild", "--nolog",
+		"--chroot-mode=schroot",
+		"--chroot="+b.chrootName(a.Dist, ab.arch),
+		"--dist="+string(a.Dist),
+		"--build-dir="+resultPath,
+		archAll,
+		"--no-run-lintian", "--no-run-piuparts", "--no-run-autopkgtest")
+	cmd.Args = append(cmd.Args, sbuildArchArgs(ab)...)
+	if a.BinNMU != nil {
+		cmd.Args = append(cmd.Args, a.BinNMU.sbuildArgs()...)
+	}
+	cmd.Args = append(cmd.Args, repositories...)
+	cmd.Args = append(cmd.Args, optionArgs...)
+	cmd.Args = append(cmd.Args, dscFile)
+	cmd.Env = append(b.maskedEnviron(), "SBUILD_CONFIG="+configPath)
+	cmd.Dir = jobPath
+	cmd.Stdin = nil
+	cmd.Stderr = output
+	cmd.Stdout = output
+	fmt.Fprintf(output, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
+	// when killed, sbuild ends its schroot session, which removes its
+	// overlay
+	if err := runCommand(ctx, cmd); err != nil {
+		return err
+	}
+
+	return collectResults(resultPath, a, ab.targetArch())
+}
+
+// BuildPackage builds a deb.SourcePackageRef package. if an io.Writer
+// is passed, all the current output of sbuild will be copied to
+// it. Architectures are built concurrently, their output lines are
+// then prefixed by the architecture. When ctx is done, the sbuild
+// processes are killed.
+func (b *Sbuild) BuildPackage(ctx context.Context, a BuildArguments, output io.Writer) (*BuildResult, error) {
+	if err := a.Options.Check(); err != nil {
+		return nil, err
+	}
+	if len(a.Options.Hooks) != 0 {
+		return nil, fmt.Errorf("Build hooks are only supported by cowbuilder builders")
+	}
+	if a.Options.Autopkgtest {
+		return nil, fmt.Errorf("Autopkgtests are only supported by cowbuilder builders")
+	}
+	return buildArchitectures(ctx, b, b.scheduler, a, output)
+}
+
+// bootstrapCommand returns the command creating the chroot of d-a
+func (b *Sbuild) bootstrapCommand(d deb.Codename, a deb.Architecture) (*exec.Cmd, error) {
+	dist, err := distributionConfig(b.basepath, d)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"--arch=" + string(a),
+		"--components=" + joinComponents(dist.Components, ","),
+		"--keyring=" + dist.Keyring,
+	}
+	env := b.maskedEnviron()
+	switch b.bootstrap {
+	case "mmdebstrap":
+		args = append([]string{"--variant=buildd"}, args...)
+		if len(dist.AptProxy) != 0 {
+			args = append(args, fmt.Sprintf("--aptopt=Acquire::http::Proxy \"%s\"", dist.AptProxy))
+		}
+	case "sbuild-createchroot":
+		// it declares the chroot to schroot, it is replaced by our
+		// own declaration
+		args = append([]string{"--chroot-prefix=ddesk-" + string(d)}, args...)
+		if len(dist.AptProxy) != 0 {
+			env = append(env, "http_proxy="+dist.AptProxy)
+		}
+	}
+	args = append(args, dist.DebootstrapOptions...)
+	args = append(args, string(d), b.imagePath(d, a), dist.Mirror)
+	cmd := exec.Command(b.bootstrap, args...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+// setAptProxy configures apt in the chroot of d-a to use the proxy
+// of its distribution configuration, if any.
+func (b *Sbuild) setAptProxy(d deb.Codename, a deb.Architecture) error {
+	dist, err := distributionConfig(b.basepath, d)
+	if err != nil {
+		return err
+	}
+	confPath := path.Join(b.imagePath(d, a), "etc/apt/apt.conf.d/99ddesk-proxy")
+	if len(dist.AptProxy) == 0 {
+		if err := os.Remove(confPath); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(confPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(confPath, []byte(fmt.Sprintf("Acquire::http::Proxy \"%s\";\n", dist.AptProxy)), 0644)
+}
+
+// InitDistribution is initializing a distribution with the given
+// architecture for the builder. The output of the bootstrap is
+// synchronously copied to the given output. If ctx is done before
+// the end of the creation, the partially created chroot is removed.
+func (b *Sbuild) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	image := b.imagePath(d, a)
+	return b.scheduler.RunExclusive(ctx, image, func() error {
+		b.setCreating(image, true)
+		defer b.setCreating(image, false)
+		return b.initDistribution(ctx, d, a, output)
+	})
+}
+
+func (b *Sbuild) setCreating(image string, creating bool) {
+	b.creatingMutex.Lock()
+	defer b.creatingMutex.Unlock()
+	if creating {
+		b.creating[image] = true
+	} else {
+		delete(b.creating, image)
+	}
+}
+
+func (b *Sbuild) isCreating(image string) bool {
+	b.creatingMutex.Lock()
+	defer b.creatingMutex.Unlock()
+	return b.creating[image]
+}
+
+func (b *Sbuild) initDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	if _, err := os.Stat(b.imagePath(d, a)); err == nil {
+		return fmt.Errorf("Distribution %s architecture %s is already supported", d, a)
+	}
+
+	supported := false
+	for _, aa := range b.supported {
+		if aa == a {
+			supported = true
+			break
+		}
+	}
+
+	if supported == false {
+		return fmt.Errorf("Architecture %s is not in the supported architecture list %v.", a, b.supported)
+	}
+
+	cmd, err := b.bootstrapCommand(d, a)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Stdin = nil
+	if output != nil {
+		fmt.Fprintf(output, "--- Executing: %v\n--- Env: %v\n", cmd.Args, cmd.Env)
+	}
+	err = runCommand(ctx, cmd)
+	if ctx.Err() != nil {
+		if cerr := cleanBuildPlace(b.imagePath(d, a)); cerr != nil {
+			log.Printf("Could not remove interrupted chroot %s: %s", b.imagePath(d, a), cerr)
+		}
+	}
+	if b.bootstrap == "sbuild-createchroot" {
+		generated, _ := filepath.Glob(path.Join(b.schrootDir, "chroot.d", b.chrootName(d, a)+"-sbuild-*"))
+		for _, f := range generated {
+			if rerr := os.Remove(f); rerr != nil {
+				log.Printf("Could not remove schroot declaration %s: %s", f, rerr)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.setAptProxy(d, a); err != nil {
+		return fmt.Errorf("Could not configure apt proxy: %s", err)
+	}
+	return ioutil.WriteFile(b.confPath(d, a), []byte(b.schrootConfig(d, a)), 0644)
+}
+
+// RemoveDistribution is removing a distribution support from the
+// builder.
+func (b *Sbuild) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
+	return b.scheduler.RunExclusive(context.Background(), b.imagePath(d, a), func() error {
+		if b.isAvailable(d, a) == false {
+			return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
+		}
+		if err := os.Remove(b.confPath(d, a)); err != nil {
+			return err
+		}
+		return os.RemoveAll(b.imagePath(d, a))
+	})
+}
+
+// UpdateDistribution is updating the chroot for the given
+// distribution. If ctx is done before the end of the update, the
+// chroot is left as is, and should be updated again.
+func (b *Sbuild) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return b.scheduler.RunExclusive(ctx, b.imagePath(d, a), func() error {
+		return b.updateDistribution(ctx, d, a, output)
+	})
+}
+
+func (b *Sbuild) updateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	if b.isAvailable(d, a) == false {
+		return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
+	}
+
+	// the configuration may have changed since the creation
+	if err := b.setAptProxy(d, a); err != nil {
+		return fmt.Errorf("Could not configure apt proxy: %s", err)
+	}
+
+	cmd := exec.Command("sbuild-update", "--update", "--dist-upgrade",
+		"--clean", "--autoclean", "--autoremove", b.chrootName(d, a))
+	cmd.Env = b.maskedEnviron()
+	cmd.Stdin = nil
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if output != nil {
+		fmt.Fprintf(output, "--- Executing: %v\n--- Env: %v\n", cmd.Args, cmd.Env)
+	}
+
+	err := runCommand(ctx, cmd)
+	if ctx.Err() != nil {
+		// the chroot is updated in place, only its mounts are
+		// cleaned
+		if merr := detachMounts(b.imagePath(d, a)); merr != nil {
+			log.Printf("Could not clean interrupted chroot %s: %s", b.imagePath(d, a), merr)
+		}
+		return fmt.Errorf("Update of %s-%s was interrupted, it should be updated again: %s", d, a, err)
+	}
+	return err
+}
+
+// isAvailable returns true if the chroot of d-a is created and
+// declared to schroot
+func (b *Sbuild) isAvailable(d deb.Codename, a deb.Architecture) bool {
+	if b.isCreating(b.imagePath(d, a)) {
+		return false
+	}
+	for _, p := range []string{b.imagePath(d, a), b.confPath(d, a)} {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Sbuild) getAllChroots() map[deb.Codename]ArchitectureList {
+	allFiles, err := ioutil.ReadDir(b.chrootpath)
+	if err != nil {
+		return nil
+	}
+
+	res := map[deb.Codename]ArchitectureList{}
+	rx := regexp.MustCompile(`^([a-z]+)-([a-z0-9]+)$`)
+	for _, f := range allFiles {
+		if f.IsDir() == false {
+			continue
+		}
+		matches := rx.FindStringSubmatch(f.Name())
+		if matches == nil {
+			continue
+		}
+		dist := deb.Codename(matches[1])
+		arch := deb.Architecture(matches[2])
+		if b.isAvailable(dist, arch) == false {
+			continue
+		}
+		res[dist] = append(res[dist], arch)
+	}
+	return res
+}
+
+// AvailableDistributions returns the distributions with at least one
+// chroot
+func (b *Sbuild) AvailableDistributions() []deb.Codename {
+	res := []deb.Codename{}
+	for d := range b.getAllChroots() {
+		res = append(res, d)
+	}
+	return res
+}
+
+// AvailableArchitectures returns the architectures of the chroots of
+// d
+func (b *Sbuild) AvailableArchitectures(d deb.Codename) ArchitectureList {
+	return b.getAllChroots()[d]
+}
+
+func init() {
+	aptDepTracker.Add("sbuild")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type SbuildSuite struct {
+	tmpDir, schrootDir string
+	b                  *Sbuild
+}
+
+var _ = Suite(&SbuildSuite{})
+
+func (s *SbuildSuite) SetUpTest(c *C) {
+	s.tmpDir = c.MkDir()
+	s.schrootDir = path.Join(s.tmpDir, "schroot")
+	c.Assert(os.MkdirAll(path.Join(s.schrootDir, "sbuild"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(s.schrootDir, "sbuild", "fstab"), []byte("/proc\t/proc\tnone\trw,bind\t0\t0\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(s.schrootDir, "sbuild", "copyfiles"), []byte("/etc/hosts\n"), 0644), IsNil)
+
+	var err error
+	s.b, err = NewSbuild(path.Join(s.tmpDir, "builder"), s.schrootDir, "mmdebstrap", 2)
+	c.Assert(err, IsNil)
+}
+
+func (s *SbuildSuite) TestProfile(c *C) {
+	data, err := ioutil.ReadFile(path.Join(s.schrootDir, sbuildProfile, "copyfiles"))
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "/etc/hosts\n")
+
+	_, err = NewSbuild(path.Join(s.tmpDir, "other"), s.schrootDir, "debootstrap", 2)
+	c.Check(err, ErrorMatches, "Unsupported chroot bootstrap `debootstrap', supported are \\[sbuild-createchroot mmdebstrap\\]")
+	_, err = NewSbuild(path.Join(s.tmpDir, "other"), path.Join(s.tmpDir, "nothing"), "mmdebstrap", 2)
+	c.Check(err, ErrorMatches, "Could not create schroot profile ddesk-sbuild: .*, is sbuild installed\\?")
+}
+
+func (s *SbuildSuite) TestBindMounts(c *C) {
+	c.Assert(s.b.bindMounts([]string{"/srv/repo", "/proc"}), IsNil)
+	c.Assert(s.b.bindMounts([]string{"/srv/repo", "/srv/other"}), IsNil)
+	data, err := ioutil.ReadFile(path.Join(s.schrootDir, sbuildProfile, "fstab"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "/proc\t/proc\tnone\trw,bind\t0\t0\n"+
+		"/srv/repo\t/srv/repo\tnone\tro,bind\t0\t0\n"+
+		"/srv/other\t/srv/other\tnone\tro,bind\t0\t0\n")
+}
+
+func (s *SbuildSuite) TestSchrootConfig(c *C) {
+	c.Check(s.b.schrootConfig("unstable", deb.Amd64), Equals, `[ddesk-unstable-amd64]
+description=ddesk unstable amd64 build chroot
+type=directory
+directory=`+path.Join(s.tmpDir, "builder", "chroots", "unstable-amd64")+`
+union-type=overlay
+groups=root,sbuild
+root-groups=root,sbuild
+profile=ddesk-sbuild
+`)
+}
+
+func (s *SbuildSuite) TestExtraRepositories(c *C) {
+	local := path.Join(s.tmpDir, "local")
+	c.Assert(os.MkdirAll(path.Join(local, "dists"), 0755), IsNil)
+	deps := []*AptRepositoryAccess{
+		{
+			Address:    "file:" + local,
+			Components: map[deb.Codename][]deb.Component{"unstable": {"main"}},
+		},
+		{
+			Address:          "http://ppa.launchpad.net/foo/ppa/ubuntu",
+			Components:       map[deb.Codename][]deb.Component{"unstable": {"main", "contrib"}},
+			ArmoredPublicKey: []byte("KEY"),
+		},
+		{
+			Address:    "file:" + path.Join(s.tmpDir, "missing"),
+			Components: map[deb.Codename][]deb.Component{"unstable": {"main"}},
+		},
+		{
+			Address:    "http://example.com/debian",
+			Components: map[deb.Codename][]deb.Component{"trusty": {"main"}},
+		},
+	}
+	keys := path.Join(s.tmpDir, "keys")
+	args, binds, err := extraRepositories(keys, "unstable", deps)
+	c.Assert(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"--extra-repository=deb [trusted=yes] file:" + local + " unstable main",
+		"--extra-repository-key=" + path.Join(keys, "1.asc"),
+		"--extra-repository=deb http://ppa.launchpad.net/foo/ppa/ubuntu unstable main contrib",
+	})
+	c.Check(binds, DeepEquals, []string{local})
+	key, err := ioutil.ReadFile(path.Join(keys, "1.asc"))
+	c.Check(err, IsNil)
+	c.Check(string(key), Equals, "KEY")
+}
+
+func (s *SbuildSuite) TestBootstrapCommand(c *C) {
+	cmd, err := s.b.bootstrapCommand("unstable", deb.Amd64)
+	c.Assert(err, IsNil)
+	c.Check(cmd.Args, DeepEquals, []string{"mmdebstrap", "--variant=buildd",
+		"--arch=amd64", "--components=main,contrib,non-free",
+		"--keyring=/usr/share/keyrings/debian-archive-keyring.gpg",
+		"unstable", s.b.imagePath("unstable", deb.Amd64), "http://ftp.us.debian.org/debian"})
+
+	s.b.bootstrap = "sbuild-createchroot"
+	cmd, err = s.b.bootstrapCommand("trusty", deb.I386)
+	c.Assert(err, IsNil)
+	c.Check(cmd.Args, DeepEquals, []string{"sbuild-createchroot", "--chroot-prefix=ddesk-trusty",
+		"--arch=i386", "--components=main,restricted,universe,multiverse",
+		"--keyring=/usr/share/keyrings/ubuntu-archive-keyring.gpg",
+		"trusty", s.b.imagePath("trusty", deb.I386), "http://ftp.ubuntu.com/ubuntu"})
+
+	_, err = s.b.bootstrapCommand("hamm", deb.I386)
+	c.Check(err, ErrorMatches, "hamm is not supported by this builder")
+}
+
+func (s *SbuildSuite) TestAvailableDistributions(c *C) {
+	for _, image := range []string{"unstable-amd64", "unstable-i386", "trusty-amd64"} {
+		c.Assert(os.MkdirAll(path.Join(s.tmpDir, "builder", "chroots", image), 0755), IsNil)
+	}
+	// chroots are only available once declared to schroot
+	for _, conf := range []string{"ddesk-unstable-amd64", "ddesk-unstable-i386"} {
+		c.Assert(ioutil.WriteFile(path.Join(s.schrootDir, "chroot.d", conf), nil, 0644), IsNil)
+	}
+	c.Check(s.b.AvailableDistributions(), DeepEquals, []deb.Codename{"unstable"})
+	c.Check(s.b.AvailableArchitectures("unstable"), DeepEquals, ArchitectureList{deb.Amd64, deb.I386})
+
+	c.Check(s.b.RemoveDistribution("unstable", deb.I386), IsNil)
+	c.Check(s.b.AvailableArchitectures("unstable"), DeepEquals, ArchitectureList{deb.Amd64})
+	c.Check(s.b.RemoveDistribution("trusty", deb.Amd64), ErrorMatches, "Distribution trusty architecture amd64 is not supported")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sort"
+
+	deb ".."
+)
+
+// FileSearchResult is a file found in the Contents index of the local
+// repository.
+type FileSearchResult struct {
+	Dist      deb.Codename
+	Arch      deb.Architecture
+	Path      string
+	Locations []string
+}
+
+type fileSearchResults []FileSearchResult
+
+func (l fileSearchResults) Len() int {
+	return len(l)
+}
+
+func (l fileSearchResults) Less(i, j int) bool {
+	if l[i].Dist != l[j].Dist {
+		return l[i].Dist < l[j].Dist
+	}
+	if l[i].Arch != l[j].Arch {
+		return l[i].Arch < l[j].Arch
+	}
+	return l[i].Path < l[j].Path
+}
+
+func (l fileSearchResults) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// SearchFile looks up which packages of the local repository ship a
+// file. If no distribution is given, all the distributions supported
+// by the user are searched. Results are sorted by distribution,
+// architecture and path.
+func (x *Interactor) SearchFile(query string, dists []deb.Codename) ([]FileSearchResult, error) {
+	if len(dists) == 0 {
+		for d := range x.userDistConfig.Supported() {
+			dists = append(dists, d)
+		}
+	}
+
+	res := []FileSearchResult{}
+	for _, d := range dists {
+		found, err := x.localRepository.SearchFile(d, query)
+		if err != nil {
+			return nil, err
+		}
+		for a, entries := range found {
+			for _, e := range entries {
+				res = append(res, FileSearchResult{
+					Dist:      d,
+					Arch:      a,
+					Path:      e.Path,
+					Locations: e.Locations,
+				})
+			}
+		}
+	}
+	sort.Sort(fileSearchResults(res))
+	return res, nil
+}
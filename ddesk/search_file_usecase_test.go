@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+type SearchFileUseCaseSuite struct {
+	x    Interactor
+	repo *aptRepositoryStub
+}
+
+var _ = Suite(&SearchFileUseCaseSuite{})
+
+func (s *SearchFileUseCaseSuite) SetUpTest(c *C) {
+	unstableAmd64 := make(deb.ContentsIndex)
+	unstableAmd64.Add("libs/libfoo1", "usr/lib/libfoo.so.1")
+	unstableAmd64.Add("libdevel/libfoo-dev", "usr/lib/libfoo.so", "usr/include/foo.h")
+	unstableI386 := make(deb.ContentsIndex)
+	unstableI386.Add("libdevel/libfoo-dev", "usr/include/foo.h")
+	sid := make(deb.ContentsIndex)
+
+	s.repo = &aptRepositoryStub{
+		Contents: map[deb.Codename]map[deb.Architecture]deb.ContentsIndex{
+			"unstable": {deb.Amd64: unstableAmd64, deb.I386: unstableI386},
+			"sid":      {deb.Amd64: sid},
+		},
+	}
+	s.x.localRepository = s.repo
+	s.x.userDistConfig = &UserDistSupportConfigStub{
+		supported: map[deb.Codename]map[deb.Architecture]bool{
+			"unstable": {deb.Amd64: true, deb.I386: true},
+			"sid":      {deb.Amd64: true},
+		},
+	}
+}
+
+func (s *SearchFileUseCaseSuite) TestSearchFile(c *C) {
+	res, err := s.x.SearchFile("/usr/include/foo.h", nil)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []FileSearchResult{
+		{Dist: "unstable", Arch: deb.Amd64, Path: "usr/include/foo.h", Locations: []string{"libdevel/libfoo-dev"}},
+		{Dist: "unstable", Arch: deb.I386, Path: "usr/include/foo.h", Locations: []string{"libdevel/libfoo-dev"}},
+	})
+
+	res, err = s.x.SearchFile("libfoo.so", []deb.Codename{"sid"})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+
+	res, err = s.x.SearchFile("libfoo.so", []deb.Codename{"buzz"})
+	c.Check(res, IsNil)
+	c.Check(err, ErrorMatches, "Distribution buzz is not supported")
+
+	s.repo.Err = fmt.Errorf("Failure")
+	res, err = s.x.SearchFile("libfoo.so", nil)
+	c.Check(res, IsNil)
+	c.Check(err, ErrorMatches, "Failure")
+}
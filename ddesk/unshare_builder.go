@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+
+	deb ".."
+	"github.com/nightlyone/lockfile"
+)
+
+// UnshareBuilder is a DebianBuilder that does not need root
+// privileges. Its images are tarballs created by mmdebstrap in a user
+// namespace, and packages are built by sbuild, unpacking these
+// tarballs in a user namespace too. The user needs subordinate user
+// and group IDs, see subuid(5).
+//
+// As images are tarballs, they are updated by creating them again.
+type UnshareBuilder struct {
+	basepath  string
+	imagepath string
+	jobspath  string
+
+	lock lockfile.Lockfile
+
+	supported ArchitectureList
+	keepEnv   []string
+
+	scheduler *buildScheduler
+}
+
+// NewUnshareBuilder initializes an UnshareBuilder with its images
+// located in basepath, running at most maxJobs sbuild jobs at the
+// same time. If maxJobs is not positive, it is the number of CPUs.
+func NewUnshareBuilder(basepath string, maxJobs int) (*UnshareBuilder, error) {
+	res := &UnshareBuilder{
+		basepath:  basepath,
+		imagepath: path.Join(basepath, "images"),
+		jobspath:  path.Join(basepath, "jobs"),
+		supported: hostArchitectures(),
+		keepEnv:   []string{"PATH", "USER", "LOGNAME"},
+	}
+	for _, d := range []string{res.imagepath, res.jobspath} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	res.lock, err = lockfile.New(path.Join(basepath, "global.lock"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = res.lock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(res, res.lock.Unlock())
+
+	if maxJobs <= 0 {
+		maxJobs = runtime.NumCPU()
+	}
+	res.scheduler = newBuildScheduler(maxJobs)
+
+	return res, nil
+}
+
+func (b *UnshareBuilder) maskedEnviron() []string {
+	res := []string{fmt.Sprintf("HOME=%s", b.basepath)}
+	for _, key := range b.keepEnv {
+		value := os.Getenv(key)
+		if len(value) == 0 {
+			continue
+		}
+		res = append(res, key+"="+value)
+	}
+	return res
+}
+
+func (b *UnshareBuilder) imagePath(d deb.Codename, a deb.Architecture) string {
+	return path.Join(b.imagepath, fmt.Sprintf("%s-%s.tar", d, a))
+}
+
+// repositoryServer serves local apt repositories over HTTP on the
+// loopback interface, as they cannot be mounted in the chroots of
+// unprivileged builds.
+type repositoryServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// serveRepositories returns deps, where local repositories are
+// served by the returned server. It must be closed once deps are not
+// used anymore.
+func serveRepositories(deps []*AptRepositoryAccess) ([]*AptRepositoryAccess, *repositoryServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	res := make([]*AptRepositoryAccess, 0, len(deps))
+	for i, dep := range deps {
+		if strings.HasPrefix(dep.Address, "file:/") == false {
+			res = append(res, dep)
+			continue
+		}
+		localpath := strings.TrimPrefix(dep.Address, "file:")
+		if _, err := os.Stat(path.Join(localpath, "dists")); err != nil {
+			// will be reported as a skipped dependency
+			res = append(res, dep)
+			continue
+		}
+		prefix := fmt.Sprintf("/%d/", i)
+		mux.Handle(prefix, http.StripPrefix(prefix, http.FileServer(http.Dir(localpath))))
+		served := *dep
+		served.Address = fmt.Sprintf("http://%s%s", l.Addr(), prefix)
+		res = append(res, &served)
+	}
+	s := &repositoryServer{
+		listener: l,
+		server:   &http.Server{Handler: mux},
+	}
+	go s.server.Serve(l)
+	return res, s, nil
+}
+
+// Close stops serving the repositories
+func (s *repositoryServer) Close() error {
+	return s.server.Close()
+}
+
+// buildArch runs the build of a package for one architecture, and
+// moves its results to the destination directory.
+func (b *UnshareBuilder) buildArch(ctx context.Context, a BuildArguments, ab *archBuild, dscFile string, output io.Writer) error {
+	jobPath, err := ioutil.TempDir(b.jobspath, fmt.Sprintf("%s-%s_", a.Dist, ab.arch))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(jobPath); err != nil {
+			log.Printf("Could not clean job directory %s: %s", jobPath, err)
+		}
+	}()
+	resultPath := path.Join(jobPath, "result")
+	if err := os.MkdirAll(resultPath, 0755); err != nil {
+		return err
+	}
+
+	deps, server, err := serveRepositories(a.Deps)
+	if err != nil {
+		return fmt.Errorf("Could not serve local repositories: %s", err)
+	}
+	defer server.Close()
+	repositories, _, err := extraRepositories(path.Join(jobPath, "keys"), a.Dist, deps)
+	if err != nil {
+		return err
+	}
+
+	optionArgs, config := sbuildOptions(a.Options)
+	configPath := path.Join(jobPath, "sbuildrc")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		return err
+	}
+
+	archAll := "--no-arch-all"
+	if ab.indep {
+		archAll = "--arch-all"
+	}
+	cmd := exec.Command("sbuild", "--nolog",
+		"--chroot-mode=unshare",
+		"--chroot="+b.imagePath(a.Dist, ab.arch),
+		"--dist="+string(a.Dist),
+		"--build-dir="+resultPath,
+		archAll,
+		"--no-run-lintian", "--no-run-piuparts", "--no-run-autopkgtest")
+	cmd.Args = append(cmd.Args, sbuildArchArgs(ab)...)
+	if a.BinNMU != nil {
+		cmd.Args = append(cmd.Args, a.BinNMU.sbuildArgs()...)
+	}
+	cmd.Args = append(cmd.Args, repositories...)
+	cmd.Args = append(cmd.Args, optionArgs...)
+	cmd.Args = append(cmd.Args, dscFile)
+	cmd.Env = append(b.maskedEnviron(), "SBUILD_CONFIG="+configPath)
+	cmd.Dir = jobPath
+	cmd.Stdin = nil
+	cmd.Stderr = output
+	cmd.Stdout = output
+	fmt.Fprintf(output, "--- Execute:%v\n--- Env:%v\n", cmd.Args, cmd.Env)
+	// when terminated, sbuild removes the chroot it unpacked
+	if err := runCommand(ctx, cmd); err != nil {
+		return err
+	}
+
+	return collectResults(resultPath, a, ab.targetArch())
+}
+
+// BuildPackage builds a deb.SourcePackageRef package. if an io.Writer
+// is passed, all the current output of sbuild will be copied to
+// it. Architectures are built concurrently, their output lines are
+// then prefixed by the architecture. When ctx is done, the sbuild
+// processes are killed.
+func (b *UnshareBuilder) BuildPackage(ctx context.Context, a BuildArguments, output io.Writer) (*BuildResult, error) {
+	if err := a.Options.Check(); err != nil {
+		return nil, err
+	}
+	if len(a.Options.Hooks) != 0 {
+		return nil, fmt.Errorf("Build hooks are only supported by cowbuilder builders")
+	}
+	if a.Options.Autopkgtest {
+		return nil, fmt.Errorf("Autopkgtests are only supported by cowbuilder builders")
+	}
+	return buildArchitectures(ctx, b, b.scheduler, a, output)
+}
+
+// bootstrapCommand returns the command creating the image of d-a in
+// dest
+func (b *UnshareBuilder) bootstrapCommand(d deb.Codename, a deb.Architecture, dest string) (*exec.Cmd, error) {
+	dist, err := distributionConfig(b.basepath, d)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"--mode=unshare", "--format=tar", "--variant=buildd", "--arch=" + string(a)}
+	mirror := dist.Mirror
+	if strings.HasPrefix(mirror, "file:") {
+		// a sources.list entry, as local mirrors are not signed
+		mirror = fmt.Sprintf("deb [trusted=yes] %s %s %s", mirror, d, joinComponents(dist.Components, " "))
+	} else {
+		args = append(args,
+			"--components="+joinComponents(dist.Components, ","),
+			"--keyring="+dist.Keyring)
+	}
+	if len(dist.AptProxy) != 0 {
+		// it is kept in the image for the builds
+		args = append(args, fmt.Sprintf("--aptopt=Acquire::http::Proxy \"%s\"", dist.AptProxy))
+	}
+	args = append(args, dist.DebootstrapOptions...)
+	args = append(args, string(d), dest, mirror)
+	cmd := exec.Command("mmdebstrap", args...)
+	cmd.Env = b.maskedEnviron()
+	return cmd, nil
+}
+
+// createImage creates the image of d-a. The image is created aside
+// and replaces the current one once complete, so an interrupted
+// creation leaves the current image unchanged.
+func (b *UnshareBuilder) createImage(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	supported := false
+	for _, aa := range b.supported {
+		if aa == a {
+			supported = true
+			break
+		}
+	}
+
+	if supported == false {
+		return fmt.Errorf("Architecture %s is not in the supported architecture list %v.", a, b.supported)
+	}
+
+	tmp, err := ioutil.TempFile(b.imagepath, "."+path.Base(b.imagePath(d, a))+".")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cmd, err := b.bootstrapCommand(d, a, tmp.Name())
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Stdin = nil
+	if output != nil {
+		fmt.Fprintf(output, "--- Executing: %v\n--- Env: %v\n", cmd.Args, cmd.Env)
+	}
+	if err := runCommand(ctx, cmd); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.imagePath(d, a))
+}
+
+// InitDistribution creates the image of a distribution with the given
+// architecture. The output of mmdebstrap is synchronously copied to
+// the given output.
+func (b *UnshareBuilder) InitDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return b.scheduler.RunExclusive(ctx, b.imagePath(d, a), func() error {
+		if _, err := os.Stat(b.imagePath(d, a)); err == nil {
+			return fmt.Errorf("Distribution %s architecture %s is already supported", d, a)
+		}
+		return b.createImage(ctx, d, a, output)
+	})
+}
+
+// RemoveDistribution is removing a distribution support from the
+// builder.
+func (b *UnshareBuilder) RemoveDistribution(d deb.Codename, a deb.Architecture) error {
+	return b.scheduler.RunExclusive(context.Background(), b.imagePath(d, a), func() error {
+		if _, err := os.Stat(b.imagePath(d, a)); err != nil {
+			return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
+		}
+		return os.Remove(b.imagePath(d, a))
+	})
+}
+
+// UpdateDistribution creates again the image of the given
+// distribution, the current image is used until the new one is
+// complete. If ctx is done before, the current image is kept.
+func (b *UnshareBuilder) UpdateDistribution(ctx context.Context, d deb.Codename, a deb.Architecture, output io.Writer) error {
+	return b.scheduler.RunExclusive(ctx, b.imagePath(d, a), func() error {
+		if _, err := os.Stat(b.imagePath(d, a)); err != nil {
+			return fmt.Errorf("Distribution %s architecture %s is not supported", d, a)
+		}
+		return b.createImage(ctx, d, a, output)
+	})
+}
+
+func (b *UnshareBuilder) getAllImages() map[deb.Codename]ArchitectureList {
+	allFiles, err := ioutil.ReadDir(b.imagepath)
+	if err != nil {
+		return nil
+	}
+
+	res := map[deb.Codename]ArchitectureList{}
+	rx := regexp.MustCompile(`^([a-z]+)-([a-z0-9]+)\.tar$`)
+	for _, f := range allFiles {
+		if f.Mode().IsRegular() == false {
+			continue
+		}
+		matches := rx.FindStringSubmatch(f.Name())
+		if matches == nil {
+			continue
+		}
+		dist := deb.Codename(matches[1])
+		res[dist] = append(res[dist], deb.Architecture(matches[2]))
+	}
+	return res
+}
+
+// AvailableDistributions returns the distributions with at least one
+// image
+func (b *UnshareBuilder) AvailableDistributions() []deb.Codename {
+	res := []deb.Codename{}
+	for d := range b.getAllImages() {
+		res = append(res, d)
+	}
+	return res
+}
+
+// AvailableArchitectures returns the architectures of the images of
+// d
+func (b *UnshareBuilder) AvailableArchitectures(d deb.Codename) ArchitectureList {
+	return b.getAllImages()[d]
+}
+
+func init() {
+	aptDepTracker.Add("mmdebstrap")
+	aptDepTracker.Add("uidmap")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	deb ".."
+	. "gopkg.in/check.v1"
+)
+
+// fakeMmdebstrap writes its arguments in the image it is asked to
+// create, and hangs with a slow mirror
+const fakeMmdebstrap = `#!/bin/sh
+eval dest=\${$(($# - 1))}
+case "$*" in
+	*slow*) sleep 10 ;;
+esac
+echo "$@" > "$dest"
+`
+
+type UnshareBuilderSuite struct {
+	tmpDir  string
+	b       *UnshareBuilder
+	oldPath string
+}
+
+var _ = Suite(&UnshareBuilderSuite{})
+
+func (s *UnshareBuilderSuite) SetUpTest(c *C) {
+	s.tmpDir = c.MkDir()
+	binPath := path.Join(s.tmpDir, "bin")
+	c.Assert(os.MkdirAll(binPath, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(binPath, "mmdebstrap"), []byte(fakeMmdebstrap), 0755), IsNil)
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", binPath+":"+s.oldPath)
+
+	var err error
+	s.b, err = NewUnshareBuilder(path.Join(s.tmpDir, "builder"), 2)
+	c.Assert(err, IsNil)
+	s.setMirror(c, "unstable", "file:///srv/mirror")
+}
+
+func (s *UnshareBuilderSuite) setMirror(c *C, d deb.Codename, mirror string) {
+	config, err := LoadBuilderConfig(s.b.basepath)
+	c.Assert(err, IsNil)
+	c.Assert(config.Set(d, DistributionConfig{Mirror: mirror}), IsNil)
+	c.Assert(config.Save(), IsNil)
+}
+
+func (s *UnshareBuilderSuite) TearDownTest(c *C) {
+	os.Setenv("PATH", s.oldPath)
+}
+
+func (s *UnshareBuilderSuite) image(c *C, d deb.Codename, a deb.Architecture) string {
+	data, err := ioutil.ReadFile(s.b.imagePath(d, a))
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *UnshareBuilderSuite) TestBootstrapCommand(c *C) {
+	cmd, err := s.b.bootstrapCommand("unstable", deb.Amd64, "/tmp/image.tar")
+	c.Assert(err, IsNil)
+	c.Check(cmd.Args, DeepEquals, []string{"mmdebstrap", "--mode=unshare", "--format=tar",
+		"--variant=buildd", "--arch=amd64", "unstable", "/tmp/image.tar",
+		"deb [trusted=yes] file:///srv/mirror unstable main contrib non-free"})
+
+	cmd, err = s.b.bootstrapCommand("trusty", deb.I386, "/tmp/image.tar")
+	c.Assert(err, IsNil)
+	c.Check(cmd.Args, DeepEquals, []string{"mmdebstrap", "--mode=unshare", "--format=tar",
+		"--variant=buildd", "--arch=i386",
+		"--components=main,restricted,universe,multiverse",
+		"--keyring=/usr/share/keyrings/ubuntu-archive-keyring.gpg",
+		"trusty", "/tmp/image.tar", "http://ftp.ubuntu.com/ubuntu"})
+
+	config, err := LoadBuilderConfig(s.b.basepath)
+	c.Assert(err, IsNil)
+	c.Assert(config.Set("trusty", DistributionConfig{
+		Mirror:             "http://mirror.example.com/ubuntu",
+		Components:         []deb.Component{"main"},
+		DebootstrapOptions: []string{"--include=eatmydata"},
+		AptProxy:           "http://proxy:3142",
+	}), IsNil)
+	c.Assert(config.Save(), IsNil)
+	cmd, err = s.b.bootstrapCommand("trusty", deb.I386, "/tmp/image.tar")
+	c.Assert(err, IsNil)
+	c.Check(cmd.Args, DeepEquals, []string{"mmdebstrap", "--mode=unshare", "--format=tar",
+		"--variant=buildd", "--arch=i386",
+		"--components=main",
+		"--keyring=/usr/share/keyrings/ubuntu-archive-keyring.gpg",
+		"--aptopt=Acquire::http::Proxy \"http://proxy:3142\"",
+		"--include=eatmydata",
+		"trusty", "/tmp/image.tar", "http://mirror.example.com/ubuntu"})
+}
+
+func (s *UnshareBuilderSuite) TestLifecycle(c *C) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	c.Assert(s.b.InitDistribution(ctx, "unstable", deb.Amd64, &out), IsNil)
+	c.Check(out.String(), Matches, "--- Executing: \\[mmdebstrap --mode=unshare .*\\]\n.*\n")
+	c.Check(s.image(c, "unstable", deb.Amd64), Matches, "--mode=unshare .* unstable .* deb \\[trusted=yes\\] file:///srv/mirror unstable main contrib non-free\n")
+	c.Check(s.b.AvailableDistributions(), DeepEquals, []deb.Codename{"unstable"})
+	c.Check(s.b.AvailableArchitectures("unstable"), DeepEquals, ArchitectureList{deb.Amd64})
+
+	c.Check(s.b.InitDistribution(ctx, "unstable", deb.Amd64, nil), ErrorMatches, "Distribution unstable architecture amd64 is already supported")
+	c.Check(s.b.InitDistribution(ctx, "unstable", "s390x", nil), ErrorMatches, "Architecture s390x is not in the supported architecture list .*")
+	c.Check(s.b.UpdateDistribution(ctx, "unstable", deb.I386, nil), ErrorMatches, "Distribution unstable architecture i386 is not supported")
+
+	// an update creates the image again
+	before := s.image(c, "unstable", deb.Amd64)
+	c.Assert(s.b.UpdateDistribution(ctx, "unstable", deb.Amd64, nil), IsNil)
+	c.Check(s.image(c, "unstable", deb.Amd64), Not(Equals), before)
+
+	c.Check(s.b.RemoveDistribution("unstable", deb.Amd64), IsNil)
+	c.Check(s.b.AvailableDistributions(), DeepEquals, []deb.Codename{})
+	c.Check(s.b.RemoveDistribution("unstable", deb.Amd64), ErrorMatches, "Distribution unstable architecture amd64 is not supported")
+}
+
+func (s *UnshareBuilderSuite) TestInterruptedUpdate(c *C) {
+	c.Assert(s.b.InitDistribution(context.Background(), "unstable", deb.Amd64, nil), IsNil)
+	before := s.image(c, "unstable", deb.Amd64)
+
+	s.setMirror(c, "unstable", "file:///srv/slow-mirror")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Check(s.b.UpdateDistribution(ctx, "unstable", deb.Amd64, nil), Equals, context.DeadlineExceeded)
+	c.Check(s.image(c, "unstable", deb.Amd64), Equals, before)
+	tmp, err := filepath.Glob(path.Join(s.b.imagepath, ".*"))
+	c.Check(err, IsNil)
+	c.Check(tmp, HasLen, 0)
+}
+
+func (s *UnshareBuilderSuite) TestServeRepositories(c *C) {
+	local := path.Join(s.tmpDir, "local")
+	c.Assert(os.MkdirAll(path.Join(local, "dists", "unstable"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(local, "dists", "unstable", "Release"), []byte("Suite: unstable\n"), 0644), IsNil)
+	deps := []*AptRepositoryAccess{
+		{Address: "http://example.com/debian"},
+		{Address: "file:" + local},
+		{Address: "file:" + path.Join(s.tmpDir, "missing")},
+	}
+
+	served, server, err := serveRepositories(deps)
+	c.Assert(err, IsNil)
+	defer server.Close()
+	c.Assert(served, HasLen, 3)
+	c.Check(served[0], Equals, deps[0])
+	c.Check(served[1].Address, Matches, "http://127.0.0.1:[0-9]+/1/")
+	c.Check(deps[1].Address, Equals, "file:"+local)
+	c.Check(served[2], Equals, deps[2])
+
+	resp, err := http.Get(served[1].Address + "dists/unstable/Release")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "Suite: unstable\n")
+}
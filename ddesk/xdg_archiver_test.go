@@ -11,7 +11,7 @@ import (
 	"regexp"
 
 	deb ".."
-	"golang.org/x/crypto/openpgp/clearsign"
+	"../pgp"
 	. "gopkg.in/check.v1"
 )
 
@@ -30,12 +30,8 @@ func (a *DebfileAuthentifierStub) CheckAnyClearsigned(r io.Reader) (io.Reader, e
 		return nil, err
 	}
 
-	block, rest := clearsign.Decode(allData)
-	if block == nil {
-		return bytes.NewReader(rest), nil
-	}
-
-	return bytes.NewReader(block.Plaintext), nil
+	plaintext, _ := pgp.Decode(allData)
+	return bytes.NewReader(plaintext), nil
 }
 
 func (a *DebfileAuthentifierStub) SignChanges(filePath string) error {
@@ -19,9 +19,15 @@ type XdgHistory struct {
 	lock     lockfile.Lockfile
 
 	data []deb.SourcePackageRef
+
+	// all the backports, unlike data which only keeps the last
+	// builds
+	backportsPath string
+	backports     []Backport
 }
 
 var xdgHistoryPath = "go-deb.ddesk/history/data.json"
+var xdgBackportsPath = "go-deb.ddesk/history/backports.json"
 
 func NewXdgHistory() (*XdgHistory, error) {
 	res := &XdgHistory{}
@@ -32,6 +38,11 @@ func NewXdgHistory() (*XdgHistory, error) {
 		return nil, err
 	}
 
+	res.backportsPath, err = xdg.Data.Ensure(xdgBackportsPath)
+	if err != nil {
+		return nil, err
+	}
+
 	lockPath := path.Join(path.Dir(res.filepath), "data.lock")
 
 	res.lock, err = lockfile.New(lockPath)
@@ -39,7 +50,12 @@ func NewXdgHistory() (*XdgHistory, error) {
 		return nil, err
 	}
 
-	err = res.load()
+	err = res.load(res.filepath, &res.data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = res.load(res.backportsPath, &res.backports)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +63,7 @@ func NewXdgHistory() (*XdgHistory, error) {
 	return res, nil
 }
 
-func (h *XdgHistory) load() error {
+func (h *XdgHistory) load(filepath string, data interface{}) error {
 	if err := h.lock.TryLock(); err != nil {
 		return err
 	}
@@ -57,14 +73,14 @@ func (h *XdgHistory) load() error {
 		}
 	}()
 
-	f, err := os.Open(h.filepath)
+	f, err := os.Open(filepath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
 	dec := json.NewDecoder(f)
-	err = dec.Decode(&h.data)
+	err = dec.Decode(data)
 	if err != nil && err != io.EOF {
 		//we mask io.EOF error, because we could have an empty file
 		//as an history
@@ -73,7 +89,7 @@ func (h *XdgHistory) load() error {
 	return nil
 }
 
-func (h *XdgHistory) save() error {
+func (h *XdgHistory) save(filepath string, data interface{}) error {
 	if err := h.lock.TryLock(); err != nil {
 		return err
 	}
@@ -83,14 +99,14 @@ func (h *XdgHistory) save() error {
 		}
 	}()
 
-	f, err := os.Create(h.filepath)
+	f, err := os.Create(filepath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
 	enc := json.NewEncoder(f)
-	return enc.Encode(h.data)
+	return enc.Encode(data)
 }
 
 func (h *XdgHistory) Append(p deb.SourcePackageRef) {
@@ -99,7 +115,7 @@ func (h *XdgHistory) Append(p deb.SourcePackageRef) {
 		toSave = h.data[0:19]
 	}
 	h.data = append([]deb.SourcePackageRef{p}, toSave...)
-	if err := h.save(); err != nil {
+	if err := h.save(h.filepath, h.data); err != nil {
 		panic(err)
 	}
 }
@@ -120,7 +136,24 @@ func (h *XdgHistory) RemoveFront(p deb.SourcePackageRef) {
 	}
 
 	h.data = h.data[i:]
-	if err := h.save(); err != nil {
+	if err := h.save(h.filepath, h.data); err != nil {
 		panic(err)
 	}
 }
+
+func (h *XdgHistory) AppendBackport(b Backport) {
+	h.backports = append([]Backport{b}, h.backports...)
+	if err := h.save(h.backportsPath, h.backports); err != nil {
+		panic(err)
+	}
+}
+
+func (h *XdgHistory) Backports(source string) []Backport {
+	var res []Backport
+	for _, b := range h.backports {
+		if b.Origin.Source == source {
+			res = append(res, b)
+		}
+	}
+	return res
+}
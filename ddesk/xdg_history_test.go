@@ -75,3 +75,23 @@ func (s *XdgHistorySuite) TestHistory(c *C) {
 	c.Check(s.hist.Get()[2], DeepEquals, aRc)
 
 }
+
+func (s *XdgHistorySuite) TestBackports(c *C) {
+	origin := deb.SourcePackageRef{
+		Source: "c",
+		Ver:    deb.Version{UpstreamVersion: "1.0", DebianRevision: "1"},
+	}
+	b := Backport{
+		Origin: origin,
+		Ref:    deb.SourcePackageRef{Source: "c", Ver: backportVersion(origin.Ver, deb.Jessie, 1)},
+		Dist:   deb.Jessie,
+	}
+	s.hist.AppendBackport(b)
+
+	c.Check(s.hist.Backports("c"), DeepEquals, []Backport{b})
+	c.Check(s.hist.Backports("d"), HasLen, 0)
+
+	reloaded, err := NewXdgHistory()
+	c.Assert(err, IsNil)
+	c.Check(reloaded.Backports("c"), DeepEquals, []Backport{b})
+}
@@ -0,0 +1,307 @@
+package deb
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// DebEntry is a file of the control or data tarball of a binary
+// package archive
+type DebEntry struct {
+	Name     string
+	Typeflag byte
+	Linkname string
+	Mode     int64
+	Uid      int
+	Gid      int
+	Uname    string
+	Gname    string
+	ModTime  time.Time
+	Size     int64
+	// Hex encoded SHA256 of the content of regular files
+	Sha256 string
+}
+
+// DebFile is the content of a binary package archive (.deb, .udeb or
+// .ddeb), as needed to compare two builds of a package.
+type DebFile struct {
+	// The format version, from the debian-binary member
+	FormatVersion string
+	// The names of the archive members, in order
+	Members []string
+	// The files of the control tarball, sorted by name
+	Control []DebEntry
+	// The files of the data tarball, sorted by name
+	Data []DebEntry
+}
+
+const arMagic = "!<arch>\n"
+const arHeaderSize = 60
+
+type arMember struct {
+	name string
+	size int64
+}
+
+// readArHeader reads the header of the next member of an ar archive
+func readArHeader(r io.Reader) (*arMember, error) {
+	var header [arHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Truncated ar member header")
+		}
+		return nil, err
+	}
+	if string(header[58:60]) != "`\n" {
+		return nil, fmt.Errorf("Invalid ar member header")
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("Invalid ar member size `%s'", strings.TrimSpace(string(header[48:58])))
+	}
+	name := strings.TrimSpace(string(header[0:16]))
+	// GNU ar terminates names with a slash
+	name = strings.TrimSuffix(name, "/")
+	return &arMember{name: name, size: size}, nil
+}
+
+// decompressor returns a reader decompressing r, according to the
+// extension of the tarball member name
+func decompressor(name string, r io.Reader) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return r, nil
+	case strings.HasSuffix(name, ".tar.gz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(name, ".tar.bz2"):
+		return bzip2.NewReader(r), nil
+	case strings.HasSuffix(name, ".tar.xz"):
+		return xz.NewReader(r)
+	case strings.HasSuffix(name, ".tar.lzma"):
+		return lzma.NewReader(r)
+	case strings.HasSuffix(name, ".tar.zst"):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression of member `%s'", name)
+}
+
+// readDebTarball lists the files of a tarball member of a binary
+// package archive
+func readDebTarball(name string, r io.Reader) ([]DebEntry, error) {
+	dr, err := decompressor(name, r)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := dr.(io.Closer); ok {
+		defer c.Close()
+	}
+	tr := tar.NewReader(dr)
+	res := []DebEntry{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", name, err)
+		}
+		e := DebEntry{
+			Name:     strings.TrimPrefix(h.Name, "./"),
+			Typeflag: h.Typeflag,
+			Linkname: h.Linkname,
+			Mode:     h.Mode,
+			Uid:      h.Uid,
+			Gid:      h.Gid,
+			Uname:    h.Uname,
+			Gname:    h.Gname,
+			ModTime:  h.ModTime,
+			Size:     h.Size,
+		}
+		if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tr); err != nil {
+				return nil, fmt.Errorf("Could not read %s in %s: %s", h.Name, name, err)
+			}
+			e.Sha256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// ReadDebFile reads a binary package archive. The control and data
+// tarballs may be uncompressed, or compressed with gzip, bzip2, xz,
+// lzma or zstd.
+func ReadDebFile(r io.Reader) (*DebFile, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != arMagic {
+		return nil, fmt.Errorf("Not an ar archive")
+	}
+
+	res := &DebFile{}
+	for {
+		m, err := readArHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Members = append(res.Members, m.name)
+		data := io.LimitReader(br, m.size)
+
+		switch {
+		case m.name == "debian-binary":
+			version, err := ioutil.ReadAll(data)
+			if err != nil {
+				return nil, err
+			}
+			res.FormatVersion = strings.TrimSpace(string(version))
+		case strings.HasPrefix(m.name, "control.tar"):
+			if res.Control, err = readDebTarball(m.name, data); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(m.name, "data.tar"):
+			if res.Data, err = readDebTarball(m.name, data); err != nil {
+				return nil, err
+			}
+		}
+		// skips what the tarball readers left, and the padding to
+		// an even offset
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			return nil, err
+		}
+		if m.size%2 == 1 {
+			if _, err := br.Discard(1); err != nil && err != io.EOF {
+				return nil, err
+			}
+		}
+	}
+
+	if len(res.Members) == 0 || res.Members[0] != "debian-binary" {
+		return nil, fmt.Errorf("Missing debian-binary first member")
+	}
+	if res.Control == nil {
+		return nil, fmt.Errorf("Missing control tarball")
+	}
+	if res.Data == nil {
+		return nil, fmt.Errorf("Missing data tarball")
+	}
+	return res, nil
+}
+
+// DebDifference is a difference between two binary package archives
+type DebDifference struct {
+	// The archive member that differs: debian-binary, control.tar or
+	// data.tar. Empty if the member list differs.
+	Member string `json:",omitempty"`
+	// The file of the member that differs, if any
+	Path string `json:",omitempty"`
+	// What differs
+	Description string
+}
+
+func (d DebDifference) String() string {
+	switch {
+	case len(d.Member) == 0:
+		return d.Description
+	case len(d.Path) == 0:
+		return fmt.Sprintf("%s: %s", d.Member, d.Description)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Member, d.Path, d.Description)
+}
+
+// compareDebEntries reports what differs between two files of a
+// tarball, nothing if they are identical
+func compareDebEntries(a, b DebEntry) []string {
+	var res []string
+	if a.Typeflag != b.Typeflag {
+		res = append(res, "type")
+	}
+	if a.Linkname != b.Linkname {
+		res = append(res, "link target")
+	}
+	if a.Mode != b.Mode {
+		res = append(res, "mode")
+	}
+	if a.Uid != b.Uid || a.Gid != b.Gid || a.Uname != b.Uname || a.Gname != b.Gname {
+		res = append(res, "owner")
+	}
+	if a.ModTime.Equal(b.ModTime) == false {
+		res = append(res, "modification time")
+	}
+	if a.Size != b.Size || a.Sha256 != b.Sha256 {
+		res = append(res, "content")
+	}
+	return res
+}
+
+// compareDebTarballs reports the differences between the files of two
+// sorted tarball listings
+func compareDebTarballs(member string, a, b []DebEntry) []DebDifference {
+	var res []DebDifference
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].Name < b[j].Name):
+			res = append(res, DebDifference{Member: member, Path: a[i].Name, Description: "only in first package"})
+			i++
+		case i == len(a) || b[j].Name < a[i].Name:
+			res = append(res, DebDifference{Member: member, Path: b[j].Name, Description: "only in second package"})
+			j++
+		default:
+			if diffs := compareDebEntries(a[i], b[j]); len(diffs) != 0 {
+				res = append(res, DebDifference{
+					Member:      member,
+					Path:        a[i].Name,
+					Description: strings.Join(diffs, ", ") + " differ",
+				})
+			}
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// CompareDebFiles compares two binary package archives member by
+// member, and file by file in their tarballs. It returns no
+// differences if they are identical.
+func CompareDebFiles(a, b *DebFile) []DebDifference {
+	var res []DebDifference
+	if strings.Join(a.Members, " ") != strings.Join(b.Members, " ") {
+		res = append(res, DebDifference{
+			Description: fmt.Sprintf("archive members differ: %s != %s", strings.Join(a.Members, " "), strings.Join(b.Members, " ")),
+		})
+	}
+	if a.FormatVersion != b.FormatVersion {
+		res = append(res, DebDifference{
+			Member:      "debian-binary",
+			Description: fmt.Sprintf("format version %s != %s", a.FormatVersion, b.FormatVersion),
+		})
+	}
+	res = append(res, compareDebTarballs("control.tar", a.Control, b.Control)...)
+	res = append(res, compareDebTarballs("data.tar", a.Data, b.Data)...)
+	return res
+}
@@ -0,0 +1,131 @@
+package deb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	. "gopkg.in/check.v1"
+)
+
+type DebFileSuite struct{}
+
+var _ = Suite(&DebFileSuite{})
+
+type testDebFile struct {
+	name    string
+	content string
+	mode    int64
+	mtime   time.Time
+}
+
+func writeTestTarball(c *C, compression string, files []testDebFile) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "gz":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		var err error
+		w, err = xz.NewWriter(&buf)
+		c.Assert(err, IsNil)
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		c.Assert(tw.WriteHeader(&tar.Header{
+			Name:     "./" + f.name,
+			Typeflag: tar.TypeReg,
+			Mode:     f.mode,
+			Size:     int64(len(f.content)),
+			ModTime:  f.mtime,
+			Uname:    "root",
+			Gname:    "root",
+		}), IsNil)
+		_, err := tw.Write([]byte(f.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(w.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func writeTestDeb(c *C, compression string, data []testDebFile) []byte {
+	mtime := time.Unix(1500000000, 0)
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar." + compression, writeTestTarball(c, compression, []testDebFile{
+			{name: "control", content: "Package: foo\n", mode: 0644, mtime: mtime},
+		})},
+		{"data.tar." + compression, writeTestTarball(c, compression, data)},
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, m := range members {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name, 1500000000, 0, 0, "100644", len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func (s *DebFileSuite) TestReadAndCompare(c *C) {
+	mtime := time.Unix(1500000000, 0)
+	files := []testDebFile{
+		{name: "usr/bin/foo", content: "#!/bin/sh\necho foo\n", mode: 0755, mtime: mtime},
+		{name: "usr/share/doc/foo/changelog", content: "odd", mode: 0644, mtime: mtime},
+	}
+
+	for _, compression := range []string{"gz", "xz"} {
+		d, err := ReadDebFile(bytes.NewReader(writeTestDeb(c, compression, files)))
+		c.Assert(err, IsNil)
+		c.Check(d.FormatVersion, Equals, "2.0")
+		c.Check(d.Members, DeepEquals, []string{"debian-binary", "control.tar." + compression, "data.tar." + compression})
+		c.Check(d.Control, HasLen, 1)
+		c.Assert(d.Data, HasLen, 2)
+		c.Check(d.Data[0].Name, Equals, "usr/bin/foo")
+		c.Check(d.Data[0].Mode, Equals, int64(0755))
+		c.Check(d.Data[0].Sha256, Matches, "[0-9a-f]{64}")
+	}
+
+	gz, err := ReadDebFile(bytes.NewReader(writeTestDeb(c, "gz", files)))
+	c.Assert(err, IsNil)
+	again, err := ReadDebFile(bytes.NewReader(writeTestDeb(c, "gz", files)))
+	c.Assert(err, IsNil)
+	c.Check(CompareDebFiles(gz, again), HasLen, 0)
+
+	changed := []testDebFile{
+		{name: "usr/bin/foo", content: "#!/bin/sh\necho bar\n", mode: 0755, mtime: mtime.Add(time.Hour)},
+		{name: "usr/share/doc/foo/NEWS", content: "", mode: 0644, mtime: mtime},
+	}
+	xzDeb, err := ReadDebFile(bytes.NewReader(writeTestDeb(c, "xz", changed)))
+	c.Assert(err, IsNil)
+	diffs := CompareDebFiles(gz, xzDeb)
+	c.Check(diffs, DeepEquals, []DebDifference{
+		{Description: "archive members differ: debian-binary control.tar.gz data.tar.gz != debian-binary control.tar.xz data.tar.xz"},
+		{Member: "data.tar", Path: "usr/bin/foo", Description: "modification time, content differ"},
+		{Member: "data.tar", Path: "usr/share/doc/foo/NEWS", Description: "only in second package"},
+		{Member: "data.tar", Path: "usr/share/doc/foo/changelog", Description: "only in first package"},
+	})
+	c.Check(diffs[1].String(), Equals, "data.tar: usr/bin/foo: modification time, content differ")
+}
+
+func (s *DebFileSuite) TestReadErrors(c *C) {
+	_, err := ReadDebFile(bytes.NewReader([]byte("not a deb")))
+	c.Check(err, ErrorMatches, "Not an ar archive")
+
+	_, err = ReadDebFile(bytes.NewReader([]byte("!<arch>\ndebian-binary   garbage")))
+	c.Check(err, ErrorMatches, "Truncated ar member header")
+
+	_, err = ReadDebFile(bytes.NewReader([]byte("!<arch>\n")))
+	c.Check(err, ErrorMatches, "Missing debian-binary first member")
+}
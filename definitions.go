@@ -6,7 +6,6 @@ import (
 	"io"
 	"os"
 	"path"
-	"regexp"
 )
 
 // Vendor is providing distributions
@@ -37,6 +36,10 @@ const (
 	Source Architecture = "source"
 	// Armel represents ARM little-endian processors
 	Armel Architecture = "armel"
+	// Armhf represents ARM hard-float processors
+	Armhf Architecture = "armhf"
+	// Arm64 represents ARM 64 bits processors
+	Arm64 Architecture = "arm64"
 )
 
 // Vendor for debian based distribution
@@ -80,6 +83,8 @@ var ArchitectureList = map[Architecture]bool{
 	I386:   true,
 	Source: true,
 	Armel:  true,
+	Armhf:  true,
+	Arm64:  true,
 }
 
 // CodenameList maps Codename to their Vendor
@@ -130,24 +135,21 @@ func (s SourcePackageRef) String() string {
 	return fmt.Sprintf("%s_%s", s.Source, s.Ver)
 }
 
-var sourceNameRx = regexp.MustCompile(`(.*)_(.*)\.(debian\.tar\.gz|dsc)`)
-
-// NewRefFromFileName gives a SourcePackageRef from a filename.
+// NewRefFromFileName gives a SourcePackageRef from the filename of
+// any artifact of a source package (.dsc, tarballs, .diff.gz,
+// upstream signatures).
 //
 // It can fails if the name is not correctly formated.
 func NewRefFromFileName(p string) (*SourcePackageRef, error) {
-	matches := sourceNameRx.FindStringSubmatch(path.Base(p))
-	if matches == nil {
-		return nil, fmt.Errorf("Invalid file name %s", p)
-	}
-	ver, err := ParseVersion(matches[2])
+	f, err := matchFileName(path.Base(p))
 	if err != nil {
 		return nil, err
 	}
-	return &SourcePackageRef{
-		Source: matches[1],
-		Ver:    *ver,
-	}, nil
+	if f == nil || f.Kind.IsSource() == false {
+		return nil, fmt.Errorf("Invalid file name %s", p)
+	}
+	res := f.SourceRef()
+	return &res, nil
 }
 
 // CheckFile test if the file designated by the FileReference has the
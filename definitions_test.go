@@ -27,6 +27,10 @@ func (s *DefinitionsSuite) TestSourcePackageRefName(c *C) {
 			Source: "foo",
 			Ver:    Version{Epoch: 2, UpstreamVersion: "1.2.3", DebianRevision: "1"},
 		},
+		"foo_1.2.3.orig-doc.tar.xz": &SourcePackageRef{
+			Source: "foo",
+			Ver:    Version{UpstreamVersion: "1.2.3", DebianRevision: "0"},
+		},
 	}
 
 	for path, expected := range validData {
@@ -39,8 +43,9 @@ func (s *DefinitionsSuite) TestSourcePackageRefName(c *C) {
 	}
 
 	invalidData := map[string]string{
-		"foo_1.2.3-1.gif": "Invalid file name .*",
-		"foo_1.2.3:3.dsc": "Invalid upstream version.*",
+		"foo_1.2.3-1.gif":       "Invalid file name .*",
+		"foo_1.2.3:3.dsc":       "Invalid upstream version.*",
+		"foo_1.2.3-1_amd64.deb": "Invalid file name .*",
 	}
 
 	for path, errMatch := range invalidData {
@@ -0,0 +1,209 @@
+package deb
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// FileKind designates the kind of artifact a file of an upload is.
+type FileKind int
+
+const (
+	// UnknownKind is a file that is not a debian artifact
+	UnknownKind FileKind = iota
+	// DscKind is a source package control file (.dsc)
+	DscKind
+	// OrigTarballKind is the main upstream tarball (.orig.tar.*)
+	OrigTarballKind
+	// OrigComponentTarballKind is an additional upstream tarball
+	// (.orig-<component>.tar.*)
+	OrigComponentTarballKind
+	// UpstreamSignatureKind is the detached upstream signature of
+	// an upstream tarball (.orig.tar.*.asc)
+	UpstreamSignatureKind
+	// DiffKind is a 1.0 source format debian diff (.diff.gz)
+	DiffKind
+	// DebianTarballKind is a 3.0 (quilt) debian directory tarball
+	// (.debian.tar.*)
+	DebianTarballKind
+	// NativeTarballKind is the tarball of a native source package
+	// (.tar.*)
+	NativeTarballKind
+	// DebKind is a binary package (.deb)
+	DebKind
+	// UdebKind is a micro binary package for the installer (.udeb)
+	UdebKind
+	// DdebKind is a debug symbols binary package (.ddeb)
+	DdebKind
+	// BuildinfoKind is a build information file (.buildinfo)
+	BuildinfoKind
+	// ChangesKind is an upload description file (.changes)
+	ChangesKind
+)
+
+var fileKindNames = map[FileKind]string{
+	UnknownKind:              "unknown",
+	DscKind:                  "dsc",
+	OrigTarballKind:          "orig tarball",
+	OrigComponentTarballKind: "orig component tarball",
+	UpstreamSignatureKind:    "upstream signature",
+	DiffKind:                 "diff",
+	DebianTarballKind:        "debian tarball",
+	NativeTarballKind:        "native tarball",
+	DebKind:                  "deb",
+	UdebKind:                 "udeb",
+	DdebKind:                 "ddeb",
+	BuildinfoKind:            "buildinfo",
+	ChangesKind:              "changes",
+}
+
+func (k FileKind) String() string {
+	if n, ok := fileKindNames[k]; ok == true {
+		return n
+	}
+	return fmt.Sprintf("FileKind(%d)", int(k))
+}
+
+// IsSource returns true if the kind of file is part of a source
+// package.
+func (k FileKind) IsSource() bool {
+	switch k {
+	case DscKind, OrigTarballKind, OrigComponentTarballKind,
+		UpstreamSignatureKind, DiffKind, DebianTarballKind, NativeTarballKind:
+		return true
+	}
+	return false
+}
+
+// IsBinary returns true if the kind of file is a binary package.
+func (k FileKind) IsBinary() bool {
+	return k == DebKind || k == UdebKind || k == DdebKind
+}
+
+// UploadFileRef is a reference to a file of an upload, as deduced
+// from its name.
+type UploadFileRef struct {
+	Kind FileKind
+	// For source artifacts, .changes and .buildinfo it is the
+	// source package name, for binary packages it is the binary
+	// package name.
+	Source string
+	// The version found in the file name. Upstream tarballs only
+	// carry the upstream version.
+	Ver Version
+	// The architecture of binary packages, and of .changes or
+	// .buildinfo when their suffix designates a single one.
+	Arch Architecture
+	// The suffix of .changes and .buildinfo files (i.e. an
+	// architecture, `source' or `multi').
+	Suffix string
+	// The upstream component name of an OrigComponentTarballKind or
+	// of its UpstreamSignatureKind.
+	Component string
+	// The compression extension of tarballs (gz, bz2, xz, lzma or
+	// zst)
+	Compression string
+}
+
+// SourceRef returns the SourcePackageRef the file refers to.
+func (r *UploadFileRef) SourceRef() SourcePackageRef {
+	return SourcePackageRef{
+		Source: r.Source,
+		Ver:    r.Ver,
+	}
+}
+
+// BinaryRef returns the BinaryPackageRef of a binary package file.
+func (r *UploadFileRef) BinaryRef() BinaryPackageRef {
+	return BinaryPackageRef{
+		Name: r.Source,
+		Ver:  r.Ver,
+		Arch: r.Arch,
+	}
+}
+
+const tarCompressionRx = `(gz|bz2|xz|lzma|zst)`
+
+type fileNamePattern struct {
+	rx   *regexp.Regexp
+	kind FileKind
+}
+
+// patterns are tested in order, as a native tarball pattern would
+// also match other tarballs.
+var fileNamePatterns = []fileNamePattern{
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.dsc$`), DscKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.orig\.tar\.` + tarCompressionRx + `\.asc$`), UpstreamSignatureKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.orig-([a-zA-Z0-9][a-zA-Z0-9\-]*)\.tar\.` + tarCompressionRx + `\.asc$`), UpstreamSignatureKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.orig\.tar\.` + tarCompressionRx + `$`), OrigTarballKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.orig-([a-zA-Z0-9][a-zA-Z0-9\-]*)\.tar\.` + tarCompressionRx + `$`), OrigComponentTarballKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.diff\.gz$`), DiffKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.debian\.tar\.` + tarCompressionRx + `$`), DebianTarballKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)\.tar\.` + tarCompressionRx + `$`), NativeTarballKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)_([^_]+)\.deb$`), DebKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)_([^_]+)\.udeb$`), UdebKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)_([^_]+)\.ddeb$`), DdebKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)_([^_]+)\.buildinfo$`), BuildinfoKind},
+	{regexp.MustCompile(`^([^_]+)_([^_]+)_([^_]+)\.changes$`), ChangesKind},
+}
+
+// matchFileName returns nil without error if no pattern matches the
+// basename, or an error if a pattern matches but the version is
+// invalid.
+func matchFileName(base string) (*UploadFileRef, error) {
+	for _, p := range fileNamePatterns {
+		m := p.rx.FindStringSubmatch(base)
+		if m == nil {
+			continue
+		}
+		ver, err := ParseVersion(m[2])
+		if err != nil {
+			return nil, err
+		}
+		res := &UploadFileRef{
+			Kind:   p.kind,
+			Source: m[1],
+			Ver:    *ver,
+		}
+		switch p.kind {
+		case OrigTarballKind, DebianTarballKind, NativeTarballKind:
+			res.Compression = m[3]
+		case OrigComponentTarballKind:
+			res.Component = m[3]
+			res.Compression = m[4]
+		case UpstreamSignatureKind:
+			if len(m) == 5 {
+				res.Component = m[3]
+				res.Compression = m[4]
+			} else {
+				res.Compression = m[3]
+			}
+		case DebKind, UdebKind, DdebKind:
+			res.Arch = Architecture(m[3])
+		case BuildinfoKind, ChangesKind:
+			res.Suffix = m[3]
+			if a, err := ParseArchitecture(m[3]); err == nil {
+				res.Arch = a
+			}
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+// ClassifyFileName returns the UploadFileRef designated by a
+// filename.
+//
+// It fails if the file is not a known debian artifact, or if its
+// name is not correctly formatted.
+func ClassifyFileName(p string) (*UploadFileRef, error) {
+	res, err := matchFileName(path.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, fmt.Errorf("Invalid file name %s", p)
+	}
+	return res, nil
+}
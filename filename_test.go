@@ -0,0 +1,96 @@
+package deb
+
+import . "gopkg.in/check.v1"
+
+type FileNameSuite struct{}
+
+var _ = Suite(&FileNameSuite{})
+
+func (s *FileNameSuite) TestClassifyFileName(c *C) {
+	ver := Version{UpstreamVersion: "1.2.3", DebianRevision: "1"}
+	upVer := Version{UpstreamVersion: "1.2.3", DebianRevision: "0"}
+
+	validData := map[string]UploadFileRef{
+		"/a/b/foo_1.2.3-1.dsc": UploadFileRef{Kind: DscKind, Source: "foo", Ver: ver},
+		"foo_1.2.3.orig.tar.gz": UploadFileRef{
+			Kind: OrigTarballKind, Source: "foo", Ver: upVer, Compression: "gz",
+		},
+		"foo_1.2.3.orig.tar.zst": UploadFileRef{
+			Kind: OrigTarballKind, Source: "foo", Ver: upVer, Compression: "zst",
+		},
+		"foo_1.2.3.orig-doc.tar.xz": UploadFileRef{
+			Kind: OrigComponentTarballKind, Source: "foo", Ver: upVer, Component: "doc", Compression: "xz",
+		},
+		"foo_1.2.3.orig.tar.bz2.asc": UploadFileRef{
+			Kind: UpstreamSignatureKind, Source: "foo", Ver: upVer, Compression: "bz2",
+		},
+		"foo_1.2.3.orig-doc.tar.lzma.asc": UploadFileRef{
+			Kind: UpstreamSignatureKind, Source: "foo", Ver: upVer, Component: "doc", Compression: "lzma",
+		},
+		"foo_1.2.3-1.diff.gz": UploadFileRef{Kind: DiffKind, Source: "foo", Ver: ver},
+		"foo_1.2.3-1.debian.tar.xz": UploadFileRef{
+			Kind: DebianTarballKind, Source: "foo", Ver: ver, Compression: "xz",
+		},
+		"foo_1.2.3.tar.gz": UploadFileRef{
+			Kind: NativeTarballKind, Source: "foo", Ver: upVer, Compression: "gz",
+		},
+		"libfoo0_1.2.3-1_amd64.deb":      UploadFileRef{Kind: DebKind, Source: "libfoo0", Ver: ver, Arch: Amd64},
+		"libfoo0-udeb_1.2.3-1_i386.udeb": UploadFileRef{Kind: UdebKind, Source: "libfoo0-udeb", Ver: ver, Arch: I386},
+		"libfoo0-dbgsym_1.2.3-1_amd64.ddeb": UploadFileRef{
+			Kind: DdebKind, Source: "libfoo0-dbgsym", Ver: ver, Arch: Amd64,
+		},
+		"foo_1.2.3-1_amd64.buildinfo": UploadFileRef{
+			Kind: BuildinfoKind, Source: "foo", Ver: ver, Arch: Amd64, Suffix: "amd64",
+		},
+		"foo_1.2.3-1_source.changes": UploadFileRef{
+			Kind: ChangesKind, Source: "foo", Ver: ver, Arch: Source, Suffix: "source",
+		},
+		"foo_1.2.3-1_multi.changes": UploadFileRef{
+			Kind: ChangesKind, Source: "foo", Ver: ver, Suffix: "multi",
+		},
+	}
+
+	for p, expected := range validData {
+		res, err := ClassifyFileName(p)
+		if c.Check(err, IsNil, Commentf("Unexpected error for %s: %s", p, err)) == false {
+			continue
+		}
+		c.Check(*res, DeepEquals, expected, Commentf("For %s", p))
+	}
+
+	invalidData := map[string]string{
+		"foo_1.2.3-1.gif":          "Invalid file name .*",
+		"foo_1.2.3.orig.tar.rar":   "Invalid file name .*",
+		"foo_1.2.3-1.deb":          "Invalid file name .*",
+		"foo_1.2.3:3.orig.tar.gz":  "Invalid upstream version.*",
+		"foo_1.2.3:3-1_amd64.deb":  "Invalid upstream version.*",
+		"foo_1.2.3-1.debian.tar.Z": "Invalid file name .*",
+	}
+
+	for p, errMatch := range invalidData {
+		res, err := ClassifyFileName(p)
+		c.Check(res, IsNil)
+		c.Check(err, ErrorMatches, errMatch)
+	}
+}
+
+func (s *FileNameSuite) TestFileKind(c *C) {
+	for _, k := range []FileKind{DscKind, OrigTarballKind, OrigComponentTarballKind,
+		UpstreamSignatureKind, DiffKind, DebianTarballKind, NativeTarballKind} {
+		c.Check(k.IsSource(), Equals, true, Commentf("%s", k))
+		c.Check(k.IsBinary(), Equals, false, Commentf("%s", k))
+	}
+
+	for _, k := range []FileKind{DebKind, UdebKind, DdebKind} {
+		c.Check(k.IsSource(), Equals, false, Commentf("%s", k))
+		c.Check(k.IsBinary(), Equals, true, Commentf("%s", k))
+	}
+
+	for _, k := range []FileKind{UnknownKind, BuildinfoKind, ChangesKind} {
+		c.Check(k.IsSource(), Equals, false, Commentf("%s", k))
+		c.Check(k.IsBinary(), Equals, false, Commentf("%s", k))
+	}
+
+	c.Check(OrigComponentTarballKind.String(), Equals, "orig component tarball")
+	c.Check(FileKind(42).String(), Equals, "FileKind(42)")
+}
@@ -0,0 +1,74 @@
+// Package pgp provides the OpenPGP signature checking and signing
+// shared by the tools of this repository. Signatures are checked
+// against a pluggable Keyring, and the verification reports the
+// signer key, its expiry and its revocation status.
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// A Keyring provides the public keys signatures are checked against.
+type Keyring interface {
+	Entities() (openpgp.EntityList, error)
+}
+
+// EntityKeyring is a Keyring of already loaded keys.
+type EntityKeyring openpgp.EntityList
+
+// Entities returns the keys of the keyring.
+func (k EntityKeyring) Entities() (openpgp.EntityList, error) {
+	return openpgp.EntityList(k), nil
+}
+
+// FileKeyring is a Keyring stored in a binary or ASCII armored file,
+// like a gnupg pubring.gpg. The file is read each time the keys are
+// needed, so it may be modified by other tools.
+type FileKeyring string
+
+// Entities reads the keys from the file. A missing file is an empty
+// keyring.
+func (k FileKeyring) Entities() (openpgp.EntityList, error) {
+	f, err := os.Open(string(k))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	res, err := ReadKeyring(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read keyring `%s': %s", string(k), err)
+	}
+	return res, nil
+}
+
+// Exists returns true if the keyring file exists.
+func (k FileKeyring) Exists() bool {
+	_, err := os.Stat(string(k))
+	return err == nil
+}
+
+var armorStart = []byte("-----BEGIN ")
+
+func isArmored(r *bufio.Reader) bool {
+	start, _ := r.Peek(256)
+	return bytes.Contains(start, armorStart)
+}
+
+// ReadKeyring reads a list of keys either binary or ASCII armored.
+func ReadKeyring(r io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(r)
+	if isArmored(br) {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
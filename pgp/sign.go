@@ -0,0 +1,48 @@
+package pgp
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+func checkSigningKey(signer *openpgp.Entity) error {
+	if signer == nil || signer.PrivateKey == nil {
+		return fmt.Errorf("Signing requires a private key")
+	}
+	if signer.PrivateKey.Encrypted {
+		return fmt.Errorf("Private key %s is encrypted", signer.PrivateKey.KeyIdString())
+	}
+	return nil
+}
+
+// Clearsign writes data clearsigned by signer to w.
+func Clearsign(w io.Writer, data []byte, signer *openpgp.Entity) error {
+	if err := checkSigningKey(signer); err != nil {
+		return err
+	}
+	ws, err := clearsign.Encode(w, signer.PrivateKey, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = ws.Write(data); err != nil {
+		ws.Close()
+		return err
+	}
+	return ws.Close()
+}
+
+// SignDetached writes to w a detached signature by signer of the
+// data read from signed. If armored is true the signature is ASCII
+// armored.
+func SignDetached(w io.Writer, signed io.Reader, signer *openpgp.Entity, armored bool) error {
+	if err := checkSigningKey(signer); err != nil {
+		return err
+	}
+	if armored {
+		return openpgp.ArmoredDetachSign(w, signer, signed, nil)
+	}
+	return openpgp.DetachSign(w, signer, signed, nil)
+}
@@ -0,0 +1,58 @@
+package pgp
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/openpgp"
+	. "gopkg.in/check.v1"
+)
+
+type SignSuite struct {
+	signer *openpgp.Entity
+	v      *Verifier
+}
+
+var _ = Suite(&SignSuite{})
+
+func (s *SignSuite) SetUpSuite(c *C) {
+	keys, err := ReadKeyring(bytes.NewReader(readFixture(c, "good-secret.asc")))
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	s.signer = keys[0]
+	s.v = NewVerifier(FileKeyring("testdata/keyring.asc"))
+}
+
+func (s *SignSuite) TestClearsign(c *C) {
+	data := []byte("Format: 1.8\nSource: bar\n")
+	var signed bytes.Buffer
+	c.Assert(Clearsign(&signed, data, s.signer), IsNil)
+
+	plain, signer, err := s.v.CheckClearsigned(signed.Bytes())
+	c.Assert(err, IsNil)
+	c.Check(plain, DeepEquals, data)
+	c.Check(signer.Entity.PrimaryKey.KeyId, Equals, s.signer.PrimaryKey.KeyId)
+
+	stripped, ok := Decode(signed.Bytes())
+	c.Check(ok, Equals, true)
+	c.Check(stripped, DeepEquals, plain)
+}
+
+func (s *SignSuite) TestSignDetached(c *C) {
+	data := []byte("Source: bar\n")
+	for _, armored := range []bool{false, true} {
+		var sig bytes.Buffer
+		c.Assert(SignDetached(&sig, bytes.NewReader(data), s.signer, armored), IsNil)
+		c.Check(bytes.HasPrefix(sig.Bytes(), []byte("-----BEGIN PGP SIGNATURE-----")), Equals, armored)
+		signer, err := s.v.CheckDetached(bytes.NewReader(data), &sig)
+		c.Check(err, IsNil)
+		c.Check(signer, NotNil)
+	}
+}
+
+func (s *SignSuite) TestNoPrivateKey(c *C) {
+	keys, err := FileKeyring("testdata/keyring.asc").Entities()
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	c.Check(Clearsign(&out, []byte("foo"), keys[0]), ErrorMatches, "Signing requires a private key")
+	c.Check(SignDetached(&out, &out, nil, true), ErrorMatches, "Signing requires a private key")
+}
@@ -0,0 +1,40 @@
+#!/bin/bash
+# Generates the OpenPGP fixtures used by the pgp package tests. It is
+# not run by the tests: its output is committed, so tests never need
+# gpg or network access. Re-run it from this directory to regenerate
+# them.
+
+set -e
+
+export GNUPGHOME=$(mktemp -d)
+trap "rm -Rf $GNUPGHOME" EXIT
+
+GPG=(gpg --batch --quiet --no-tty --pinentry-mode loopback --passphrase "")
+
+fpr() {
+	gpg --batch --with-colons --fingerprint "$1" | awk -F: '/^fpr/ { print $10; exit }'
+}
+
+"${GPG[@]}" --quick-gen-key "Good Signer <good@example.com>" rsa2048 sign never
+"${GPG[@]}" --quick-gen-key "Revoked Signer <revoked@example.com>" rsa2048 sign never
+"${GPG[@]}" --faked-system-time 20150101T000000 --quick-gen-key "Expired Signer <expired@example.com>" rsa2048 sign 1d
+
+printf 'Format: 1.8\nSource: foo\n' > data.txt
+
+"${GPG[@]}" --local-user good@example.com --clearsign --output good.txt.asc data.txt
+"${GPG[@]}" --local-user good@example.com --detach-sign --output data.txt.sig data.txt
+"${GPG[@]}" --local-user good@example.com --armor --detach-sign --output data.txt.asc data.txt
+"${GPG[@]}" --local-user revoked@example.com --clearsign --output revoked.txt.asc data.txt
+"${GPG[@]}" --faked-system-time 20150101T120000 --local-user expired@example.com --clearsign --output expired.txt.asc data.txt
+
+# revokes the key with the revocation certificate gpg made at creation
+sed 's/^:-----BEGIN/-----BEGIN/' $GNUPGHOME/openpgp-revocs.d/$(fpr revoked@example.com).rev > revocation.asc
+"${GPG[@]}" --import revocation.asc
+rm revocation.asc
+
+"${GPG[@]}" --armor --export good@example.com revoked@example.com expired@example.com > keyring.asc
+"${GPG[@]}" --armor --export-secret-keys good@example.com > good-secret.asc
+
+# an unknown signer, not listed in keyring.asc
+"${GPG[@]}" --quick-gen-key "Unknown Signer <unknown@example.com>" rsa2048 sign never
+"${GPG[@]}" --local-user unknown@example.com --clearsign --output unknown.txt.asc data.txt
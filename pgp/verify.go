@@ -0,0 +1,234 @@
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ErrNotClearsigned is returned when checking data that is not
+// clearsigned.
+var ErrNotClearsigned = errors.New("data is not clearsigned")
+
+// ErrKeyRevoked is returned for a valid signature made with a revoked
+// key.
+var ErrKeyRevoked = errors.New("signing key is revoked")
+
+// ErrKeyExpired is returned for a valid signature made with an
+// expired key.
+var ErrKeyExpired = errors.New("signing key is expired")
+
+// Signer describes the key that made a valid signature.
+type Signer struct {
+	// The entity owning the signing key, which may be a subkey
+	Entity *openpgp.Entity
+	// The signing key
+	Key *packet.PublicKey
+	// When the signature was made
+	SignedAt time.Time
+	// When the signing key expires, nil if it never expires
+	Expiry *time.Time
+	// true if the signing key was expired at verification time, or
+	// when it made the signature if the Verifier checks expiry at
+	// signing time
+	Expired bool
+	// true if the signing key or its owning entity is revoked
+	Revoked bool
+}
+
+// KeyID returns the long key ID of the signing key.
+func (s *Signer) KeyID() string {
+	return s.Key.KeyIdString()
+}
+
+// Fingerprint returns the fingerprint of the signing key, in
+// uppercase hexadecimal.
+func (s *Signer) Fingerprint() string {
+	return fmt.Sprintf("%X", s.Key.Fingerprint)
+}
+
+// Err returns ErrKeyRevoked or ErrKeyExpired if the signer key should
+// not be trusted anymore, nil otherwise.
+func (s *Signer) Err() error {
+	if s.Revoked {
+		return ErrKeyRevoked
+	}
+	if s.Expired {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// A Verifier checks signatures against a Keyring.
+type Verifier struct {
+	keyring Keyring
+	now     func() time.Time
+	// checks expiry at signing time instead of verification time
+	expiryAtSigning bool
+}
+
+// NewVerifier creates a Verifier checking signatures against k.
+func NewVerifier(k Keyring) *Verifier {
+	return &Verifier{
+		keyring: k,
+		now:     time.Now,
+	}
+}
+
+// CheckExpiryAtSigningTime makes v accept signatures made before their
+// key expired. The signing time is set by the signer, so anyone holding
+// an expired key may backdate signatures: only enable it if signatures
+// are also timestamped by a trusted party, like an archive receiving
+// them.
+func (v *Verifier) CheckExpiryAtSigningTime(enabled bool) {
+	v.expiryAtSigning = enabled
+}
+
+// Decode splits clearsigned data. It returns the plaintext and true
+// if data is clearsigned, or data and false otherwise.
+func Decode(data []byte) ([]byte, bool) {
+	block, rest := clearsign.Decode(data)
+	if block == nil {
+		return rest, false
+	}
+	return block.Plaintext, true
+}
+
+// CheckClearsigned checks the signature of clearsigned data, and
+// returns its plaintext. If data is not clearsigned, it returns data
+// with ErrNotClearsigned. If the signature is valid but made with a
+// revoked or expired key, the Signer is returned along with
+// ErrKeyRevoked or ErrKeyExpired.
+func (v *Verifier) CheckClearsigned(data []byte) ([]byte, *Signer, error) {
+	block, rest := clearsign.Decode(data)
+	if block == nil {
+		return rest, nil, ErrNotClearsigned
+	}
+
+	signer, err := v.check(bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	return block.Plaintext, signer, err
+}
+
+// CheckDetached checks a detached signature, either binary or ASCII
+// armored, of the signed data. It reports revoked and expired keys
+// like CheckClearsigned.
+func (v *Verifier) CheckDetached(signed, signature io.Reader) (*Signer, error) {
+	br := bufio.NewReader(signature)
+	var sig io.Reader = br
+	if isArmored(br) {
+		block, err := armor.Decode(br)
+		if err != nil {
+			return nil, err
+		}
+		if block.Type != openpgp.SignatureType {
+			return nil, fmt.Errorf("Invalid armored signature type `%s'", block.Type)
+		}
+		sig = block.Body
+	}
+	return v.check(signed, sig)
+}
+
+// signerKeyring exposes revoked keys to openpgp, so we can report
+// their status instead of an unknown issuer, and remembers the keys
+// it returned last.
+type signerKeyring struct {
+	openpgp.EntityList
+	candidates []openpgp.Key
+}
+
+// keyUsage returns the usage flags of a key, as packet.KeyFlag*
+func keyUsage(sig *packet.Signature) byte {
+	var res byte
+	if sig.FlagCertify {
+		res |= packet.KeyFlagCertify
+	}
+	if sig.FlagSign {
+		res |= packet.KeyFlagSign
+	}
+	if sig.FlagEncryptCommunications {
+		res |= packet.KeyFlagEncryptCommunications
+	}
+	if sig.FlagEncryptStorage {
+		res |= packet.KeyFlagEncryptStorage
+	}
+	return res
+}
+
+func (k *signerKeyring) KeysByIdUsage(id uint64, requiredUsage byte) []openpgp.Key {
+	k.candidates = nil
+	for _, key := range k.KeysById(id) {
+		// keys without valid flags may be used for anything
+		if sig := key.SelfSignature; sig != nil && sig.FlagsValid && keyUsage(sig)&requiredUsage != requiredUsage {
+			continue
+		}
+		k.candidates = append(k.candidates, key)
+	}
+	return k.candidates
+}
+
+func (v *Verifier) check(signed, signature io.Reader) (*Signer, error) {
+	entities, err := v.keyring.Entities()
+	if err != nil {
+		return nil, err
+	}
+
+	// we need the signature packet afterwards to know its creation time
+	sigData, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	kr := &signerKeyring{EntityList: entities}
+	entity, err := openpgp.CheckDetachedSignature(kr, signed, bytes.NewReader(sigData))
+	if err != nil {
+		return nil, err
+	}
+
+	var key *openpgp.Key
+	for i, k := range kr.candidates {
+		if k.Entity == entity {
+			key = &kr.candidates[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("Could not find signing key of %s", entity.PrimaryKey.KeyIdString())
+	}
+
+	res := &Signer{
+		Entity:  entity,
+		Key:     key.PublicKey,
+		Revoked: len(entity.Revocations) > 0,
+	}
+	if p, err := packet.Read(bytes.NewReader(sigData)); err == nil {
+		if sig, ok := p.(*packet.Signature); ok {
+			res.SignedAt = sig.CreationTime
+		}
+	}
+
+	if sig := key.SelfSignature; sig != nil {
+		if sig.RevocationReason != nil {
+			res.Revoked = true
+		}
+		if sig.KeyLifetimeSecs != nil && *sig.KeyLifetimeSecs != 0 {
+			expiry := key.PublicKey.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+			res.Expiry = &expiry
+			checkedAt := v.now()
+			if v.expiryAtSigning && res.SignedAt.IsZero() == false {
+				checkedAt = res.SignedAt
+			}
+			res.Expired = checkedAt.After(expiry)
+		}
+	}
+
+	return res, res.Err()
+}
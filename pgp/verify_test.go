@@ -0,0 +1,181 @@
+package pgp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type VerifySuite struct {
+	v    *Verifier
+	data []byte
+}
+
+var _ = Suite(&VerifySuite{})
+
+func readFixture(c *C, name string) []byte {
+	data, err := ioutil.ReadFile(path.Join("testdata", name))
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *VerifySuite) SetUpTest(c *C) {
+	s.v = NewVerifier(FileKeyring("testdata/keyring.asc"))
+	s.data = readFixture(c, "data.txt")
+}
+
+func (s *VerifySuite) TestClearsigned(c *C) {
+	plain, signer, err := s.v.CheckClearsigned(readFixture(c, "good.txt.asc"))
+	c.Assert(err, IsNil)
+	c.Check(plain, DeepEquals, s.data)
+	c.Assert(signer, NotNil)
+	c.Check(signer.Entity.Identities["Good Signer <good@example.com>"], NotNil)
+	c.Check(signer.Fingerprint(), HasLen, 40)
+	c.Check(signer.Expiry, IsNil)
+	c.Check(signer.Expired, Equals, false)
+	c.Check(signer.Revoked, Equals, false)
+
+	plain, signer, err = s.v.CheckClearsigned(s.data)
+	c.Check(err, Equals, ErrNotClearsigned)
+	c.Check(signer, IsNil)
+	c.Check(plain, DeepEquals, s.data)
+
+	tampered := bytes.Replace(readFixture(c, "good.txt.asc"), []byte("foo"), []byte("bar"), 1)
+	_, signer, err = s.v.CheckClearsigned(tampered)
+	c.Check(err, ErrorMatches, "openpgp: invalid signature: .*")
+	c.Check(signer, IsNil)
+
+	_, signer, err = s.v.CheckClearsigned(readFixture(c, "unknown.txt.asc"))
+	c.Check(err, ErrorMatches, "openpgp: signature made by unknown entity")
+	c.Check(signer, IsNil)
+}
+
+func (s *VerifySuite) TestRevokedAndExpired(c *C) {
+	_, signer, err := s.v.CheckClearsigned(readFixture(c, "revoked.txt.asc"))
+	c.Check(err, Equals, ErrKeyRevoked)
+	c.Assert(signer, NotNil)
+	c.Check(signer.Revoked, Equals, true)
+	c.Check(signer.Entity.Identities["Revoked Signer <revoked@example.com>"], NotNil)
+
+	_, signer, err = s.v.CheckClearsigned(readFixture(c, "expired.txt.asc"))
+	c.Check(err, Equals, ErrKeyExpired)
+	c.Assert(signer, NotNil)
+	c.Check(signer.Revoked, Equals, false)
+	c.Check(signer.Expired, Equals, true)
+	c.Assert(signer.Expiry, NotNil)
+	c.Check(signer.Expiry.Sub(signer.Key.CreationTime), Equals, 24*time.Hour)
+	c.Check(signer.SignedAt.Before(*signer.Expiry), Equals, true)
+
+	// the key was valid at signing time
+	s.v.now = func() time.Time { return signer.SignedAt }
+	_, signer, err = s.v.CheckClearsigned(readFixture(c, "expired.txt.asc"))
+	c.Check(err, IsNil)
+	c.Check(signer.Expired, Equals, false)
+}
+
+func (s *VerifySuite) TestExpiryAtSigningTime(c *C) {
+	// gpg refuses to sign with an expired key, we make one here
+	created := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := &packet.Config{RSABits: 1024, Time: func() time.Time { return created }}
+	entity, err := openpgp.NewEntity("Late Signer", "", "late@example.com", config)
+	c.Assert(err, IsNil)
+	lifetime := uint32(24 * 3600)
+	for _, id := range entity.Identities {
+		id.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	v := NewVerifier(EntityKeyring{entity})
+
+	signAt := func(t time.Time) []byte {
+		var sig bytes.Buffer
+		config.Time = func() time.Time { return t }
+		c.Assert(openpgp.DetachSign(&sig, entity, bytes.NewReader(s.data), config), IsNil)
+		return sig.Bytes()
+	}
+
+	// the key has expired since the signature
+	early := signAt(created.Add(12 * time.Hour))
+	signer, err := v.CheckDetached(bytes.NewReader(s.data), bytes.NewReader(early))
+	c.Check(err, Equals, ErrKeyExpired)
+	c.Assert(signer, NotNil)
+	c.Check(signer.Expired, Equals, true)
+
+	v.CheckExpiryAtSigningTime(true)
+	signer, err = v.CheckDetached(bytes.NewReader(s.data), bytes.NewReader(early))
+	c.Check(err, IsNil)
+	c.Assert(signer, NotNil)
+	c.Check(signer.Expired, Equals, false)
+
+	// even when checked right away
+	late := created.Add(48 * time.Hour)
+	v.now = func() time.Time { return late }
+	signer, err = v.CheckDetached(bytes.NewReader(s.data), bytes.NewReader(signAt(late)))
+	c.Check(err, Equals, ErrKeyExpired)
+	c.Assert(signer, NotNil)
+	c.Check(signer.Expired, Equals, true)
+	c.Check(signer.SignedAt.Equal(late), Equals, true)
+}
+
+func (s *VerifySuite) TestSignerKeyUsage(c *C) {
+	entities, err := FileKeyring("testdata/keyring.asc").Entities()
+	c.Assert(err, IsNil)
+	kr := &signerKeyring{EntityList: entities}
+	id := entities[0].PrimaryKey.KeyId
+
+	// candidates do not pile up across lookups
+	c.Check(kr.KeysByIdUsage(id, packet.KeyFlagSign), HasLen, 1)
+	c.Check(kr.KeysByIdUsage(id, packet.KeyFlagSign), HasLen, 1)
+	c.Check(kr.candidates, HasLen, 1)
+
+	// the keys are sign only
+	c.Check(kr.KeysByIdUsage(id, packet.KeyFlagEncryptCommunications), HasLen, 0)
+	c.Check(kr.candidates, HasLen, 0)
+}
+
+func (s *VerifySuite) TestDetached(c *C) {
+	for _, sigName := range []string{"data.txt.sig", "data.txt.asc"} {
+		signer, err := s.v.CheckDetached(bytes.NewReader(s.data), bytes.NewReader(readFixture(c, sigName)))
+		c.Check(err, IsNil, Commentf("%s", sigName))
+		c.Check(signer, NotNil)
+
+		_, err = s.v.CheckDetached(bytes.NewBufferString("Source: bar\n"), bytes.NewReader(readFixture(c, sigName)))
+		c.Check(err, ErrorMatches, "openpgp: invalid signature: .*")
+	}
+}
+
+func (s *VerifySuite) TestKeyrings(c *C) {
+	keys, err := FileKeyring("testdata/keyring.asc").Entities()
+	c.Assert(err, IsNil)
+	c.Check(keys, HasLen, 3)
+
+	var binary bytes.Buffer
+	for _, k := range keys {
+		c.Assert(k.Serialize(&binary), IsNil)
+	}
+	fromBinary, err := ReadKeyring(&binary)
+	c.Assert(err, IsNil)
+	c.Check(fromBinary, HasLen, 3)
+
+	keys, err = FileKeyring(path.Join(c.MkDir(), "pubring.gpg")).Entities()
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 0)
+
+	broken := path.Join(c.MkDir(), "pubring.gpg")
+	c.Assert(ioutil.WriteFile(broken, []byte("foo"), 0644), IsNil)
+	_, err = FileKeyring(broken).Entities()
+	c.Check(err, ErrorMatches, "Could not read keyring `.*pubring.gpg': .*")
+
+	// an empty keyring knows no signer
+	_, _, err = NewVerifier(EntityKeyring(nil)).CheckClearsigned(readFixture(c, "good.txt.asc"))
+	c.Check(err, ErrorMatches, "openpgp: signature made by unknown entity")
+
+	c.Check(FileKeyring("testdata/keyring.asc").Exists(), Equals, true)
+	c.Check(FileKeyring(broken+".missing").Exists(), Equals, false)
+}
@@ -0,0 +1,321 @@
+package quilt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// HunkResult reports how a hunk was applied.
+type HunkResult struct {
+	File string
+	// 1-based index of the hunk in its file diff
+	Hunk int
+	// Lines between the expected and the actual position
+	Offset int
+	// Number of context lines ignored at each end to match
+	Fuzz   int
+	Failed bool
+}
+
+// String formats the result like patch(1) does.
+func (r HunkResult) String() string {
+	if r.Failed {
+		return fmt.Sprintf("%s: Hunk #%d FAILED", r.File, r.Hunk)
+	}
+	res := fmt.Sprintf("%s: Hunk #%d succeeded", r.File, r.Hunk)
+	if r.Fuzz > 0 {
+		res = res + fmt.Sprintf(" with fuzz %d", r.Fuzz)
+	}
+	if r.Offset != 0 {
+		res = res + fmt.Sprintf(" (offset %d lines)", r.Offset)
+	}
+	return res + "."
+}
+
+// ApplyResult reports the application of a patch.
+type ApplyResult struct {
+	Hunks []HunkResult
+}
+
+// Fuzzy returns true if any hunk needed fuzz to apply.
+func (r *ApplyResult) Fuzzy() bool {
+	for _, h := range r.Hunks {
+		if h.Fuzz > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Failed returns the hunks that could not be applied.
+func (r *ApplyResult) Failed() []HunkResult {
+	var res []HunkResult
+	for _, h := range r.Hunks {
+		if h.Failed {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// String reports all hunks that did not apply cleanly, one per line.
+func (r *ApplyResult) String() string {
+	var lines []string
+	for _, h := range r.Hunks {
+		if h.Failed || h.Fuzz > 0 || h.Offset != 0 {
+			lines = append(lines, h.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ApplyError is returned when some hunks of a patch do not apply. No
+// file is modified in that case.
+type ApplyError struct {
+	Result *ApplyResult
+}
+
+func (e *ApplyError) Error() string {
+	failed := e.Result.Failed()
+	res := make([]string, 0, len(failed))
+	for _, h := range failed {
+		res = append(res, h.String())
+	}
+	return fmt.Sprintf("%d hunk(s) failed to apply:\n%s", len(failed), strings.Join(res, "\n"))
+}
+
+// fileContent is a text file as lines without end of line
+type fileContent struct {
+	lines []string
+	eol   bool
+}
+
+func splitLines(data []byte) *fileContent {
+	res := &fileContent{eol: true}
+	if len(data) == 0 {
+		return res
+	}
+	if data[len(data)-1] != '\n' {
+		res.eol = false
+	} else {
+		data = data[:len(data)-1]
+	}
+	res.lines = strings.Split(string(data), "\n")
+	return res
+}
+
+func (f *fileContent) bytes() []byte {
+	if len(f.lines) == 0 {
+		return []byte{}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(strings.Join(f.lines, "\n"))
+	if f.eol {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// hunkSides returns the old and new text of the lines of a hunk.
+func hunkSides(lines []string) ([]string, []string) {
+	var old, new []string
+	for _, l := range lines {
+		switch l[0] {
+		case ' ':
+			old = append(old, l[1:])
+			new = append(new, l[1:])
+		case '-':
+			old = append(old, l[1:])
+		case '+':
+			new = append(new, l[1:])
+		}
+	}
+	return old, new
+}
+
+func matchesAt(lines, old []string, pos int) bool {
+	if pos < 0 || pos+len(old) > len(lines) {
+		return false
+	}
+	for i, l := range old {
+		if lines[pos+i] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// contextLen returns the number of context lines at the start and at
+// the end of a hunk.
+func contextLen(lines []string) (int, int) {
+	leading, trailing := 0, 0
+	for leading < len(lines) && lines[leading][0] == ' ' {
+		leading++
+	}
+	for trailing < len(lines)-leading && lines[len(lines)-1-trailing][0] == ' ' {
+		trailing++
+	}
+	return leading, trailing
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// applyHunk applies a hunk to f, searching its position from
+// expected, but not before min. It returns the position of the hunk,
+// the end of the replacement text, the fuzz used and the difference
+// of line count.
+func (f *fileContent) applyHunk(h *Hunk, expected, min, maxFuzz int) (pos, end, fuzz, delta int, ok bool) {
+	leading, trailing := contextLen(h.Lines)
+	for fuzz = 0; fuzz <= maxFuzz; fuzz++ {
+		skipStart, skipEnd := minInt(fuzz, leading), minInt(fuzz, trailing)
+		if fuzz > 0 && skipStart < fuzz && skipEnd < fuzz {
+			// no more context to ignore
+			break
+		}
+		old, new := hunkSides(h.Lines[skipStart : len(h.Lines)-skipEnd])
+		start := expected + skipStart
+		// searches the nearest position, after then before expected
+		for d := 0; start+d <= len(f.lines) || start-d >= min; d++ {
+			candidates := []int{start + d}
+			if d > 0 {
+				candidates = append(candidates, start-d)
+			}
+			for _, p := range candidates {
+				if p < min || matchesAt(f.lines, old, p) == false {
+					continue
+				}
+				atEnd := p+len(old) == len(f.lines)
+				replaced := append([]string(nil), f.lines[:p]...)
+				replaced = append(replaced, new...)
+				f.lines = append(replaced, f.lines[p+len(old):]...)
+				if atEnd && (h.OldNoEOL || h.NewNoEOL) {
+					f.eol = !h.NewNoEOL
+				} else if atEnd && skipEnd == 0 {
+					f.eol = true
+				}
+				return p - skipStart, p + len(new), fuzz, len(new) - len(old), true
+			}
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+// fileChange is the new content of a file once a patch is applied
+type fileChange struct {
+	Path    string
+	Content []byte
+	Remove  bool
+}
+
+// prepare computes the changes of the patch on the tree at dir,
+// without modifying it.
+func (p *Patch) prepare(dir string, strip, maxFuzz int) ([]fileChange, *ApplyResult, error) {
+	res := &ApplyResult{}
+	contents := make(map[string]*fileContent)
+	var order []string
+	removed := make(map[string]bool)
+
+	for _, fd := range p.Files {
+		target, err := fd.Target(strip)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, ok := contents[target]
+		if ok == false {
+			data, err := ioutil.ReadFile(path.Join(dir, target))
+			if err != nil && (os.IsNotExist(err) == false || fd.IsCreation() == false) {
+				return nil, nil, err
+			}
+			if err == nil && fd.IsCreation() && len(data) > 0 {
+				return nil, nil, fmt.Errorf("Patch creates `%s', which already exists", target)
+			}
+			content = splitLines(data)
+			contents[target] = content
+			order = append(order, target)
+		}
+		removed[target] = fd.IsDeletion()
+
+		shift, min := 0, 0
+		for i, h := range fd.Hunks {
+			expected := h.OldStart - 1 + shift
+			if h.OldLines == 0 {
+				// an empty old range designates the line before
+				expected = h.OldStart + shift
+			}
+			pos, end, fuzz, delta, ok := content.applyHunk(h, expected, min, maxFuzz)
+			hr := HunkResult{File: target, Hunk: i + 1}
+			if ok == false {
+				hr.Failed = true
+				res.Hunks = append(res.Hunks, hr)
+				continue
+			}
+			hr.Offset = pos - expected
+			hr.Fuzz = fuzz
+			res.Hunks = append(res.Hunks, hr)
+			shift = shift + hr.Offset + delta
+			min = end
+		}
+	}
+
+	if len(res.Failed()) > 0 {
+		return nil, res, &ApplyError{Result: res}
+	}
+
+	changes := make([]fileChange, 0, len(order))
+	for _, target := range order {
+		data := contents[target].bytes()
+		if removed[target] && len(data) > 0 {
+			return nil, res, fmt.Errorf("Patch should remove `%s', but it is not empty once patched", target)
+		}
+		changes = append(changes, fileChange{
+			Path:    target,
+			Content: data,
+			Remove:  removed[target],
+		})
+	}
+	return changes, res, nil
+}
+
+func commitChanges(dir string, changes []fileChange) error {
+	for _, c := range changes {
+		p := path.Join(dir, c.Path)
+		if c.Remove {
+			if err := os.Remove(p); err != nil && os.IsNotExist(err) == false {
+				return err
+			}
+			continue
+		}
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(p); err == nil {
+			mode = info.Mode()
+		}
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, c.Content, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply applies the patch to the tree at dir, stripping strip leading
+// components of file names and ignoring up to maxFuzz context lines
+// to match a hunk. If any hunk fails, no file is modified and an
+// *ApplyError is returned.
+func (p *Patch) Apply(dir string, strip, maxFuzz int) (*ApplyResult, error) {
+	changes, res, err := p.prepare(dir, strip, maxFuzz)
+	if err != nil {
+		return res, err
+	}
+	return res, commitChanges(dir, changes)
+}
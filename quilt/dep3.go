@@ -0,0 +1,188 @@
+package quilt
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Dep3Header is the metadata of a patch, following
+// https://dep-team.pages.debian.net/deps/dep3/
+type Dep3Header struct {
+	// Short description on the first line, long description after
+	Description string
+	Origin      string
+	// Bug URLs by vendor, the upstream bug having an empty vendor
+	Bugs            map[string]string
+	Forwarded       string
+	Author          string
+	ReviewedBy      []string
+	LastUpdate      string
+	AppliedUpstream string
+	// Any other field
+	Extra map[string]string
+}
+
+var dep3FieldRx = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*):\s*(.*)$`)
+
+// dep3Aliases maps alternative field names to their DEP-3 names
+var dep3Aliases = map[string]string{
+	"subject":  "description",
+	"from":     "author",
+	"acked-by": "reviewed-by",
+}
+
+// ParseDep3 parses the header of a patch. Free-form lines, after the
+// fields or in place of them, are appended to the description. The
+// header ends on a `---' line, as in git formatted patches.
+func ParseDep3(header string) *Dep3Header {
+	res := &Dep3Header{
+		Bugs:  make(map[string]string),
+		Extra: make(map[string]string),
+	}
+
+	var freeForm []string
+	inFields := true
+	var last *string
+	for _, line := range strings.Split(header, "\n") {
+		if strings.HasPrefix(line, "---") {
+			break
+		}
+		if inFields == false {
+			freeForm = append(freeForm, line)
+			continue
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			last = nil
+			if len(res.Description) > 0 || len(res.Origin) > 0 || len(res.Author) > 0 {
+				// the fields paragraph is over
+				inFields = false
+			}
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && last != nil {
+			l := strings.TrimSpace(line)
+			if l == "." {
+				l = ""
+			}
+			*last = *last + "\n" + l
+			continue
+		}
+		m := dep3FieldRx.FindStringSubmatch(line)
+		if m == nil {
+			inFields = false
+			freeForm = append(freeForm, line)
+			continue
+		}
+		last = res.field(m[1], strings.TrimSpace(m[2]))
+	}
+
+	long := strings.TrimSpace(strings.Join(freeForm, "\n"))
+	if len(long) > 0 {
+		if len(res.Description) > 0 {
+			res.Description = res.Description + "\n" + long
+		} else {
+			res.Description = long
+		}
+	}
+	return res
+}
+
+// field sets a field and returns where its continuation lines go
+func (h *Dep3Header) field(name, value string) *string {
+	lower := strings.ToLower(name)
+	if alias, ok := dep3Aliases[lower]; ok {
+		lower = alias
+	}
+	switch {
+	case lower == "description":
+		h.Description = value
+		return &h.Description
+	case lower == "origin":
+		h.Origin = value
+		return &h.Origin
+	case lower == "bug":
+		h.Bugs[""] = value
+		return nil
+	case strings.HasPrefix(lower, "bug-"):
+		h.Bugs[name[4:]] = value
+		return nil
+	case lower == "forwarded":
+		h.Forwarded = value
+		return &h.Forwarded
+	case lower == "author":
+		h.Author = value
+		return &h.Author
+	case lower == "reviewed-by":
+		h.ReviewedBy = append(h.ReviewedBy, value)
+		return nil
+	case lower == "last-update":
+		h.LastUpdate = value
+		return nil
+	case lower == "applied-upstream":
+		h.AppliedUpstream = value
+		return nil
+	}
+	h.Extra[name] = value
+	return nil
+}
+
+// String formats the header as DEP-3 fields, followed by an empty
+// line.
+func (h *Dep3Header) String() string {
+	var lines []string
+	add := func(name, value string) {
+		if len(value) == 0 {
+			return
+		}
+		valueLines := strings.Split(value, "\n")
+		lines = append(lines, fmt.Sprintf("%s: %s", name, valueLines[0]))
+		for _, l := range valueLines[1:] {
+			if len(l) == 0 {
+				l = "."
+			}
+			lines = append(lines, " "+l)
+		}
+	}
+
+	add("Description", h.Description)
+	add("Author", h.Author)
+	add("Origin", h.Origin)
+	vendors := make([]string, 0, len(h.Bugs))
+	for v := range h.Bugs {
+		vendors = append(vendors, v)
+	}
+	sort.Strings(vendors)
+	for _, v := range vendors {
+		if len(v) == 0 {
+			add("Bug", h.Bugs[v])
+		} else {
+			add("Bug-"+v, h.Bugs[v])
+		}
+	}
+	add("Forwarded", h.Forwarded)
+	for _, r := range h.ReviewedBy {
+		add("Reviewed-by", r)
+	}
+	add("Applied-Upstream", h.AppliedUpstream)
+	extra := make([]string, 0, len(h.Extra))
+	for name := range h.Extra {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		add(name, h.Extra[name])
+	}
+	add("Last-Update", h.LastUpdate)
+
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n\n"
+}
+
+// Dep3 parses the header of the patch.
+func (p *Patch) Dep3() *Dep3Header {
+	return ParseDep3(p.Header)
+}
@@ -0,0 +1,79 @@
+package quilt
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type Dep3Suite struct{}
+
+var _ = Suite(&Dep3Suite{})
+
+func (s *Dep3Suite) TestParse(c *C) {
+	h := ParseDep3(`Description: Fix the greeting
+ The greeting had a typo.
+ .
+ It is now fixed.
+Author: Jane Doe <jane@example.com>
+Origin: upstream, https://example.com/commit/1234
+Bug: https://example.com/bugs/12
+Bug-Debian: https://bugs.debian.org/123456
+Forwarded: not-needed
+Acked-by: John Doe <john@example.com>
+Reviewed-by: Foo Bar <foo@example.com>
+Last-Update: 2014-06-10
+X-Custom: value
+
+Some free form text.
+---
+ hello.c | 2 +-
+`)
+	c.Check(h.Description, Equals, "Fix the greeting\nThe greeting had a typo.\n\nIt is now fixed.\nSome free form text.")
+	c.Check(h.Author, Equals, "Jane Doe <jane@example.com>")
+	c.Check(h.Origin, Equals, "upstream, https://example.com/commit/1234")
+	c.Check(h.Bugs, DeepEquals, map[string]string{
+		"":       "https://example.com/bugs/12",
+		"Debian": "https://bugs.debian.org/123456",
+	})
+	c.Check(h.Forwarded, Equals, "not-needed")
+	c.Check(h.ReviewedBy, DeepEquals, []string{"John Doe <john@example.com>", "Foo Bar <foo@example.com>"})
+	c.Check(h.LastUpdate, Equals, "2014-06-10")
+	c.Check(h.Extra, DeepEquals, map[string]string{"X-Custom": "value"})
+
+	// git format-patch style
+	h = ParseDep3("From: Jane Doe <jane@example.com>\nSubject: [PATCH] Fix build\n\nWith gcc 4.9\n---\n")
+	c.Check(h.Author, Equals, "Jane Doe <jane@example.com>")
+	c.Check(h.Description, Equals, "[PATCH] Fix build\nWith gcc 4.9")
+
+	h = ParseDep3("Only free form\ntext\n")
+	c.Check(h.Description, Equals, "Only free form\ntext")
+}
+
+func (s *Dep3Suite) TestString(c *C) {
+	h := &Dep3Header{
+		Description: "Fix the greeting\nLong\n\ndescription",
+		Author:      "Jane Doe <jane@example.com>",
+		Bugs:        map[string]string{"Ubuntu": "https://launchpad.net/bugs/1", "": "https://example.com/bugs/12"},
+		ReviewedBy:  []string{"John Doe <john@example.com>"},
+		LastUpdate:  "2014-06-10",
+	}
+	c.Check(h.String(), Equals, `Description: Fix the greeting
+ Long
+ .
+ description
+Author: Jane Doe <jane@example.com>
+Bug: https://example.com/bugs/12
+Bug-Ubuntu: https://launchpad.net/bugs/1
+Reviewed-by: John Doe <john@example.com>
+Last-Update: 2014-06-10
+
+`)
+	c.Check(ParseDep3(h.String()), DeepEquals, &Dep3Header{
+		Description: h.Description,
+		Author:      h.Author,
+		Bugs:        h.Bugs,
+		ReviewedBy:  h.ReviewedBy,
+		LastUpdate:  h.LastUpdate,
+		Extra:       map[string]string{},
+	})
+	c.Check((&Dep3Header{}).String(), Equals, "")
+}
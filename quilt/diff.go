@@ -0,0 +1,200 @@
+package quilt
+
+import "strings"
+
+// DiffContext is the number of context lines around changes in
+// generated diffs.
+const DiffContext = 3
+
+type editOp int
+
+const (
+	opEqual editOp = iota
+	opDelete
+	opInsert
+)
+
+type edit struct {
+	op   editOp
+	line string
+}
+
+// myers computes the shortest edit script from a to b, using Myers'
+// O(ND) algorithm.
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && found == false; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// backtracks from the end, trace[d] being the state before step d
+	var res []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			res = append(res, edit{opEqual, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				res = append(res, edit{opInsert, b[y-1]})
+				y--
+			} else {
+				res = append(res, edit{opDelete, a[x-1]})
+				x--
+			}
+		}
+	}
+
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// noEOLMarker tags, while diffing, a last line without end of line,
+// so it differs from the same line with one.
+const noEOLMarker = "\x00"
+
+func diffLines(data []byte) []string {
+	c := splitLines(data)
+	if c.eol == false && len(c.lines) > 0 {
+		c.lines[len(c.lines)-1] = c.lines[len(c.lines)-1] + noEOLMarker
+	}
+	return c.lines
+}
+
+var editPrefixes = map[editOp]string{
+	opEqual:  " ",
+	opDelete: "-",
+	opInsert: "+",
+}
+
+func newHunk(edits []edit, oldBefore, newBefore int) *Hunk {
+	h := &Hunk{}
+	for _, e := range edits {
+		line := e.line
+		if strings.HasSuffix(line, noEOLMarker) {
+			line = strings.TrimSuffix(line, noEOLMarker)
+			switch e.op {
+			case opEqual:
+				h.OldNoEOL = true
+				h.NewNoEOL = true
+			case opDelete:
+				h.OldNoEOL = true
+			case opInsert:
+				h.NewNoEOL = true
+			}
+		}
+		h.Lines = append(h.Lines, editPrefixes[e.op]+line)
+		if e.op != opInsert {
+			h.OldLines++
+		}
+		if e.op != opDelete {
+			h.NewLines++
+		}
+	}
+	h.OldStart = oldBefore
+	if h.OldLines > 0 {
+		h.OldStart++
+	}
+	h.NewStart = newBefore
+	if h.NewLines > 0 {
+		h.NewStart++
+	}
+	return h
+}
+
+// Diff returns the changes from old to new as a FileDiff with
+// DiffContext lines of context, or nil if they are identical. Use
+// DevNull as a name for a missing file.
+func Diff(oldName, newName string, old, new []byte) *FileDiff {
+	edits := myers(diffLines(old), diffLines(new))
+
+	res := &FileDiff{OldName: oldName, NewName: newName}
+	oldLine, newLine := 0, 0
+	i := 0
+	for i < len(edits) {
+		if edits[i].op == opEqual {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// a hunk starts with up to DiffContext equal lines
+		start := i - DiffContext
+		if start < 0 {
+			start = 0
+		}
+		oldBefore, newBefore := oldLine-(i-start), newLine-(i-start)
+
+		// and extends until DiffContext equal lines follow its last
+		// change, merging changes closer than twice the context
+		end := i
+		lastChange := i
+		for end < len(edits) {
+			if edits[end].op != opEqual {
+				lastChange = end
+			} else if end-lastChange > 2*DiffContext {
+				break
+			}
+			switch edits[end].op {
+			case opEqual:
+				oldLine++
+				newLine++
+			case opDelete:
+				oldLine++
+			case opInsert:
+				newLine++
+			}
+			end++
+		}
+		hunkEnd := lastChange + 1 + DiffContext
+		if hunkEnd > end {
+			hunkEnd = end
+		}
+		res.Hunks = append(res.Hunks, newHunk(edits[start:hunkEnd], oldBefore, newBefore))
+		i = end
+	}
+
+	if len(res.Hunks) == 0 {
+		return nil
+	}
+	return res
+}
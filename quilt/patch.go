@@ -0,0 +1,318 @@
+// Package quilt manages the patch series of 3.0 (quilt) source
+// packages: series files, application and removal of patches with
+// fuzz reporting, refresh from a working tree and DEP-3 headers. Its
+// state directory is compatible with the quilt tool and dpkg-source.
+package quilt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Hunk is a block of changes in a unified diff.
+type Hunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	// The text after the closing @@, usually a function name
+	Section string
+	// The lines of the hunk, prefixed by ' ', '-' or '+', without
+	// end of line.
+	Lines []string
+	// true if the last line of the old or new text has no end of
+	// line
+	OldNoEOL, NewNoEOL bool
+}
+
+// FileDiff are the hunks modifying a file
+type FileDiff struct {
+	// Lines preceding the ---/+++ lines, like `Index:' or `diff --git'
+	Preamble []string
+	// Names on the ---/+++ lines, without timestamps
+	OldName, NewName string
+	Hunks            []*Hunk
+}
+
+// Patch is a unified diff, optionally preceded by a header describing
+// it.
+type Patch struct {
+	Header string
+	Files  []*FileDiff
+}
+
+// DevNull is the name used in diffs for a missing file
+const DevNull = "/dev/null"
+
+var hunkHeaderRx = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@ ?(.*)$`)
+var preambleRx = regexp.MustCompile(`^(Index: |diff |=+$|index |new file mode |deleted file mode |old mode |new mode |similarity index |rename from |rename to )`)
+
+func diffName(line string) string {
+	name := line[4:]
+	if idx := strings.Index(name, "\t"); idx >= 0 {
+		name = name[:idx]
+	}
+	return strings.TrimRight(name, " ")
+}
+
+func atoiDefault(s string, def int) int {
+	if len(s) == 0 {
+		return def
+	}
+	res, _ := strconv.Atoi(s)
+	return res
+}
+
+// ParsePatch parses a unified diff. Everything before the first file
+// diff is kept as the patch Header.
+func ParsePatch(r io.Reader) (*Patch, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	res := &Patch{}
+	var pending []string
+	var current *FileDiff
+	headerDone := false
+
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		if strings.HasPrefix(l, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") {
+			// the preamble is the end of the pending lines
+			start := len(pending)
+			for start > 0 && preambleRx.MatchString(pending[start-1]) {
+				start--
+			}
+			if headerDone == false {
+				if start > 0 {
+					res.Header = strings.Join(pending[:start], "\n") + "\n"
+				}
+				headerDone = true
+			}
+			current = &FileDiff{
+				Preamble: append([]string(nil), pending[start:]...),
+				OldName:  diffName(l),
+				NewName:  diffName(lines[i+1]),
+			}
+			res.Files = append(res.Files, current)
+			pending = nil
+			i++
+			continue
+		}
+
+		m := hunkHeaderRx.FindStringSubmatch(l)
+		if m == nil || current == nil {
+			pending = append(pending, l)
+			continue
+		}
+
+		h := &Hunk{
+			OldStart: atoiDefault(m[1], 0),
+			OldLines: atoiDefault(m[2], 1),
+			NewStart: atoiDefault(m[3], 0),
+			NewLines: atoiDefault(m[4], 1),
+			Section:  m[5],
+		}
+		oldLeft, newLeft := h.OldLines, h.NewLines
+		for (oldLeft > 0 || newLeft > 0) && i+1 < len(lines) {
+			i++
+			l = lines[i]
+			if len(l) == 0 {
+				// some tools strip the space of empty context lines
+				l = " "
+			}
+			switch l[0] {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			case '\\':
+				h.markNoEOL()
+				continue
+			default:
+				return nil, fmt.Errorf("Invalid line %d in hunk: `%s'", i+1, l)
+			}
+			h.Lines = append(h.Lines, l)
+		}
+		if oldLeft != 0 || newLeft != 0 {
+			return nil, fmt.Errorf("Truncated hunk at line %d", i+1)
+		}
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\") {
+			i++
+			h.markNoEOL()
+		}
+		current.Hunks = append(current.Hunks, h)
+	}
+
+	if headerDone == false && len(pending) > 0 {
+		res.Header = strings.Join(pending, "\n") + "\n"
+	}
+
+	return res, nil
+}
+
+func (h *Hunk) markNoEOL() {
+	if len(h.Lines) == 0 {
+		return
+	}
+	switch h.Lines[len(h.Lines)-1][0] {
+	case ' ':
+		h.OldNoEOL = true
+		h.NewNoEOL = true
+	case '-':
+		h.OldNoEOL = true
+	case '+':
+		h.NewNoEOL = true
+	}
+}
+
+// lastLineIndex returns the index in Lines of the last line of the
+// old or new text.
+func (h *Hunk) lastLineIndex(exclude byte) int {
+	for i := len(h.Lines) - 1; i >= 0; i-- {
+		if h.Lines[i][0] != exclude {
+			return i
+		}
+	}
+	return -1
+}
+
+func formatRange(start, count int) string {
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// Write writes the hunk in unified diff format.
+func (h *Hunk) Write(w io.Writer) error {
+	header := fmt.Sprintf("@@ -%s +%s @@", formatRange(h.OldStart, h.OldLines), formatRange(h.NewStart, h.NewLines))
+	if len(h.Section) > 0 {
+		header = header + " " + h.Section
+	}
+	if _, err := fmt.Fprintln(w, header); err != nil {
+		return err
+	}
+	oldLast, newLast := h.lastLineIndex('+'), h.lastLineIndex('-')
+	for i, l := range h.Lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+		if (h.OldNoEOL && i == oldLast && l[0] != '+') || (h.NewNoEOL && i == newLast && l[0] != '-') {
+			if _, err := fmt.Fprintln(w, `\ No newline at end of file`); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write writes the file diff in unified diff format.
+func (f *FileDiff) Write(w io.Writer) error {
+	for _, l := range f.Preamble {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", f.OldName, f.NewName); err != nil {
+		return err
+	}
+	for _, h := range f.Hunks {
+		if err := h.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes the patch, header included.
+func (p *Patch) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, p.Header); err != nil {
+		return err
+	}
+	for _, f := range p.Files {
+		if err := f.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reverse returns a patch undoing p.
+func (p *Patch) Reverse() *Patch {
+	res := &Patch{Header: p.Header}
+	for _, f := range p.Files {
+		rf := &FileDiff{
+			Preamble: f.Preamble,
+			OldName:  f.NewName,
+			NewName:  f.OldName,
+		}
+		for _, h := range f.Hunks {
+			rh := &Hunk{
+				OldStart: h.NewStart,
+				OldLines: h.NewLines,
+				NewStart: h.OldStart,
+				NewLines: h.OldLines,
+				Section:  h.Section,
+				OldNoEOL: h.NewNoEOL,
+				NewNoEOL: h.OldNoEOL,
+				Lines:    make([]string, len(h.Lines)),
+			}
+			for i, l := range h.Lines {
+				switch l[0] {
+				case '-':
+					l = "+" + l[1:]
+				case '+':
+					l = "-" + l[1:]
+				}
+				rh.Lines[i] = l
+			}
+			rf.Hunks = append(rf.Hunks, rh)
+		}
+		res.Files = append(res.Files, rf)
+	}
+	return res
+}
+
+func stripPath(p string, strip int) (string, error) {
+	parts := strings.Split(p, "/")
+	if strip >= len(parts) {
+		return "", fmt.Errorf("Cannot strip %d components from `%s'", strip, p)
+	}
+	res := path.Clean(strings.Join(parts[strip:], "/"))
+	if path.IsAbs(res) || res == ".." || strings.HasPrefix(res, "../") {
+		return "", fmt.Errorf("Patch modifies a file outside of the tree: `%s'", p)
+	}
+	return res, nil
+}
+
+// Target returns the path, relative to the tree, of the file modified
+// by the diff once strip leading components are removed.
+func (f *FileDiff) Target(strip int) (string, error) {
+	if f.NewName != DevNull {
+		return stripPath(f.NewName, strip)
+	}
+	return stripPath(f.OldName, strip)
+}
+
+// IsCreation returns true if the diff creates a file.
+func (f *FileDiff) IsCreation() bool {
+	return f.OldName == DevNull
+}
+
+// IsDeletion returns true if the diff removes a file.
+func (f *FileDiff) IsDeletion() bool {
+	return f.NewName == DevNull
+}
@@ -0,0 +1,182 @@
+package quilt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PatchSuite struct {
+	dir string
+}
+
+var _ = Suite(&PatchSuite{})
+
+var fooPatch = `Description: Fix the greeting
+Author: Jane Doe <jane@example.com>
+
+Index: foo/hello.c
+===================================================================
+--- foo.orig/hello.c	2014-06-10 21:44:59.000000000 +0200
++++ foo/hello.c	2014-06-10 21:45:59.000000000 +0200
+@@ -1,6 +1,6 @@
+ #include <stdio.h>
+ 
+ int main() {
+-	printf("helo\n");
++	printf("hello\n");
+ 	return 0;
+ }
+--- /dev/null
++++ foo/NEWS
+@@ -0,0 +1,2 @@
++1.0: fixed greeting
++no newline
+\ No newline at end of file
+`
+
+var helloC = `#include <stdio.h>
+
+int main() {
+	printf("helo\n");
+	return 0;
+}
+`
+
+func (s *PatchSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "hello.c"), []byte(helloC), 0644), IsNil)
+}
+
+func (s *PatchSuite) readFile(c *C, name string) string {
+	data, err := ioutil.ReadFile(path.Join(s.dir, name))
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *PatchSuite) TestParseAndWrite(c *C) {
+	p, err := ParsePatch(strings.NewReader(fooPatch))
+	c.Assert(err, IsNil)
+	c.Check(p.Header, Equals, "Description: Fix the greeting\nAuthor: Jane Doe <jane@example.com>\n\n")
+	c.Assert(p.Files, HasLen, 2)
+	c.Check(p.Files[0].Preamble, HasLen, 2)
+	c.Check(p.Files[0].OldName, Equals, "foo.orig/hello.c")
+	c.Check(p.Files[0].NewName, Equals, "foo/hello.c")
+	c.Assert(p.Files[0].Hunks, HasLen, 1)
+	h := p.Files[0].Hunks[0]
+	c.Check([]int{h.OldStart, h.OldLines, h.NewStart, h.NewLines}, DeepEquals, []int{1, 6, 1, 6})
+	c.Check(h.Lines[1], Equals, " ")
+	c.Check(p.Files[1].IsCreation(), Equals, true)
+	c.Check(p.Files[1].Hunks[0].NewNoEOL, Equals, true)
+	target, err := p.Files[1].Target(1)
+	c.Check(err, IsNil)
+	c.Check(target, Equals, "NEWS")
+
+	var out bytes.Buffer
+	c.Assert(p.Write(&out), IsNil)
+	c.Check(out.String(), Equals, strings.Replace(strings.Replace(fooPatch,
+		"\t2014-06-10 21:44:59.000000000 +0200", "", 1),
+		"\t2014-06-10 21:45:59.000000000 +0200", "", 1))
+
+	_, err = ParsePatch(strings.NewReader("--- a/foo\n+++ b/foo\n@@ -1,2 +1,2 @@\n-foo\n"))
+	c.Check(err, ErrorMatches, "Truncated hunk at line 4")
+	_, err = ParsePatch(strings.NewReader("--- a/foo\n+++ b/foo\n@@ -1,2 +1,2 @@\n-foo\n*bar\n"))
+	c.Check(err, ErrorMatches, "Invalid line 5 in hunk: `\\*bar'")
+
+	_, err = p.Files[0].Target(3)
+	c.Check(err, ErrorMatches, "Cannot strip 3 components from `foo/hello.c'")
+	_, err = (&FileDiff{OldName: "a/../../etc/passwd", NewName: "b/../../etc/passwd"}).Target(1)
+	c.Check(err, ErrorMatches, "Patch modifies a file outside of the tree: .*")
+}
+
+func (s *PatchSuite) TestApplyAndReverse(c *C) {
+	p, err := ParsePatch(strings.NewReader(fooPatch))
+	c.Assert(err, IsNil)
+
+	res, err := p.Apply(s.dir, 1, 0)
+	c.Assert(err, IsNil)
+	c.Check(res.Hunks, HasLen, 2)
+	c.Check(res.Fuzzy(), Equals, false)
+	c.Check(res.String(), Equals, "")
+	c.Check(s.readFile(c, "hello.c"), Equals, strings.Replace(helloC, "helo", "hello", 1))
+	c.Check(s.readFile(c, "NEWS"), Equals, "1.0: fixed greeting\nno newline")
+
+	_, err = p.Apply(s.dir, 1, 2)
+	c.Check(err, ErrorMatches, "Patch creates `NEWS', which already exists")
+
+	res, err = p.Reverse().Apply(s.dir, 1, 0)
+	c.Assert(err, IsNil)
+	c.Check(s.readFile(c, "hello.c"), Equals, helloC)
+	_, err = os.Stat(path.Join(s.dir, "NEWS"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *PatchSuite) TestOffsetAndFuzz(c *C) {
+	shifted := "/* header */\n/* added */\n" + strings.Replace(helloC, "return 0;", "return 1;", 1)
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "hello.c"), []byte(shifted), 0644), IsNil)
+	p, err := ParsePatch(strings.NewReader(fooPatch))
+	c.Assert(err, IsNil)
+	p.Files = p.Files[:1]
+
+	res, err := p.Apply(s.dir, 1, 0)
+	c.Check(err, ErrorMatches, "1 hunk\\(s\\) failed to apply:\nhello.c: Hunk #1 FAILED")
+	c.Check(res.Failed(), HasLen, 1)
+	c.Check(s.readFile(c, "hello.c"), Equals, shifted)
+
+	res, err = p.Apply(s.dir, 1, 2)
+	c.Assert(err, IsNil)
+	c.Check(res.Fuzzy(), Equals, true)
+	c.Check(res.String(), Equals, "hello.c: Hunk #1 succeeded with fuzz 2 (offset 2 lines).")
+	c.Check(s.readFile(c, "hello.c"), Equals, strings.Replace(shifted, "helo", "hello", 1))
+}
+
+func (s *PatchSuite) TestDiff(c *C) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n17\n18\n19\n20"
+	new := "0\n1\n2\n3\n4\n5\n6\nseven\n8\n9\n10\n11\n12\n13\n14\n15\n16\n17\n18\n19\n20\n"
+
+	d := Diff("a/f", "b/f", []byte(old), []byte(new))
+	c.Assert(d, NotNil)
+	var out bytes.Buffer
+	c.Assert(d.Write(&out), IsNil)
+	c.Check(out.String(), Equals, `--- a/f
++++ b/f
+@@ -1,10 +1,11 @@
++0
+ 1
+ 2
+ 3
+ 4
+ 5
+ 6
+-7
++seven
+ 8
+ 9
+ 10
+@@ -17,4 +18,4 @@
+ 17
+ 18
+ 19
+-20
+\ No newline at end of file
++20
+`)
+	c.Check(Diff("a/f", "b/f", []byte(old), []byte(old)), IsNil)
+
+	// applying the diff gives the new content back
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "f"), []byte(old), 0644), IsNil)
+	_, err := (&Patch{Files: []*FileDiff{d}}).Apply(s.dir, 1, 0)
+	c.Assert(err, IsNil)
+	c.Check(s.readFile(c, "f"), Equals, new)
+
+	d = Diff(DevNull, "b/f", nil, []byte("foo\n"))
+	c.Check(d.Hunks[0].Lines, DeepEquals, []string{"+foo"})
+	c.Check([]int{d.Hunks[0].OldStart, d.Hunks[0].OldLines}, DeepEquals, []int{0, 0})
+}
@@ -0,0 +1,455 @@
+package quilt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Tree is a source tree with a quilt patch series. Applied patches
+// are tracked in its .pc directory, with a backup of the files they
+// modify, like quilt and dpkg-source do. A backup of a file the patch
+// creates is empty.
+type Tree struct {
+	// Root of the source tree
+	Dir string
+	// Directory of the patches and series file, relative to Dir
+	PatchesDir string
+	// Maximal fuzz used to apply patches
+	MaxFuzz int
+}
+
+const pcDir = ".pc"
+
+// NewTree returns the Tree rooted at dir, with its patches in
+// debian/patches. Patches are applied with up to 2 lines of fuzz, as
+// quilt does.
+func NewTree(dir string) *Tree {
+	return &Tree{
+		Dir:        dir,
+		PatchesDir: "debian/patches",
+		MaxFuzz:    2,
+	}
+}
+
+func (t *Tree) seriesPath() string {
+	return path.Join(t.Dir, t.PatchesDir, "series")
+}
+
+func (t *Tree) patchPath(name string) string {
+	return path.Join(t.Dir, t.PatchesDir, name)
+}
+
+func (t *Tree) pcPath(elem ...string) string {
+	return path.Join(append([]string{t.Dir, pcDir}, elem...)...)
+}
+
+// Series reads the series file. A missing file is an empty series.
+func (t *Tree) Series() (Series, error) {
+	f, err := os.Open(t.seriesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Series{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSeries(f)
+}
+
+// SaveSeries writes the series file.
+func (t *Tree) SaveSeries(s Series) error {
+	var buf bytes.Buffer
+	if err := s.Write(&buf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(t.seriesPath()), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.seriesPath(), buf.Bytes(), 0644)
+}
+
+// ReadPatch parses a patch of the series.
+func (t *Tree) ReadPatch(name string) (*Patch, error) {
+	f, err := os.Open(t.patchPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePatch(f)
+}
+
+// Applied returns the applied patches, in application order.
+func (t *Tree) Applied() ([]string, error) {
+	f, err := os.Open(t.pcPath("applied-patches"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var res []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := strings.TrimSpace(scanner.Text()); len(l) > 0 {
+			res = append(res, l)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// Top returns the last applied patch, or an empty string.
+func (t *Tree) Top() (string, error) {
+	applied, err := t.Applied()
+	if err != nil || len(applied) == 0 {
+		return "", err
+	}
+	return applied[len(applied)-1], nil
+}
+
+func (t *Tree) saveApplied(applied []string) error {
+	if len(applied) == 0 {
+		return os.RemoveAll(t.pcPath())
+	}
+	if err := os.MkdirAll(t.pcPath(), 0755); err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		".version":        "2\n",
+		".quilt_patches":  t.PatchesDir + "\n",
+		".quilt_series":   "series\n",
+		"applied-patches": strings.Join(applied, "\n") + "\n",
+	}
+	for name, content := range metadata {
+		if err := ioutil.WriteFile(t.pcPath(name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup saves the current content of a file in the .pc directory of
+// a patch, unless it is already saved.
+func (t *Tree) backup(patch, file string) error {
+	dest := t.pcPath(patch, file)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path.Join(t.Dir, file))
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, data, 0644)
+}
+
+// backedUpFiles lists the files saved for a patch, relative to the
+// tree.
+func (t *Tree) backedUpFiles(patch string) ([]string, error) {
+	root := t.pcPath(patch)
+	var res []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() == ".timestamp" {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		res = append(res, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(res)
+	return res, err
+}
+
+// Push applies the next unapplied patch of the series, and returns
+// its name and how it applied. If it does not apply, the tree is left
+// unmodified.
+func (t *Tree) Push() (string, *ApplyResult, error) {
+	series, err := t.Series()
+	if err != nil {
+		return "", nil, err
+	}
+	applied, err := t.Applied()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(applied) >= len(series) {
+		return "", nil, fmt.Errorf("All patches are applied")
+	}
+	entry := series[len(applied)]
+
+	p, err := t.ReadPatch(entry.Name)
+	if err != nil {
+		return "", nil, err
+	}
+	changes, res, err := p.prepare(t.Dir, entry.Strip, t.MaxFuzz)
+	if err != nil {
+		return entry.Name, res, fmt.Errorf("Patch %s does not apply: %s", entry.Name, err)
+	}
+	for _, c := range changes {
+		if err := t.backup(entry.Name, c.Path); err != nil {
+			return entry.Name, res, err
+		}
+	}
+	if err := commitChanges(t.Dir, changes); err != nil {
+		return entry.Name, res, err
+	}
+	return entry.Name, res, t.saveApplied(append(applied, entry.Name))
+}
+
+// PushAll applies all unapplied patches, and reports how they applied
+// by patch name.
+func (t *Tree) PushAll() (map[string]*ApplyResult, error) {
+	res := make(map[string]*ApplyResult)
+	for {
+		series, err := t.Series()
+		if err != nil {
+			return res, err
+		}
+		applied, err := t.Applied()
+		if err != nil {
+			return res, err
+		}
+		if len(applied) >= len(series) {
+			return res, nil
+		}
+		name, r, err := t.Push()
+		res[name] = r
+		if err != nil {
+			return res, err
+		}
+	}
+}
+
+// Pop removes the last applied patch by restoring the files it
+// modified, and returns its name.
+func (t *Tree) Pop() (string, error) {
+	applied, err := t.Applied()
+	if err != nil {
+		return "", err
+	}
+	if len(applied) == 0 {
+		return "", fmt.Errorf("No patch is applied")
+	}
+	name := applied[len(applied)-1]
+
+	files, err := t.backedUpFiles(name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(t.pcPath(name, f))
+		if err != nil {
+			return "", err
+		}
+		dest := path.Join(t.Dir, f)
+		if len(data) == 0 {
+			if err := os.Remove(dest); err != nil && os.IsNotExist(err) == false {
+				return "", err
+			}
+			continue
+		}
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(dest); err == nil {
+			mode = info.Mode()
+		}
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(dest, data, mode); err != nil {
+			return "", err
+		}
+	}
+	if err := os.RemoveAll(t.pcPath(name)); err != nil {
+		return "", err
+	}
+	return name, t.saveApplied(applied[:len(applied)-1])
+}
+
+// PopAll removes all applied patches.
+func (t *Tree) PopAll() error {
+	for {
+		applied, err := t.Applied()
+		if err != nil || len(applied) == 0 {
+			return err
+		}
+		if _, err := t.Pop(); err != nil {
+			return err
+		}
+	}
+}
+
+// New creates an empty patch after the last applied one, and marks it
+// applied. Files should be added to it with Add before being
+// modified, then the patch is written with Refresh.
+func (t *Tree) New(name string, header *Dep3Header) error {
+	series, err := t.Series()
+	if err != nil {
+		return err
+	}
+	applied, err := t.Applied()
+	if err != nil {
+		return err
+	}
+	top := ""
+	if len(applied) > 0 {
+		top = applied[len(applied)-1]
+	}
+	series, err = series.Insert(SeriesEntry{Name: name, Strip: 1}, top)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.patchPath(name)); err == nil {
+		return fmt.Errorf("Patch file %s already exists", name)
+	}
+
+	p := &Patch{}
+	if header != nil {
+		p.Header = header.String()
+	}
+	if err := t.writePatch(name, p); err != nil {
+		return err
+	}
+	if err := t.SaveSeries(series); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(t.pcPath(name), 0755); err != nil {
+		return err
+	}
+	return t.saveApplied(append(applied, name))
+}
+
+// Add saves files, relative to the tree, in the last applied patch
+// before they are modified.
+func (t *Tree) Add(files ...string) error {
+	top, err := t.Top()
+	if err != nil {
+		return err
+	}
+	if len(top) == 0 {
+		return fmt.Errorf("No patch is applied")
+	}
+	for _, f := range files {
+		clean, err := stripPath(f, 0)
+		if err != nil {
+			return err
+		}
+		if err := t.backup(top, clean); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tree) writePatch(name string, p *Patch) error {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(t.patchPath(name)), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.patchPath(name), buf.Bytes(), 0644)
+}
+
+// Refresh regenerates the last applied patch from the differences
+// between its saved files and the tree, keeping its header.
+func (t *Tree) Refresh() error {
+	top, err := t.Top()
+	if err != nil {
+		return err
+	}
+	if len(top) == 0 {
+		return fmt.Errorf("No patch is applied")
+	}
+
+	p, err := t.ReadPatch(top)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	if p == nil {
+		p = &Patch{}
+	}
+	files, err := t.backedUpFiles(top)
+	if err != nil {
+		return err
+	}
+
+	base := path.Base(t.Dir)
+	p.Files = nil
+	for _, f := range files {
+		old, err := ioutil.ReadFile(t.pcPath(top, f))
+		if err != nil {
+			return err
+		}
+		new, err := ioutil.ReadFile(path.Join(t.Dir, f))
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+		oldName, newName := path.Join(base+".orig", f), path.Join(base, f)
+		if len(old) == 0 {
+			oldName = DevNull
+		}
+		if os.IsNotExist(err) {
+			newName = DevNull
+		}
+		if d := Diff(oldName, newName, old, new); d != nil {
+			d.Preamble = []string{"Index: " + path.Join(base, f), strings.Repeat("=", 67)}
+			p.Files = append(p.Files, d)
+		}
+	}
+	return t.writePatch(top, p)
+}
+
+// Import copies a patch in the patches directory, and inserts it in
+// the series after the last applied patch. It is not applied.
+func (t *Tree) Import(name string, r io.Reader) error {
+	series, err := t.Series()
+	if err != nil {
+		return err
+	}
+	top, err := t.Top()
+	if err != nil {
+		return err
+	}
+	series, err = series.Insert(SeriesEntry{Name: name, Strip: 1}, top)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p, err := ParsePatch(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Invalid patch %s: %s", name, err)
+	}
+	if len(p.Files) == 0 {
+		return fmt.Errorf("Invalid patch %s: it modifies no file", name)
+	}
+	if err := os.MkdirAll(path.Dir(t.patchPath(name)), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(t.patchPath(name), data, 0644); err != nil {
+		return err
+	}
+	return t.SaveSeries(series)
+}
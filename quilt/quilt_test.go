@@ -0,0 +1,133 @@
+package quilt
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type TreeSuite struct {
+	t *Tree
+}
+
+var _ = Suite(&TreeSuite{})
+
+func (s *TreeSuite) write(c *C, name, content string) {
+	p := path.Join(s.t.Dir, name)
+	c.Assert(os.MkdirAll(path.Dir(p), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(p, []byte(content), 0644), IsNil)
+}
+
+func (s *TreeSuite) read(c *C, name string) string {
+	data, err := ioutil.ReadFile(path.Join(s.t.Dir, name))
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *TreeSuite) SetUpTest(c *C) {
+	s.t = NewTree(path.Join(c.MkDir(), "foo"))
+	s.write(c, "hello.c", helloC)
+	s.write(c, "debian/patches/fix-greeting.patch", fooPatch)
+	s.write(c, "debian/patches/series", "fix-greeting.patch\n")
+}
+
+func (s *TreeSuite) TestPushAndPop(c *C) {
+	name, res, err := s.t.Push()
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "fix-greeting.patch")
+	c.Check(res.Fuzzy(), Equals, false)
+	c.Check(s.read(c, "hello.c"), Equals, strings.Replace(helloC, "helo", "hello", 1))
+	c.Check(s.read(c, ".pc/applied-patches"), Equals, "fix-greeting.patch\n")
+	c.Check(s.read(c, ".pc/.quilt_patches"), Equals, "debian/patches\n")
+	c.Check(s.read(c, ".pc/fix-greeting.patch/hello.c"), Equals, helloC)
+	c.Check(s.read(c, ".pc/fix-greeting.patch/NEWS"), Equals, "")
+
+	_, _, err = s.t.Push()
+	c.Check(err, ErrorMatches, "All patches are applied")
+
+	name, err = s.t.Pop()
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "fix-greeting.patch")
+	c.Check(s.read(c, "hello.c"), Equals, helloC)
+	_, err = os.Stat(path.Join(s.t.Dir, "NEWS"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(path.Join(s.t.Dir, ".pc"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	_, err = s.t.Pop()
+	c.Check(err, ErrorMatches, "No patch is applied")
+
+	// a patch that does not apply leaves the tree untouched
+	s.write(c, "hello.c", "int main() {}\n")
+	results, err := s.t.PushAll()
+	c.Check(err, ErrorMatches, "Patch fix-greeting.patch does not apply: 1 hunk\\(s\\) failed to apply:\n.*")
+	c.Check(results["fix-greeting.patch"].Failed(), HasLen, 1)
+	applied, err := s.t.Applied()
+	c.Check(err, IsNil)
+	c.Check(applied, HasLen, 0)
+	_, err = os.Stat(path.Join(s.t.Dir, "NEWS"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TreeSuite) TestNewAndRefresh(c *C) {
+	_, err := s.t.PushAll()
+	c.Assert(err, IsNil)
+
+	header := &Dep3Header{Description: "Say goodbye", Forwarded: "not-needed"}
+	c.Assert(s.t.New("goodbye.patch", header), IsNil)
+	c.Assert(s.t.Add("hello.c", "bye.txt"), IsNil)
+	s.write(c, "hello.c", strings.Replace(s.read(c, "hello.c"), "hello", "goodbye", 1))
+	s.write(c, "bye.txt", "bye\n")
+	c.Assert(s.t.Refresh(), IsNil)
+
+	c.Check(s.read(c, "debian/patches/series"), Equals, "fix-greeting.patch\ngoodbye.patch\n")
+	c.Check(s.read(c, "debian/patches/goodbye.patch"), Equals, `Description: Say goodbye
+Forwarded: not-needed
+
+Index: foo/bye.txt
+===================================================================
+--- /dev/null
++++ foo/bye.txt
+@@ -0,0 +1 @@
++bye
+Index: foo/hello.c
+===================================================================
+--- foo.orig/hello.c
++++ foo/hello.c
+@@ -1,6 +1,6 @@
+ #include <stdio.h>
+ 
+ int main() {
+-	printf("hello\n");
++	printf("goodbye\n");
+ 	return 0;
+ }
+`)
+
+	// the refreshed patch can be popped and pushed again
+	c.Assert(s.t.PopAll(), IsNil)
+	c.Check(s.read(c, "hello.c"), Equals, helloC)
+	_, err = s.t.PushAll()
+	c.Assert(err, IsNil)
+	c.Check(s.read(c, "bye.txt"), Equals, "bye\n")
+	c.Check(strings.Contains(s.read(c, "hello.c"), "goodbye"), Equals, true)
+
+	c.Check(s.t.New("goodbye.patch", nil), ErrorMatches, "Patch goodbye.patch is already in the series")
+}
+
+func (s *TreeSuite) TestImport(c *C) {
+	c.Assert(s.t.Import("00-first.patch", strings.NewReader("--- a/hello.c\n+++ b/hello.c\n@@ -1 +1 @@\n-#include <stdio.h>\n+#include <stdlib.h>\n")), IsNil)
+	series, err := s.t.Series()
+	c.Assert(err, IsNil)
+	c.Check(series, DeepEquals, Series{{"00-first.patch", 1}, {"fix-greeting.patch", 1}})
+
+	c.Check(s.t.Import("bad.patch", strings.NewReader("not a patch\n")), ErrorMatches, "Invalid patch bad.patch: it modifies no file")
+
+	results, err := s.t.PushAll()
+	c.Assert(err, IsNil)
+	c.Check(results, HasLen, 2)
+	c.Check(strings.HasPrefix(s.read(c, "hello.c"), "#include <stdlib.h>\n"), Equals, true)
+}
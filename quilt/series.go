@@ -0,0 +1,101 @@
+package quilt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SeriesEntry is a patch listed in a series file.
+type SeriesEntry struct {
+	Name string
+	// The number of leading path components to strip, 1 by default
+	Strip int
+}
+
+// Series is the ordered list of patches of a tree.
+type Series []SeriesEntry
+
+var stripOptionRx = regexp.MustCompile(`^-p(\d+)$`)
+
+// ParseSeries parses a quilt series file. Comments and empty lines
+// are ignored.
+func ParseSeries(r io.Reader) (Series, error) {
+	res := Series{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber = lineNumber + 1
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		entry := SeriesEntry{Name: fields[0], Strip: 1}
+		for _, opt := range fields[1:] {
+			m := stripOptionRx.FindStringSubmatch(opt)
+			if m == nil {
+				return nil, fmt.Errorf("series:%d: unsupported option `%s' for patch %s", lineNumber, opt, entry.Name)
+			}
+			entry.Strip, _ = strconv.Atoi(m[1])
+		}
+		if res.Index(entry.Name) >= 0 {
+			return nil, fmt.Errorf("series:%d: patch %s is listed twice", lineNumber, entry.Name)
+		}
+		res = append(res, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Index returns the position of a patch in the series, or -1 if it
+// is not listed.
+func (s Series) Index(name string) int {
+	for i, e := range s {
+		if e.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Insert returns the series with entry inserted after the patch
+// named after, or at the start of the series if after is empty.
+func (s Series) Insert(entry SeriesEntry, after string) (Series, error) {
+	if s.Index(entry.Name) >= 0 {
+		return nil, fmt.Errorf("Patch %s is already in the series", entry.Name)
+	}
+	pos := 0
+	if len(after) > 0 {
+		pos = s.Index(after) + 1
+		if pos == 0 {
+			return nil, fmt.Errorf("Patch %s is not in the series", after)
+		}
+	}
+	res := make(Series, 0, len(s)+1)
+	res = append(res, s[:pos]...)
+	res = append(res, entry)
+	return append(res, s[pos:]...), nil
+}
+
+// Write writes the series file.
+func (s Series) Write(w io.Writer) error {
+	for _, e := range s {
+		line := e.Name
+		if e.Strip != 1 {
+			line = fmt.Sprintf("%s -p%d", e.Name, e.Strip)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package quilt
+
+import (
+	"bytes"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type SeriesSuite struct{}
+
+var _ = Suite(&SeriesSuite{})
+
+func (s *SeriesSuite) TestParseAndWrite(c *C) {
+	series, err := ParseSeries(strings.NewReader(`# patches from upstream
+upstream/fix-build.patch
+01-typo.diff -p0 # applied at the root
+
+02-manpage.patch
+`))
+	c.Assert(err, IsNil)
+	c.Check(series, DeepEquals, Series{
+		{Name: "upstream/fix-build.patch", Strip: 1},
+		{Name: "01-typo.diff", Strip: 0},
+		{Name: "02-manpage.patch", Strip: 1},
+	})
+	c.Check(series.Index("02-manpage.patch"), Equals, 2)
+	c.Check(series.Index("foo"), Equals, -1)
+
+	var out bytes.Buffer
+	c.Assert(series.Write(&out), IsNil)
+	c.Check(out.String(), Equals, "upstream/fix-build.patch\n01-typo.diff -p0\n02-manpage.patch\n")
+
+	_, err = ParseSeries(strings.NewReader("foo.patch -R\n"))
+	c.Check(err, ErrorMatches, "series:1: unsupported option `-R' for patch foo.patch")
+	_, err = ParseSeries(strings.NewReader("foo.patch\nfoo.patch\n"))
+	c.Check(err, ErrorMatches, "series:2: patch foo.patch is listed twice")
+}
+
+func (s *SeriesSuite) TestInsert(c *C) {
+	series := Series{{Name: "a", Strip: 1}, {Name: "c", Strip: 1}}
+	res, err := series.Insert(SeriesEntry{Name: "b", Strip: 1}, "a")
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, Series{{"a", 1}, {"b", 1}, {"c", 1}})
+	res, err = series.Insert(SeriesEntry{Name: "0", Strip: 1}, "")
+	c.Assert(err, IsNil)
+	c.Check(res[0].Name, Equals, "0")
+
+	_, err = series.Insert(SeriesEntry{Name: "a"}, "c")
+	c.Check(err, ErrorMatches, "Patch a is already in the series")
+	_, err = series.Insert(SeriesEntry{Name: "b"}, "z")
+	c.Check(err, ErrorMatches, "Patch z is not in the series")
+}
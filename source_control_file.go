@@ -6,6 +6,7 @@ import (
 	"net/mail"
 	"path"
 	"regexp"
+	"strings"
 )
 
 // SourceControlFile represents a .dsc file content.
@@ -28,6 +29,14 @@ type SourceControlFile struct {
 	// The maintainer email address, which is mandatory
 	Maintainer *mail.Address
 
+	// The binary packages built from the source
+	Binaries []string `field:"Binary"`
+	// The build dependencies, as dependency expressions like
+	// `foo (>= 1.0) | bar'
+	BuildDepends      []string
+	BuildDependsIndep []string
+	BuildDependsArch  []string
+
 	// A list of md5 checksumed files
 	Md5Files []FileReference `field:"Files"`
 	// A list of sha1 checksumed files
@@ -69,8 +78,7 @@ func ParseDsc(r io.Reader) (*SourceControlFile, error) {
 		required: make([]string, 0),
 	}
 	for k, v := range p.fMapper {
-		if k == "Architecture" {
-			//we need this, but this is not mandatory according to debian policy
+		if dscOptionalFields[k] {
 			continue
 		}
 		if v != nil {
@@ -103,10 +111,57 @@ func parseDscFormat(f ControlField, v interface{}) error {
 	return fmt.Errorf("invalid format %s", f.Data[0])
 }
 
+// dscOptionalFields are the parsed fields that a .dsc may omit
+var dscOptionalFields = map[string]bool{
+	//we need this, but this is not mandatory according to debian policy
+	"Architecture":        true,
+	"Binary":              true,
+	"Build-Depends":       true,
+	"Build-Depends-Indep": true,
+	"Build-Depends-Arch":  true,
+}
+
+// parseDscBinary parses the Binary field of a .dsc, a comma separated
+// list unlike the one of a .changes
+func parseDscBinary(f ControlField, v interface{}) error {
+	return setField(v, "Binary", splitList(f.Data))
+}
+
+// parseBuildDepends returns the parser of a build dependency field,
+// setting the given structure field
+func parseBuildDepends(name string) controlFieldParser {
+	return func(f ControlField, v interface{}) error {
+		return setField(v, name, splitDependencies(f.Data))
+	}
+}
+
+var dependencyNameRx = regexp.MustCompile(`^([a-z0-9][a-z0-9+.\-]+)(:[a-z0-9\-]+)?`)
+
+// BuildDependencyNames returns the names of the packages the build
+// dependencies refer to, in any of their alternatives. Versions,
+// architecture qualifiers and restrictions are dropped.
+func (dsc *SourceControlFile) BuildDependencyNames() []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, deps := range [][]string{dsc.BuildDepends, dsc.BuildDependsIndep, dsc.BuildDependsArch} {
+		for _, d := range deps {
+			for _, alternative := range strings.Split(d, "|") {
+				m := dependencyNameRx.FindStringSubmatch(strings.TrimSpace(alternative))
+				if m == nil || seen[m[1]] {
+					continue
+				}
+				seen[m[1]] = true
+				res = append(res, m[1])
+			}
+		}
+	}
+	return res
+}
+
 var dscParsers = map[string]controlFieldParser{
 	"Format":                parseDscFormat,
 	"Source":                parseSource,
-	"Binary":                nil,
+	"Binary":                parseDscBinary,
 	"Architecture":          parseArchitecture,
 	"Version":               parseVersion,
 	"Maintainer":            parseMaintainer,
@@ -123,8 +178,9 @@ var dscParsers = map[string]controlFieldParser{
 	"Vcs-Svn":               nil,
 	"Dgit":                  nil,
 	"Standards-Version":     nil,
-	"Build-Depends":         nil,
-	"Build-Depends-Indep":   nil,
+	"Build-Depends":         parseBuildDepends("BuildDepends"),
+	"Build-Depends-Indep":   parseBuildDepends("BuildDependsIndep"),
+	"Build-Depends-Arch":    parseBuildDepends("BuildDependsArch"),
 	"Build-Conflicts":       nil,
 	"Build-Conflicts-Indep": nil,
 	"Package-List":          nil,
@@ -70,6 +70,20 @@ Files:
 	c.Check(dsc.Identifier.Source, Equals, "aha")
 	c.Check(dsc.Identifier.Ver, DeepEquals, Version{UpstreamVersion: "0.4.4", DebianRevision: "1"})
 	c.Check(dsc.Maintainer, DeepEquals, &mail.Address{Name: "Axel Beckert", Address: "abe@debian.org"})
+	c.Check(dsc.Binaries, DeepEquals, []string{"aha"})
+	c.Check(dsc.BuildDepends, DeepEquals, []string{"debhelper (>= 7)"})
+}
+
+func (s *SourceControlFileSuite) TestBuildDependencyNames(c *C) {
+	dsc := SourceControlFile{
+		BuildDepends: []string{
+			"debhelper-compat (= 13)",
+			"libfoo-dev:native (>= 1.0) [amd64] <!nocheck> | libbar-dev",
+			"python3:any",
+		},
+		BuildDependsIndep: []string{"libfoo-dev", "graphviz"},
+	}
+	c.Check(dsc.BuildDependencyNames(), DeepEquals, []string{"debhelper-compat", "libfoo-dev", "libbar-dev", "python3", "graphviz"})
 }
 
 func (s *SourceControlFileSuite) TestSourceControlFileParseError(c *C) {
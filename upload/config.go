@@ -0,0 +1,272 @@
+// Package upload uploads .changes files and the files they reference
+// to the hosts defined in dput.cf or dupload.conf.
+package upload
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Host is an upload target, as defined in dput.cf or dupload.conf
+type Host struct {
+	// The name of the host section
+	Name string
+	// The hostname, optionally followed by :<port>
+	Fqdn string
+	// The transport method: local, scp, sftp, http or https
+	Method string
+	// Directory on the host where files are uploaded
+	Incoming string
+	// Login on the host, empty or `*' for the default
+	Login string
+	// If false, only signed .changes files can be uploaded
+	AllowUnsignedUploads bool
+	// All the options set for the host, by name
+	Options map[string]string
+}
+
+// Config is a set of upload hosts
+type Config struct {
+	Hosts       map[string]*Host
+	DefaultHost string
+}
+
+// NewConfig returns an empty Config
+func NewConfig() *Config {
+	return &Config{Hosts: make(map[string]*Host)}
+}
+
+// Host returns the host definition of name, or the default host if
+// name is empty.
+func (c *Config) Host(name string) (*Host, error) {
+	if len(name) == 0 {
+		name = c.DefaultHost
+		if len(name) == 0 {
+			return nil, fmt.Errorf("No host specified and no default host configured")
+		}
+	}
+	h, ok := c.Hosts[name]
+	if ok == false {
+		return nil, fmt.Errorf("Unknown upload host `%s'", name)
+	}
+	return h, nil
+}
+
+// Merge adds the hosts of other to c, replacing the ones with the
+// same name. The default host of other, if any, takes precedence.
+func (c *Config) Merge(other *Config) {
+	for n, h := range other.Hosts {
+		c.Hosts[n] = h
+	}
+	if len(other.DefaultHost) > 0 {
+		c.DefaultHost = other.DefaultHost
+	}
+}
+
+// HostAndPort splits Fqdn in a hostname and a port, 0 if none is
+// given.
+func (h *Host) HostAndPort() (string, int, error) {
+	idx := strings.LastIndex(h.Fqdn, ":")
+	if idx < 0 {
+		return h.Fqdn, 0, nil
+	}
+	port, err := strconv.Atoi(h.Fqdn[idx+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid port in fqdn `%s'", h.Fqdn)
+	}
+	return h.Fqdn[:idx], port, nil
+}
+
+func isTrue(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "yes", "true", "on":
+		return true
+	}
+	return false
+}
+
+func newHost(name string, options map[string]string) *Host {
+	return &Host{
+		Name:                 name,
+		Fqdn:                 options["fqdn"],
+		Method:               options["method"],
+		Incoming:             options["incoming"],
+		Login:                options["login"],
+		AllowUnsignedUploads: isTrue(options["allow_unsigned_uploads"]),
+		Options:              options,
+	}
+}
+
+var dputSectionRx = regexp.MustCompile(`^\[([^\]]+)\]$`)
+var dputOptionRx = regexp.MustCompile(`^([^=:\s]+)\s*[=:]\s*(.*)$`)
+
+// ParseDputConfig parses a dput.cf file. Options of the [DEFAULT]
+// section are inherited by all hosts, and its default_host_main
+// option sets the default host.
+func ParseDputConfig(r io.Reader) (*Config, error) {
+	defaults := make(map[string]string)
+	sections := make(map[string]map[string]string)
+	order := []string{}
+
+	var current map[string]string
+	lastOption := ""
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber = lineNumber + 1
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// continuation of the previous option value
+			if current == nil || len(lastOption) == 0 {
+				return nil, fmt.Errorf("dput.cf:%d: unexpected continuation line", lineNumber)
+			}
+			current[lastOption] = current[lastOption] + "\n" + trimmed
+			continue
+		}
+
+		if m := dputSectionRx.FindStringSubmatch(trimmed); m != nil {
+			lastOption = ""
+			if m[1] == "DEFAULT" {
+				current = defaults
+				continue
+			}
+			if _, ok := sections[m[1]]; ok == false {
+				sections[m[1]] = make(map[string]string)
+				order = append(order, m[1])
+			}
+			current = sections[m[1]]
+			continue
+		}
+
+		m := dputOptionRx.FindStringSubmatch(trimmed)
+		if m == nil {
+			return nil, fmt.Errorf("dput.cf:%d: invalid line `%s'", lineNumber, trimmed)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("dput.cf:%d: option `%s' outside of a section", lineNumber, m[1])
+		}
+		lastOption = strings.ToLower(m[1])
+		current[lastOption] = strings.TrimSpace(m[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	res := NewConfig()
+	res.DefaultHost = defaults["default_host_main"]
+	for _, name := range order {
+		options := make(map[string]string)
+		for k, v := range defaults {
+			options[k] = v
+		}
+		for k, v := range sections[name] {
+			options[k] = v
+		}
+		res.Hosts[name] = newHost(name, options)
+	}
+	return res, nil
+}
+
+var duploadHostRx = regexp.MustCompile(`(?s)\$cfg\{\s*['"]([^'"]+)['"]\s*\}\s*=\s*\{(.*?)\}\s*;`)
+var duploadOptionRx = regexp.MustCompile(`(\w+)\s*=>\s*(?:"([^"]*)"|'([^']*)'|(\w+))`)
+var duploadDefaultRx = regexp.MustCompile(`\$default_host\s*=\s*['"]([^'"]*)['"]\s*;`)
+var duploadCommentRx = regexp.MustCompile(`(?m)^\s*#.*$`)
+
+// duploadMethods translates dupload methods to their dput equivalent
+var duploadMethods = map[string]string{
+	"scpb": "scp",
+	"copy": "local",
+}
+
+// ParseDuploadConfig parses a dupload.conf file. As it is a perl
+// script, only the usual `$cfg{"host"} = { key => "value", };' host
+// definitions and the `$default_host' assignation are understood.
+func ParseDuploadConfig(r io.Reader) (*Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	content := duploadCommentRx.ReplaceAllString(string(data), "")
+
+	res := NewConfig()
+	for _, m := range duploadHostRx.FindAllStringSubmatch(content, -1) {
+		options := make(map[string]string)
+		for _, o := range duploadOptionRx.FindAllStringSubmatch(m[2], -1) {
+			options[strings.ToLower(o[1])] = o[2] + o[3] + o[4]
+		}
+		if method, ok := duploadMethods[options["method"]]; ok {
+			options["method"] = method
+		}
+		if len(options["method"]) == 0 {
+			// dupload default method
+			options["method"] = "ftp"
+		}
+		res.Hosts[m[1]] = newHost(m[1], options)
+	}
+	if m := duploadDefaultRx.FindStringSubmatch(content); m != nil {
+		res.DefaultHost = m[1]
+	}
+	return res, nil
+}
+
+func loadConfigFile(p string, parse func(io.Reader) (*Config, error)) (*Config, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse `%s': %s", p, err)
+	}
+	return res, nil
+}
+
+// systemConfigDir holds the system wide dput and dupload configurations
+var systemConfigDir = "/etc"
+
+// LoadConfig reads the system and user dput configurations
+// (/etc/dput.cf and <home>/.dput.cf). If none exists, it falls back
+// on the dupload ones (/etc/dupload.conf and <home>/.dupload.conf).
+// User definitions override the system ones.
+func LoadConfig(home string) (*Config, error) {
+	candidates := []struct {
+		paths []string
+		parse func(io.Reader) (*Config, error)
+	}{
+		{[]string{path.Join(systemConfigDir, "dput.cf"), path.Join(home, ".dput.cf")}, ParseDputConfig},
+		{[]string{path.Join(systemConfigDir, "dupload.conf"), path.Join(home, ".dupload.conf")}, ParseDuploadConfig},
+	}
+
+	for _, c := range candidates {
+		res := NewConfig()
+		found := false
+		for _, p := range c.paths {
+			conf, err := loadConfigFile(p, c.parse)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			found = true
+			res.Merge(conf)
+		}
+		if found == true {
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("No dput.cf or dupload.conf configuration found")
+}
@@ -0,0 +1,140 @@
+package upload
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) TestParseDput(c *C) {
+	content := `# a comment
+[DEFAULT]
+login = *
+method = scp
+default_host_main = local-queue
+allow_unsigned_uploads = 0
+
+[local-queue]
+method = local
+incoming = /srv/queue/incoming
+allow_unsigned_uploads = 1
+
+[mentors]
+fqdn: mentors.example.com:2222
+incoming = /upload
+login = jdoe
+post_upload_command = echo
+  done
+
+[ppa]
+fqdn = ppa.example.com
+method = https
+incoming = ~%(ppa)s
+`
+	conf, err := ParseDputConfig(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	c.Check(conf.DefaultHost, Equals, "local-queue")
+	c.Assert(conf.Hosts, HasLen, 3)
+
+	h, err := conf.Host("")
+	c.Assert(err, IsNil)
+	c.Check(h.Name, Equals, "local-queue")
+	c.Check(h.Method, Equals, "local")
+	c.Check(h.Incoming, Equals, "/srv/queue/incoming")
+	c.Check(h.AllowUnsignedUploads, Equals, true)
+
+	h, err = conf.Host("mentors")
+	c.Assert(err, IsNil)
+	c.Check(h.Method, Equals, "scp")
+	c.Check(h.Login, Equals, "jdoe")
+	c.Check(h.AllowUnsignedUploads, Equals, false)
+	c.Check(h.Options["post_upload_command"], Equals, "echo\ndone")
+	hostname, port, err := h.HostAndPort()
+	c.Check(err, IsNil)
+	c.Check(hostname, Equals, "mentors.example.com")
+	c.Check(port, Equals, 2222)
+
+	c.Check(conf.Hosts["ppa"].Login, Equals, "*")
+
+	_, err = conf.Host("foo")
+	c.Check(err, ErrorMatches, "Unknown upload host `foo'")
+
+	errors := map[string]string{
+		"login = foo\n":      "dput.cf:1: option `login' outside of a section",
+		"[foo]\nnot valid\n": "dput.cf:2: invalid line `not valid'",
+		"  continuation\n":   "dput.cf:1: unexpected continuation line",
+	}
+	for content, expected := range errors {
+		_, err := ParseDputConfig(strings.NewReader(content))
+		c.Check(err, ErrorMatches, expected)
+	}
+}
+
+func (s *ConfigSuite) TestParseDupload(c *C) {
+	content := `package config;
+
+$default_host = "queue";
+
+# $cfg{'commented'} = { fqdn => "nowhere" };
+$cfg{'queue'} = {
+	fqdn => "queue.example.com",
+	method => "scpb",
+	incoming => "/srv/incoming",
+	login => 'uploader',
+	dinstall_runs => 1,
+};
+
+$cfg{"copy"} = { method => "copy", incoming => "/tmp/incoming" };
+
+1;
+`
+	conf, err := ParseDuploadConfig(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	c.Check(conf.DefaultHost, Equals, "queue")
+	c.Assert(conf.Hosts, HasLen, 2)
+	h := conf.Hosts["queue"]
+	c.Check(h.Fqdn, Equals, "queue.example.com")
+	c.Check(h.Method, Equals, "scp")
+	c.Check(h.Login, Equals, "uploader")
+	c.Check(h.Options["dinstall_runs"], Equals, "1")
+	c.Check(conf.Hosts["copy"].Method, Equals, "local")
+}
+
+func (s *ConfigSuite) TestLoadConfig(c *C) {
+	defer func(dir string) { systemConfigDir = dir }(systemConfigDir)
+	systemConfigDir = c.MkDir()
+	home := c.MkDir()
+
+	_, err := LoadConfig(home)
+	c.Check(err, ErrorMatches, "No dput.cf or dupload.conf configuration found")
+
+	c.Assert(ioutil.WriteFile(path.Join(home, ".dupload.conf"),
+		[]byte(`$cfg{'user'} = { method => "copy", incoming => "/tmp" };`), 0644), IsNil)
+	conf, err := LoadConfig(home)
+	c.Assert(err, IsNil)
+	c.Check(conf.Hosts["user"], NotNil)
+
+	c.Assert(ioutil.WriteFile(path.Join(systemConfigDir, "dput.cf"),
+		[]byte("[DEFAULT]\ndefault_host_main = system\n[system]\nmethod = local\n[user-dput]\nmethod = scp\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(home, ".dput.cf"),
+		[]byte("[user-dput]\nmethod = local\n"), 0644), IsNil)
+	conf, err = LoadConfig(home)
+	c.Assert(err, IsNil)
+	c.Check(conf.DefaultHost, Equals, "system")
+	c.Check(conf.Hosts["user-dput"].Method, Equals, "local")
+	c.Check(conf.Hosts["system"], NotNil)
+	c.Check(conf.Hosts["user"], IsNil)
+
+	c.Assert(ioutil.WriteFile(path.Join(home, ".dput.cf"), []byte("foo\n"), 0644), IsNil)
+	_, err = LoadConfig(home)
+	c.Check(err, ErrorMatches, "Could not parse `.*/.dput.cf': dput.cf:1: invalid line `foo'")
+}
@@ -0,0 +1,187 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+)
+
+// A Transport copies files to the incoming directory of a host.
+type Transport interface {
+	// Put uploads a local file to the incoming directory, under the
+	// same name.
+	Put(localPath string) error
+}
+
+// NewTransport returns the Transport matching the method of a host.
+func NewTransport(h *Host) (Transport, error) {
+	switch h.Method {
+	case "local":
+		return &LocalTransport{Dir: h.Incoming}, nil
+	case "scp", "sftp":
+		hostname, port, err := h.HostAndPort()
+		if err != nil {
+			return nil, err
+		}
+		if len(hostname) == 0 {
+			return nil, fmt.Errorf("Host %s has no fqdn", h.Name)
+		}
+		res := &SshTransport{
+			Host:     hostname,
+			Port:     port,
+			Incoming: h.Incoming,
+			Sftp:     h.Method == "sftp",
+		}
+		if h.Login != "*" {
+			res.Login = h.Login
+		}
+		return res, nil
+	case "http", "https":
+		if len(h.Fqdn) == 0 {
+			return nil, fmt.Errorf("Host %s has no fqdn", h.Name)
+		}
+		res := &HttpTransport{
+			URL: &url.URL{
+				Scheme: h.Method,
+				Host:   h.Fqdn,
+				Path:   path.Join("/", h.Incoming),
+			},
+		}
+		if len(h.Login) > 0 && h.Login != "*" {
+			res.URL.User = url.User(h.Login)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("Upload method `%s' of host %s is not supported", h.Method, h.Name)
+}
+
+// LocalTransport copies files to a local directory, for example the
+// incoming directory watched by apt-repo-queue.
+type LocalTransport struct {
+	Dir string
+}
+
+// Put implements Transport. Files are made world readable once fully
+// written, the change of mode signaling watchers the file is
+// complete.
+func (t *LocalTransport) Put(localPath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	destPath := path.Join(t.Dir, path.Base(localPath))
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dest, src); err != nil {
+		dest.Close()
+		return err
+	}
+	if err = dest.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(destPath, 0644)
+}
+
+// SshTransport uploads files with the scp or sftp commands. They
+// should authenticate through a ssh-agent or the user ssh
+// configuration, as they are run in batch mode.
+type SshTransport struct {
+	Host     string
+	Port     int
+	Login    string
+	Incoming string
+	Sftp     bool
+}
+
+func (t *SshTransport) destination() string {
+	if len(t.Login) == 0 {
+		return t.Host
+	}
+	return t.Login + "@" + t.Host
+}
+
+func (t *SshTransport) command(localPath string) *exec.Cmd {
+	if t.Sftp {
+		args := []string{"-b", "-"}
+		if t.Port != 0 {
+			args = append(args, "-P", strconv.Itoa(t.Port))
+		}
+		cmd := exec.Command("sftp", append(args, t.destination())...)
+		cmd.Stdin = bytes.NewBufferString(fmt.Sprintf("put %s %s\nchmod 644 %s\n",
+			strconv.Quote(localPath),
+			strconv.Quote(path.Join(t.Incoming, path.Base(localPath))),
+			strconv.Quote(path.Join(t.Incoming, path.Base(localPath)))))
+		return cmd
+	}
+
+	args := []string{"-B", "-p"}
+	if t.Port != 0 {
+		args = append(args, "-P", strconv.Itoa(t.Port))
+	}
+	args = append(args, localPath, t.destination()+":"+t.Incoming+"/")
+	cmd := exec.Command("scp", args...)
+	cmd.Stdin = nil
+	return cmd
+}
+
+// Put implements Transport
+func (t *SshTransport) Put(localPath string) error {
+	cmd := t.command(localPath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Could not upload %s to %s: %s\n%s", path.Base(localPath), t.Host, err, out)
+	}
+	return nil
+}
+
+// HttpTransport uploads files with HTTP PUT requests to
+// <URL>/<filename>.
+type HttpTransport struct {
+	URL    *url.URL
+	Client *http.Client
+}
+
+// Put implements Transport
+func (t *HttpTransport) Put(localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	u := *t.URL
+	u.Path = path.Join(u.Path, path.Base(localPath))
+	req, err := http.NewRequest("PUT", u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Could not upload %s to %s: %s", path.Base(localPath), t.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	deb ".."
+	"../pgp"
+)
+
+// An Uploader uploads .changes files and the files they reference to
+// a Host. Each upload is recorded in a <changes>.<host>.upload log
+// next to the .changes file, and a .changes already uploaded to a
+// host is refused unless Force is set.
+type Uploader struct {
+	Host      *Host
+	Transport Transport
+	// Uploads even if the log records a complete upload
+	Force bool
+}
+
+// NewUploader creates an Uploader for a host, using the Transport of
+// its method.
+func NewUploader(h *Host) (*Uploader, error) {
+	t, err := NewTransport(h)
+	if err != nil {
+		return nil, err
+	}
+	return &Uploader{Host: h, Transport: t}, nil
+}
+
+// LogPath returns the path of the upload log of a .changes file for
+// the host.
+func (u *Uploader) LogPath(changesPath string) string {
+	return strings.TrimSuffix(changesPath, ".changes") + "." + u.Host.Name + ".upload"
+}
+
+var uploadLogRx = regexp.MustCompile(`^Successfully uploaded (.*) to (.*) for (.*)\.$`)
+
+func (u *Uploader) readLog(logPath string) (map[string]bool, error) {
+	res := make(map[string]bool)
+	f, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := uploadLogRx.FindStringSubmatch(scanner.Text())
+		if m == nil || m[3] != u.Host.Name {
+			continue
+		}
+		res[m[1]] = true
+	}
+	return res, scanner.Err()
+}
+
+// Upload uploads a .changes file and all the files it references,
+// which should be in the same directory. The .changes file is
+// uploaded last, so the remote queue only processes complete
+// uploads. Files recorded in the log of an interrupted upload are
+// not uploaded again. Progress is reported to out.
+func (u *Uploader) Upload(changesPath string, out io.Writer) error {
+	if _, err := deb.ClassifyFileName(changesPath); err != nil || path.Ext(changesPath) != ".changes" {
+		return fmt.Errorf("Invalid .changes file name `%s'", changesPath)
+	}
+
+	data, err := ioutil.ReadFile(changesPath)
+	if err != nil {
+		return err
+	}
+	plaintext, signed := pgp.Decode(data)
+	if signed == false && u.Host.AllowUnsignedUploads == false {
+		return fmt.Errorf("%s is not signed, and host %s does not allow unsigned uploads", path.Base(changesPath), u.Host.Name)
+	}
+	changes, err := deb.ParseChangeFile(bytes.NewReader(plaintext))
+	if err != nil {
+		return err
+	}
+
+	logPath := u.LogPath(changesPath)
+	uploaded, err := u.readLog(logPath)
+	if err != nil {
+		return err
+	}
+	if u.Force == true {
+		uploaded = make(map[string]bool)
+	} else if uploaded[path.Base(changesPath)] == true {
+		return fmt.Errorf("%s was already uploaded to %s according to %s", path.Base(changesPath), u.Host.Name, logPath)
+	}
+
+	// checks everything is there before uploading anything
+	dir := path.Dir(changesPath)
+	toUpload := make([]string, 0, len(changes.Md5Files)+1)
+	for _, f := range changes.Md5Files {
+		p := path.Join(dir, f.Name)
+		if _, err := os.Stat(p); err != nil {
+			return fmt.Errorf("Missing file listed in %s: %s", path.Base(changesPath), err)
+		}
+		toUpload = append(toUpload, p)
+	}
+	toUpload = append(toUpload, changesPath)
+
+	logFlags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if u.Force == true {
+		logFlags = logFlags | os.O_TRUNC
+	}
+	logFile, err := os.OpenFile(logPath, logFlags, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	for _, p := range toUpload {
+		name := path.Base(p)
+		if uploaded[name] == true {
+			fmt.Fprintf(out, "Skipping %s, already uploaded\n", name)
+			continue
+		}
+		fmt.Fprintf(out, "Uploading %s to %s\n", name, u.Host.Name)
+		if err := u.Transport.Put(p); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(logFile, "Successfully uploaded %s to %s for %s.\n", name, u.Host.Fqdn, u.Host.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
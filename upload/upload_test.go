@@ -0,0 +1,221 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+
+	"../pgp"
+	. "gopkg.in/check.v1"
+)
+
+type UploadSuite struct {
+	dir      string
+	incoming string
+	changes  string
+}
+
+var _ = Suite(&UploadSuite{})
+
+var changesContent = `Format: 1.8
+Date: Tue, 10 Jun 2014 21:44:59 +0200
+Source: aha
+Binary: aha
+Architecture: source amd64
+Version: 0.4.7.2-1
+Distribution: unstable
+Maintainer: Axel Beckert <abe@debian.org>
+Description: 
+ aha        - ANSI color to HTML converter
+Changes: 
+ aha (0.4.7.2-1) unstable; urgency=medium
+ .
+   * New upstream release
+Checksums-Sha1: 
+ 8a1d9bd7e1ea2dd5b9e47dc2d5b1bc3e4ea4e0b6 1806 aha_0.4.7.2-1.dsc
+ 0c5d0d8ce9b9d4a4ee6cba1ef1b0e1e13ec0e9c5 6601 aha_0.4.7.2.orig.tar.gz
+ e7a6c57c3e1fdd8fd2d5aa7adc61ee5d2b1ab7b8 20402 aha_0.4.7.2-1_amd64.deb
+Checksums-Sha256: 
+ 0bd3e94e0a7e3fdb8ec9c2b7fe2cfb5dd44a1cdd0ac25a9e17f30bd98e1c8f43 1806 aha_0.4.7.2-1.dsc
+ 5bc6a89d0b8f4d17bd22b5b0a7b1fda6e4d8f7f8a5f1a92cd9a06bbd9bf0b2d3 6601 aha_0.4.7.2.orig.tar.gz
+ 2b8fd1bc6a0cd5ce4e5e51f2bd4fbb2d61bd4dbd0bd5b1f25e8c2c7e1f8a9c70 20402 aha_0.4.7.2-1_amd64.deb
+Files: 
+ 97ae4c309d12083da26e63f21a8189a8 1806 utils extra aha_0.4.7.2-1.dsc
+ daeb9fc99362098340197c957645a877 6601 utils extra aha_0.4.7.2.orig.tar.gz
+ 9240c714a75eb540871330f0fc454487 20402 utils extra aha_0.4.7.2-1_amd64.deb
+`
+
+// recordingTransport records uploaded files and fails after a given
+// number of them
+type recordingTransport struct {
+	uploaded []string
+	failAt   int
+}
+
+func (t *recordingTransport) Put(localPath string) error {
+	if t.failAt > 0 && len(t.uploaded) == t.failAt {
+		return fmt.Errorf("connection lost")
+	}
+	t.uploaded = append(t.uploaded, path.Base(localPath))
+	return nil
+}
+
+func (s *UploadSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.incoming = c.MkDir()
+	for _, name := range []string{"aha_0.4.7.2-1.dsc", "aha_0.4.7.2.orig.tar.gz", "aha_0.4.7.2-1_amd64.deb"} {
+		c.Assert(ioutil.WriteFile(path.Join(s.dir, name), []byte(name), 0644), IsNil)
+	}
+	s.changes = path.Join(s.dir, "aha_0.4.7.2-1_amd64.changes")
+	c.Assert(ioutil.WriteFile(s.changes, []byte(changesContent), 0644), IsNil)
+}
+
+func (s *UploadSuite) TestUploadLog(c *C) {
+	t := &recordingTransport{failAt: 2}
+	u := &Uploader{
+		Host:      &Host{Name: "queue", Fqdn: "queue.example.com", AllowUnsignedUploads: true},
+		Transport: t,
+	}
+	var out bytes.Buffer
+
+	err := u.Upload(s.changes, &out)
+	c.Check(err, ErrorMatches, "connection lost")
+	c.Check(t.uploaded, DeepEquals, []string{"aha_0.4.7.2-1.dsc", "aha_0.4.7.2.orig.tar.gz"})
+
+	// resumes the interrupted upload, .changes last
+	t.failAt = 0
+	t.uploaded = nil
+	c.Assert(u.Upload(s.changes, &out), IsNil)
+	c.Check(t.uploaded, DeepEquals, []string{"aha_0.4.7.2-1_amd64.deb", "aha_0.4.7.2-1_amd64.changes"})
+
+	logPath := path.Join(s.dir, "aha_0.4.7.2-1_amd64.queue.upload")
+	c.Check(u.LogPath(s.changes), Equals, logPath)
+	logData, err := ioutil.ReadFile(logPath)
+	c.Assert(err, IsNil)
+	c.Check(string(logData), Equals, `Successfully uploaded aha_0.4.7.2-1.dsc to queue.example.com for queue.
+Successfully uploaded aha_0.4.7.2.orig.tar.gz to queue.example.com for queue.
+Successfully uploaded aha_0.4.7.2-1_amd64.deb to queue.example.com for queue.
+Successfully uploaded aha_0.4.7.2-1_amd64.changes to queue.example.com for queue.
+`)
+
+	t.uploaded = nil
+	err = u.Upload(s.changes, &out)
+	c.Check(err, ErrorMatches, "aha_0.4.7.2-1_amd64.changes was already uploaded to queue according to .*queue.upload")
+	c.Check(t.uploaded, HasLen, 0)
+
+	// an other host has its own log
+	other := &Uploader{Host: &Host{Name: "other", AllowUnsignedUploads: true}, Transport: t}
+	c.Check(other.Upload(s.changes, &out), IsNil)
+	c.Check(t.uploaded, HasLen, 4)
+
+	t.uploaded = nil
+	u.Force = true
+	c.Check(u.Upload(s.changes, &out), IsNil)
+	c.Check(t.uploaded, HasLen, 4)
+	logData, err = ioutil.ReadFile(logPath)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Count(logData, []byte("\n")), Equals, 4)
+}
+
+func (s *UploadSuite) TestUploadChecks(c *C) {
+	t := &recordingTransport{}
+	u := &Uploader{Host: &Host{Name: "queue"}, Transport: t}
+	var out bytes.Buffer
+
+	c.Check(u.Upload(s.changes, &out), ErrorMatches, "aha_0.4.7.2-1_amd64.changes is not signed, and host queue does not allow unsigned uploads")
+
+	keys, err := pgp.ReadKeyring(bytes.NewReader(mustRead(c, "../pgp/testdata/good-secret.asc")))
+	c.Assert(err, IsNil)
+	var signed bytes.Buffer
+	c.Assert(pgp.Clearsign(&signed, []byte(changesContent), keys[0]), IsNil)
+	c.Assert(ioutil.WriteFile(s.changes, signed.Bytes(), 0644), IsNil)
+	c.Check(u.Upload(s.changes, &out), IsNil)
+	c.Check(t.uploaded, HasLen, 4)
+
+	u.Host.AllowUnsignedUploads = true
+	c.Check(u.Upload(path.Join(s.dir, "aha_0.4.7.2-1.dsc"), &out), ErrorMatches, "Invalid .changes file name .*")
+
+	c.Assert(os.Remove(path.Join(s.dir, "aha_0.4.7.2-1_amd64.deb")), IsNil)
+	u.Force = true
+	t.uploaded = nil
+	c.Check(u.Upload(s.changes, &out), ErrorMatches, "Missing file listed in aha_0.4.7.2-1_amd64.changes: .*no such file or directory")
+	c.Check(t.uploaded, HasLen, 0)
+}
+
+func mustRead(c *C, p string) []byte {
+	data, err := ioutil.ReadFile(p)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func (s *UploadSuite) TestLocalTransport(c *C) {
+	u, err := NewUploader(&Host{Name: "local", Method: "local", Incoming: s.incoming, AllowUnsignedUploads: true})
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	c.Assert(u.Upload(s.changes, &out), IsNil)
+
+	for _, name := range []string{"aha_0.4.7.2-1.dsc", "aha_0.4.7.2-1_amd64.deb", "aha_0.4.7.2-1_amd64.changes"} {
+		info, err := os.Stat(path.Join(s.incoming, name))
+		c.Assert(err, IsNil)
+		c.Check(info.Mode().Perm(), Equals, os.FileMode(0644))
+	}
+	c.Check(mustRead(c, path.Join(s.incoming, "aha_0.4.7.2-1.dsc")), DeepEquals, []byte("aha_0.4.7.2-1.dsc"))
+}
+
+func (s *UploadSuite) TestHttpTransport(c *C) {
+	received := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		if r.Method != "PUT" || user != "jdoe" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		received[r.URL.Path] = string(data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	c.Assert(err, IsNil)
+
+	h := &Host{Name: "http", Method: "http", Fqdn: serverURL.Host, Incoming: "upload", Login: "jdoe", AllowUnsignedUploads: true}
+	u, err := NewUploader(h)
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	c.Assert(u.Upload(s.changes, &out), IsNil)
+	c.Check(received, HasLen, 4)
+	c.Check(received["/upload/aha_0.4.7.2.orig.tar.gz"], Equals, "aha_0.4.7.2.orig.tar.gz")
+
+	h.Login = "*"
+	u, err = NewUploader(h)
+	c.Assert(err, IsNil)
+	u.Force = true
+	c.Check(u.Upload(s.changes, &out), ErrorMatches, "Could not upload aha_0.4.7.2-1.dsc to .*: 403 Forbidden")
+}
+
+func (s *UploadSuite) TestNewTransport(c *C) {
+	t, err := NewTransport(&Host{Name: "mentors", Method: "scp", Fqdn: "mentors.example.com:2222", Login: "jdoe", Incoming: "/upload"})
+	c.Assert(err, IsNil)
+	cmd := t.(*SshTransport).command("/tmp/foo.dsc")
+	c.Check(cmd.Args, DeepEquals, []string{"scp", "-B", "-p", "-P", "2222", "/tmp/foo.dsc", "jdoe@mentors.example.com:/upload/"})
+
+	t, err = NewTransport(&Host{Name: "mentors", Method: "sftp", Fqdn: "mentors.example.com", Login: "*", Incoming: "/upload"})
+	c.Assert(err, IsNil)
+	cmd = t.(*SshTransport).command("/tmp/foo.dsc")
+	c.Check(cmd.Args, DeepEquals, []string{"sftp", "-b", "-", "mentors.example.com"})
+	batch, err := ioutil.ReadAll(cmd.Stdin)
+	c.Assert(err, IsNil)
+	c.Check(string(batch), Equals, "put \"/tmp/foo.dsc\" \"/upload/foo.dsc\"\nchmod 644 \"/upload/foo.dsc\"\n")
+
+	_, err = NewTransport(&Host{Name: "ftp-master", Method: "ftp"})
+	c.Check(err, ErrorMatches, "Upload method `ftp' of host ftp-master is not supported")
+	_, err = NewTransport(&Host{Name: "nowhere", Method: "scp"})
+	c.Check(err, ErrorMatches, "Host nowhere has no fqdn")
+	_, err = NewTransport(&Host{Name: "badport", Method: "sftp", Fqdn: "foo:bar"})
+	c.Check(err, ErrorMatches, "Invalid port in fqdn `foo:bar'")
+}